@@ -2,15 +2,123 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"strings"
 
 	"github.com/Artiqlate/cyprus"
+	"github.com/Artiqlate/cyprus/transmission"
 )
 
 func main() {
+	configPath := flag.String("config", "", "Config file (defaults to config.json in the config directory)")
 	isSecure := flag.Bool("secure", true, "Use Secure Server")
+	mpBackend := flag.String("mp-backend", "", "Media player backend (\"mpris\" or \"memory\", defaults to the platform's)")
+	pairing := flag.Bool("pairing", true, "Require clients to pair (with a PIN shown in the log) before using the server")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file to serve with, instead of the generated identity")
+	tlsKey := flag.String("tls-key", "", "TLS key file (for -tls-cert)")
+	tlsChain := flag.String("tls-chain", "", "TLS intermediate certificates file (for -tls-cert, optional)")
+	mutualTLS := flag.Bool("mtls", false, "Require client certificates (issued with -issue-client, or pinned with -pin-client)")
+	allowedOrigins := flag.String("allowed-origins", "", "Comma-separated browser origin hosts which can connect (patterns, ex: \"*.lan:8080\")")
+	compression := flag.Bool("compression", true, "Compress messages (permessage-deflate) for clients which support it")
+	compressionThreshold := flag.Int("compression-threshold", 0, "Smallest message to compress, in bytes (0 for the default)")
+	maxMessageSize := flag.Int64("max-message-size", 0, "Largest message accepted from clients, in bytes (0 for the default)")
+	chunkSize := flag.Int("chunk-size", 0, "Size of the chunks larger messages are sent in, in bytes (0 for the default)")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 0, "How often clients are pinged (0 for the default)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Disconnect clients which show no sign of life for this long (0 for the default)")
+	issueClient := flag.String("issue-client", "", "Issue a client certificate with the given name (into -issue-dir), and exit")
+	issueDir := flag.String("issue-dir", ".", "Directory -issue-client writes the certificate and key to")
+	pinClient := flag.String("pin-client", "", "Trust a client certificate, given as name=fingerprint (SHA-256), and exit")
+	revokeClient := flag.String("revoke-client", "", "Revoke the client certificate with the given serial number or fingerprint, and exit")
+	rotateIdentity := flag.Bool("rotate-identity", false, "Replace the TLS identity (paired clients have to pin the new fingerprint), and exit")
 	flag.Parse()
-	serv, servErr := cyprus.NewServerModule(0, *isSecure)
+	if *rotateIdentity {
+		fingerprint, rotateErr := cyprus.RotateIdentity()
+		if rotateErr != nil {
+			log.Fatalf("Identity rotation error: %v", rotateErr)
+		}
+		fmt.Printf("New certificate fingerprint (SHA-256): %s\n", fingerprint)
+		return
+	}
+	// -- CLIENT CERTIFICATES
+	if *issueClient != "" {
+		issuedClient, issueErr := cyprus.IssueClientCertificate(*issueClient, *issueDir)
+		if issueErr != nil {
+			log.Fatalf("Client certificate error: %v", issueErr)
+		}
+		fmt.Printf("Issued client certificate for %q\n", issuedClient.Name)
+		fmt.Printf("Serial: %s\nFingerprint (SHA-256): %s\n", issuedClient.Serial, issuedClient.Fingerprint)
+		return
+	}
+	if *pinClient != "" {
+		clientName, fingerprint, isPair := strings.Cut(*pinClient, "=")
+		if !isPair {
+			log.Fatalf("-pin-client: expected name=fingerprint")
+		}
+		clientId, pinErr := cyprus.PinClientCertificate(clientName, fingerprint)
+		if pinErr != nil {
+			log.Fatalf("Client certificate error: %v", pinErr)
+		}
+		fmt.Printf("Pinned client certificate for %q (%s)\n", clientName, clientId)
+		return
+	}
+	if *revokeClient != "" {
+		revoked, revokeErr := cyprus.RevokeClientCertificate(*revokeClient)
+		if revokeErr != nil {
+			log.Fatalf("Client certificate error: %v", revokeErr)
+		}
+		if revoked == 0 {
+			log.Fatalf("No client certificate matches %s", *revokeClient)
+		}
+		fmt.Printf("Revoked %d client certificate(s)\n", revoked)
+		return
+	}
+	// An explicitly given config file has to exist.
+	configRequired := *configPath != ""
+	if !configRequired {
+		var pathErr error
+		if *configPath, pathErr = cyprus.DefaultConfigPath(); pathErr != nil {
+			log.Fatalf("Config error: %v", pathErr)
+		}
+	}
+	config, configErr := cyprus.LoadConfig(*configPath, configRequired)
+	if configErr != nil {
+		log.Fatalf("Config error: %v", configErr)
+	}
+	// Flags given on the command line override the config file.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "secure":
+			config.Secure = *isSecure
+		case "mp-backend":
+			config.MPBackend = *mpBackend
+		case "pairing":
+			config.Pairing = *pairing
+		case "tls-cert":
+			config.TLS.CertFile = *tlsCert
+		case "tls-key":
+			config.TLS.KeyFile = *tlsKey
+		case "tls-chain":
+			config.TLS.ChainFile = *tlsChain
+		case "mtls":
+			config.MutualTLS = *mutualTLS
+		case "allowed-origins":
+			config.AllowedOrigins = strings.Split(*allowedOrigins, ",")
+		case "compression":
+			config.Transport.Compression = *compression
+		case "compression-threshold":
+			config.Transport.CompressionThreshold = *compressionThreshold
+		case "max-message-size":
+			config.Transport.MaxMessageSize = *maxMessageSize
+		case "chunk-size":
+			config.Transport.ChunkSize = *chunkSize
+		case "heartbeat-interval":
+			config.Transport.HeartbeatInterval = transmission.Duration(*heartbeatInterval)
+		case "idle-timeout":
+			config.Transport.IdleTimeout = transmission.Duration(*idleTimeout)
+		}
+	})
+	serv, servErr := cyprus.NewServerModule(config)
 	if servErr != nil {
 		log.Fatalf("Server erorr: %v", servErr)
 	}
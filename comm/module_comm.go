@@ -1,27 +1,70 @@
 package comm
 
-import "github.com/Artiqlate/ganymede/models"
+import (
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Session messages are sent to when they're meant for every session which
+// enabled the module (events).
+const BroadcastSession uint64 = 0
+
+// A client request, with the session it came from.
+type Request struct {
+	Session uint64
+	// ID the client gave the request (nil when it gave none), left encoded
+	// as the client may use any type for it
+	Id   msgpack.RawMessage
+	Data []byte
+}
+
+// A message for a session (or `BroadcastSession`).
+type Envelope struct {
+	Session uint64
+	// ID of the request this replies to (nil for events)
+	RequestId msgpack.RawMessage
+	Message   models.Message
+	// Sequence number of an event (0 for messages which aren't sequenced,
+	// see `ext_models.SequencedEvent`)
+	Seq uint64
+}
 
 type BiDirMessageChannel struct {
-	InChannel      chan []byte
+	InChannel      chan Request
 	CommandChannel chan string
-	OutChannel     chan models.Message
+	OutChannel     chan Envelope
+	// Sessions joining a running module, which are sent its current state.
+	AttachChannel chan uint64
 }
 
 func NewBiDirMessageChannel() *BiDirMessageChannel {
 	return &BiDirMessageChannel{
-		InChannel:      make(chan []byte),
+		InChannel:      make(chan Request),
 		CommandChannel: make(chan string),
-		OutChannel:     make(chan models.Message),
+		OutChannel:     make(chan Envelope),
+		AttachChannel:  make(chan uint64),
 	}
 }
 
 type CommChannels struct {
-	MPChannel BiDirMessageChannel
+	MPChannel    BiDirMessageChannel
+	AudioChannel BiDirMessageChannel
 }
 
 func NewCommChannels() *CommChannels {
 	return &CommChannels{
-		MPChannel: *NewBiDirMessageChannel(),
+		MPChannel:    *NewBiDirMessageChannel(),
+		AudioChannel: *NewBiDirMessageChannel(),
+	}
+}
+
+// Channel of the given module (nil for unknown modules).
+func (cc *CommChannels) Module(module string) *BiDirMessageChannel {
+	switch module {
+	case "mp":
+		return &cc.MPChannel
+	case "audio":
+		return &cc.AudioChannel
 	}
+	return nil
 }
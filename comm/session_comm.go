@@ -0,0 +1,16 @@
+package comm
+
+// Modules a session asks for through `init`. The modules which could be
+// enabled are sent back on `Reply`.
+type SessionInit struct {
+	Session uint64
+	Modules []string
+	Reply   chan []string
+}
+
+// Modules a session stops using (all of them when `Modules` is nil), once it
+// sends `close` or `<module>:close`, or disconnects.
+type SessionClose struct {
+	Session uint64
+	Modules []string
+}
@@ -0,0 +1,79 @@
+package cyprus
+
+/*
+Cyprus: Configuration
+
+Server settings, read from the config file (`$XDG_CONFIG_HOME/cyprus/config.json`
+by default). Command-line flags override them.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Artiqlate/cyprus/transmission"
+	"github.com/Artiqlate/cyprus/utils"
+)
+
+const ConfigFileName = "config.json"
+
+type Config struct {
+	// Port to listen on (0 for the default port of the mode)
+	Port   int  `json:"port"`
+	Secure bool `json:"secure"`
+	// Media player backend (empty for the platform's default)
+	MPBackend string `json:"mp_backend"`
+	// Require clients to pair before using the server
+	Pairing bool `json:"pairing"`
+	// Certificate to serve with in secure mode (the generated identity is
+	// used when none is given)
+	TLS transmission.CertificateFiles `json:"tls"`
+	// Require client certificates in secure mode (see
+	// `transmission.ClientAuthenticator`)
+	MutualTLS bool `json:"mutual_tls"`
+	// Browser origins which can connect, as host patterns (see
+	// `transmission.OriginPolicy`)
+	AllowedOrigins []string `json:"allowed_origins"`
+	// Compression, and message size limits
+	Transport transmission.TransportOptions `json:"transport"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Secure:    true,
+		Pairing:   true,
+		Transport: transmission.DefaultTransportOptions(),
+	}
+}
+
+// Config file in the config directory (see `utils.ConfigDir`).
+func DefaultConfigPath() (string, error) {
+	configDir, configDirErr := utils.ConfigDir()
+	if configDirErr != nil {
+		return "", configDirErr
+	}
+	return filepath.Join(configDir, ConfigFileName), nil
+}
+
+// Reads the config file over the defaults. A missing file is only an error
+// when required.
+func LoadConfig(path string, required bool) (Config, error) {
+	config := DefaultConfig()
+	content, readErr := os.ReadFile(path)
+	if errors.Is(readErr, os.ErrNotExist) && !required {
+		return config, nil
+	} else if readErr != nil {
+		return config, fmt.Errorf("config: %w", readErr)
+	}
+	if decodeErr := json.Unmarshal(content, &config); decodeErr != nil {
+		return config, fmt.Errorf("config %s: %w", path, decodeErr)
+	}
+	// Relative paths are relative to the config file.
+	config.TLS = config.TLS.RelativeTo(filepath.Dir(path))
+	return config, nil
+}
@@ -0,0 +1,83 @@
+package ext_audio
+
+/*
+System Audio
+
+State of the default output (sink) and input (source) devices. Volumes are
+linear, 1.0 being 100% (and can go above it).
+
+The state is sent as a `state` event whenever it changes, and as the
+`rstate` reply to `audio:get`. It can be changed with `set_volume`,
+`set_mute` and `set_source_mute`, which are answered with `ok` or `err`
+(see `ext_models.CommandOk` and `ext_models.CommandError`).
+
+Output devices are listed with `list_sinks` (replied with `rsinks`), and
+`set_default_sink` switches to another one, moving the streams which are
+playing to it. Plugged and unplugged devices are sent as `sink_added` and
+`sink_removed` events, and `sink_changed` is sent when the active port of a
+device changes (ex: headphones plugged into the jack).
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+// -- ERROR CODES --
+const (
+	// The audio tooling failed (or isn't available)
+	ErrCodeAudioError = "audio_error"
+	// Value out of range (ex: a negative volume)
+	ErrCodeInvalidValue = "invalid_value"
+	// Sink (by name) does not exist
+	ErrCodeSinkNotFound = "sink_not_found"
+)
+
+// TODO: Move to ganymede.
+type AudioState struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack    struct{} `msgpack:",as_array"`
+	SinkName    string
+	Volume      float64
+	Muted       bool
+	SourceName  string
+	SourceMuted bool
+}
+
+// TODO: Move to ganymede.
+type VolumeRequest struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	Volume   float64
+}
+
+// TODO: Move to ganymede.
+type MuteRequest struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	Muted    bool
+}
+
+// TODO: Move to ganymede.
+type Sink struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack    struct{} `msgpack:",as_array"`
+	Name        string
+	Description string
+	// Empty for devices without ports
+	ActivePort string
+	Volume     float64
+	// Whether this is the default sink
+	Default bool
+}
+
+// TODO: Move to ganymede.
+type SinkList struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	Sinks    []Sink
+}
+
+// TODO: Move to ganymede.
+type SinkSelection struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	Name     string
+}
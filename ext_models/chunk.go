@@ -0,0 +1,31 @@
+package ext_models
+
+/*
+Chunked Transfers
+
+Sessions which ask for the `chunked` capability in `init` get large messages
+split into `chunk` messages, so smaller messages (ex: events) aren't held up
+behind them: they can be sent between two chunks of a transfer. A transfer's
+chunks come in order; joined together, their data is the whole message,
+encoded as any other message of the session.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+// TODO: Move to ganymede.
+const (
+	CapabilityChunked = "chunked"
+	MethodChunk       = "chunk"
+)
+
+// TODO: Move to ganymede.
+type Chunk struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	// Transfer the chunk is part of (unique within the session)
+	Transfer uint64
+	// Of the chunk within the transfer, from 0 to `Count` - 1
+	Index int
+	Count int
+	Data  []byte
+}
@@ -0,0 +1,39 @@
+package ext_mp
+
+/*
+Command Replies
+
+Every inbound `mp` request is answered with either an `ok` or an `err`
+message. Both carry the method of the request being answered, so the client
+can correlate the reply with its request.
+
+Requests which already reply with data (ex: `list` replies with `rlist`) use
+that reply in place of `ok`. Replies, and the codes every module shares, are
+the same as the server's (see `ext_models.CommandOk`).
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import "github.com/Artiqlate/cyprus/ext_models"
+
+// -- ERROR CODES --
+// These are stable, and are meant to be matched on by clients.
+const (
+	ErrCodeDecode           = ext_models.ErrCodeDecode
+	ErrCodePlatformMismatch = ext_models.ErrCodePlatformMismatch
+	ErrCodeUnknownMethod    = ext_models.ErrCodeUnknownMethod
+	// Player index is out of range
+	ErrCodeInvalidIndex = "invalid_index"
+	// Player (by name) does not exist
+	ErrCodePlayerNotFound = "player_not_found"
+	// Player doesn't support the requested operation
+	ErrCodeNotSupported = "not_supported"
+	// Player failed to carry out the requested operation
+	ErrCodePlayerError = "player_error"
+	// Local storage (ex: the scrobble queue) couldn't be read or written
+	ErrCodeStorage = ext_models.ErrCodeStorage
+)
+
+type CommandOk = ext_models.CommandOk
+
+type CommandError = ext_models.CommandError
@@ -0,0 +1,26 @@
+package ext_mp
+
+/*
+Sequenced Events
+
+Every unsolicited `mp` event (signals, player changes, setup metadata) has a
+sequence number, which increases by one for each event sent. Sessions get it
+by asking for the `sequenced` capability (see `ext_models.SequencedEvent`).
+
+A client which sees a gap in the sequence has missed an event, and can recover
+by sending `mp:sync`. The `rsync` reply carries a full snapshot, tagged with the
+sequence number of the last event sent before it was taken; events with a
+higher sequence number apply on top of the snapshot.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import "github.com/Artiqlate/ganymede/models/mp"
+
+// TODO: Move to ganymede.
+type Snapshot struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	Seq      uint64
+	Statuses []mp.Status
+}
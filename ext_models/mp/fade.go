@@ -0,0 +1,25 @@
+package ext_mp
+
+/*
+Volume Fades
+
+Ramps a player's volume from its current level to `Target` over `DurationMs`.
+Starting a new fade on a player cancels the one in progress.
+
+With `PauseAtEnd`, the player is paused once the fade completes. The volume is
+then either restored straight away, or (with `FadeInOnResumeMs`) faded back in
+from `Target` when the player resumes playing.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+// TODO: Move to ganymede.
+type FadeRequest struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack         struct{} `msgpack:",as_array"`
+	PlayerName       string
+	Target           float64
+	DurationMs       int64
+	PauseAtEnd       bool
+	FadeInOnResumeMs int64
+}
@@ -0,0 +1,46 @@
+package ext_mp
+
+/*
+Playback Handoff
+
+Moves playback between players (ex: from the desktop to the phone, and back).
+
+`handoff` captures a descriptor of what a player is playing, replied with
+`rhandoff`, and optionally pauses the player. `handoff_apply` opens the
+descriptor's track on a chosen player and seeks it to the captured position.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+// TODO: Move to ganymede.
+type HandoffRequest struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack   struct{} `msgpack:",as_array"`
+	PlayerName string
+	// Pause the player once the descriptor is captured
+	Pause bool
+}
+
+// TODO: Move to ganymede.
+type HandoffDescriptor struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	// Player the descriptor was captured from
+	PlayerName string
+	// `xesam:url` of the track, as reported by the player
+	Url     string
+	TrackId string
+	// Position in the track, in microseconds (μs)
+	PositionUs int64
+	Rate       float64
+	// Web URL of the track on its streaming service (empty if unknown)
+	ServiceUrl string
+}
+
+// TODO: Move to ganymede.
+type HandoffApplyRequest struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack   struct{} `msgpack:",as_array"`
+	PlayerName string
+	Descriptor HandoffDescriptor
+}
@@ -0,0 +1,45 @@
+package ext_mp
+
+/*
+Scrobbles
+
+A track is scrobbled once it has played for half of its length, or for four
+minutes (whichever comes first). Each scrobble is sent as a `scrobble` event,
+and appended to a local queue file (in ListenBrainz JSON format).
+
+The queue is managed with `scrobble_list` (replied with `rscrobbles`),
+`scrobble_export` (replied with `rscrobble_export`) and `scrobble_clear`.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+// TODO: Move to ganymede.
+type Scrobble struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	// When the track started playing (UNIX time, in seconds)
+	ListenedAt int64
+	Artist     string
+	Track      string
+	Release    string
+	// Zero if unknown
+	DurationMs int64
+	PlayerName string
+	Url        string
+}
+
+// TODO: Move to ganymede.
+type ScrobbleList struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack  struct{} `msgpack:",as_array"`
+	Scrobbles []Scrobble
+}
+
+// TODO: Move to ganymede.
+type ScrobbleExport struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	Count    int
+	// ListenBrainz import document (`{"listen_type": "import", ...}`)
+	Json string
+}
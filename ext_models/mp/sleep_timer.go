@@ -0,0 +1,48 @@
+package ext_mp
+
+/*
+Sleep Timer
+
+The sleep timer pauses all players, either after a fixed duration or at the
+end of the current track. The volume can optionally fade out over the last
+few seconds before the pause (and is restored after it).
+
+Every change to the timer state is sent as a `sleep` event.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+const (
+	// Pause after `DurationSec` seconds.
+	SleepModeDuration = "duration"
+	// Pause at the end of the current track.
+	SleepModeTrackEnd = "track"
+)
+
+// TODO: Move to ganymede.
+type SleepTimerRequest struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	Mode     string
+	// Duration in seconds (only for `SleepModeDuration`)
+	DurationSec int64
+	// Fade out over the last `FadeSec` seconds (0 disables fading)
+	FadeSec int64
+	// Player whose track end is waited on (only for `SleepModeTrackEnd`).
+	// Defaults to the first playing player.
+	PlayerName string
+}
+
+// TODO: Move to ganymede.
+type SleepTimerState struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack   struct{} `msgpack:",as_array"`
+	Active     bool
+	Mode       string
+	PlayerName string
+	// Time remaining until the pause, -1 when unknown (track end without a
+	// known track length, only the track change will trigger the pause).
+	RemainingMs int64
+	FadeSec     int64
+	Fading      bool
+}
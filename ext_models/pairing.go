@@ -0,0 +1,78 @@
+package ext_models
+
+/*
+Device Pairing
+
+Sessions have to be authenticated before `init` is accepted. Unknown clients
+pair first:
+
+ 1. `pair` (`PairRequest`): the server shows a one-time PIN (in its log), and
+    replies `rpair` with a `PairChallenge`.
+ 2. `pair_verify` (`PairVerify`): the client proves it knows the PIN
+    (see `transmission.PinProof`), and the server replies `rpair_verify`
+    with a `ClientCredential`, kept in its trust store.
+
+Paired clients authenticate with `auth` (`ClientCredential`), which replies
+`rauth`. Failures reply `err` with a `CommandError`.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+// -- PAIRING METHODS --
+// TODO: Move to ganymede.
+const (
+	MethodPair        = "pair"
+	MethodRPair       = "rpair"
+	MethodPairVerify  = "pair_verify"
+	MethodRPairVerify = "rpair_verify"
+	MethodAuth        = "auth"
+	MethodRAuth       = "rauth"
+	MethodError       = "err"
+)
+
+// -- ERROR CODES --
+const (
+	// Session isn't authenticated yet (`init` before `auth` or pairing)
+	ErrCodeUnauthorized = "unauthorized"
+	// Wrong, expired or missing PIN proof (a new `pair` is needed)
+	ErrCodePairingFailed = "pairing_failed"
+	// Unknown client, or wrong credential
+	ErrCodeAuthFailed = "auth_failed"
+	// Another client is pairing, or pairing failed too often lately (a
+	// `pair` can be tried again later)
+	ErrCodePairingUnavailable = "pairing_unavailable"
+)
+
+// TODO: Move to ganymede.
+type PairRequest struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	// Shown next to the PIN, and kept in the trust store
+	ClientName string `msgpack:"clientName"`
+}
+
+// TODO: Move to ganymede.
+type PairChallenge struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	// Hex-encoded random bytes, to prove the PIN against
+	Nonce string `msgpack:"nonce"`
+	// Time left to answer, in seconds
+	ExpiresIn int64 `msgpack:"expiresIn"`
+}
+
+// TODO: Move to ganymede.
+type PairVerify struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	// Hex-encoded HMAC-SHA256 of the nonce, keyed with the PIN
+	Proof string `msgpack:"proof"`
+}
+
+// TODO: Move to ganymede.
+type ClientCredential struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack   struct{} `msgpack:",as_array"`
+	ClientId   string   `msgpack:"clientId"`
+	Credential string   `msgpack:"credential"`
+}
@@ -0,0 +1,56 @@
+package ext_models
+
+/*
+Request Errors
+
+Every request gets a reply: `ok` (`CommandOk`) or `err` (`CommandError`), both
+carrying the method of the request being answered. That's so for requests the
+server handles itself (ex: `init`, `close`), or can't hand to a subsystem, as
+well. The errors of requests to a module are qualified with it (ex:
+`mp:linux:err`), and modules add codes of their own (ex: `ext_mp`'s).
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+// TODO: Move to ganymede.
+const MethodOk = "ok"
+
+// -- ERROR CODES --
+// These are stable, and are meant to be matched on by clients.
+const (
+	// Request could not be decoded (malformed method name or arguments)
+	ErrCodeDecode = "decode"
+	// Method name is qualified with another platform than the server's
+	// (ex: `mp:windows:iplay` sent to a Linux server)
+	ErrCodePlatformMismatch = "platform_mismatch"
+	// Method is not implemented by the module
+	ErrCodeUnknownMethod = "unknown_method"
+	// Local storage (ex: the trust store) couldn't be read or written
+	ErrCodeStorage = "storage"
+	// Session was already initialized (`init` again, before `close`)
+	ErrCodeAlreadyInitialized = "already_initialized"
+	// No module with the requested name
+	ErrCodeUnknownModule = "unknown_module"
+	// Module wasn't enabled through `init`
+	ErrCodeModuleNotEnabled = "module_not_enabled"
+	// Module didn't accept the request in time (ex: while it's stopping)
+	ErrCodeModuleUnavailable = "module_unavailable"
+	// Pairing methods, on a server with pairing off
+	ErrCodePairingDisabled = "pairing_disabled"
+)
+
+// TODO: Move to ganymede.
+type CommandOk struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	Method   string
+}
+
+// TODO: Move to ganymede.
+type CommandError struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	Method   string
+	Code     string
+	Message  string
+}
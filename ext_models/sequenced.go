@@ -0,0 +1,23 @@
+package ext_models
+
+/*
+Sequenced Events
+
+Modules may number their events (ex: `mp`, see `ext_mp.Snapshot`), so that a
+client can tell when it missed one. Events keep their arguments as they are;
+sessions which ask for the `sequenced` capability in `init` get them wrapped
+in a `SequencedEvent` instead, with the sequence number.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+// TODO: Move to ganymede.
+const CapabilitySequenced = "sequenced"
+
+// TODO: Move to ganymede.
+type SequencedEvent struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack struct{} `msgpack:",as_array"`
+	Seq      uint64
+	Data     interface{}
+}
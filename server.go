@@ -12,63 +12,84 @@ Copyright (C) 2023 Goutham Krishna K V
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"time"
 
 	"github.com/Artiqlate/cyprus/comm"
 	"github.com/Artiqlate/cyprus/subsystems"
 	"github.com/Artiqlate/cyprus/transmission"
 	"github.com/Artiqlate/cyprus/utils"
-	"github.com/Artiqlate/ganymede/models"
-	"github.com/Artiqlate/ganymede/models/base"
 )
 
 // Default server port
 const DefaultPort = 3969
 const DefaultInsecurePort = 3970
 
+// Time given to a subsystem to stop, before giving up on it.
+const SubsystemStopTimeout = time.Second * 5
+
 type ServerSignalChannels struct {
-	moduleInitChannel  chan []string
-	moduleCloseChannel chan bool
+	moduleInitChannel  chan comm.SessionInit
+	moduleCloseChannel chan comm.SessionClose
 	netTransmissionErr chan error
 	progSignals        chan os.Signal
-	commChannels       *comm.CommChannels
+	// Certificates reloaded from their files
+	certificateReloaded chan *tls.Certificate
+	commChannels        *comm.CommChannels
 }
 
 func NewServerSignalChannels(
-	moduleInitChan chan []string,
-	moduleCloseChan chan bool,
+	moduleInitChan chan comm.SessionInit,
+	moduleCloseChan chan comm.SessionClose,
 ) *ServerSignalChannels {
 	return &ServerSignalChannels{
 		moduleInitChannel:  moduleInitChan,
 		moduleCloseChannel: moduleCloseChan,
 		netTransmissionErr: make(chan error, 1),
 		progSignals:        make(chan os.Signal, 1),
-		commChannels:       comm.NewCommChannels(),
+		// Only the latest certificate matters (see `ServerModule.routine`)
+		certificateReloaded: make(chan *tls.Certificate, 1),
+		commChannels:        comm.NewCommChannels(),
 	}
 }
 
+// A running module, and the sessions using it (it's stopped once the last
+// one lets go of it).
+type serverModuleUsers struct {
+	subsystem subsystems.Subsystem
+	sessions  map[uint64]bool
+}
+
 type ServerModule struct {
-	secure       bool
-	serverPort   int
-	logf         func(string, ...interface{})
-	writeChannel chan models.Message
-	nt           *transmission.NetworkTransmissionServer
-	mp           subsystems.MediaPlayerSubsystem
-	nd           *subsystems.NetworkDiscovery
-	signals      *ServerSignalChannels
-}
-
-func NewServerModule(port int, secure bool) (*ServerModule, error) {
-	moduleInitChan := make(chan []string, 20)
-	moduleCloseChan := make(chan bool)
-	serverWriteChannel := make(chan models.Message)
+	secure     bool
+	serverPort int
+	// Certificate served in secure mode
+	certificate *tls.Certificate
+	// Media player backend (empty for the platform's default)
+	mpBackend string
+	logf      func(string, ...interface{})
+	nt        *transmission.NetworkTransmissionServer
+	// Running modules ("mp", "audio"), by name
+	modules map[string]*serverModuleUsers
+	nd      *subsystems.NetworkDiscovery
+	signals *ServerSignalChannels
+}
+
+// Clients have to pair before using the server, unless pairing is off (see
+// `transmission.TrustStore`).
+func NewServerModule(config Config) (*ServerModule, error) {
+	moduleInitChan := make(chan comm.SessionInit, 20)
+	moduleCloseChan := make(chan comm.SessionClose)
 	serverSignalChannels := NewServerSignalChannels(moduleInitChan, moduleCloseChan)
 	logf := func(s string, i ...interface{}) {
 		utils.LogFunc("SRV", s, i...)
 	}
+	port, secure, pairing := config.Port, config.Secure, config.Pairing
 	// Default port values (and security options)
 	if port == 0 {
 		if secure {
@@ -77,26 +98,157 @@ func NewServerModule(port int, secure bool) (*ServerModule, error) {
 			port = DefaultInsecurePort
 		}
 	}
-	logf("Port: %d Secure: %v", port, secure)
-	return &ServerModule{
-		secure:       secure,
-		serverPort:   port,
-		logf:         logf,
-		writeChannel: serverWriteChannel,
+	if config.MutualTLS && !secure {
+		return nil, fmt.Errorf("mutual TLS needs secure mode")
+	}
+	var trustStore *transmission.TrustStore
+	if pairing || config.MutualTLS {
+		var trustStoreErr error
+		if trustStore, trustStoreErr = transmission.DefaultTrustStore(); trustStoreErr != nil {
+			return nil, fmt.Errorf("trust store: %w", trustStoreErr)
+		}
+	}
+	logf("Port: %d Secure: %v Pairing: %v Mutual TLS: %v", port, secure, pairing, config.MutualTLS)
+	// Without pairing, any session can `init` (mutual TLS still checks the
+	// pinned client certificates in the trust store).
+	pairingTrustStore := trustStore
+	if !pairing {
+		pairingTrustStore = nil
+	}
+	originPolicy, originPolicyErr := transmission.NewOriginPolicy(config.AllowedOrigins)
+	if originPolicyErr != nil {
+		return nil, originPolicyErr
+	}
+	if len(config.AllowedOrigins) != 0 {
+		logf("Allowed origins: %v", config.AllowedOrigins)
+	}
+	var clientAuthenticator *transmission.ClientAuthenticator
+	if config.MutualTLS {
+		clientCA, clientCAErr := transmission.DefaultClientCA()
+		if clientCAErr != nil {
+			return nil, clientCAErr
+		}
+		clientAuthenticator = transmission.NewClientAuthenticator(clientCA, trustStore)
+		logf("Client CA: %s", clientCA.CertPath())
+	}
+	// Secure mode serves with the configured certificate (reloaded when its
+	// files change), or else the same identity across restarts.
+	var certificate *tls.Certificate
+	var certificateReloader *transmission.CertificateReloader
+	if secure && config.TLS.Configured() {
+		var reloaderErr error
+		certificateReloader, reloaderErr = transmission.NewCertificateReloader(config.TLS, func(s string, i ...interface{}) {
+			utils.LogFunc("TLS", s, i...)
+		})
+		if reloaderErr != nil {
+			return nil, reloaderErr
+		}
+		certificateReloader.OnReload(func(reloaded *tls.Certificate) {
+			// Replace a reload the routine hasn't picked up yet.
+			select {
+			case <-serverSignalChannels.certificateReloaded:
+			default:
+			}
+			serverSignalChannels.certificateReloaded <- reloaded
+		})
+		certificate = certificateReloader.Certificate()
+		logf("Certificate: %s", config.TLS.CertFile)
+		logf("Certificate fingerprint (SHA-256): %s", transmission.Fingerprint(certificate))
+	} else if secure {
+		var identityErr error
+		if certificate, identityErr = transmission.LoadDefaultIdentity(); identityErr != nil {
+			return nil, fmt.Errorf("TLS identity: %w", identityErr)
+		}
+		logf("Certificate fingerprint (SHA-256): %s", transmission.Fingerprint(certificate))
+	}
+	serverModule := &ServerModule{
+		secure:      secure,
+		certificate: certificate,
+		serverPort:  port,
+		mpBackend:   config.MPBackend,
+		logf:        logf,
 		nt: transmission.NewNetworkTransmissionServer(
-			serverWriteChannel,
 			moduleInitChan,
 			moduleCloseChan,
 			serverSignalChannels.commChannels,
+			pairingTrustStore,
 			port,
 		),
 		signals: serverSignalChannels,
 		// - Modules
-		// 1. mp: Media Player
-		mp: nil,
-		// 2. nd: Network Discovery
+		// 1. mp: Media Player, 2. audio: System Audio
+		modules: make(map[string]*serverModuleUsers),
+		// 3. nd: Network Discovery
 		nd: nil,
-	}, nil
+	}
+	if certificateReloader != nil {
+		serverModule.nt.SetCertificateReloader(certificateReloader)
+	} else {
+		serverModule.nt.SetCertificate(certificate)
+	}
+	serverModule.nt.SetClientAuthenticator(clientAuthenticator)
+	serverModule.nt.SetOriginPolicy(originPolicy)
+	serverModule.nt.SetTransportOptions(config.Transport)
+	return serverModule, nil
+}
+
+// Replaces the TLS identity secure mode serves with, and returns the
+// fingerprint of the new certificate. Clients have to pin it again.
+func RotateIdentity() (string, error) {
+	certificate, rotateErr := transmission.RotateDefaultIdentity()
+	if rotateErr != nil {
+		return "", rotateErr
+	}
+	return transmission.Fingerprint(certificate), nil
+}
+
+// Issues a client certificate (for mutual TLS), and writes it with its key
+// to dir, as `<clientName>.crt` and `<clientName>.key`.
+func IssueClientCertificate(clientName string, dir string) (*transmission.IssuedClient, error) {
+	clientCA, clientCAErr := transmission.DefaultClientCA()
+	if clientCAErr != nil {
+		return nil, clientCAErr
+	}
+	certificatePEM, keyPEM, issuedClient, issueErr := clientCA.Issue(clientName)
+	if issueErr != nil {
+		return nil, issueErr
+	}
+	fileName := filepath.Join(dir, filepath.Base(clientName))
+	if writeErr := os.WriteFile(fileName+".key", keyPEM, 0o600); writeErr != nil {
+		return nil, writeErr
+	}
+	if writeErr := os.WriteFile(fileName+".crt", certificatePEM, 0o644); writeErr != nil {
+		return nil, writeErr
+	}
+	return issuedClient, nil
+}
+
+// Trusts the client certificate with the given fingerprint (for mutual TLS).
+func PinClientCertificate(clientName string, fingerprint string) (string, error) {
+	trustStore, trustStoreErr := transmission.DefaultTrustStore()
+	if trustStoreErr != nil {
+		return "", trustStoreErr
+	}
+	return trustStore.PinCertificate(clientName, fingerprint)
+}
+
+// Revokes the client certificates with the given serial number or
+// fingerprint (issued, or pinned). Returns how many were revoked.
+func RevokeClientCertificate(serialOrFingerprint string) (int, error) {
+	clientCA, clientCAErr := transmission.DefaultClientCA()
+	if clientCAErr != nil {
+		return 0, clientCAErr
+	}
+	revoked, revokeErr := clientCA.Revoke(serialOrFingerprint)
+	if revokeErr != nil {
+		return revoked, revokeErr
+	}
+	trustStore, trustStoreErr := transmission.DefaultTrustStore()
+	if trustStoreErr != nil {
+		return revoked, trustStoreErr
+	}
+	unpinned, removeErr := trustStore.Remove(serialOrFingerprint)
+	return revoked + unpinned, removeErr
 }
 
 func (s *ServerModule) setup() {
@@ -105,7 +257,11 @@ func (s *ServerModule) setup() {
 
 	// -- NETWORK DISCOVERY (this module needs to be set-up on launch so that
 	//	it can be discovered by other devices over the network).
-	networkDiscoveryModule, ndErr := subsystems.NewNetworkDiscovery(s.serverPort, s.secure)
+	networkDiscoveryModule, ndErr := subsystems.NewNetworkDiscovery(
+		s.serverPort,
+		s.secure,
+		transmission.Fingerprint(s.certificate),
+	)
 	if ndErr != nil {
 		s.logf("NetworkDiscoveryError: %v", ndErr)
 	} else {
@@ -116,71 +272,135 @@ func (s *ServerModule) setup() {
 	// -- Setup for any other modules
 }
 
-func (s *ServerModule) initializeModule(mods []string) []string {
+// Creates and starts a module.
+func (s *ServerModule) startModule(mod string) (subsystems.Subsystem, error) {
+	var subsystem subsystems.Subsystem
+	switch mod {
+	case "mp":
+		// Initialize new media player
+		mPlayer, mPlayerErr := subsystems.NewMediaPlayerSubsystem(&s.signals.commChannels.MPChannel, s.mpBackend)
+		if mPlayerErr != nil {
+			return nil, mPlayerErr
+		}
+		subsystem = mPlayer
+	case "audio":
+		subsystem = subsystems.NewAudioSubsystem(&s.signals.commChannels.AudioChannel)
+	default:
+		return nil, fmt.Errorf("unknown module %s", mod)
+	}
+	if startErr := subsystem.Start(context.Background()); startErr != nil {
+		return nil, startErr
+	}
+	return subsystem, nil
+}
+
+// Enables modules for a session: modules which aren't running yet are
+// started, and running ones send their current state to the session.
+func (s *ServerModule) initializeModule(session uint64, mods []string) []string {
 	enabledModules := []string{}
 	for _, mod := range mods {
 		// TODO: find a better way to transfer the errors
 		s.logf("Enabling modules: %s\n", mod)
-		switch mod {
-		case "mp":
-			// Initialize new media player
-			mPlayer, mPlayerErr := subsystems.NewMediaPlayerSubsystem(&s.signals.commChannels.MPChannel)
-			if mPlayerErr != nil {
-				s.logf("mPlayerErr: %s", mPlayerErr)
-			} else {
-				s.mp = mPlayer
-				// Setup and run coroutine
-				s.mp.Setup()
-				go s.mp.Routine()
-				enabledModules = append(enabledModules, mod)
-			}
+		users := s.modules[mod]
+		// Modules may stop on their own (ex: `mp:close` reaching it).
+		if users != nil && users.subsystem.State() != utils.StateRunning {
+			s.stopSubsystem(mod, users.subsystem)
+			delete(s.modules, mod)
+			users = nil
+		}
+		if users != nil {
+			users.sessions[session] = true
+			s.attachSession(mod, session)
+			enabledModules = append(enabledModules, mod)
+			continue
 		}
+		subsystem, startErr := s.startModule(mod)
+		if startErr != nil {
+			s.logf("%s start: %v", mod, startErr)
+			continue
+		}
+		s.modules[mod] = &serverModuleUsers{
+			subsystem: subsystem,
+			sessions:  map[uint64]bool{session: true},
+		}
+		enabledModules = append(enabledModules, mod)
 	}
 	return enabledModules
 }
 
-func (s *ServerModule) closeModule() {
-	// -- MEDIA PLAYER
-	if s.mp != nil {
-		s.logf("Stopping MediaPlayer")
-		s.mp.Shutdown()
-		s.mp = nil
+// Asks a running module to send its current state to a session which just
+// joined.
+func (s *ServerModule) attachSession(mod string, session uint64) {
+	select {
+	case s.signals.commChannels.Module(mod).AttachChannel <- session:
+	case <-time.After(transmission.ModuleSendTimeout):
+		s.logf("%s: not accepting session %d", mod, session)
 	}
-	// Network Discovery
-	if s.nd == nil {
-		s.logf("Restarting NetworkDiscovery")
-		ndServer, ndServErr := subsystems.NewNetworkDiscovery(s.serverPort, s.secure)
-		if ndServErr != nil {
-			s.logf("closeModule(networkDiscovery) Error: %v", ndServErr)
-		} else {
-			s.nd = ndServer
+}
+
+// Stops a subsystem, giving up on it after `SubsystemStopTimeout` (a stuck
+// subsystem is left behind rather than hanging the server).
+func (s *ServerModule) stopSubsystem(name string, subsystem subsystems.Subsystem) {
+	s.logf("Stopping %s (%s)", name, subsystem.State())
+	stopContext, cancel := context.WithTimeout(context.Background(), SubsystemStopTimeout)
+	defer cancel()
+	if stopErr := subsystem.Stop(stopContext); stopErr != nil {
+		s.logf("%s: %v", name, stopErr)
+	}
+}
+
+// Lets go of modules for a session (all of them when mods is nil), and
+// stops the ones no session uses anymore.
+func (s *ServerModule) closeModule(session uint64, mods []string) {
+	if mods == nil {
+		for mod := range s.modules {
+			mods = append(mods, mod)
 		}
 	}
+	for _, mod := range mods {
+		users := s.modules[mod]
+		if users == nil || !users.sessions[session] {
+			continue
+		}
+		delete(users.sessions, session)
+		if len(users.sessions) == 0 {
+			s.stopSubsystem(mod, users.subsystem)
+			delete(s.modules, mod)
+		}
+	}
+}
+
+func (s *ServerModule) stopModules() {
+	for mod, users := range s.modules {
+		s.stopSubsystem(mod, users.subsystem)
+		delete(s.modules, mod)
+	}
 }
 
 func (s *ServerModule) routine() {
 	// -- TRANSMISSION MODULE --
 	go s.nt.Coroutine(s.signals.netTransmissionErr, s.secure)
-	// Stop Network discovery as soon as connection is established.
+	// Network discovery keeps running, so other devices can connect too.
 routineForLoop:
 	for {
 		select {
 		// Module Initialization Channel
 		case initModule := <-s.signals.moduleInitChannel:
-			initializedModules := s.initializeModule(initModule)
-			s.logf("Initializing Modules : %s\n", initializedModules)
-			s.writeChannel <- *base.NewInitWithCapabilities(initializedModules).GenMessage("rinit")
-			// Stop network discovery so nobody else can see this server after connection
+			initializedModules := s.initializeModule(initModule.Session, initModule.Modules)
+			s.logf("Session %d: Initializing Modules : %s\n", initModule.Session, initializedModules)
+			initModule.Reply <- initializedModules
+		// Module Close Channel
+		case closeModule := <-s.signals.moduleCloseChannel:
+			s.logf("Session %d: close triggered", closeModule.Session)
+			s.closeModule(closeModule.Session, closeModule.Modules)
+		// New certificate (only new connections get it)
+		case certificate := <-s.signals.certificateReloaded:
+			s.certificate = certificate
+			fingerprint := transmission.Fingerprint(certificate)
+			s.logf("Certificate fingerprint (SHA-256): %s", fingerprint)
 			if s.nd != nil {
-				s.logf("Stopping Network Discovery")
-				s.nd.Shutdown()
-				s.nd = nil
+				s.nd.SetFingerprint(fingerprint)
 			}
-			continue routineForLoop
-		// Module Close Channel
-		case <-s.signals.moduleCloseChannel:
-			s.logf("close triggered")
-			s.closeModule()
 		// If the server encounters an error
 		case servErr := <-s.signals.netTransmissionErr:
 			s.logf("NetworkTransmission error: %v", servErr)
@@ -202,10 +422,8 @@ func (s *ServerModule) shutdown() {
 		s.logf("server error: %v", <-s.signals.netTransmissionErr)
 	}
 
-	// -- MEDIA PLAYER SHUTDOWN
-	if s.mp != nil {
-		s.mp.Shutdown()
-	}
+	// -- MEDIA PLAYER, AUDIO SHUTDOWN
+	s.stopModules()
 
 	// -- NETWORK TRANSMISSION SHUTDOWN
 	shutDownErr := s.nt.Shutdown(shutdownContext)
@@ -0,0 +1,15 @@
+package subsystems
+
+import (
+	"github.com/Artiqlate/cyprus/comm"
+	"github.com/Artiqlate/cyprus/subsystems/audio"
+)
+
+type AudioSubsystem interface {
+	Subsystem
+}
+
+// Creates the audio subsystem, using the system's audio tooling.
+func NewAudioSubsystem(bidirChan *comm.BiDirMessageChannel) AudioSubsystem {
+	return audio.NewSubsystem(bidirChan, audio.ExecRunner{})
+}
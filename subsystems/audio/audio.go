@@ -0,0 +1,524 @@
+package audio
+
+/*
+Audio Subsystem
+
+This controls the system audio: the volume and mute state of the default
+output device (sink), the mute state of the default input device (source),
+and which sink is the default. Changes (from the client or anything else)
+are pushed to the client as events.
+
+Like the media player subsystem, all the state is owned by the `routine`
+goroutine.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/Artiqlate/cyprus/comm"
+	"github.com/Artiqlate/cyprus/ext_models"
+	ext_audio "github.com/Artiqlate/cyprus/ext_models/audio"
+	"github.com/Artiqlate/cyprus/utils"
+	"github.com/Artiqlate/ganymede/models"
+)
+
+const (
+	AudioSubsystemName = "audio"
+	// Time given to the audio tooling to answer
+	AudioCommandTimeout = time.Second * 2
+	// Delay before resubscribing to changes, when the sound server goes away
+	AudioResubscribeDelay = time.Second
+	// Highest volume which can be set (150%)
+	MaxVolume = 1.5
+)
+
+// -- Audio Methods
+const (
+	MethodState  = "state"
+	MethodRState = "rstate"
+	MethodOk     = "ok"
+	MethodError  = "err"
+	// Output devices
+	MethodRSinks      = "rsinks"
+	MethodSinkAdded   = "sink_added"
+	MethodSinkRemoved = "sink_removed"
+	MethodSinkChanged = "sink_changed"
+)
+
+// `pactl subscribe` facilities which can change the state.
+var stateFacilities = map[string]bool{
+	"sink":   true,
+	"source": true,
+	"server": true,
+}
+
+var ErrSubsystemStopped = errors.New("audio: subsystem already stopped")
+
+type Subsystem struct {
+	logf         func(string, ...interface{})
+	pactl        *pactl
+	bidirChannel *comm.BiDirMessageChannel
+	// Lifecycle (same as the media player's)
+	lifecycle utils.Lifecycle
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan bool
+	// Last state sent to the clients
+	state *ext_audio.AudioState
+	// Session of the request being handled, which replies go to (with the
+	// request's ID, if it has one)
+	requester uint64
+	requestId msgpack.RawMessage
+	// Sinks, as last seen (to tell which ones were plugged or unplugged)
+	sinks []ext_audio.Sink
+	// `pactl subscribe` lines (nil while resubscribing)
+	changes     <-chan string
+	resubscribe <-chan time.Time
+}
+
+func NewSubsystem(bidirChan *comm.BiDirMessageChannel, runner CommandRunner) *Subsystem {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Subsystem{
+		logf: func(f string, v ...interface{}) {
+			utils.LogFunc("AUD", f, v...)
+		},
+		pactl:        &pactl{runner: runner},
+		bidirChannel: bidirChan,
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan bool),
+	}
+}
+
+// -- UTILITY METHODS --
+
+// Method name for events and replies (`audio:<platform>:<method>`).
+func (as *Subsystem) platformMethod(method string) string {
+	return utils.GeneratePlatformMethod(AudioSubsystemName, utils.CurrentPlatform(), method)
+}
+
+// Sends a message to a client session, or to every session with
+// `comm.BroadcastSession` (gives up once the subsystem is stopping).
+func (as *Subsystem) send(session uint64, message models.Message) bool {
+	return as.sendEnvelope(comm.Envelope{Session: session, Message: message})
+}
+
+func (as *Subsystem) sendEnvelope(envelope comm.Envelope) bool {
+	select {
+	case as.bidirChannel.OutChannel <- envelope:
+		return true
+	case <-as.ctx.Done():
+		return false
+	}
+}
+
+// Sends a message to every session.
+func (as *Subsystem) broadcast(message models.Message) bool {
+	return as.send(comm.BroadcastSession, message)
+}
+
+// Sends a message to the session of the request being handled.
+func (as *Subsystem) reply(message models.Message) bool {
+	return as.sendEnvelope(comm.Envelope{Session: as.requester, RequestId: as.requestId, Message: message})
+}
+
+func (as *Subsystem) replyOk(requestMethod string) {
+	as.reply(models.Message{
+		Method: as.platformMethod(MethodOk),
+		Args:   &ext_models.CommandOk{Method: requestMethod},
+	})
+}
+
+func (as *Subsystem) replyError(requestMethod string, err error) {
+	commandErr := AsCommandError(err)
+	as.logf("%s: %v", requestMethod, commandErr)
+	as.reply(models.Message{
+		Method: as.platformMethod(MethodError),
+		Args: &ext_models.CommandError{
+			Method:  requestMethod,
+			Code:    commandErr.Code,
+			Message: commandErr.Message,
+		},
+	})
+}
+
+// Context for a single call to the audio tooling.
+func (as *Subsystem) commandContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(as.ctx, AudioCommandTimeout)
+}
+
+// -- STATE --
+
+func (as *Subsystem) readState() (*ext_audio.AudioState, error) {
+	ctx, cancel := as.commandContext()
+	defer cancel()
+	return as.pactl.state(ctx)
+}
+
+// Reads the state, and sends it to the clients if it changed.
+func (as *Subsystem) refreshState() {
+	state, stateErr := as.readState()
+	if stateErr != nil {
+		as.logf("State: %v", stateErr)
+		return
+	}
+	if as.state != nil && *state == *as.state {
+		return
+	}
+	as.state = state
+	as.broadcast(models.Message{
+		Method: as.platformMethod(MethodState),
+		Args:   state,
+	})
+}
+
+// Follows changes to the sound server (retried after
+// `AudioResubscribeDelay` on failure).
+func (as *Subsystem) subscribe() {
+	changes, subscribeErr := as.pactl.subscribe(as.ctx)
+	if subscribeErr != nil {
+		as.logf("Subscribe: %v", subscribeErr)
+		as.changes = nil
+		as.resubscribe = time.After(AudioResubscribeDelay)
+		return
+	}
+	as.changes = changes
+	as.resubscribe = nil
+}
+
+// Whether a `pactl subscribe` line affects the state, and the sinks.
+func classifyChange(line string) (bool, bool) {
+	event, isEvent := parsePactlEvent(line)
+	if !isEvent {
+		return false, false
+	}
+	return stateFacilities[event.facility], event.facility == "sink"
+}
+
+// Handles a `pactl subscribe` line. Bursts of changes are coalesced, so the
+// state is only read once for them.
+func (as *Subsystem) handleChange(line string) {
+	stateChanged, sinksChanged := classifyChange(line)
+coalesceChanges:
+	for {
+		select {
+		case nextLine, changesOpen := <-as.changes:
+			if !changesOpen {
+				as.changesClosed()
+				break coalesceChanges
+			}
+			nextStateChanged, nextSinksChanged := classifyChange(nextLine)
+			stateChanged = stateChanged || nextStateChanged
+			sinksChanged = sinksChanged || nextSinksChanged
+		default:
+			break coalesceChanges
+		}
+	}
+	// Devices first, the state may only have changed because of them.
+	if sinksChanged {
+		as.refreshSinks()
+	}
+	if stateChanged {
+		as.refreshState()
+	}
+}
+
+// -- SINKS --
+
+func (as *Subsystem) readSinks() ([]ext_audio.Sink, error) {
+	ctx, cancel := as.commandContext()
+	defer cancel()
+	return as.pactl.sinks(ctx)
+}
+
+// Reads the sinks, and tells the client about the ones which were plugged,
+// unplugged, or switched to another port.
+func (as *Subsystem) refreshSinks() {
+	sinks, sinksErr := as.readSinks()
+	if sinksErr != nil {
+		as.logf("Sinks: %v", sinksErr)
+		return
+	}
+	previous := make(map[string]ext_audio.Sink, len(as.sinks))
+	for _, sink := range as.sinks {
+		previous[sink.Name] = sink
+	}
+	for sinkIdx := range sinks {
+		sink := &sinks[sinkIdx]
+		previousSink, existed := previous[sink.Name]
+		delete(previous, sink.Name)
+		if !existed {
+			as.logf("Sink added: %s", sink.Name)
+			as.broadcast(models.Message{Method: as.platformMethod(MethodSinkAdded), Args: sink})
+		} else if previousSink.ActivePort != sink.ActivePort {
+			as.broadcast(models.Message{Method: as.platformMethod(MethodSinkChanged), Args: sink})
+		}
+	}
+	// Removed sinks, in the order they were listed
+	for _, sink := range as.sinks {
+		if removedSink, removed := previous[sink.Name]; removed {
+			as.logf("Sink removed: %s", sink.Name)
+			as.broadcast(models.Message{Method: as.platformMethod(MethodSinkRemoved), Args: &removedSink})
+		}
+	}
+	as.sinks = sinks
+}
+
+func hasSink(sinks []ext_audio.Sink, sinkName string) bool {
+	for _, sink := range sinks {
+		if sink.Name == sinkName {
+			return true
+		}
+	}
+	return false
+}
+
+func (as *Subsystem) changesClosed() {
+	as.logf("Subscribe: stopped, resubscribing")
+	as.changes = nil
+	as.resubscribe = time.After(AudioResubscribeDelay)
+}
+
+// -- REQUESTS --
+
+// Handles a single client request.
+//
+// Returns whether the reply was already sent (for requests which reply with
+// data), and the error to reply with otherwise.
+func (as *Subsystem) handleRequest(method string, decoder *msgpack.Decoder) (bool, error) {
+	ctx, cancel := as.commandContext()
+	defer cancel()
+	switch method {
+	case "get":
+		// The state last sent stays as it is: it's only updated when the
+		// change is sent to every session (see `refreshState`).
+		state, stateErr := as.pactl.state(ctx)
+		if stateErr != nil {
+			return false, stateErr
+		}
+		as.reply(models.Message{
+			Method: as.platformMethod(MethodRState),
+			Args:   state,
+		})
+		return true, nil
+	case "set_volume":
+		var volumeRequest ext_audio.VolumeRequest
+		if parseErr := decoder.Decode(&volumeRequest); parseErr != nil {
+			return false, NewCommandError(ext_models.ErrCodeDecode, "set_volume: %v", parseErr)
+		}
+		if volumeRequest.Volume < 0 || volumeRequest.Volume > MaxVolume {
+			return false, NewCommandError(
+				ext_audio.ErrCodeInvalidValue,
+				"volume %v out of range (0 to %v)",
+				volumeRequest.Volume,
+				MaxVolume,
+			)
+		}
+		return false, as.pactl.setSinkVolume(ctx, volumeRequest.Volume)
+	case "set_mute", "set_source_mute":
+		var muteRequest ext_audio.MuteRequest
+		if parseErr := decoder.Decode(&muteRequest); parseErr != nil {
+			return false, NewCommandError(ext_models.ErrCodeDecode, "%s: %v", method, parseErr)
+		}
+		if method == "set_mute" {
+			return false, as.pactl.setSinkMute(ctx, muteRequest.Muted)
+		}
+		return false, as.pactl.setSourceMute(ctx, muteRequest.Muted)
+	case "list_sinks":
+		// The sinks plug events are diffed against stay as they are (see
+		// `refreshSinks`).
+		sinks, sinksErr := as.pactl.sinks(ctx)
+		if sinksErr != nil {
+			return false, sinksErr
+		}
+		as.reply(models.Message{
+			Method: as.platformMethod(MethodRSinks),
+			Args:   &ext_audio.SinkList{Sinks: append([]ext_audio.Sink{}, sinks...)},
+		})
+		return true, nil
+	case "set_default_sink":
+		var sinkSelection ext_audio.SinkSelection
+		if parseErr := decoder.Decode(&sinkSelection); parseErr != nil {
+			return false, NewCommandError(ext_models.ErrCodeDecode, "set_default_sink: %v", parseErr)
+		}
+		// Checked against the current sinks, the device may have just been
+		// plugged in.
+		sinks, sinksErr := as.pactl.sinks(ctx)
+		if sinksErr != nil {
+			return false, sinksErr
+		}
+		if !hasSink(sinks, sinkSelection.Name) {
+			return false, NewCommandError(ext_audio.ErrCodeSinkNotFound, "sink %s not found", sinkSelection.Name)
+		}
+		return false, as.pactl.setDefaultSink(ctx, sinkSelection.Name)
+	default:
+		return false, NewCommandError(ext_models.ErrCodeUnknownMethod, "method %s unimplemented", method)
+	}
+}
+
+// --- ROUTINE ---
+
+// Reads the initial state (failing if the audio tooling isn't available),
+// sends it once, and subscribes to changes.
+func (as *Subsystem) setup() error {
+	state, stateErr := as.readState()
+	if stateErr != nil {
+		return fmt.Errorf("audio: %v", stateErr)
+	}
+	as.state = state
+	as.broadcast(models.Message{
+		Method: as.platformMethod(MethodState),
+		Args:   state,
+	})
+	// Not fatal, devices are then only known from the first change on.
+	sinks, sinksErr := as.readSinks()
+	if sinksErr != nil {
+		as.logf("Sinks: %v", sinksErr)
+	}
+	as.sinks = sinks
+	as.subscribe()
+	return nil
+}
+
+// Main Subsystem Routine
+//
+// Handles client requests, module commands and changes to the sound server,
+// until the client sends `audio:close`, a module sends "close", or the
+// context is cancelled.
+func (as *Subsystem) routine() {
+	as.logf("Routine: starting")
+	defer as.finish()
+audioForRoutine:
+	for {
+		select {
+		case <-as.ctx.Done():
+			break audioForRoutine
+		case request := <-as.bidirChannel.InChannel:
+			as.requester, as.requestId = request.Session, request.Id
+			decoder := msgpack.NewDecoder(bytes.NewReader(request.Data))
+			if payloadErr := utils.ValidateDecoder(decoder); payloadErr != nil {
+				as.logf("payloadErr: %v", payloadErr)
+			}
+			methodData, decodeErr := decoder.DecodeString()
+			if decodeErr != nil {
+				as.replyError(methodData, NewCommandError(ext_models.ErrCodeDecode, "method: %v", decodeErr))
+				continue audioForRoutine
+			}
+			methodName, methodErr := utils.ParsePlatformMethod(methodData, utils.CurrentPlatform())
+			if methodErr != nil {
+				as.replyError(methodData, commandErrorFromMethod(methodErr))
+				continue audioForRoutine
+			}
+			method := methodName.Method
+			if method == "" {
+				method = methodName.Module
+			}
+			if method == "close" {
+				as.replyOk(methodData)
+				break audioForRoutine
+			}
+			replied, requestErr := as.handleRequest(method, decoder)
+			if requestErr != nil {
+				as.replyError(methodData, requestErr)
+			} else if !replied {
+				as.replyOk(methodData)
+				// Send the new state straight away, rather than waiting for
+				// the sound server to report it.
+				as.refreshState()
+			}
+		case session := <-as.bidirChannel.AttachChannel:
+			// Sessions joining later get the last state sent.
+			as.send(session, models.Message{
+				Method: as.platformMethod(MethodState),
+				Args:   as.state,
+			})
+		case line, changesOpen := <-as.changes:
+			if !changesOpen {
+				as.changesClosed()
+				continue audioForRoutine
+			}
+			as.handleChange(line)
+		case <-as.resubscribe:
+			as.subscribe()
+			// Changes may have been missed meanwhile.
+			as.refreshSinks()
+			as.refreshState()
+		case moduleCommand := <-as.bidirChannel.CommandChannel:
+			if moduleCommand != "close" {
+				as.logf("ERROR: Unexpected command passed in!")
+			}
+			break audioForRoutine
+		}
+	}
+	as.logf("Stopping")
+}
+
+func (as *Subsystem) finish() {
+	as.lifecycle.Advance(utils.StateStopping)
+	// Also stops `pactl subscribe`
+	as.cancel()
+	as.lifecycle.Advance(utils.StateStopped)
+	close(as.done)
+	as.logf("Stopped")
+}
+
+// -- LIFECYCLE --
+
+func (as *Subsystem) State() utils.LifecycleState {
+	return as.lifecycle.State()
+}
+
+// Sets up the subsystem and starts its routine. The subsystem stops when ctx
+// is cancelled (or through `Stop`). Same rules as the media player's `Start`.
+func (as *Subsystem) Start(ctx context.Context) error {
+	if !as.lifecycle.Transition(utils.StateCreated, utils.StateSettingUp) {
+		if as.lifecycle.State() >= utils.StateStopping {
+			return ErrSubsystemStopped
+		}
+		return nil
+	}
+	if as.bidirChannel.InChannel == nil || as.bidirChannel.OutChannel == nil {
+		as.finish()
+		return fmt.Errorf("audio: channels not initialized")
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			as.cancel()
+		case <-as.done:
+		}
+	}()
+	if setupErr := as.setup(); setupErr != nil {
+		as.finish()
+		return setupErr
+	}
+	as.lifecycle.Transition(utils.StateSettingUp, utils.StateRunning)
+	go as.routine()
+	return nil
+}
+
+// Stops the subsystem and waits for it to clean up, or for ctx to be done
+// (whichever comes first).
+func (as *Subsystem) Stop(ctx context.Context) error {
+	if as.lifecycle.Transition(utils.StateCreated, utils.StateStopped) {
+		as.cancel()
+		close(as.done)
+		return nil
+	}
+	as.lifecycle.Advance(utils.StateStopping)
+	as.cancel()
+	select {
+	case <-as.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("audio: stop: %w", ctx.Err())
+	}
+}
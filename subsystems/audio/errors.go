@@ -0,0 +1,45 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Artiqlate/cyprus/ext_models"
+	ext_audio "github.com/Artiqlate/cyprus/ext_models/audio"
+	"github.com/Artiqlate/cyprus/utils"
+)
+
+// Error returned by request handlers, which is sent back to the client.
+type CommandError struct {
+	Code    string
+	Message string
+}
+
+func NewCommandError(code string, format string, args ...interface{}) *CommandError {
+	return &CommandError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (ce *CommandError) Error() string {
+	return fmt.Sprintf("%s: %s", ce.Code, ce.Message)
+}
+
+// Converts an error from `utils.ParsePlatformMethod` to a command error.
+func commandErrorFromMethod(err error) *CommandError {
+	if errors.Is(err, utils.ErrPlatformMismatch) {
+		return NewCommandError(ext_models.ErrCodePlatformMismatch, "%v", err)
+	}
+	return NewCommandError(ext_models.ErrCodeDecode, "method: %v", err)
+}
+
+// Converts any handler error to a command error. Errors which aren't already
+// command errors are treated as failures of the audio tooling.
+func AsCommandError(err error) *CommandError {
+	var commandErr *CommandError
+	if errors.As(err, &commandErr) {
+		return commandErr
+	}
+	return NewCommandError(ext_audio.ErrCodeAudioError, "%v", err)
+}
@@ -0,0 +1,220 @@
+package audio
+
+/*
+pactl
+
+Reads and changes the default devices through `pactl`, which works with both
+PulseAudio and PipeWire (through `pipewire-pulse`). Only the plain text
+output is parsed, as JSON output needs a recent `pactl`.
+
+REFERENCE: https://www.freedesktop.org/wiki/Software/PulseAudio/Documentation/User/CLI/
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	ext_audio "github.com/Artiqlate/cyprus/ext_models/audio"
+)
+
+const (
+	PactlCommand  = "pactl"
+	DefaultSink   = "@DEFAULT_SINK@"
+	DefaultSource = "@DEFAULT_SOURCE@"
+)
+
+// Percentages of every channel in a volume ("Volume: front-left: 32768 /  50% / ...")
+var pactlVolumePercent = regexp.MustCompile(`(\d+)%`)
+
+// `pactl subscribe` lines ("Event 'change' on sink #52")
+var pactlEventLine = regexp.MustCompile(`^Event '([a-z]+)' on ([a-z-]+) #`)
+
+// A change reported by `pactl subscribe`.
+type pactlEvent struct {
+	kind     string
+	facility string
+}
+
+func parsePactlEvent(line string) (pactlEvent, bool) {
+	match := pactlEventLine.FindStringSubmatch(line)
+	if match == nil {
+		return pactlEvent{}, false
+	}
+	return pactlEvent{kind: match[1], facility: match[2]}, true
+}
+
+type pactl struct {
+	runner CommandRunner
+}
+
+func (pa *pactl) run(ctx context.Context, args ...string) (string, error) {
+	output, runErr := pa.runner.Output(ctx, PactlCommand, args...)
+	if runErr != nil {
+		return "", NewCommandError(ext_audio.ErrCodeAudioError, "%v", runErr)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Average volume of all the channels.
+func parseVolume(output string) (float64, error) {
+	volumeLine, _, _ := strings.Cut(output, "\n")
+	matches := pactlVolumePercent.FindAllStringSubmatch(volumeLine, -1)
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("no volume in %q", volumeLine)
+	}
+	total := 0
+	for _, match := range matches {
+		percent, _ := strconv.Atoi(match[1])
+		total += percent
+	}
+	return float64(total) / float64(len(matches)) / 100, nil
+}
+
+// "Mute: yes"
+func parseMute(output string) (bool, error) {
+	if !strings.HasPrefix(output, "Mute:") {
+		return false, fmt.Errorf("no mute state in %q", output)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(output, "Mute:")) == "yes", nil
+}
+
+func boolArg(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
+// -- DEFAULT DEVICES --
+
+func (pa *pactl) state(ctx context.Context) (*ext_audio.AudioState, error) {
+	state := &ext_audio.AudioState{}
+	var runErr error
+	if state.SinkName, runErr = pa.run(ctx, "get-default-sink"); runErr != nil {
+		return nil, runErr
+	}
+	volumeOutput, runErr := pa.run(ctx, "get-sink-volume", DefaultSink)
+	if runErr != nil {
+		return nil, runErr
+	}
+	var parseErr error
+	if state.Volume, parseErr = parseVolume(volumeOutput); parseErr != nil {
+		return nil, NewCommandError(ext_audio.ErrCodeAudioError, "sink volume: %v", parseErr)
+	}
+	muteOutput, runErr := pa.run(ctx, "get-sink-mute", DefaultSink)
+	if runErr != nil {
+		return nil, runErr
+	}
+	if state.Muted, parseErr = parseMute(muteOutput); parseErr != nil {
+		return nil, NewCommandError(ext_audio.ErrCodeAudioError, "sink mute: %v", parseErr)
+	}
+	if state.SourceName, runErr = pa.run(ctx, "get-default-source"); runErr != nil {
+		return nil, runErr
+	}
+	sourceMuteOutput, runErr := pa.run(ctx, "get-source-mute", DefaultSource)
+	if runErr != nil {
+		return nil, runErr
+	}
+	if state.SourceMuted, parseErr = parseMute(sourceMuteOutput); parseErr != nil {
+		return nil, NewCommandError(ext_audio.ErrCodeAudioError, "source mute: %v", parseErr)
+	}
+	return state, nil
+}
+
+func (pa *pactl) setSinkVolume(ctx context.Context, volume float64) error {
+	_, runErr := pa.run(ctx, "set-sink-volume", DefaultSink, fmt.Sprintf("%d%%", int(volume*100+0.5)))
+	return runErr
+}
+
+func (pa *pactl) setSinkMute(ctx context.Context, muted bool) error {
+	_, runErr := pa.run(ctx, "set-sink-mute", DefaultSink, boolArg(muted))
+	return runErr
+}
+
+func (pa *pactl) setSourceMute(ctx context.Context, muted bool) error {
+	_, runErr := pa.run(ctx, "set-source-mute", DefaultSource, boolArg(muted))
+	return runErr
+}
+
+// Changes to the sound server, as `pactl subscribe` lines.
+func (pa *pactl) subscribe(ctx context.Context) (<-chan string, error) {
+	return pa.runner.Lines(ctx, PactlCommand, "subscribe")
+}
+
+// -- SINKS --
+
+// Parses `pactl list sinks`: one block per sink, starting with "Sink #<index>",
+// with one "<Field>: <value>" per line (list values are indented further).
+func parseSinks(output string, defaultSink string) []ext_audio.Sink {
+	sinks := []ext_audio.Sink{}
+	var sink *ext_audio.Sink
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "Sink #") {
+			sinks = append(sinks, ext_audio.Sink{})
+			sink = &sinks[len(sinks)-1]
+			continue
+		}
+		if sink == nil || !strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "\t\t") {
+			continue
+		}
+		field, value, isField := strings.Cut(strings.TrimSpace(line), ":")
+		if !isField {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch field {
+		case "Name":
+			sink.Name = value
+			sink.Default = value == defaultSink
+		case "Description":
+			sink.Description = value
+		case "Active Port":
+			sink.ActivePort = value
+		case "Volume":
+			if volume, volumeErr := parseVolume(line); volumeErr == nil {
+				sink.Volume = volume
+			}
+		}
+	}
+	return sinks
+}
+
+func (pa *pactl) sinks(ctx context.Context) ([]ext_audio.Sink, error) {
+	defaultSink, runErr := pa.run(ctx, "get-default-sink")
+	if runErr != nil {
+		return nil, runErr
+	}
+	sinksOutput, runErr := pa.run(ctx, "list", "sinks")
+	if runErr != nil {
+		return nil, runErr
+	}
+	return parseSinks(sinksOutput, defaultSink), nil
+}
+
+// Makes a sink the default, and moves the streams which are playing to it
+// (new streams go to the default sink, existing ones stay where they are).
+func (pa *pactl) setDefaultSink(ctx context.Context, sinkName string) error {
+	if _, runErr := pa.run(ctx, "set-default-sink", sinkName); runErr != nil {
+		return runErr
+	}
+	// "<index>\t<sink>\t<client>\t<driver>\t<format>" per stream
+	inputsOutput, runErr := pa.run(ctx, "list", "short", "sink-inputs")
+	if runErr != nil {
+		return runErr
+	}
+	for _, line := range strings.Split(inputsOutput, "\n") {
+		inputFields := strings.Fields(line)
+		if len(inputFields) == 0 {
+			continue
+		}
+		if _, runErr := pa.run(ctx, "move-sink-input", inputFields[0], sinkName); runErr != nil {
+			return runErr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package audio
+
+/*
+Command Runner
+
+The audio subsystem drives the system's audio tooling (`pactl`) through a
+`CommandRunner`, so tests can replace it with a fake.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type CommandRunner interface {
+	// Runs a command to completion, and returns its standard output.
+	Output(ctx context.Context, name string, args ...string) ([]byte, error)
+	// Starts a long-running command, and returns its standard output line by
+	// line. The channel is closed once the command exits (it's killed when
+	// ctx is done).
+	Lines(ctx context.Context, name string, args ...string) (<-chan string, error)
+}
+
+// Runs commands on the system, with the C locale (so their output isn't
+// translated).
+type ExecRunner struct{}
+
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	return cmd
+}
+
+func (ExecRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	output, runErr := command(ctx, name, args...).Output()
+	if exitErr, isExitErr := runErr.(*exec.ExitError); isExitErr {
+		return nil, fmt.Errorf("%s %s: %v (%s)", name, strings.Join(args, " "), runErr, strings.TrimSpace(string(exitErr.Stderr)))
+	} else if runErr != nil {
+		return nil, fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), runErr)
+	}
+	return output, nil
+}
+
+func (ExecRunner) Lines(ctx context.Context, name string, args ...string) (<-chan string, error) {
+	cmd := command(ctx, name, args...)
+	stdout, pipeErr := cmd.StdoutPipe()
+	if pipeErr != nil {
+		return nil, pipeErr
+	}
+	if startErr := cmd.Start(); startErr != nil {
+		return nil, fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), startErr)
+	}
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+			}
+		}
+		cmd.Wait()
+	}()
+	return lines, nil
+}
@@ -1,5 +1,20 @@
 package subsystems
 
+import (
+	"context"
+
+	"github.com/Artiqlate/cyprus/utils"
+)
+
 type AbstractSubsystem interface {
 	Setup() error
 }
+
+// Lifecycle shared by the subsystems enabled through `init`.
+type Subsystem interface {
+	// Sets up and runs the subsystem until ctx is cancelled (idempotent).
+	Start(ctx context.Context) error
+	// Stops the subsystem, waiting until ctx is done at most (idempotent).
+	Stop(ctx context.Context) error
+	State() utils.LifecycleState
+}
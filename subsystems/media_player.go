@@ -2,26 +2,24 @@ package subsystems
 
 import (
 	"fmt"
-	"runtime"
 
 	"github.com/Artiqlate/cyprus/comm"
 	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
 )
 
 type MediaPlayerSubsystem interface {
-	// -- SUBSYSTEM METHODS --
-	Setup() error
-	Routine()
-	Shutdown()
+	Subsystem
 	// -- MEDIA PLAYER - SPECIFIC METHODS
 	// ListPlayers() ([]string, error)
 	// GetPlayers() error
 }
 
-func NewMediaPlayerSubsystem(bidirChan *comm.BiDirMessageChannel) (MediaPlayerSubsystem, error) {
-	// Only platform currently supported is Linux
-	if runtime.GOOS == "linux" {
-		return media_player.NewLinuxMediaPlayerSubsystem(bidirChan), nil
+// Creates the media player subsystem with the given backend (see
+// `media_player.NewBackend`, empty for the platform's default).
+func NewMediaPlayerSubsystem(bidirChan *comm.BiDirMessageChannel, backendName string) (MediaPlayerSubsystem, error) {
+	backend, backendErr := media_player.NewBackend(backendName)
+	if backendErr != nil {
+		return nil, fmt.Errorf("MediaPlayerSubsystem: %v", backendErr)
 	}
-	return nil, fmt.Errorf("MediaPlayerSubsystem: OS not supported (%s)", runtime.GOOS)
+	return media_player.NewSubsystem(bidirChan, backend), nil
 }
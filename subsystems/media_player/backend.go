@@ -0,0 +1,103 @@
+package media_player
+
+/*
+Media Player Backend
+
+A backend talks to the media players of one platform (ex: MPRIS on Linux),
+while the subsystem core handles the protocol, the player registry and the
+events sent to the client.
+
+The core calls a backend only from its routine goroutine. Backends report
+changes to players through `Events`, from whichever goroutine they like.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"time"
+
+	"github.com/Artiqlate/cyprus/utils"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+// Names of the available backends.
+const (
+	BackendMPRIS  = "mpris"
+	BackendMemory = "memory"
+)
+
+type PlayerAction string
+
+const (
+	ActionPlay      PlayerAction = "Play"
+	ActionPause     PlayerAction = "Pause"
+	ActionPlayPause PlayerAction = "PlayPause"
+	ActionNext      PlayerAction = "Next"
+	ActionPrevious  PlayerAction = "Previous"
+)
+
+type BackendEventKind int
+
+const (
+	// A new player appeared
+	EventPlayerAdded BackendEventKind = iota
+	// An existing player was replaced (ex: restarted under the same name)
+	EventPlayerUpdated
+	EventPlayerRemoved
+	EventPlaybackStatusChanged
+	EventMetadataChanged
+	EventSeeked
+)
+
+// A change to a player, reported by the backend.
+type BackendEvent struct {
+	Kind   BackendEventKind
+	Player string
+	// Set for added, updated and playback status events
+	PlaybackStatus string
+	// Set for added, updated and metadata events
+	Metadata *mp.Metadata
+	// Set for seeked events
+	Position time.Duration
+}
+
+type Backend interface {
+	// Platform used in the method names of events (`mp:<platform>:<method>`).
+	Platform() utils.PlatformKind
+	// Connects to the platform, and returns the players which already exist,
+	// in a stable order.
+	Open() ([]string, error)
+	// Changes to players, once the backend is open. Nothing is sent after
+	// `Close`.
+	Events() <-chan BackendEvent
+	Close()
+	// -- PLAYER OPERATIONS --
+	PlaybackStatus(player string) (string, error)
+	Metadata(player string) (*mp.Metadata, error)
+	// Position in the current track
+	Position(player string) (time.Duration, error)
+	Rate(player string) (float64, error)
+	SetRate(player string, rate float64) error
+	Volume(player string) (float64, error)
+	SetVolume(player string, volume float64) error
+	// Runs an action on a player. Fails with an `ErrCodeNotSupported` command
+	// error if the player can't do it.
+	Action(player string, action PlayerAction) error
+	// URI of the current track, exactly as the player reports it (`Metadata`
+	// decodes it).
+	TrackUri(player string) (string, error)
+	// Opens and plays the given URI.
+	OpenUri(player string, uri string) error
+	// Moves to an absolute position in the current track (reported through
+	// `EventSeeked`).
+	Seek(player string, position time.Duration) error
+}
+
+// Creates the backend with the given name, or the platform's default backend
+// for an empty name.
+func NewBackend(name string) (Backend, error) {
+	if name == BackendMemory {
+		return NewDemoMemoryBackend(), nil
+	}
+	return newPlatformBackend(name)
+}
@@ -0,0 +1,12 @@
+package media_player
+
+import "fmt"
+
+func newPlatformBackend(name string) (Backend, error) {
+	switch name {
+	case "", BackendMPRIS:
+		return NewMPRISBackend(), nil
+	default:
+		return nil, fmt.Errorf("media player: unknown backend '%s'", name)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package media_player
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Only Linux (MPRIS) has a native backend so far.
+func newPlatformBackend(name string) (Backend, error) {
+	return nil, fmt.Errorf("media player: backend '%s' not supported on %s", name, runtime.GOOS)
+}
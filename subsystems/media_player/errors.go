@@ -0,0 +1,61 @@
+package media_player
+
+import (
+	"errors"
+	"fmt"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/cyprus/utils"
+	"github.com/godbus/dbus/v5"
+)
+
+// D-Bus errors which mean the player doesn't implement an operation.
+const (
+	DBusErrorNotSupported  = "org.freedesktop.DBus.Error.NotSupported"
+	DBusErrorUnknownMethod = "org.freedesktop.DBus.Error.UnknownMethod"
+)
+
+// Error returned by request handlers, which is sent back to the client.
+type CommandError struct {
+	Code    string
+	Message string
+}
+
+func NewCommandError(code string, format string, args ...interface{}) *CommandError {
+	return &CommandError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (ce *CommandError) Error() string {
+	return fmt.Sprintf("%s: %s", ce.Code, ce.Message)
+}
+
+// Converts any handler error to a command error. Errors which aren't already
+// command errors are treated as player failures.
+func AsCommandError(err error) *CommandError {
+	var commandErr *CommandError
+	if errors.As(err, &commandErr) {
+		return commandErr
+	}
+	return NewCommandError(ext_mp.ErrCodePlayerError, "%v", err)
+}
+
+// Converts an error from `utils.ParsePlatformMethod` to a command error.
+func commandErrorFromMethod(err error) *CommandError {
+	if errors.Is(err, utils.ErrPlatformMismatch) {
+		return NewCommandError(ext_mp.ErrCodePlatformMismatch, "%v", err)
+	}
+	return NewCommandError(ext_mp.ErrCodeDecode, "method: %v", err)
+}
+
+// Converts an error from an MPRIS call to a command error.
+func commandErrorFromMPRIS(action string, err error) *CommandError {
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) &&
+		(dbusErr.Name == DBusErrorNotSupported || dbusErr.Name == DBusErrorUnknownMethod) {
+		return NewCommandError(ext_mp.ErrCodeNotSupported, "Player doesn't support %s", action)
+	}
+	return NewCommandError(ext_mp.ErrCodePlayerError, "%s failed: %v", action, err)
+}
@@ -0,0 +1,210 @@
+package media_player
+
+/*
+Volume Fader
+
+This ramps player volumes over time, with at most one fade per player. It is
+driven by the subsystem routine (`tick`), and only touches players through
+`volumePlayers`.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"time"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+const FaderTickInterval = time.Millisecond * 50
+
+// Player operations needed to change volumes.
+type volumePlayers interface {
+	pausePlayer(playerName string) error
+	playerVolume(playerName string) (float64, error)
+	setPlayerVolume(playerName string, volume float64) error
+}
+
+type volumeFade struct {
+	start      time.Time
+	duration   time.Duration
+	from       float64
+	to         float64
+	pauseAtEnd bool
+	// Volume to return to after the pause
+	restoreVolume  float64
+	fadeInOnResume time.Duration
+}
+
+// Fade-in waiting for the player to resume.
+type resumeFade struct {
+	volume   float64
+	duration time.Duration
+}
+
+type fader struct {
+	players volumePlayers
+	logf    func(string, ...interface{})
+	fades   map[string]*volumeFade
+	resumes map[string]*resumeFade
+	ticker  *time.Ticker
+}
+
+func newFader(players volumePlayers, logf func(string, ...interface{})) *fader {
+	return &fader{
+		players: players,
+		logf:    logf,
+		fades:   make(map[string]*volumeFade),
+		resumes: make(map[string]*resumeFade),
+	}
+}
+
+// Ticks while any fade is running, nil otherwise (blocks forever in `select`).
+func (f *fader) ticks() <-chan time.Time {
+	if f.ticker == nil {
+		return nil
+	}
+	return f.ticker.C
+}
+
+// Starts a fade, replacing the one in progress on the same player.
+func (f *fader) start(request *ext_mp.FadeRequest, now time.Time) error {
+	if request.Target < 0 {
+		return NewCommandError(ext_mp.ErrCodeDecode, "target volume can't be negative (%f)", request.Target)
+	}
+	if request.DurationMs < 0 || request.FadeInOnResumeMs < 0 {
+		return NewCommandError(ext_mp.ErrCodeDecode, "durations can't be negative")
+	}
+	current, volumeErr := f.players.playerVolume(request.PlayerName)
+	if volumeErr != nil {
+		return volumeErr
+	}
+	// The volume to restore is the one before any fade on this player began.
+	restoreVolume := current
+	if previous, fading := f.fades[request.PlayerName]; fading {
+		restoreVolume = previous.restoreVolume
+	} else if pending, resuming := f.resumes[request.PlayerName]; resuming {
+		restoreVolume = pending.volume
+	}
+	delete(f.resumes, request.PlayerName)
+	f.fades[request.PlayerName] = &volumeFade{
+		start:          now,
+		duration:       time.Duration(request.DurationMs) * time.Millisecond,
+		from:           current,
+		to:             request.Target,
+		pauseAtEnd:     request.PauseAtEnd,
+		restoreVolume:  restoreVolume,
+		fadeInOnResume: time.Duration(request.FadeInOnResumeMs) * time.Millisecond,
+	}
+	f.logf("Fader: %s %.2f -> %.2f (%dms)", request.PlayerName, current, request.Target, request.DurationMs)
+	f.ensureTicker()
+	f.tick(now)
+	return nil
+}
+
+// Stops the fade on a player, leaving the volume where it is.
+func (f *fader) cancel(playerName string) bool {
+	_, fading := f.fades[playerName]
+	_, resuming := f.resumes[playerName]
+	delete(f.fades, playerName)
+	delete(f.resumes, playerName)
+	f.stopTickerIfIdle()
+	return fading || resuming
+}
+
+// Drops all fades (ex: on shutdown), putting back the volumes from before
+// them, so players aren't left faded out.
+func (f *fader) stop() {
+	for playerName, fade := range f.fades {
+		if setErr := f.players.setPlayerVolume(playerName, fade.restoreVolume); setErr != nil {
+			f.logf("Fader: restore %s: %v", playerName, setErr)
+		}
+	}
+	for playerName, pending := range f.resumes {
+		if setErr := f.players.setPlayerVolume(playerName, pending.volume); setErr != nil {
+			f.logf("Fader: restore %s: %v", playerName, setErr)
+		}
+	}
+	f.fades = make(map[string]*volumeFade)
+	f.resumes = make(map[string]*resumeFade)
+	f.stopTickerIfIdle()
+}
+
+func (f *fader) ensureTicker() {
+	if f.ticker == nil {
+		f.ticker = time.NewTicker(FaderTickInterval)
+	}
+}
+
+func (f *fader) stopTickerIfIdle() {
+	if len(f.fades) == 0 && f.ticker != nil {
+		f.ticker.Stop()
+		f.ticker = nil
+	}
+}
+
+// Moves every fade forward, finishing the ones which are due.
+func (f *fader) tick(now time.Time) {
+	for playerName, fade := range f.fades {
+		elapsed := now.Sub(fade.start)
+		if elapsed >= fade.duration {
+			f.finish(playerName, fade)
+			continue
+		}
+		progress := float64(elapsed) / float64(fade.duration)
+		if setErr := f.players.setPlayerVolume(playerName, fade.from+(fade.to-fade.from)*progress); setErr != nil {
+			f.logf("Fader: %s: %v", playerName, setErr)
+			delete(f.fades, playerName)
+		}
+	}
+	f.stopTickerIfIdle()
+}
+
+// Sets the target volume of a fade, and pauses the player if requested. The
+// volume from before the fade is put back after the pause: right away, or
+// once the player resumes (when it's faded back in, or restoring it failed).
+func (f *fader) finish(playerName string, fade *volumeFade) {
+	delete(f.fades, playerName)
+	if setErr := f.players.setPlayerVolume(playerName, fade.to); setErr != nil {
+		f.logf("Fader: %s: %v", playerName, setErr)
+	}
+	if !fade.pauseAtEnd {
+		return
+	}
+	if pauseErr := f.players.pausePlayer(playerName); pauseErr != nil {
+		f.logf("Fader: pause %s: %v", playerName, pauseErr)
+	}
+	if fade.fadeInOnResume <= 0 {
+		setErr := f.players.setPlayerVolume(playerName, fade.restoreVolume)
+		if setErr == nil {
+			return
+		}
+		f.logf("Fader: restore %s (retrying on resume): %v", playerName, setErr)
+	}
+	f.resumes[playerName] = &resumeFade{
+		volume:   fade.restoreVolume,
+		duration: fade.fadeInOnResume,
+	}
+}
+
+// Called when a player's playback status changes, to fade back in players
+// which were faded out and paused.
+func (f *fader) playbackStatusChanged(playerName string, playbackStatus string, now time.Time) {
+	if playbackStatus != mp.PlaybackStatusPlaying {
+		return
+	}
+	pending, resuming := f.resumes[playerName]
+	if !resuming {
+		return
+	}
+	delete(f.resumes, playerName)
+	startErr := f.start(&ext_mp.FadeRequest{
+		PlayerName: playerName,
+		Target:     pending.volume,
+		DurationMs: pending.duration.Milliseconds(),
+	}, now)
+	if startErr != nil {
+		f.logf("Fader: fade in %s: %v", playerName, startErr)
+	}
+}
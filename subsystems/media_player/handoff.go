@@ -0,0 +1,192 @@
+package media_player
+
+/*
+Playback Handoff
+
+`handoff` captures a descriptor of a player's current track (see
+`ext_mp.HandoffDescriptor`), and `handoff_apply` plays a descriptor on another
+player.
+
+Players load the track opened through `OpenUri` asynchronously, and can only
+be seeked once it's loaded. The seek to the descriptor's position (and its
+rate) is kept pending until the player reports the new track. It's dropped if
+the player reports another track, or `HandoffSeekTimeout` passes.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+// How long a player has to load a handed off track before the seek to its
+// position is dropped.
+const HandoffSeekTimeout = 10 * time.Second
+
+const (
+	SpotifyUriPrefix     = "spotify:"
+	SpotifyTrackIdPrefix = "/com/spotify/"
+	SpotifyWebUrl        = "https://open.spotify.com/"
+)
+
+// Seek to run once a player has loaded a handed off track.
+type pendingSeek struct {
+	// Track being loaded (as opened, and its service URL)
+	uri        string
+	serviceUrl string
+	position   time.Duration
+	rate       float64
+	deadline   time.Time
+}
+
+// Web URL of a track on its streaming service, from its (decoded) metadata.
+// Empty when the track isn't from a known service.
+func ServiceUrl(metadata *mp.Metadata) string {
+	if parsedUrl, parseErr := url.Parse(metadata.Url); parseErr == nil &&
+		(parsedUrl.Scheme == "http" || parsedUrl.Scheme == "https") && parsedUrl.Host != "" {
+		return metadata.Url
+	}
+	// "spotify:track:<ID>"
+	if spotifyPath := strings.TrimPrefix(metadata.Url, SpotifyUriPrefix); spotifyPath != metadata.Url {
+		return spotifyWebUrl(strings.Split(spotifyPath, ":"))
+	}
+	// "/com/spotify/track/<ID>"
+	if spotifyPath := strings.TrimPrefix(metadata.TrackId, SpotifyTrackIdPrefix); spotifyPath != metadata.TrackId {
+		return spotifyWebUrl(strings.Split(spotifyPath, "/"))
+	}
+	return ""
+}
+
+func spotifyWebUrl(parts []string) string {
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ""
+	}
+	return SpotifyWebUrl + parts[0] + "/" + parts[1]
+}
+
+// -- HANDLERS --
+
+// Captures the descriptor of a player, pausing it if requested.
+func (mps *Subsystem) captureHandoff(request *ext_mp.HandoffRequest) (*ext_mp.HandoffDescriptor, error) {
+	if playerErr := mps.knownPlayer(request.PlayerName); playerErr != nil {
+		return nil, playerErr
+	}
+	metadata, metadataErr := mps.backend.Metadata(request.PlayerName)
+	if metadataErr != nil {
+		return nil, metadataErr
+	}
+	trackUri, trackUriErr := mps.backend.TrackUri(request.PlayerName)
+	if trackUriErr != nil {
+		return nil, trackUriErr
+	}
+	position, positionErr := mps.backend.Position(request.PlayerName)
+	if positionErr != nil {
+		return nil, positionErr
+	}
+	rate, rateErr := mps.backend.Rate(request.PlayerName)
+	if rateErr != nil || rate <= 0 {
+		rate = 1
+	}
+	if request.Pause {
+		if pauseErr := mps.backend.Action(request.PlayerName, ActionPause); pauseErr != nil {
+			return nil, pauseErr
+		}
+	}
+	return &ext_mp.HandoffDescriptor{
+		PlayerName: request.PlayerName,
+		Url:        trackUri,
+		TrackId:    metadata.TrackId,
+		PositionUs: position.Microseconds(),
+		Rate:       rate,
+		ServiceUrl: ServiceUrl(metadata),
+	}, nil
+}
+
+// Plays a descriptor on a player. Players which already play the track are
+// only seeked.
+func (mps *Subsystem) applyHandoff(request *ext_mp.HandoffApplyRequest, now time.Time) error {
+	if playerErr := mps.knownPlayer(request.PlayerName); playerErr != nil {
+		return playerErr
+	}
+	descriptor := &request.Descriptor
+	trackUri := descriptor.Url
+	if trackUri == "" {
+		trackUri = descriptor.ServiceUrl
+	}
+	if trackUri == "" {
+		return NewCommandError(ext_mp.ErrCodeDecode, "handoff_apply: descriptor has no URL")
+	}
+	position := time.Duration(descriptor.PositionUs) * time.Microsecond
+	if currentUri, currentErr := mps.backend.TrackUri(request.PlayerName); currentErr == nil && currentUri == trackUri {
+		delete(mps.handoffSeeks, request.PlayerName)
+		mps.applyHandoffRate(request.PlayerName, descriptor.Rate)
+		return mps.backend.Seek(request.PlayerName, position)
+	}
+	if openErr := mps.backend.OpenUri(request.PlayerName, trackUri); openErr != nil {
+		return openErr
+	}
+	seek := pendingSeek{
+		uri:        trackUri,
+		serviceUrl: descriptor.ServiceUrl,
+		position:   position,
+		rate:       descriptor.Rate,
+		deadline:   now.Add(HandoffSeekTimeout),
+	}
+	mps.handoffSeeks[request.PlayerName] = seek
+	time.AfterFunc(HandoffSeekTimeout, func() {
+		mps.post(func() { mps.expireHandoffSeek(request.PlayerName, seek.deadline) })
+	})
+	return nil
+}
+
+// Runs the pending seek of a player once it reports the handed off track.
+func (mps *Subsystem) handoffTrackChanged(playerName string, metadata *mp.Metadata, now time.Time) {
+	seek, seekPending := mps.handoffSeeks[playerName]
+	if !seekPending || trackKey(metadata) == "" {
+		return
+	}
+	delete(mps.handoffSeeks, playerName)
+	if now.After(seek.deadline) {
+		mps.logf("Handoff: %s took too long to load the track, not seeking", playerName)
+		return
+	}
+	currentUri, _ := mps.backend.TrackUri(playerName)
+	if currentUri != seek.uri && (seek.serviceUrl == "" || ServiceUrl(metadata) != seek.serviceUrl) {
+		mps.logf("Handoff: %s loaded another track, not seeking", playerName)
+		return
+	}
+	mps.applyHandoffRate(playerName, seek.rate)
+	if seek.position <= 0 {
+		return
+	}
+	if seekErr := mps.backend.Seek(playerName, seek.position); seekErr != nil {
+		mps.logf("Handoff: seek on %s: %v", playerName, seekErr)
+	}
+}
+
+// Drops the pending seek of a player, if it's still the one with the given
+// deadline.
+func (mps *Subsystem) expireHandoffSeek(playerName string, deadline time.Time) {
+	if seek, seekPending := mps.handoffSeeks[playerName]; seekPending && seek.deadline.Equal(deadline) {
+		delete(mps.handoffSeeks, playerName)
+		mps.logf("Handoff: %s took too long to load the track, not seeking", playerName)
+	}
+}
+
+// Plays a handed off track at its rate (unknown when zero).
+func (mps *Subsystem) applyHandoffRate(playerName string, rate float64) {
+	if rate <= 0 {
+		return
+	}
+	if currentRate, rateErr := mps.backend.Rate(playerName); rateErr == nil && currentRate == rate {
+		return
+	}
+	if rateErr := mps.backend.SetRate(playerName, rate); rateErr != nil {
+		mps.logf("Handoff: rate on %s: %v", playerName, rateErr)
+	}
+}
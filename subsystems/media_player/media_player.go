@@ -1,11 +1,67 @@
 package media_player
 
-import "github.com/Artiqlate/cyprus/utils"
+/*
+Media Player Subsystem
+
+This is the platform-neutral core of the media player subsystem: it handles
+client requests, keeps the player registry (player names, in index order),
+and sends events to the client. Talking to the actual players is left to a
+`Backend`.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/Artiqlate/cyprus/comm"
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/cyprus/utils"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/Artiqlate/ganymede/models/mp"
+	mp_signals "github.com/Artiqlate/ganymede/models/mp/signals"
+)
 
 const (
 	MediaPlayerSubsystemName = "mp"
 )
 
+// -- MP Methods
+// TODO: Move to ganymede.
+const (
+	MethodInit                  = "init"
+	MethodSeeked                = "seeked"
+	MethodMetadataUpdated       = "mu"
+	MethodPlaybackStatusUpdated = "psu"
+	MethodRList                 = "rlist"
+	// Player changes
+	MethodPlayerCreated = "cr"
+	MethodPlayerUpdated = "up"
+	MethodPlayerRemoved = "rm"
+	// TODO: Switch this to "init" soon
+	MethodRSetupMetadata = "rsetup_metadata"
+	// Command replies
+	MethodOk    = "ok"
+	MethodError = "err"
+	// Snapshot resync
+	MethodRSync = "rsync"
+	// Sleep timer
+	MethodSleep  = "sleep"
+	MethodRSleep = "rsleep"
+	// Playback handoff
+	MethodRHandoff = "rhandoff"
+	// Scrobbles
+	MethodScrobble        = "scrobble"
+	MethodRScrobbles      = "rscrobbles"
+	MethodRScrobbleExport = "rscrobble_export"
+)
+
 func MPAutoPlatformMethod(method string) string {
 	return utils.GenerateAutoPlatformMethod(MediaPlayerSubsystemName, method)
 }
@@ -13,3 +69,492 @@ func MPAutoPlatformMethod(method string) string {
 func MPMethod(method string) string {
 	return utils.GenerateMethod(MediaPlayerSubsystemName, method)
 }
+
+var ErrSubsystemStopped = errors.New("media player: subsystem already stopped")
+
+// Media Player Subsystem
+//
+// All of the player state below is owned by the `routine` goroutine: backend
+// events, client requests, module commands and timers are all handled from
+// its single loop. `setup` runs before `routine` starts, and `Stop` only
+// talks to it by cancelling its context. Anything running on another
+// goroutine hands work to it through `post`.
+type Subsystem struct {
+	logf         func(string, ...interface{})
+	backend      Backend
+	bidirChannel *comm.BiDirMessageChannel
+	// Lifecycle (see `Start` and `Stop`)
+	lifecycle utils.Lifecycle
+	ctx       context.Context
+	cancel    context.CancelFunc
+	// Closed once the subsystem is stopped (and cleaned up)
+	done chan bool
+	// Player registry, in player index order
+	// TODO: Remove playerNames. We'll move this logic to client-side.
+	playerNames []string
+	// Event sequencing (see `ext_mp.Snapshot`)
+	eventSeq uint64
+	// Session of the request being handled, which replies go to (with the
+	// request's ID, if it has one)
+	requester uint64
+	requestId msgpack.RawMessage
+	// Work to be run on the `routine` goroutine
+	actions chan func()
+	// Sleep timer and volume fades
+	sleep *sleepTimer
+	fader *fader
+	// Seeks waiting for a handed off track to load, by player name
+	handoffSeeks map[string]pendingSeek
+	// Scrobble detection, and the queue scrobbles go to (nil when there's no
+	// data directory)
+	scrobbler *scrobbler
+	scrobbles *ScrobbleQueue
+}
+
+func NewSubsystem(bidirChan *comm.BiDirMessageChannel, backend Backend) *Subsystem {
+	ctx, cancel := context.WithCancel(context.Background())
+	mps := &Subsystem{
+		logf: func(f string, v ...interface{}) {
+			utils.LogFunc("MP", f, v...)
+		},
+		backend:      backend,
+		bidirChannel: bidirChan,
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan bool),
+		actions:      make(chan func(), 32),
+		playerNames:  []string{},
+		handoffSeeks: make(map[string]pendingSeek),
+	}
+	mps.sleep = newSleepTimer(mps, mps.emitSleepTimerState, mps.logf)
+	mps.fader = newFader(mps, mps.logf)
+	mps.scrobbler = newScrobbler(mps.recordScrobble, mps.logf)
+	scrobbles, scrobblesErr := DefaultScrobbleQueue()
+	if scrobblesErr != nil {
+		mps.logf("Scrobbles won't be kept: %v", scrobblesErr)
+	}
+	mps.scrobbles = scrobbles
+	return mps
+}
+
+// -- UTILITY METHODS --
+
+// Method name for events and replies (`mp:<platform>:<method>`).
+func (mps *Subsystem) platformMethod(method string) string {
+	return utils.GeneratePlatformMethod(MediaPlayerSubsystemName, mps.backend.Platform(), method)
+}
+
+// Sends a message to a client session (`comm.BroadcastSession` for every
+// session). Gives up (returning false) once the subsystem is stopping, so a
+// client which stopped reading can't block it.
+func (mps *Subsystem) send(session uint64, message models.Message) bool {
+	return mps.sendEnvelope(comm.Envelope{Session: session, Message: message})
+}
+
+func (mps *Subsystem) sendEnvelope(envelope comm.Envelope) bool {
+	select {
+	case mps.bidirChannel.OutChannel <- envelope:
+		return true
+	case <-mps.ctx.Done():
+		return false
+	}
+}
+
+// Sends a message to the session of the request being handled.
+func (mps *Subsystem) reply(message models.Message) bool {
+	return mps.sendEnvelope(comm.Envelope{Session: mps.requester, RequestId: mps.requestId, Message: message})
+}
+
+// Runs the given function on the `routine` goroutine (dropped once the
+// subsystem is stopping).
+func (mps *Subsystem) post(action func()) {
+	select {
+	case mps.actions <- action:
+	case <-mps.ctx.Done():
+	}
+}
+
+// Messages are encoded on another goroutine, while `playerNames` keeps being
+// modified here. Always send a copy.
+func (mps *Subsystem) copyPlayerNames() []string {
+	players := make([]string, len(mps.playerNames))
+	copy(players, mps.playerNames)
+	return players
+}
+
+// -- PLAYER REGISTRY --
+
+func (mps *Subsystem) playerIndex(playerName string) (int, bool) {
+	for playerIdx, playerVal := range mps.playerNames {
+		if playerVal == playerName {
+			return playerIdx, true
+		}
+	}
+	return 0, false
+}
+
+func (mps *Subsystem) hasPlayer(playerName string) bool {
+	_, playerExists := mps.playerIndex(playerName)
+	return playerExists
+}
+
+func (mps *Subsystem) removePlayer(playerName string) bool {
+	playerIdx, playerExists := mps.playerIndex(playerName)
+	if !playerExists {
+		return false
+	}
+	mps.playerNames = append(mps.playerNames[:playerIdx], mps.playerNames[playerIdx+1:]...)
+	mps.fader.cancel(playerName)
+	delete(mps.handoffSeeks, playerName)
+	mps.scrobbler.removed(playerName)
+	return true
+}
+
+// Collects the status of every player, in player index order.
+func (mps *Subsystem) collectStatuses() []mp.Status {
+	statuses := []mp.Status{}
+	for playerIdx, playerName := range mps.playerNames {
+		// Get playback status
+		plStatus, statusErr := mps.backend.PlaybackStatus(playerName)
+		if statusErr != nil {
+			mps.logf("Status: PlaybackStatus for %d (%s): %v", playerIdx, playerName, statusErr)
+			continue
+		}
+		// Get Metadata
+		metadata, metadataErr := mps.backend.Metadata(playerName)
+		if metadataErr != nil {
+			mps.logf("Status: Metadata for %d (%s): %v", playerIdx, playerName, metadataErr)
+			metadata = &mp.Metadata{}
+		}
+		statuses = append(statuses, mp.Status{
+			Status:   plStatus,
+			Index:    playerIdx,
+			Name:     playerName,
+			Metadata: *metadata,
+		})
+	}
+	return statuses
+}
+
+// --- EVENTS ---
+
+// Sends an unsolicited event to the client, tagged with the next sequence
+// number.
+func (mps *Subsystem) emitEvent(event models.Message) {
+	mps.eventSeq++
+	mps.sendEnvelope(comm.Envelope{Session: comm.BroadcastSession, Message: event, Seq: mps.eventSeq})
+}
+
+// Sends a full snapshot of all players, tagged with the sequence number of
+// the last event sent. Events and snapshots are both sent from `routine`, so
+// no event can be sent while the snapshot is being taken.
+func (mps *Subsystem) sendSnapshot() {
+	mps.reply(models.Message{
+		Method: mps.platformMethod(MethodRSync),
+		Args: &ext_mp.Snapshot{
+			Seq:      mps.eventSeq,
+			Statuses: mps.collectStatuses(),
+		},
+	})
+}
+
+// Turns a backend event into an event for the client.
+func (mps *Subsystem) handleBackendEvent(event BackendEvent) {
+	switch event.Kind {
+	case EventPlayerAdded, EventPlayerUpdated:
+		isUpdate := mps.removePlayer(event.Player) || event.Kind == EventPlayerUpdated
+		mps.playerNames = append(mps.playerNames, event.Player)
+		playerData := mp.PlayerData{
+			PlayerName:     event.Player,
+			PlaybackStatus: event.PlaybackStatus,
+		}
+		if event.Metadata != nil {
+			playerData.Metadata = *event.Metadata
+		}
+		mps.scrobbler.trackChanged(event.Player, &playerData.Metadata, time.Now())
+		mps.scrobbler.playbackStatusChanged(event.Player, event.PlaybackStatus, time.Now())
+		if isUpdate {
+			mps.emitEvent(models.Message{
+				Method: mps.platformMethod(MethodPlayerUpdated),
+				Args: &mp_signals.PlayerUpdated{
+					PlayerData:         playerData,
+					UpdatedPlayerNames: mps.copyPlayerNames(),
+				},
+			})
+			mps.logf("Player Changed: %s", event.Player)
+		} else {
+			mps.emitEvent(models.Message{
+				Method: mps.platformMethod(MethodPlayerCreated),
+				Args: &mp_signals.PlayerCreated{
+					PlayerData:         playerData,
+					UpdatedPlayerNames: mps.copyPlayerNames(),
+				},
+			})
+			mps.logf("Player Added: %s", event.Player)
+		}
+	case EventPlayerRemoved:
+		// Players which were never added are unknown to the client as well.
+		if !mps.removePlayer(event.Player) {
+			return
+		}
+		mps.emitEvent(models.Message{
+			Method: mps.platformMethod(MethodPlayerRemoved),
+			Args: &mp_signals.PlayerRemoved{
+				PlayerName:         event.Player,
+				UpdatedPlayerNames: mps.copyPlayerNames(),
+			},
+		})
+		mps.logf("Player Removed: %s", event.Player)
+	case EventPlaybackStatusChanged:
+		// TODO: Remove the index value, let client handle that.
+		playerIdx, playerExists := mps.playerIndex(event.Player)
+		if !playerExists {
+			return
+		}
+		mps.logf("Player %d (%s): %s", playerIdx, event.Player, event.PlaybackStatus)
+		mps.fader.playbackStatusChanged(event.Player, event.PlaybackStatus, time.Now())
+		mps.sleep.playbackStatusChanged(event.Player, event.PlaybackStatus, time.Now())
+		mps.scrobbler.playbackStatusChanged(event.Player, event.PlaybackStatus, time.Now())
+		mps.emitEvent(models.Message{
+			Method: mps.platformMethod(MethodPlaybackStatusUpdated),
+			Args: &mp_signals.PlaybackStatusChanged{
+				PlayerIndex:    playerIdx,
+				PlayerName:     event.Player,
+				PlaybackStatus: event.PlaybackStatus,
+			},
+		})
+	case EventMetadataChanged:
+		playerIdx, playerExists := mps.playerIndex(event.Player)
+		if !playerExists || event.Metadata == nil {
+			return
+		}
+		mps.sleep.trackChanged(event.Player, trackKey(event.Metadata), time.Now())
+		mps.handoffTrackChanged(event.Player, event.Metadata, time.Now())
+		mps.scrobbler.trackChanged(event.Player, event.Metadata, time.Now())
+		mps.emitEvent(models.Message{
+			Method: mps.platformMethod(MethodMetadataUpdated),
+			Args: &mp_signals.MetadataChanged{
+				PlayerIndex: playerIdx,
+				PlayerName:  event.Player,
+				Metadata:    event.Metadata,
+			},
+		})
+	case EventSeeked:
+		playerIdx, playerExists := mps.playerIndex(event.Player)
+		if !playerExists {
+			return
+		}
+		mps.sleep.seeked(event.Player, time.Now())
+		// Send "Seeked" signal, with the seeked time in microseconds (μs).
+		mps.emitEvent(models.Message{
+			Method: mps.platformMethod(MethodSeeked),
+			Args: &mp_signals.Seeked{
+				// TODO: Remove player index
+				PlayerIndex: playerIdx,
+				PlayerName:  event.Player,
+				SeekedInUs:  event.Position.Microseconds(),
+			},
+		})
+	}
+}
+
+// --- SETUP ---
+
+// Opens the backend, and sends the statuses of the players which already
+// exist once.
+func (mps *Subsystem) setup() error {
+	playerNames, openErr := mps.backend.Open()
+	if openErr != nil {
+		return openErr
+	}
+	mps.playerNames = append([]string{}, playerNames...)
+	mps.logf("Players added: %d", len(mps.playerNames))
+	statuses := mps.collectStatuses()
+	// Tracks which are already playing are scrobbled from now on.
+	now := time.Now()
+	for statusIdx := range statuses {
+		status := &statuses[statusIdx]
+		mps.scrobbler.trackChanged(status.Name, &status.Metadata, now)
+		mps.scrobbler.playbackStatusChanged(status.Name, status.Status, now)
+	}
+	// TODO: Change this to `mp:init`
+	mps.emitEvent(models.Message{
+		Method: MPMethod(MethodRSetupMetadata),
+		Args: &mp.SetupStatus{
+			Statuses: statuses,
+		},
+	})
+	return nil
+}
+
+// Sends the statuses of all players to a session which joined after setup,
+// tagged with the sequence number of the last event sent (like a snapshot).
+func (mps *Subsystem) attach(session uint64) {
+	mps.logf("Session %d attached", session)
+	mps.sendEnvelope(comm.Envelope{
+		Session: session,
+		Message: models.Message{
+			Method: MPMethod(MethodRSetupMetadata),
+			Args: &mp.SetupStatus{
+				Statuses: mps.collectStatuses(),
+			},
+		},
+		Seq: mps.eventSeq,
+	})
+}
+
+// Main Subsystem Routine + Communication Loop
+//
+// This loop reads from command channel (from other modules), communication
+// channel (for communication with clients) and backend events. It is the only
+// goroutine which touches player state. It runs until the client sends
+// `mp:close`, a module sends "close", or the context is cancelled.
+func (mps *Subsystem) routine() {
+	mps.logf("Routine: starting")
+	defer mps.finish()
+	backendEvents := mps.backend.Events()
+	// Run the routine to pass in commands to validate values
+mpForRoutine:
+	for {
+		select {
+		case <-mps.ctx.Done():
+			break mpForRoutine
+		case request := <-mps.bidirChannel.InChannel:
+			// This read channel will recieve the and will run actions which are deemed required
+			mps.requester, mps.requestId = request.Session, request.Id
+			decoder := msgpack.NewDecoder(bytes.NewReader(request.Data))
+			// Validate Array-based Msgpack-RPC (by checking array length)
+			payloadErr := utils.ValidateDecoder(decoder)
+			if payloadErr != nil {
+				mps.logf("payloadErr: %v", payloadErr)
+			}
+
+			methodData, decodeErr := decoder.DecodeString()
+			if decodeErr != nil {
+				mps.replyError(methodData, NewCommandError(ext_mp.ErrCodeDecode, "method: %v", decodeErr))
+				continue mpForRoutine
+			}
+
+			methodName, methodErr := utils.ParsePlatformMethod(methodData, mps.backend.Platform())
+			if methodErr != nil {
+				mps.replyError(methodData, commandErrorFromMethod(methodErr))
+				continue mpForRoutine
+			}
+			method := methodName.Method
+			if method == "" {
+				mps.logf("Routine: method doesn't exist")
+				method = methodName.Module
+			}
+			// -- FUNCTIONS --
+			if method == "close" {
+				mps.replyOk(methodData)
+				break mpForRoutine
+			}
+			replied, requestErr := mps.handleRequest(method, decoder)
+			if requestErr != nil {
+				mps.replyError(methodData, requestErr)
+			} else if !replied {
+				mps.replyOk(methodData)
+			}
+		case session := <-mps.bidirChannel.AttachChannel:
+			mps.attach(session)
+		case event := <-backendEvents:
+			mps.handleBackendEvent(event)
+		case action := <-mps.actions:
+			action()
+		case now := <-mps.sleep.ticks():
+			mps.sleep.tick(now)
+		case now := <-mps.fader.ticks():
+			mps.fader.tick(now)
+		case now := <-mps.scrobbler.ticks():
+			mps.scrobbler.tick(now)
+		case moduleCommand := <-mps.bidirChannel.CommandChannel:
+			// If there's any other commands, put here
+			switch moduleCommand {
+			case "close":
+				break mpForRoutine
+			default:
+				mps.logf("ERROR: Unexpected command passed in!")
+				break mpForRoutine
+			}
+		}
+	}
+	mps.logf("Stopping")
+}
+
+// Moves to stopped: cancels pending work, releases all the player state and
+// the backend, and wakes up anyone waiting in `Stop`.
+func (mps *Subsystem) finish() {
+	mps.lifecycle.Advance(utils.StateStopping)
+	mps.cancel()
+	// Don't leave players faded out (no event, the client is going away)
+	mps.sleep.restoreVolumes()
+	mps.sleep.stop()
+	mps.fader.stop()
+	mps.scrobbler.stop()
+	mps.playerNames = []string{}
+	mps.handoffSeeks = make(map[string]pendingSeek)
+	mps.backend.Close()
+	mps.lifecycle.Advance(utils.StateStopped)
+	close(mps.done)
+	mps.logf("Stopped")
+}
+
+// -- LIFECYCLE --
+
+func (mps *Subsystem) State() utils.LifecycleState {
+	return mps.lifecycle.State()
+}
+
+// Sets up the subsystem and starts its routine. The subsystem stops when ctx
+// is cancelled (or through `Stop`).
+//
+// Starting a subsystem which is already started does nothing. A stopped
+// subsystem can't be started again (`ErrSubsystemStopped`).
+func (mps *Subsystem) Start(ctx context.Context) error {
+	if !mps.lifecycle.Transition(utils.StateCreated, utils.StateSettingUp) {
+		if mps.lifecycle.State() >= utils.StateStopping {
+			return ErrSubsystemStopped
+		}
+		return nil
+	}
+	if mps.bidirChannel.InChannel == nil || mps.bidirChannel.OutChannel == nil {
+		mps.finish()
+		return fmt.Errorf("media player: channels not initialized")
+	}
+	// Tie the subsystem to the caller's context.
+	go func() {
+		select {
+		case <-ctx.Done():
+			mps.cancel()
+		case <-mps.done:
+		}
+	}()
+	if setupErr := mps.setup(); setupErr != nil {
+		mps.finish()
+		return setupErr
+	}
+	// `Stop` may have been called during setup, `routine` exits straight
+	// away in that case.
+	mps.lifecycle.Transition(utils.StateSettingUp, utils.StateRunning)
+	go mps.routine()
+	return nil
+}
+
+// Stops the subsystem and waits for it to clean up, or for ctx to be done
+// (whichever comes first). Stopping a stopped subsystem does nothing.
+func (mps *Subsystem) Stop(ctx context.Context) error {
+	if mps.lifecycle.Transition(utils.StateCreated, utils.StateStopped) {
+		mps.cancel()
+		close(mps.done)
+		return nil
+	}
+	mps.lifecycle.Advance(utils.StateStopping)
+	mps.cancel()
+	select {
+	case <-mps.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("media player: stop: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,436 @@
+package media_player
+
+/*
+In-memory Backend
+
+This backend keeps its players in memory, and is driven entirely through its
+methods (`AddPlayer`, `SetPlaybackStatus`, ...). It works on any platform, so
+clients can be developed without real media players, and protocol tests get
+deterministic players.
+
+Players act like simple real ones: actions change the playback status (and
+report it), `OpenUri` starts playing a track with just that URL, while
+positions only change through `SetPosition`/`Seek`.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/cyprus/utils"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+type memoryPlayer struct {
+	playbackStatus string
+	metadata       mp.Metadata
+	position       time.Duration
+	rate           float64
+	volume         float64
+	unsupported    map[PlayerAction]bool
+	actions        []PlayerAction
+}
+
+type MemoryBackend struct {
+	platform utils.PlatformKind
+	events   chan BackendEvent
+	// Events not sent yet (sent in order by `pump`), so that scripting and
+	// actions never block on the subsystem.
+	queue     []BackendEvent
+	queued    chan bool
+	closed    chan bool
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	open      bool
+	// Players, in the order they were added
+	playerNames []string
+	players     map[string]*memoryPlayer
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		platform:    utils.CurrentPlatform(),
+		events:      make(chan BackendEvent),
+		queued:      make(chan bool, 1),
+		closed:      make(chan bool),
+		playerNames: []string{},
+		players:     make(map[string]*memoryPlayer),
+	}
+}
+
+// Memory backend with a single playing player, for trying out clients.
+func NewDemoMemoryBackend() *MemoryBackend {
+	backend := NewMemoryBackend()
+	backend.AddPlayer("org.mpris.MediaPlayer2.cyprus_demo", mp.PlaybackStatusPlaying, &mp.Metadata{
+		TrackId: "/org/cyprus/demo/track/1",
+		Length:  uint64(time.Minute * 3 / time.Microsecond),
+		Title:   "Demo Track",
+		Artist:  []string{"Cyprus"},
+		Album:   "Demo Album",
+	})
+	return backend
+}
+
+// Queues an event for the subsystem, if the backend is open. Called with the
+// mutex held.
+func (mb *MemoryBackend) emit(event BackendEvent) {
+	if !mb.open {
+		return
+	}
+	mb.queue = append(mb.queue, event)
+	select {
+	case mb.queued <- true:
+	default:
+	}
+}
+
+// Sends queued events to the subsystem, until the backend is closed.
+func (mb *MemoryBackend) pump() {
+	for {
+		mb.mutex.Lock()
+		if len(mb.queue) == 0 {
+			mb.mutex.Unlock()
+			select {
+			case <-mb.queued:
+				continue
+			case <-mb.closed:
+				return
+			}
+		}
+		event := mb.queue[0]
+		mb.queue = mb.queue[1:]
+		mb.mutex.Unlock()
+		select {
+		case mb.events <- event:
+		case <-mb.closed:
+			return
+		}
+	}
+}
+
+func (mb *MemoryBackend) player(playerName string) (*memoryPlayer, error) {
+	player, playerExists := mb.players[playerName]
+	if !playerExists {
+		return nil, NewCommandError(ext_mp.ErrCodePlayerNotFound, "player %s not found", playerName)
+	}
+	return player, nil
+}
+
+// -- SCRIPTING --
+
+// Adds a player (replacing the one with the same name, if any).
+func (mb *MemoryBackend) AddPlayer(playerName string, playbackStatus string, metadata *mp.Metadata) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	_, replaced := mb.players[playerName]
+	player := &memoryPlayer{
+		playbackStatus: playbackStatus,
+		rate:           1,
+		volume:         1,
+		unsupported:    make(map[PlayerAction]bool),
+	}
+	if metadata != nil {
+		player.metadata = *metadata
+	}
+	mb.players[playerName] = player
+	if !replaced {
+		mb.playerNames = append(mb.playerNames, playerName)
+	}
+	added := player.metadata
+	event := BackendEvent{
+		Kind:           EventPlayerAdded,
+		Player:         playerName,
+		PlaybackStatus: playbackStatus,
+		Metadata:       &added,
+	}
+	if replaced {
+		event.Kind = EventPlayerUpdated
+	}
+	mb.emit(event)
+}
+
+func (mb *MemoryBackend) RemovePlayer(playerName string) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	_, playerExists := mb.players[playerName]
+	delete(mb.players, playerName)
+	for playerIdx, playerVal := range mb.playerNames {
+		if playerVal == playerName {
+			mb.playerNames = append(mb.playerNames[:playerIdx], mb.playerNames[playerIdx+1:]...)
+			break
+		}
+	}
+	if playerExists {
+		mb.emit(BackendEvent{Kind: EventPlayerRemoved, Player: playerName})
+	}
+}
+
+func (mb *MemoryBackend) SetPlaybackStatus(playerName string, playbackStatus string) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	player.playbackStatus = playbackStatus
+	mb.emit(BackendEvent{
+		Kind:           EventPlaybackStatusChanged,
+		Player:         playerName,
+		PlaybackStatus: playbackStatus,
+	})
+	return nil
+}
+
+func (mb *MemoryBackend) SetMetadata(playerName string, metadata *mp.Metadata) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	player.metadata = *metadata
+	player.position = 0
+	updated := player.metadata
+	mb.emit(BackendEvent{
+		Kind:     EventMetadataChanged,
+		Player:   playerName,
+		Metadata: &updated,
+	})
+	return nil
+}
+
+// Moves the position without telling the subsystem (like normal playback).
+func (mb *MemoryBackend) SetPosition(playerName string, position time.Duration) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	player.position = position
+	return nil
+}
+
+// Moves the position, and reports the seek.
+func (mb *MemoryBackend) Seek(playerName string, position time.Duration) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	player.position = position
+	mb.emit(BackendEvent{
+		Kind:     EventSeeked,
+		Player:   playerName,
+		Position: position,
+	})
+	return nil
+}
+
+func (mb *MemoryBackend) SetRate(playerName string, rate float64) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	player.rate = rate
+	return nil
+}
+
+// Sets whether a player supports an action (all actions are supported by
+// default).
+func (mb *MemoryBackend) SetSupported(playerName string, action PlayerAction, supported bool) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	player.unsupported[action] = !supported
+	return nil
+}
+
+// Actions run on a player so far, in order.
+func (mb *MemoryBackend) Actions(playerName string) []PlayerAction {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return nil
+	}
+	return append([]PlayerAction{}, player.actions...)
+}
+
+// -- BACKEND --
+
+func (mb *MemoryBackend) Platform() utils.PlatformKind {
+	return mb.platform
+}
+
+func (mb *MemoryBackend) Events() <-chan BackendEvent {
+	return mb.events
+}
+
+func (mb *MemoryBackend) Open() ([]string, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	select {
+	case <-mb.closed:
+		return nil, fmt.Errorf("media player: memory backend closed")
+	default:
+	}
+	if !mb.open {
+		mb.open = true
+		go mb.pump()
+	}
+	return append([]string{}, mb.playerNames...), nil
+}
+
+func (mb *MemoryBackend) Close() {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	mb.open = false
+	mb.closeOnce.Do(func() { close(mb.closed) })
+}
+
+// -- PLAYER OPERATIONS --
+
+func (mb *MemoryBackend) PlaybackStatus(playerName string) (string, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return "", playerErr
+	}
+	return player.playbackStatus, nil
+}
+
+func (mb *MemoryBackend) Metadata(playerName string) (*mp.Metadata, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return nil, playerErr
+	}
+	metadata := player.metadata
+	return &metadata, nil
+}
+
+func (mb *MemoryBackend) Position(playerName string) (time.Duration, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return 0, playerErr
+	}
+	return player.position, nil
+}
+
+func (mb *MemoryBackend) Rate(playerName string) (float64, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return 0, playerErr
+	}
+	return player.rate, nil
+}
+
+func (mb *MemoryBackend) Volume(playerName string) (float64, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return 0, playerErr
+	}
+	return player.volume, nil
+}
+
+func (mb *MemoryBackend) SetVolume(playerName string, volume float64) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	player.volume = volume
+	return nil
+}
+
+func (mb *MemoryBackend) Action(playerName string, action PlayerAction) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	if player.unsupported[action] {
+		return NewCommandError(ext_mp.ErrCodeNotSupported, "Player doesn't support %s", action)
+	}
+	player.actions = append(player.actions, action)
+	playbackStatus := player.playbackStatus
+	switch action {
+	case ActionPlay:
+		playbackStatus = mp.PlaybackStatusPlaying
+	case ActionPause:
+		playbackStatus = mp.PlaybackStatusPaused
+	case ActionPlayPause:
+		if playbackStatus == mp.PlaybackStatusPlaying {
+			playbackStatus = mp.PlaybackStatusPaused
+		} else {
+			playbackStatus = mp.PlaybackStatusPlaying
+		}
+	}
+	statusChanged := playbackStatus != player.playbackStatus
+	player.playbackStatus = playbackStatus
+	if statusChanged {
+		mb.emit(BackendEvent{
+			Kind:           EventPlaybackStatusChanged,
+			Player:         playerName,
+			PlaybackStatus: playbackStatus,
+		})
+	}
+	return nil
+}
+
+func (mb *MemoryBackend) TrackUri(playerName string) (string, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return "", playerErr
+	}
+	return player.metadata.Url, nil
+}
+
+func (mb *MemoryBackend) OpenUri(playerName string, uri string) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	player.metadata = mp.Metadata{Url: uri}
+	player.position = 0
+	opened := player.metadata
+	mb.emit(BackendEvent{
+		Kind:     EventMetadataChanged,
+		Player:   playerName,
+		Metadata: &opened,
+	})
+	if player.playbackStatus != mp.PlaybackStatusPlaying {
+		player.playbackStatus = mp.PlaybackStatusPlaying
+		mb.emit(BackendEvent{
+			Kind:           EventPlaybackStatusChanged,
+			Player:         playerName,
+			PlaybackStatus: player.playbackStatus,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,582 @@
+package media_player
+
+/*
+MPRIS Backend
+
+This backend controls media players on Linux through MPRIS (over the D-Bus
+session bus). Signals from the bus are handled on the backend's own goroutine,
+and turned into `BackendEvent`s.
+
+REFERENCE: https://specifications.freedesktop.org/mpris-spec/latest/
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	// 3rd party imports
+	"github.com/Pauloo27/go-mpris"
+	"github.com/godbus/dbus/v5"
+
+	// 1st party imports
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/cyprus/utils"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+// -- DBus Specific Methods
+
+const (
+	DBusMPRISPath          = "/org/mpris/MediaPlayer2"
+	DBusGetNameOwner       = "org.freedesktop.DBus.GetNameOwner"
+	SeekedMember           = "Seeked"
+	PlayerSeekedMemberName = "org.mpris.MediaPlayer2.Player.Seeked"
+)
+
+// Delay before adding a player which just appeared on the bus, to let the
+// media player set itself up.
+const PlayerSetupDelay = time.Second / 2
+
+// MPRIS capability property which tells whether a player supports an action.
+var mprisActionCapabilities = map[PlayerAction]string{
+	ActionPlay:      "CanPlay",
+	ActionPause:     "CanPause",
+	ActionPlayPause: "CanPause",
+	ActionNext:      "CanGoNext",
+	ActionPrevious:  "CanGoPrevious",
+}
+
+var mprisActionCalls = map[PlayerAction]func(*mpris.Player) error{
+	ActionPlay:      (*mpris.Player).Play,
+	ActionPause:     (*mpris.Player).Pause,
+	ActionPlayPause: (*mpris.Player).PlayPause,
+	ActionNext:      (*mpris.Player).Next,
+	ActionPrevious:  (*mpris.Player).Previous,
+}
+
+// Player to add once its setup delay is over.
+type pendingPlayer struct {
+	name string
+	kind BackendEventKind
+}
+
+type MPRISBackend struct {
+	logf    func(string, ...interface{})
+	bus     *dbus.Conn
+	signals chan *dbus.Signal
+	// Players waiting to be added (see `addPlayerLater`)
+	pending chan pendingPlayer
+	events  chan BackendEvent
+	// Closed on `Close`
+	closed    chan bool
+	closeOnce sync.Once
+	// Players are only added and removed by `signalLoop` (once open), and
+	// read from the subsystem routine.
+	mutex           sync.Mutex
+	playerMap       map[string]*mpris.Player
+	senderPlayerMap map[string]string
+}
+
+func NewMPRISBackend() *MPRISBackend {
+	return &MPRISBackend{
+		logf: func(f string, v ...interface{}) {
+			utils.LogFunc("MPL", f, v...)
+		},
+		signals:         make(chan *dbus.Signal, 5),
+		pending:         make(chan pendingPlayer),
+		events:          make(chan BackendEvent, 16),
+		closed:          make(chan bool),
+		playerMap:       make(map[string]*mpris.Player),
+		senderPlayerMap: make(map[string]string),
+	}
+}
+
+func (mb *MPRISBackend) Platform() utils.PlatformKind {
+	return utils.PlatformLinux
+}
+
+func (mb *MPRISBackend) Events() <-chan BackendEvent {
+	return mb.events
+}
+
+// Sends an event to the subsystem (dropped once the backend is closed).
+func (mb *MPRISBackend) emit(event BackendEvent) {
+	select {
+	case mb.events <- event:
+	case <-mb.closed:
+	}
+}
+
+// -- PLAYER MAP --
+
+func (mb *MPRISBackend) player(playerName string) (*mpris.Player, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	player, playerExists := mb.playerMap[playerName]
+	if !playerExists {
+		return nil, NewCommandError(ext_mp.ErrCodePlayerNotFound, "player %s not found", playerName)
+	}
+	return player, nil
+}
+
+// Name of the player which sent a signal (signals are sent from the unique
+// name of the connection which owns the player name).
+func (mb *MPRISBackend) signalPlayer(signal *dbus.Signal) (string, bool) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	playerName, playerExists := mb.senderPlayerMap[signal.Sender]
+	return playerName, playerExists
+}
+
+// - Remove Player
+func (mb *MPRISBackend) removePlayer(playerName string) bool {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	if _, playerExists := mb.playerMap[playerName]; !playerExists {
+		return false
+	}
+	mb.bus.RemoveMatchSignal(
+		dbus.WithMatchSender(playerName),
+		dbus.WithMatchObjectPath(DBusMPRISPath),
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+	)
+	for sender, senderPlayer := range mb.senderPlayerMap {
+		if senderPlayer == playerName {
+			mb.bus.RemoveMatchSignal(
+				dbus.WithMatchSender(sender),
+				dbus.WithMatchObjectPath(DBusMPRISPath),
+				dbus.WithMatchInterface(mpris.PlayerInterface),
+				dbus.WithMatchMember(SeekedMember),
+			)
+			delete(mb.senderPlayerMap, sender)
+		}
+	}
+	delete(mb.playerMap, playerName)
+	return true
+}
+
+// - Add Player
+func (mb *MPRISBackend) addPlayer(playerName string) error {
+	if mb.removePlayer(playerName) {
+		mb.logf("WARN: Player previously existed. Removing.")
+	}
+	// Look up the unique name of the player, to map signals back to it.
+	var sender string
+	ownerErr := mb.bus.BusObject().Call(DBusGetNameOwner, 0, playerName).Store(&sender)
+	if ownerErr != nil {
+		return ownerErr
+	}
+	// Register "org.freedesktop.DBus.Properties.PropertiesChanged"
+	mb.bus.AddMatchSignal(
+		dbus.WithMatchSender(playerName),
+		dbus.WithMatchObjectPath(DBusMPRISPath),
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+	)
+	// Register "org.mpris.MediaPlayer2.Player.Seeked"
+	mb.bus.AddMatchSignal(
+		dbus.WithMatchSender(sender),
+		dbus.WithMatchObjectPath(DBusMPRISPath),
+		dbus.WithMatchInterface(mpris.PlayerInterface),
+		dbus.WithMatchMember(SeekedMember),
+	)
+	mb.logf("PLAYER NAME: %s", playerName)
+
+	// Store the players and senders
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	mb.playerMap[playerName] = mpris.New(mb.bus, playerName)
+	mb.senderPlayerMap[sender] = playerName
+	return nil
+}
+
+// Adds a player which just appeared on the bus, after `PlayerSetupDelay` to
+// let the media player set itself up. The player is handed back to
+// `signalLoop` once the delay is over, so signals keep being handled
+// meanwhile.
+func (mb *MPRISBackend) addPlayerLater(playerName string, kind BackendEventKind) {
+	time.AfterFunc(PlayerSetupDelay, func() {
+		select {
+		case mb.pending <- pendingPlayer{name: playerName, kind: kind}:
+		case <-mb.closed:
+		}
+	})
+}
+
+func (mb *MPRISBackend) announcePlayer(pending pendingPlayer) {
+	if addErr := mb.addPlayer(pending.name); addErr != nil {
+		// The player went away during the delay.
+		mb.logf("Add player %s: %v", pending.name, addErr)
+		return
+	}
+	playbackStatus, playbackStatusErr := mb.PlaybackStatus(pending.name)
+	if playbackStatusErr != nil {
+		mb.logf("PlaybackErr: %v", playbackStatusErr)
+		return
+	}
+	metadata, metadataErr := mb.Metadata(pending.name)
+	if metadataErr != nil {
+		mb.logf("Get Metadata (unparsed): %v", metadataErr)
+		return
+	}
+	mb.emit(BackendEvent{
+		Kind:           pending.kind,
+		Player:         pending.name,
+		PlaybackStatus: playbackStatus,
+		Metadata:       metadata,
+	})
+}
+
+// -- BACKEND --
+
+// Connects to the session bus, and adds the players which are alive.
+func (mb *MPRISBackend) Open() ([]string, error) {
+	// Set up Desktop Bus for Media Player Subsystem (Linux)
+	busConn, sessionBusErr := dbus.SessionBus()
+	if sessionBusErr != nil {
+		return nil, sessionBusErr
+	}
+	mb.bus = busConn
+
+	// Add signal for create/remove for player objects.
+	dbusConnAddSignalErr := mb.bus.AddMatchSignal(
+		dbus.WithMatchSender("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"),
+		dbus.WithMatchArg0Namespace("org.mpris.MediaPlayer2"),
+	)
+	if dbusConnAddSignalErr != nil {
+		return nil, dbusConnAddSignalErr
+	}
+	// Add the currently alive players @ launch.
+	mediaPlayerNames, playerListErr := mpris.List(mb.bus)
+	if playerListErr != nil {
+		return nil, playerListErr
+	}
+	playerNames := []string{}
+	for _, mPlayerName := range mediaPlayerNames {
+		if addErr := mb.addPlayer(mPlayerName); addErr != nil {
+			mb.logf("Setup: add player %s: %v", mPlayerName, addErr)
+			continue
+		}
+		playerNames = append(playerNames, mPlayerName)
+	}
+	// Bind DBus singal
+	mb.bus.Signal(mb.signals)
+	go mb.signalLoop()
+	return playerNames, nil
+}
+
+// Closes the message bus, and ends `signalLoop`.
+func (mb *MPRISBackend) Close() {
+	mb.closeOnce.Do(func() {
+		close(mb.closed)
+		if mb.bus != nil {
+			mb.bus.Close()
+		}
+	})
+}
+
+// -- PLAYER OPERATIONS --
+
+func (mb *MPRISBackend) PlaybackStatus(playerName string) (string, error) {
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return "", playerErr
+	}
+	playbackStatus, playbackStatusErr := player.GetPlaybackStatus()
+	return string(playbackStatus), playbackStatusErr
+}
+
+func (mb *MPRISBackend) Metadata(playerName string) (*mp.Metadata, error) {
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return nil, playerErr
+	}
+	rawMetadata, metadataErr := player.GetMetadata()
+	if metadataErr != nil {
+		return nil, metadataErr
+	}
+	return MetadataFromMPRIS(playerName, rawMetadata), nil
+}
+
+func (mb *MPRISBackend) Position(playerName string) (time.Duration, error) {
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return 0, playerErr
+	}
+	position, positionErr := player.GetPosition()
+	if positionErr != nil {
+		return 0, positionErr
+	}
+	return time.Duration(position * float64(time.Second)), nil
+}
+
+func (mb *MPRISBackend) Rate(playerName string) (float64, error) {
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return 0, playerErr
+	}
+	return player.GetRate()
+}
+
+func (mb *MPRISBackend) SetRate(playerName string, rate float64) error {
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	return player.SetPlayerProperty("Rate", rate)
+}
+
+func (mb *MPRISBackend) Volume(playerName string) (float64, error) {
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return 0, playerErr
+	}
+	return player.GetVolume()
+}
+
+func (mb *MPRISBackend) SetVolume(playerName string, volume float64) error {
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	return player.SetVolume(volume)
+}
+
+func (mb *MPRISBackend) Action(playerName string, action PlayerAction) error {
+	call, actionExists := mprisActionCalls[action]
+	if !actionExists {
+		return NewCommandError(ext_mp.ErrCodeNotSupported, "unknown action %s", action)
+	}
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	// Players report unsupported operations through capabilities, calling them
+	// anyway is a no-op as per the MPRIS spec.
+	capability, capabilityErr := player.GetPlayerProperty(mprisActionCapabilities[action])
+	if capabilityErr == nil {
+		if supported, isBool := capability.Value().(bool); isBool && !supported {
+			return NewCommandError(ext_mp.ErrCodeNotSupported, "Player doesn't support %s", action)
+		}
+	}
+	if callErr := call(player); callErr != nil {
+		return commandErrorFromMPRIS(string(action), callErr)
+	}
+	return nil
+}
+
+func (mb *MPRISBackend) TrackUri(playerName string) (string, error) {
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return "", playerErr
+	}
+	rawMetadata, metadataErr := player.GetMetadata()
+	if metadataErr != nil {
+		return "", metadataErr
+	}
+	return metadataString(rawMetadata[mp.URL].Value()), nil
+}
+
+func (mb *MPRISBackend) OpenUri(playerName string, uri string) error {
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	if openErr := player.OpenUri(uri); openErr != nil {
+		return commandErrorFromMPRIS("OpenUri", openErr)
+	}
+	return nil
+}
+
+// Uses `SetPosition` with the player's own track ID (not the normalized one,
+// which may be derived). Players without a usable track ID are seeked
+// relative to their current position instead.
+func (mb *MPRISBackend) Seek(playerName string, position time.Duration) error {
+	player, playerErr := mb.player(playerName)
+	if playerErr != nil {
+		return playerErr
+	}
+	rawMetadata, metadataErr := player.GetMetadata()
+	if metadataErr != nil {
+		return metadataErr
+	}
+	trackId := dbus.ObjectPath(metadataString(rawMetadata[mp.TRACKID].Value()))
+	var seekErr error
+	if trackId.IsValid() && trackId != MPRISNoTrack {
+		seekErr = player.SetTrackPosition(&trackId, position.Seconds())
+	} else {
+		current, positionErr := player.GetPosition()
+		if positionErr != nil {
+			return positionErr
+		}
+		seekErr = player.Seek(position.Seconds() - current)
+	}
+	if seekErr != nil {
+		return commandErrorFromMPRIS("SetPosition", seekErr)
+	}
+	return nil
+}
+
+//	--- HANDLERS ---
+
+// DBus Signal Loop
+//
+// This dispatches signals from MPRIS (through DBus) and adds pending players,
+// until the backend is closed.
+func (mb *MPRISBackend) signalLoop() {
+	for {
+		select {
+		case signal, signalsOpen := <-mb.signals:
+			if !signalsOpen {
+				mb.logf("DBus signal channel closed")
+				return
+			}
+			mb.handleSignal(signal)
+		case pending := <-mb.pending:
+			mb.announcePlayer(pending)
+		case <-mb.closed:
+			return
+		}
+	}
+}
+
+func (mb *MPRISBackend) handleSignal(signal *dbus.Signal) {
+	if signal == nil {
+		mb.logf("Warning: DBus signal being sent is 'nil'")
+		return
+	}
+	switch signal.Name {
+	case "org.freedesktop.DBus.Properties.PropertiesChanged":
+		if handleErr := mb.handlePropertiesChanged(signal); handleErr != nil {
+			mb.logf("PropertiesChanged: %v", handleErr)
+		}
+	case "org.freedesktop.DBus.NameOwnerChanged":
+		mb.handleNameOwnerChanged(signal)
+	case PlayerSeekedMemberName:
+		mb.handleSeeked(signal)
+	default:
+		mb.logf("WARNING: MPRIS Signal")
+	}
+}
+
+// Handles the `Seeked` signal from Media Player
+func (mb *MPRISBackend) handleSeeked(signal *dbus.Signal) {
+	playerName, playerExists := mb.signalPlayer(signal)
+	if !playerExists || len(signal.Body) == 0 {
+		return
+	}
+	seekedTime, isInt := signal.Body[0].(int64)
+	if !isInt {
+		return
+	}
+	mb.emit(BackendEvent{
+		Kind:     EventSeeked,
+		Player:   playerName,
+		Position: time.Duration(seekedTime) * time.Microsecond,
+	})
+}
+
+// Property handler for handlePropertiesChanged
+//
+// Currently, the following properties are supported:
+// 1. `PlaybackStatus`: When Player Playback Status changes.
+// 2. `Metadata`: When Player Metadata changes (When media changes).
+func (mb *MPRISBackend) parseProperty(playerName string, property map[string]dbus.Variant) error {
+	for propKey, propValue := range property {
+		switch propKey {
+		case "PlaybackStatus":
+			newPlaybackStatus, psParseError := ext_mp.ParsePlaybackStatus(propValue.Value().(string))
+			if psParseError != nil {
+				return psParseError
+			}
+			mb.emit(BackendEvent{
+				Kind:           EventPlaybackStatusChanged,
+				Player:         playerName,
+				PlaybackStatus: newPlaybackStatus,
+			})
+		case "Metadata":
+			metadata, metadataGetErr := mb.Metadata(playerName)
+			if metadataGetErr != nil {
+				return metadataGetErr
+			}
+			mb.emit(BackendEvent{
+				Kind:     EventMetadataChanged,
+				Player:   playerName,
+				Metadata: metadata,
+			})
+		default:
+			return fmt.Errorf("key not found: KEY(%s): %s", propKey, propValue)
+		}
+	}
+	return nil
+}
+
+// Signal handler for "PropertiesChanged"
+func (mb *MPRISBackend) handlePropertiesChanged(signal *dbus.Signal) error {
+	// signal.Body[0] = "org.mpris.MediaPlayer2.Player", representing interface
+	// name. Ignore that value.
+	mb.logf("Signal: %+v", signal.Body)
+	playerName, playerExists := mb.signalPlayer(signal)
+	if playerExists {
+		for _, signalProp := range signal.Body[1:] {
+			// Two kinds of value for signal body value are expected here:
+			// 1. map[string]dbus.Variant
+			// 2. []string (empty string)
+			// We need 1, ignore 2.
+			if property, propertyExists := signalProp.(map[string]dbus.Variant); propertyExists {
+				parseErr := mb.parseProperty(playerName, property)
+				if parseErr != nil {
+					return parseErr
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Signal handler for "NameOwnerChanged"
+//
+// This handles "org.freedesktop.DBus.NameOwnerChanged", for seeing the owner
+// changes to a specific player.
+func (mb *MPRISBackend) handleNameOwnerChanged(busSignal *dbus.Signal) {
+	if len(busSignal.Body) != 3 {
+		mb.logf("ERROR: Incorrect name owner value length.")
+		return
+	}
+	playerName, oldValue, newValue := busSignal.Body[0].(string),
+		busSignal.Body[1].(string),
+		busSignal.Body[2].(string)
+	// ---- NOTE ABOUT **SIGNALS** ----
+	// 	There's 3 arguments here. Each argument describes something.
+	// 	Every change is represented by values in `NameOwnerChanged` signal.
+	//	Arg 0: Media Player Name (org.mpris.MediaPlayer2.spotify).
+	//	Arg 1: "Old Value" (oldValue).
+	//	Arg 2: "New Value" (newValue).
+	//	-- TYPES OF CHANGES --
+	// Table shows value emptiness (empty string or "" is ❎, non-empty is ✅).
+	// +----------+----------+---------------+
+	// | OldValue | NewValue |     Change    |
+	// +----------+----------+---------------+
+	// |    ❎    |    ✅    | Create Player |
+	// |    ✅    |    ❎    | Remove Player |
+	// |  	✅    |    ✅    | Update Player |
+	// +----------+----------+---------------+
+	if oldValue == "" {
+		// CREATE PLAYER
+		mb.addPlayerLater(playerName, EventPlayerAdded)
+	} else if newValue == "" {
+		// -- DELETE PLAYER
+		// Players which were never added (ex: gone during the setup delay) are
+		// unknown to the subsystem as well.
+		if mb.removePlayer(playerName) {
+			mb.emit(BackendEvent{Kind: EventPlayerRemoved, Player: playerName})
+		}
+	} else {
+		// -- UPDATE PLAYER
+		mb.removePlayer(playerName)
+		mb.addPlayerLater(playerName, EventPlayerUpdated)
+	}
+}
@@ -0,0 +1,228 @@
+package media_player
+
+/*
+MPRIS Metadata Normalization
+
+Players don't all follow the MPRIS metadata spec to the letter. This turns
+the raw metadata of a player into the types `mp.MetadataFromMPRIS` expects:
+
+- `mpris:trackid`: string (object paths are converted). Players which send
+  an empty (or "NoTrack") track ID get one derived from the track itself.
+- `mpris:length`: uint64, in microseconds (from any integer type).
+- `xesam:artist`, `xesam:albumArtist`: a list, with every artist joined in
+  a single entry ("A, B").
+- `xesam:url`: percent-decoded.
+
+Known per-player quirks are listed in `MetadataQuirkTable`.
+
+REFERENCE: https://www.freedesktop.org/wiki/Specifications/mpris-spec/metadata/
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+const (
+	MPRISNamePrefix = "org.mpris.MediaPlayer2."
+	// Track ID for "no track" (as per the MPRIS spec)
+	MPRISNoTrack = "/org/mpris/MediaPlayer2/TrackList/NoTrack"
+	// Prefix of the track IDs derived by cyprus
+	DerivedTrackIdPrefix = "/org/cyprus/Track/"
+	// Separator between multiple artists
+	ArtistSeparator = ", "
+)
+
+// Per-player metadata overrides
+type MetadataQuirks struct {
+	// The player reuses the same track ID for different tracks.
+	IgnoreTrackId bool
+	// The player reports the length in milliseconds.
+	LengthInMs bool
+	// The player sends a single artist string with several artists in it,
+	// separated by this.
+	ArtistSplit string
+	// Art URLs starting with the first value get it replaced by the second.
+	ArtUrlRewrite [2]string
+}
+
+// Quirks of known players, by player name (without the MPRIS prefix, and
+// without any instance suffix: "org.mpris.MediaPlayer2.firefox.instance_1"
+// uses "firefox").
+var MetadataQuirkTable = map[string]MetadataQuirks{
+	// Every track is "/org/chromium/MediaPlayer2/TrackList/TrackFooBar".
+	"chromium": {IgnoreTrackId: true},
+	// Art URLs point to a host which doesn't serve the images.
+	"spotify": {
+		ArtUrlRewrite: [2]string{"https://open.spotify.com/image/", "https://i.scdn.co/image/"},
+	},
+}
+
+// Quirks for the given player (zero value for players without any).
+func QuirksFor(playerName string) MetadataQuirks {
+	shortName := strings.TrimPrefix(playerName, MPRISNamePrefix)
+	shortName, _, _ = strings.Cut(shortName, ".")
+	return MetadataQuirkTable[shortName]
+}
+
+// Returns a normalized copy of the raw metadata of a player.
+func NormalizeMPRISMetadata(playerName string, raw map[string]dbus.Variant) map[string]dbus.Variant {
+	quirks := QuirksFor(playerName)
+	normalized := make(map[string]dbus.Variant, len(raw))
+	for key, value := range raw {
+		normalized[key] = value
+	}
+	if length, lengthOk := normalizeLength(raw[mp.LENGTH].Value()); lengthOk {
+		if quirks.LengthInMs {
+			length *= 1000
+		}
+		normalized[mp.LENGTH] = dbus.MakeVariant(length)
+	} else {
+		delete(normalized, mp.LENGTH)
+	}
+	for _, artistKey := range []string{mp.ARTIST, mp.ALBUM_ARTIST} {
+		if artists := normalizeArtists(raw[artistKey].Value(), quirks.ArtistSplit); len(artists) > 0 {
+			normalized[artistKey] = dbus.MakeVariant([]string{strings.Join(artists, ArtistSeparator)})
+		} else {
+			delete(normalized, artistKey)
+		}
+	}
+	if rawUrl, isString := raw[mp.URL].Value().(string); isString {
+		normalized[mp.URL] = dbus.MakeVariant(decodeUrl(rawUrl))
+	}
+	if artUrl, isString := raw[mp.ART_URL].Value().(string); isString && quirks.ArtUrlRewrite[0] != "" {
+		if strings.HasPrefix(artUrl, quirks.ArtUrlRewrite[0]) {
+			normalized[mp.ART_URL] = dbus.MakeVariant(
+				quirks.ArtUrlRewrite[1] + strings.TrimPrefix(artUrl, quirks.ArtUrlRewrite[0]),
+			)
+		}
+	}
+	trackId := metadataString(raw[mp.TRACKID].Value())
+	if trackId == MPRISNoTrack || quirks.IgnoreTrackId {
+		trackId = ""
+	}
+	if trackId == "" {
+		trackId = deriveTrackId(normalized)
+	}
+	normalized[mp.TRACKID] = dbus.MakeVariant(trackId)
+	return normalized
+}
+
+// Converts MPRIS metadata to `mp.Metadata`, through `NormalizeMPRISMetadata`.
+func MetadataFromMPRIS(playerName string, raw map[string]dbus.Variant) *mp.Metadata {
+	return mp.MetadataFromMPRIS(NormalizeMPRISMetadata(playerName, raw))
+}
+
+// -- NORMALIZERS --
+
+// Strings and object paths (ex: `mpris:trackid`) as a string.
+func metadataString(value interface{}) string {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue
+	case dbus.ObjectPath:
+		return string(typedValue)
+	default:
+		return ""
+	}
+}
+
+// Lengths as uint64 (negative and missing lengths are unknown).
+func normalizeLength(value interface{}) (uint64, bool) {
+	var length int64
+	switch typedValue := value.(type) {
+	case uint64:
+		return typedValue, typedValue > 0
+	case int64:
+		length = typedValue
+	case int32:
+		length = int64(typedValue)
+	case uint32:
+		length = int64(typedValue)
+	case float64:
+		length = int64(typedValue)
+	default:
+		return 0, false
+	}
+	if length <= 0 {
+		return 0, false
+	}
+	return uint64(length), true
+}
+
+// Artists (from a string or a list) as a list of non-empty, unique names.
+func normalizeArtists(value interface{}, split string) []string {
+	var rawArtists []string
+	switch typedValue := value.(type) {
+	case string:
+		rawArtists = []string{typedValue}
+	case []string:
+		rawArtists = typedValue
+	case []interface{}:
+		for _, artist := range typedValue {
+			if artistName, isString := artist.(string); isString {
+				rawArtists = append(rawArtists, artistName)
+			}
+		}
+	}
+	if split != "" {
+		splitArtists := []string{}
+		for _, artist := range rawArtists {
+			splitArtists = append(splitArtists, strings.Split(artist, split)...)
+		}
+		rawArtists = splitArtists
+	}
+	artists := []string{}
+	seen := make(map[string]bool)
+	for _, artist := range rawArtists {
+		artist = strings.TrimSpace(artist)
+		if artist == "" || seen[artist] {
+			continue
+		}
+		seen[artist] = true
+		artists = append(artists, artist)
+	}
+	return artists
+}
+
+// Percent-decodes a URL, leaving it as it is if it can't be decoded.
+func decodeUrl(rawUrl string) string {
+	decodedUrl, decodeErr := url.PathUnescape(rawUrl)
+	if decodeErr != nil {
+		return rawUrl
+	}
+	return decodedUrl
+}
+
+// Derives a track ID from the (normalized) metadata: from the URL when there
+// is one, and from the title, artists, album and length otherwise. Empty
+// when there's nothing to derive it from.
+func deriveTrackId(normalized map[string]dbus.Variant) string {
+	var identity string
+	if trackUrl := metadataString(normalized[mp.URL].Value()); trackUrl != "" {
+		identity = "url:" + trackUrl
+	} else {
+		title := metadataString(normalized[mp.TITLE].Value())
+		if title == "" {
+			return ""
+		}
+		identity = fmt.Sprintf(
+			"meta:%s|%v|%s|%v",
+			title,
+			normalized[mp.ARTIST].Value(),
+			metadataString(normalized[mp.ALBUM].Value()),
+			normalized[mp.LENGTH].Value(),
+		)
+	}
+	hash := sha1.Sum([]byte(identity))
+	return DerivedTrackIdPrefix + hex.EncodeToString(hash[:8])
+}
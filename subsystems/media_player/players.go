@@ -0,0 +1,115 @@
+package media_player
+
+import (
+	"fmt"
+	"time"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+func (mps *Subsystem) emitSleepTimerState(state *ext_mp.SleepTimerState) {
+	mps.emitEvent(models.Message{
+		Method: mps.platformMethod(MethodSleep),
+		Args:   state,
+	})
+}
+
+// Queues a scrobble, and tells the client about it.
+func (mps *Subsystem) recordScrobble(scrobble *ext_mp.Scrobble) {
+	if queueErr := mps.scrobbleQueue(); queueErr != nil {
+		mps.logf("Scrobble: %v", queueErr)
+	} else if appendErr := mps.scrobbles.Append(ListenFromScrobble(scrobble)); appendErr != nil {
+		mps.logf("Scrobble: %v", appendErr)
+	}
+	mps.emitEvent(models.Message{
+		Method: mps.platformMethod(MethodScrobble),
+		Args:   scrobble,
+	})
+}
+
+// Fails when scrobbles can't be kept.
+func (mps *Subsystem) scrobbleQueue() error {
+	if mps.scrobbles == nil {
+		return NewCommandError(ext_mp.ErrCodeStorage, "no scrobble queue (data directory unknown)")
+	}
+	return nil
+}
+
+// Key which identifies the current track of a player.
+func trackKey(metadata *mp.Metadata) string {
+	if metadata == nil || (metadata.TrackId == "" && metadata.Url == "" && metadata.Title == "") {
+		return ""
+	}
+	return fmt.Sprintf("%v|%v|%v", metadata.TrackId, metadata.Url, metadata.Title)
+}
+
+// -- SLEEP TIMER PLAYERS --
+
+// Fails for players which aren't in the registry (yet, or anymore).
+func (mps *Subsystem) knownPlayer(playerName string) error {
+	if !mps.hasPlayer(playerName) {
+		return NewCommandError(ext_mp.ErrCodePlayerNotFound, "player %s not found", playerName)
+	}
+	return nil
+}
+
+func (mps *Subsystem) playingPlayers() []string {
+	playing := []string{}
+	for _, playerName := range mps.playerNames {
+		status, statusErr := mps.backend.PlaybackStatus(playerName)
+		if statusErr == nil && status == mp.PlaybackStatusPlaying {
+			playing = append(playing, playerName)
+		}
+	}
+	return playing
+}
+
+func (mps *Subsystem) pausePlayer(playerName string) error {
+	if playerErr := mps.knownPlayer(playerName); playerErr != nil {
+		return playerErr
+	}
+	return mps.backend.Action(playerName, ActionPause)
+}
+
+func (mps *Subsystem) playerVolume(playerName string) (float64, error) {
+	if playerErr := mps.knownPlayer(playerName); playerErr != nil {
+		return 0, playerErr
+	}
+	return mps.backend.Volume(playerName)
+}
+
+func (mps *Subsystem) setPlayerVolume(playerName string, volume float64) error {
+	if playerErr := mps.knownPlayer(playerName); playerErr != nil {
+		return playerErr
+	}
+	return mps.backend.SetVolume(playerName, volume)
+}
+
+func (mps *Subsystem) trackRemaining(playerName string) (time.Duration, bool, string) {
+	if !mps.hasPlayer(playerName) {
+		return 0, false, ""
+	}
+	metadata, metadataErr := mps.backend.Metadata(playerName)
+	if metadataErr != nil {
+		return 0, false, ""
+	}
+	currentTrack := trackKey(metadata)
+	if metadata.Length == 0 {
+		return 0, false, currentTrack
+	}
+	position, positionErr := mps.backend.Position(playerName)
+	if positionErr != nil {
+		return 0, false, currentTrack
+	}
+	rate, rateErr := mps.backend.Rate(playerName)
+	if rateErr != nil || rate <= 0 {
+		rate = 1
+	}
+	remaining := time.Duration(metadata.Length)*time.Microsecond - position
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Duration(float64(remaining) / rate), true, currentTrack
+}
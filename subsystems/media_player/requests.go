@@ -0,0 +1,190 @@
+package media_player
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+type PlayerSelection struct {
+	//lint:ignore U1000 `msgpack` options, not for serialization.
+	_msgpack   struct{} `msgpack:",as_array"`
+	PlayerName string
+}
+
+// Index-based player actions
+var indexPlayerActions = map[string]PlayerAction{
+	"iplay":      ActionPlay,
+	"ipause":     ActionPause,
+	"iplaypause": ActionPlayPause,
+	"ifwd":       ActionNext,
+	"iprv":       ActionPrevious,
+}
+
+// -- REPLIES --
+
+func (mps *Subsystem) replyOk(requestMethod string) {
+	mps.reply(models.Message{
+		Method: mps.platformMethod(MethodOk),
+		Args:   &ext_mp.CommandOk{Method: requestMethod},
+	})
+}
+
+func (mps *Subsystem) replyError(requestMethod string, err error) {
+	commandErr := AsCommandError(err)
+	mps.logf("%s: %v", requestMethod, commandErr)
+	mps.reply(models.Message{
+		Method: mps.platformMethod(MethodError),
+		Args: &ext_mp.CommandError{
+			Method:  requestMethod,
+			Code:    commandErr.Code,
+			Message: commandErr.Message,
+		},
+	})
+}
+
+// -- REQUEST HANDLERS --
+
+// Runs an index-based player action (`iplay`, `ipause`, ...).
+func (mps *Subsystem) handleIndexAction(action PlayerAction, decoder *msgpack.Decoder) error {
+	var playerIndex mp.PlayerIndex
+	if parseErr := decoder.Decode(&playerIndex); parseErr != nil {
+		return NewCommandError(ext_mp.ErrCodeDecode, "%s: %v", action, parseErr)
+	}
+	mps.logf("%s on player %d", action, playerIndex.PlayerIndex)
+	if playerIndex.PlayerIndex < 0 || playerIndex.PlayerIndex >= len(mps.playerNames) {
+		return NewCommandError(
+			ext_mp.ErrCodeInvalidIndex,
+			"player index %d out of range (%d players)",
+			playerIndex.PlayerIndex,
+			len(mps.playerNames),
+		)
+	}
+	return mps.backend.Action(mps.playerNames[playerIndex.PlayerIndex], action)
+}
+
+// Handles a single client request.
+//
+// Returns whether the reply was already sent (for requests which reply with
+// data), and the error to reply with otherwise.
+func (mps *Subsystem) handleRequest(method string, decoder *msgpack.Decoder) (bool, error) {
+	switch method {
+	case "list":
+		players := mps.copyPlayerNames()
+		mps.logf("Players: %s", players)
+		mps.reply(models.Message{
+			Method: mps.platformMethod(MethodRList),
+			Args:   &mp.MPlayerList{Players: players},
+		})
+		return true, nil
+	case "sync":
+		mps.sendSnapshot()
+		return true, nil
+	// SLEEP TIMER
+	case "sleep":
+		var sleepRequest ext_mp.SleepTimerRequest
+		if parseErr := decoder.Decode(&sleepRequest); parseErr != nil {
+			return false, NewCommandError(ext_mp.ErrCodeDecode, "sleep: %v", parseErr)
+		}
+		return false, mps.sleep.arm(&sleepRequest, time.Now())
+	case "sleep_get":
+		mps.reply(models.Message{
+			Method: mps.platformMethod(MethodRSleep),
+			Args:   mps.sleep.state(time.Now()),
+		})
+		return true, nil
+	case "sleep_cancel":
+		mps.sleep.cancel(time.Now())
+		return false, nil
+	// VOLUME FADES
+	case "fade":
+		var fadeRequest ext_mp.FadeRequest
+		if parseErr := decoder.Decode(&fadeRequest); parseErr != nil {
+			return false, NewCommandError(ext_mp.ErrCodeDecode, "fade: %v", parseErr)
+		}
+		return false, mps.fader.start(&fadeRequest, time.Now())
+	case "fade_cancel":
+		var playerSelection PlayerSelection
+		if parseErr := decoder.Decode(&playerSelection); parseErr != nil {
+			return false, NewCommandError(ext_mp.ErrCodeDecode, "fade_cancel: %v", parseErr)
+		}
+		mps.fader.cancel(playerSelection.PlayerName)
+		return false, nil
+	// PLAYBACK HANDOFF
+	case "handoff":
+		var handoffRequest ext_mp.HandoffRequest
+		if parseErr := decoder.Decode(&handoffRequest); parseErr != nil {
+			return false, NewCommandError(ext_mp.ErrCodeDecode, "handoff: %v", parseErr)
+		}
+		descriptor, handoffErr := mps.captureHandoff(&handoffRequest)
+		if handoffErr != nil {
+			return false, handoffErr
+		}
+		mps.reply(models.Message{
+			Method: mps.platformMethod(MethodRHandoff),
+			Args:   descriptor,
+		})
+		return true, nil
+	case "handoff_apply":
+		var applyRequest ext_mp.HandoffApplyRequest
+		if parseErr := decoder.Decode(&applyRequest); parseErr != nil {
+			return false, NewCommandError(ext_mp.ErrCodeDecode, "handoff_apply: %v", parseErr)
+		}
+		return false, mps.applyHandoff(&applyRequest, time.Now())
+	// SCROBBLES
+	case "scrobble_list":
+		if queueErr := mps.scrobbleQueue(); queueErr != nil {
+			return false, queueErr
+		}
+		listens, listErr := mps.scrobbles.List()
+		if listErr != nil {
+			return false, NewCommandError(ext_mp.ErrCodeStorage, "scrobble_list: %v", listErr)
+		}
+		scrobbleList := &ext_mp.ScrobbleList{Scrobbles: make([]ext_mp.Scrobble, 0, len(listens))}
+		for listenIdx := range listens {
+			scrobbleList.Scrobbles = append(scrobbleList.Scrobbles, listens[listenIdx].Scrobble())
+		}
+		mps.reply(models.Message{
+			Method: mps.platformMethod(MethodRScrobbles),
+			Args:   scrobbleList,
+		})
+		return true, nil
+	case "scrobble_export":
+		if queueErr := mps.scrobbleQueue(); queueErr != nil {
+			return false, queueErr
+		}
+		submission, exportErr := mps.scrobbles.Export()
+		if exportErr != nil {
+			return false, NewCommandError(ext_mp.ErrCodeStorage, "scrobble_export: %v", exportErr)
+		}
+		exported, encodeErr := json.Marshal(submission)
+		if encodeErr != nil {
+			return false, NewCommandError(ext_mp.ErrCodeStorage, "scrobble_export: %v", encodeErr)
+		}
+		mps.reply(models.Message{
+			Method: mps.platformMethod(MethodRScrobbleExport),
+			Args:   &ext_mp.ScrobbleExport{Count: len(submission.Payload), Json: string(exported)},
+		})
+		return true, nil
+	case "scrobble_clear":
+		if queueErr := mps.scrobbleQueue(); queueErr != nil {
+			return false, queueErr
+		}
+		if clearErr := mps.scrobbles.Clear(); clearErr != nil {
+			return false, NewCommandError(ext_mp.ErrCodeStorage, "scrobble_clear: %v", clearErr)
+		}
+		return false, nil
+	// -- METHODS --
+	// NAME METHODS
+	// INDEX METHODS
+	case "iplay", "ipause", "iplaypause", "ifwd", "iprv":
+		return false, mps.handleIndexAction(indexPlayerActions[method], decoder)
+	default:
+		return false, NewCommandError(ext_mp.ErrCodeUnknownMethod, "method %s unimplemented", method)
+	}
+}
@@ -0,0 +1,180 @@
+package media_player
+
+/*
+Scrobble Queue
+
+Scrobbles are appended to a local file, one ListenBrainz listen (JSON) per
+line. Other tools read the file (or an export of it) and submit it.
+
+REFERENCE: https://listenbrainz.readthedocs.io/en/latest/users/json.html
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/cyprus/utils"
+)
+
+const (
+	ScrobbleQueueFileName = "scrobbles.jsonl"
+	// Sent as `submission_client` with every listen
+	ScrobbleSubmissionClient = "cyprus"
+	ListenTypeImport         = "import"
+)
+
+// -- LISTENBRAINZ JSON --
+
+type Listen struct {
+	ListenedAt    int64               `json:"listened_at"`
+	TrackMetadata ListenTrackMetadata `json:"track_metadata"`
+}
+
+type ListenTrackMetadata struct {
+	ArtistName     string               `json:"artist_name"`
+	TrackName      string               `json:"track_name"`
+	ReleaseName    string               `json:"release_name,omitempty"`
+	AdditionalInfo ListenAdditionalInfo `json:"additional_info"`
+}
+
+type ListenAdditionalInfo struct {
+	DurationMs       int64  `json:"duration_ms,omitempty"`
+	MediaPlayer      string `json:"media_player,omitempty"`
+	OriginUrl        string `json:"origin_url,omitempty"`
+	SubmissionClient string `json:"submission_client"`
+}
+
+// Document to import a batch of listens.
+type ListenSubmission struct {
+	ListenType string   `json:"listen_type"`
+	Payload    []Listen `json:"payload"`
+}
+
+func ListenFromScrobble(scrobble *ext_mp.Scrobble) Listen {
+	return Listen{
+		ListenedAt: scrobble.ListenedAt,
+		TrackMetadata: ListenTrackMetadata{
+			ArtistName:  scrobble.Artist,
+			TrackName:   scrobble.Track,
+			ReleaseName: scrobble.Release,
+			AdditionalInfo: ListenAdditionalInfo{
+				DurationMs:       scrobble.DurationMs,
+				MediaPlayer:      scrobble.PlayerName,
+				OriginUrl:        scrobble.Url,
+				SubmissionClient: ScrobbleSubmissionClient,
+			},
+		},
+	}
+}
+
+func (listen *Listen) Scrobble() ext_mp.Scrobble {
+	return ext_mp.Scrobble{
+		ListenedAt: listen.ListenedAt,
+		Artist:     listen.TrackMetadata.ArtistName,
+		Track:      listen.TrackMetadata.TrackName,
+		Release:    listen.TrackMetadata.ReleaseName,
+		DurationMs: listen.TrackMetadata.AdditionalInfo.DurationMs,
+		PlayerName: listen.TrackMetadata.AdditionalInfo.MediaPlayer,
+		Url:        listen.TrackMetadata.AdditionalInfo.OriginUrl,
+	}
+}
+
+// -- QUEUE --
+
+type ScrobbleQueue struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewScrobbleQueue(path string) *ScrobbleQueue {
+	return &ScrobbleQueue{path: path}
+}
+
+// Queue in the data directory (see `utils.DataDir`).
+func DefaultScrobbleQueue() (*ScrobbleQueue, error) {
+	dataDir, dataDirErr := utils.DataDir()
+	if dataDirErr != nil {
+		return nil, dataDirErr
+	}
+	return NewScrobbleQueue(filepath.Join(dataDir, ScrobbleQueueFileName)), nil
+}
+
+func (sq *ScrobbleQueue) Path() string {
+	return sq.path
+}
+
+func (sq *ScrobbleQueue) Append(listen Listen) error {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	line, encodeErr := json.Marshal(listen)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if mkdirErr := os.MkdirAll(filepath.Dir(sq.path), 0o700); mkdirErr != nil {
+		return mkdirErr
+	}
+	queueFile, openErr := os.OpenFile(sq.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if openErr != nil {
+		return openErr
+	}
+	// A single write, so a crash can't leave half a line behind.
+	_, writeErr := queueFile.Write(append(line, '\n'))
+	closeErr := queueFile.Close()
+	if writeErr != nil {
+		return writeErr
+	}
+	return closeErr
+}
+
+// All the listens in the queue, oldest first. Lines which can't be parsed
+// are skipped.
+func (sq *ScrobbleQueue) List() ([]Listen, error) {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	content, readErr := os.ReadFile(sq.path)
+	if errors.Is(readErr, os.ErrNotExist) {
+		return []Listen{}, nil
+	} else if readErr != nil {
+		return nil, readErr
+	}
+	listens := []Listen{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		var listen Listen
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		if decodeErr := json.Unmarshal(scanner.Bytes(), &listen); decodeErr != nil {
+			continue
+		}
+		listens = append(listens, listen)
+	}
+	return listens, scanner.Err()
+}
+
+// The whole queue, as a ListenBrainz import document.
+func (sq *ScrobbleQueue) Export() (*ListenSubmission, error) {
+	listens, listErr := sq.List()
+	if listErr != nil {
+		return nil, listErr
+	}
+	return &ListenSubmission{ListenType: ListenTypeImport, Payload: listens}, nil
+}
+
+func (sq *ScrobbleQueue) Clear() error {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+	if removeErr := os.Remove(sq.path); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+		return fmt.Errorf("clear %s: %w", sq.path, removeErr)
+	}
+	return nil
+}
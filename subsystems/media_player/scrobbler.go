@@ -0,0 +1,176 @@
+package media_player
+
+/*
+Scrobbler
+
+This follows the track and playback status of every player, and scrobbles a
+track once it has played for half of its length or `ScrobbleMaxPlayTime`
+(whichever comes first). Only the time spent playing counts: pauses don't,
+and neither do seeks. A track is scrobbled at most once per play.
+
+Tracks without a title or an artist can't be scrobbled, and are ignored.
+
+The scrobbler is driven by the subsystem routine (`tick`).
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"strings"
+	"time"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+const (
+	ScrobbleMaxPlayTime  = time.Minute * 4
+	ScrobbleTickInterval = time.Millisecond * 250
+)
+
+// Current track of a player.
+type scrobbleTrack struct {
+	key       string
+	metadata  mp.Metadata
+	startedAt time.Time
+	// Time played, up to `playingSince`
+	played time.Duration
+	// Zero while the player isn't playing
+	playingSince time.Time
+	scrobbled    bool
+}
+
+func (track *scrobbleTrack) playTime(now time.Time) time.Duration {
+	if track.playingSince.IsZero() {
+		return track.played
+	}
+	return track.played + now.Sub(track.playingSince)
+}
+
+// Play time after which the track is scrobbled (zero for tracks which can't
+// be scrobbled).
+func (track *scrobbleTrack) threshold() time.Duration {
+	if track.key == "" || track.metadata.Title == "" || len(track.metadata.Artist) == 0 {
+		return 0
+	}
+	halfLength := time.Duration(track.metadata.Length) * time.Microsecond / 2
+	if halfLength > 0 && halfLength < ScrobbleMaxPlayTime {
+		return halfLength
+	}
+	return ScrobbleMaxPlayTime
+}
+
+// Whether the track is playing and still has to be scrobbled.
+func (track *scrobbleTrack) pending() bool {
+	return !track.scrobbled && !track.playingSince.IsZero() && track.threshold() > 0
+}
+
+type scrobbler struct {
+	scrobble func(*ext_mp.Scrobble)
+	logf     func(string, ...interface{})
+	tracks   map[string]*scrobbleTrack
+	ticker   *time.Ticker
+}
+
+func newScrobbler(scrobble func(*ext_mp.Scrobble), logf func(string, ...interface{})) *scrobbler {
+	return &scrobbler{
+		scrobble: scrobble,
+		logf:     logf,
+		tracks:   make(map[string]*scrobbleTrack),
+	}
+}
+
+// Ticks while a track is waiting to be scrobbled, nil otherwise (blocks
+// forever in `select`).
+func (sc *scrobbler) ticks() <-chan time.Time {
+	if sc.ticker == nil {
+		return nil
+	}
+	return sc.ticker.C
+}
+
+// Runs the ticker only while it's needed.
+func (sc *scrobbler) updateTicker() {
+	pending := false
+	for _, track := range sc.tracks {
+		pending = pending || track.pending()
+	}
+	if pending && sc.ticker == nil {
+		sc.ticker = time.NewTicker(ScrobbleTickInterval)
+	} else if !pending && sc.ticker != nil {
+		sc.ticker.Stop()
+		sc.ticker = nil
+	}
+}
+
+func (sc *scrobbler) track(playerName string) *scrobbleTrack {
+	track, trackExists := sc.tracks[playerName]
+	if !trackExists {
+		track = &scrobbleTrack{}
+		sc.tracks[playerName] = track
+	}
+	return track
+}
+
+// Called when a player reports its metadata. A different track starts a new
+// play (in the same playback state).
+func (sc *scrobbler) trackChanged(playerName string, metadata *mp.Metadata, now time.Time) {
+	track := sc.track(playerName)
+	newKey := trackKey(metadata)
+	if newKey == track.key {
+		return
+	}
+	playing := !track.playingSince.IsZero()
+	*track = scrobbleTrack{
+		key:       newKey,
+		metadata:  *metadata,
+		startedAt: now,
+	}
+	if playing {
+		track.playingSince = now
+	}
+	sc.updateTicker()
+}
+
+func (sc *scrobbler) playbackStatusChanged(playerName string, playbackStatus string, now time.Time) {
+	track := sc.track(playerName)
+	playing := playbackStatus == mp.PlaybackStatusPlaying
+	if playing && track.playingSince.IsZero() {
+		track.playingSince = now
+	} else if !playing && !track.playingSince.IsZero() {
+		track.played = track.playTime(now)
+		track.playingSince = time.Time{}
+	}
+	sc.updateTicker()
+}
+
+func (sc *scrobbler) removed(playerName string) {
+	delete(sc.tracks, playerName)
+	sc.updateTicker()
+}
+
+// Periodic check: scrobbles the tracks which have played long enough.
+func (sc *scrobbler) tick(now time.Time) {
+	for playerName, track := range sc.tracks {
+		if !track.pending() || track.playTime(now) < track.threshold() {
+			continue
+		}
+		track.scrobbled = true
+		sc.logf("Scrobbler: %s on %s", track.metadata.Title, playerName)
+		sc.scrobble(&ext_mp.Scrobble{
+			ListenedAt: track.startedAt.Unix(),
+			Artist:     strings.Join(track.metadata.Artist, ArtistSeparator),
+			Track:      track.metadata.Title,
+			Release:    track.metadata.Album,
+			DurationMs: int64(track.metadata.Length / 1000),
+			PlayerName: playerName,
+			Url:        track.metadata.Url,
+		})
+	}
+	sc.updateTicker()
+}
+
+func (sc *scrobbler) stop() {
+	sc.tracks = make(map[string]*scrobbleTrack)
+	sc.updateTicker()
+}
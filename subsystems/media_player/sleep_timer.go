@@ -0,0 +1,265 @@
+package media_player
+
+/*
+Sleep Timer
+
+This pauses all players after a duration, or at the end of the current track.
+The end of the track is detected either by the track changing, or from the
+track length and the current position (whichever comes first). The latter is
+put on hold while the player isn't playing.
+
+The timer is driven by the subsystem routine (`tick`), and only touches
+players through `sleepTimerPlayers`.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"time"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+const SleepTimerTickInterval = time.Millisecond * 250
+
+// Player operations needed by the sleep timer.
+type sleepTimerPlayers interface {
+	volumePlayers
+	// Names of all the players which are currently playing.
+	playingPlayers() []string
+	// Time left in the current track (false if unknown), and a key which
+	// identifies the current track.
+	trackRemaining(playerName string) (time.Duration, bool, string)
+}
+
+type sleepTimer struct {
+	players sleepTimerPlayers
+	emit    func(*ext_mp.SleepTimerState)
+	logf    func(string, ...interface{})
+	// Timer state
+	active     bool
+	mode       string
+	playerName string
+	trackKey   string
+	// Zero when the deadline is unknown
+	deadline time.Time
+	fade     time.Duration
+	// Volumes before fading started (restored after the pause)
+	fadeVolumes map[string]float64
+	ticker      *time.Ticker
+}
+
+func newSleepTimer(
+	players sleepTimerPlayers,
+	emit func(*ext_mp.SleepTimerState),
+	logf func(string, ...interface{}),
+) *sleepTimer {
+	return &sleepTimer{
+		players: players,
+		emit:    emit,
+		logf:    logf,
+	}
+}
+
+// Ticks while the timer is active, nil otherwise (blocks forever in `select`).
+func (st *sleepTimer) ticks() <-chan time.Time {
+	if st.ticker == nil {
+		return nil
+	}
+	return st.ticker.C
+}
+
+// Starts (or replaces) the timer.
+func (st *sleepTimer) arm(request *ext_mp.SleepTimerRequest, now time.Time) error {
+	if request.FadeSec < 0 {
+		return NewCommandError(ext_mp.ErrCodeDecode, "fade can't be negative (%d)", request.FadeSec)
+	}
+	fade := time.Duration(request.FadeSec) * time.Second
+	var deadline time.Time
+	var playerName, trackKey string
+	switch request.Mode {
+	case ext_mp.SleepModeDuration:
+		if request.DurationSec <= 0 {
+			return NewCommandError(ext_mp.ErrCodeDecode, "duration must be positive (%d)", request.DurationSec)
+		}
+		deadline = now.Add(time.Duration(request.DurationSec) * time.Second)
+	case ext_mp.SleepModeTrackEnd:
+		playerName = request.PlayerName
+		if playerName == "" {
+			playing := st.players.playingPlayers()
+			if len(playing) == 0 {
+				return NewCommandError(ext_mp.ErrCodePlayerNotFound, "no player is playing")
+			}
+			playerName = playing[0]
+		}
+		remaining, remainingKnown, currentTrack := st.players.trackRemaining(playerName)
+		if currentTrack == "" && !remainingKnown {
+			return NewCommandError(ext_mp.ErrCodePlayerNotFound, "player %s has no current track", playerName)
+		}
+		if remainingKnown && st.isPlaying(playerName) {
+			deadline = now.Add(remaining)
+		}
+		trackKey = currentTrack
+	default:
+		return NewCommandError(ext_mp.ErrCodeDecode, "unknown sleep timer mode '%s'", request.Mode)
+	}
+	st.stop()
+	st.active, st.mode, st.playerName, st.trackKey = true, request.Mode, playerName, trackKey
+	st.deadline, st.fade = deadline, fade
+	st.ticker = time.NewTicker(SleepTimerTickInterval)
+	st.logf("SleepTimer: armed (%s, player: '%s')", st.mode, st.playerName)
+	st.emit(st.state(now))
+	return nil
+}
+
+// Cancels the timer (restoring any faded volume). Returns false if the timer
+// wasn't running.
+func (st *sleepTimer) cancel(now time.Time) bool {
+	if !st.active {
+		return false
+	}
+	st.restoreVolumes()
+	st.stop()
+	st.logf("SleepTimer: cancelled")
+	st.emit(st.state(now))
+	return true
+}
+
+func (st *sleepTimer) stop() {
+	if st.ticker != nil {
+		st.ticker.Stop()
+		st.ticker = nil
+	}
+	st.active = false
+	st.deadline = time.Time{}
+	st.fadeVolumes = nil
+}
+
+func (st *sleepTimer) state(now time.Time) *ext_mp.SleepTimerState {
+	if !st.active {
+		return &ext_mp.SleepTimerState{RemainingMs: -1}
+	}
+	remainingMs := int64(-1)
+	if !st.deadline.IsZero() {
+		remainingMs = st.deadline.Sub(now).Milliseconds()
+		if remainingMs < 0 {
+			remainingMs = 0
+		}
+	}
+	return &ext_mp.SleepTimerState{
+		Active:      true,
+		Mode:        st.mode,
+		PlayerName:  st.playerName,
+		RemainingMs: remainingMs,
+		FadeSec:     int64(st.fade / time.Second),
+		Fading:      st.fadeVolumes != nil,
+	}
+}
+
+// Periodic check: fades the volume out near the deadline, and pauses once
+// it's reached.
+func (st *sleepTimer) tick(now time.Time) {
+	if !st.active || st.deadline.IsZero() {
+		return
+	}
+	remaining := st.deadline.Sub(now)
+	if remaining <= 0 {
+		st.fire(now)
+		return
+	}
+	if st.fade <= 0 || remaining > st.fade {
+		return
+	}
+	if st.fadeVolumes == nil {
+		st.fadeVolumes = make(map[string]float64)
+		for _, playerName := range st.players.playingPlayers() {
+			if volume, volumeErr := st.players.playerVolume(playerName); volumeErr == nil {
+				st.fadeVolumes[playerName] = volume
+			}
+		}
+		st.logf("SleepTimer: fading out %d players", len(st.fadeVolumes))
+		st.emit(st.state(now))
+	}
+	scale := float64(remaining) / float64(st.fade)
+	for playerName, volume := range st.fadeVolumes {
+		st.players.setPlayerVolume(playerName, volume*scale)
+	}
+}
+
+// Pauses all the playing players, and stops the timer.
+func (st *sleepTimer) fire(now time.Time) {
+	for _, playerName := range st.players.playingPlayers() {
+		if pauseErr := st.players.pausePlayer(playerName); pauseErr != nil {
+			st.logf("SleepTimer: pause %s: %v", playerName, pauseErr)
+		}
+	}
+	st.restoreVolumes()
+	st.stop()
+	st.logf("SleepTimer: fired")
+	st.emit(st.state(now))
+}
+
+func (st *sleepTimer) restoreVolumes() {
+	for playerName, volume := range st.fadeVolumes {
+		st.players.setPlayerVolume(playerName, volume)
+	}
+	st.fadeVolumes = nil
+}
+
+// Called when a player's metadata changes. In track end mode, a new track on
+// the awaited player means the previous one ended.
+func (st *sleepTimer) trackChanged(playerName string, trackKey string, now time.Time) {
+	if !st.active || st.mode != ext_mp.SleepModeTrackEnd || playerName != st.playerName {
+		return
+	}
+	if trackKey == st.trackKey {
+		return
+	}
+	st.fire(now)
+}
+
+// Called when a player seeks. In track end mode, the deadline moves with the
+// position.
+func (st *sleepTimer) seeked(playerName string, now time.Time) {
+	if !st.active || st.mode != ext_mp.SleepModeTrackEnd || playerName != st.playerName {
+		return
+	}
+	st.resync(st.isPlaying(playerName), now)
+}
+
+// Called when a player's playback status changes. In track end mode, the
+// deadline is put on hold while the awaited player isn't playing, and worked
+// out again from the position once it plays.
+func (st *sleepTimer) playbackStatusChanged(playerName string, playbackStatus string, now time.Time) {
+	if !st.active || st.mode != ext_mp.SleepModeTrackEnd || playerName != st.playerName {
+		return
+	}
+	st.resync(playbackStatus == mp.PlaybackStatusPlaying, now)
+}
+
+// Works out the deadline from the position of the awaited player.
+func (st *sleepTimer) resync(playing bool, now time.Time) {
+	remaining, remainingKnown, _ := st.players.trackRemaining(st.playerName)
+	if !playing {
+		st.deadline = time.Time{}
+	} else if remainingKnown {
+		st.deadline = now.Add(remaining)
+	} else {
+		return
+	}
+	// Pausing, or seeking back out of the fade window, undoes the fade.
+	if st.fadeVolumes != nil && (!playing || remaining > st.fade) {
+		st.restoreVolumes()
+	}
+	st.emit(st.state(now))
+}
+
+func (st *sleepTimer) isPlaying(playerName string) bool {
+	for _, playing := range st.players.playingPlayers() {
+		if playing == playerName {
+			return true
+		}
+	}
+	return false
+}
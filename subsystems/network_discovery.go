@@ -14,22 +14,38 @@ const (
 
 type NetworkDiscovery struct {
 	server *zeroconf.Server
+	secure bool
 }
 
-func NewNetworkDiscovery(port int, secure bool) (*NetworkDiscovery, error) {
+func txtRecords(secure bool, fingerprint string) []string {
+	// If more information needs to be passed, add it here.
+	records := []string{fmt.Sprintf("secure=%t", secure)}
+	if secure && fingerprint != "" {
+		records = append(records, "sha256="+fingerprint)
+	}
+	return records
+}
+
+// Advertises the server. In secure mode, the fingerprint of its certificate
+// (see `transmission.Fingerprint`) is published for clients to pin.
+func NewNetworkDiscovery(port int, secure bool, fingerprint string) (*NetworkDiscovery, error) {
 	zcServer, registerErr := zeroconf.Register(
 		InstanceName,
 		Service,
 		"local.",
 		port,
-		// If more information needs to be passed, add it here.
-		[]string{fmt.Sprintf("secure=%t", secure)},
+		txtRecords(secure, fingerprint),
 		nil,
 	)
 	if registerErr != nil {
 		return nil, registerErr
 	}
-	return &NetworkDiscovery{zcServer}, nil
+	return &NetworkDiscovery{server: zcServer, secure: secure}, nil
+}
+
+// Publishes the fingerprint of a new certificate.
+func (nt *NetworkDiscovery) SetFingerprint(fingerprint string) {
+	nt.server.SetText(txtRecords(nt.secure, fingerprint))
 }
 
 func (nt *NetworkDiscovery) Shutdown() {
@@ -12,9 +12,9 @@ func NewServerSubsystem() *ServerSubsystems {
 	}
 }
 
-func (s *ServerSubsystems) SetupMediaPlayer(mpBiDirChan *comm.BiDirMessageChannel) error {
+func (s *ServerSubsystems) SetupMediaPlayer(mpBiDirChan *comm.BiDirMessageChannel, backendName string) error {
 	if s.mp != nil {
-		newMediaPlayer, mediaPlayerSetupErr := NewMediaPlayerSubsystem(mpBiDirChan)
+		newMediaPlayer, mediaPlayerSetupErr := NewMediaPlayerSubsystem(mpBiDirChan, backendName)
 		if mediaPlayerSetupErr != nil {
 			return mediaPlayerSetupErr
 		}
@@ -0,0 +1,185 @@
+package audio
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Artiqlate/cyprus/comm"
+	"github.com/Artiqlate/cyprus/ext_models"
+	ext_audio "github.com/Artiqlate/cyprus/ext_models/audio"
+	"github.com/Artiqlate/cyprus/subsystems/audio"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/utils"
+)
+
+func expectOk(t *testing.T, client *harness.Client, requestMethod string) {
+	t.Helper()
+	reply, isOk := client.Expect(t, "ok").Args.(*ext_models.CommandOk)
+	if !isOk || reply.Method != requestMethod {
+		t.Errorf("expected ok for %s, got %+v", requestMethod, reply)
+	}
+}
+
+func expectError(t *testing.T, client *harness.Client, requestMethod string, code string) {
+	t.Helper()
+	reply, isErr := client.Expect(t, "err").Args.(*ext_models.CommandError)
+	if !isErr || reply.Method != requestMethod || reply.Code != code {
+		t.Errorf("expected %s error for %s, got %+v", code, requestMethod, reply)
+	}
+}
+
+func expectState(t *testing.T, client *harness.Client) *ext_audio.AudioState {
+	t.Helper()
+	state, isState := client.Expect(t, "state").Args.(*ext_audio.AudioState)
+	if !isState {
+		t.Fatalf("state: unexpected args")
+	}
+	return state
+}
+
+func startAudio(t *testing.T) (*harness.FakePactl, *harness.Client) {
+	t.Helper()
+	pactl := harness.NewFakePactl()
+	_, client := harness.StartAudio(t, pactl)
+	initial := expectState(t, client)
+	if initial.SinkName != pactl.SinkName || initial.Volume != 0.5 || initial.Muted || initial.SourceName != pactl.SourceName {
+		t.Fatalf("initial state: unexpected %+v", initial)
+	}
+	return pactl, client
+}
+
+func TestAudioSetVolumeAndMute(t *testing.T) {
+	pactl, client := startAudio(t)
+
+	client.Send(t, "audio:set_volume", &ext_audio.VolumeRequest{Volume: 0.8})
+	expectOk(t, client, "audio:set_volume")
+	if state := expectState(t, client); state.Volume != 0.8 {
+		t.Errorf("set_volume: unexpected state %+v", state)
+	}
+
+	client.Send(t, "audio:set_mute", &ext_audio.MuteRequest{Muted: true})
+	expectOk(t, client, "audio:set_mute")
+	if state := expectState(t, client); !state.Muted || state.SourceMuted {
+		t.Errorf("set_mute: unexpected state %+v", state)
+	}
+
+	client.Send(t, "audio:set_source_mute", &ext_audio.MuteRequest{Muted: true})
+	expectOk(t, client, "audio:set_source_mute")
+	if state := expectState(t, client); !state.SourceMuted {
+		t.Errorf("set_source_mute: unexpected state %+v", state)
+	}
+
+	client.Send(t, "audio:get", nil)
+	if state := client.Expect(t, "rstate").Args.(*ext_audio.AudioState); state.Volume != 0.8 || !state.Muted {
+		t.Errorf("get: unexpected state %+v", state)
+	}
+
+	expectedCalls := []string{
+		"set-sink-volume @DEFAULT_SINK@ 80%",
+		"set-sink-mute @DEFAULT_SINK@ 1",
+		"set-source-mute @DEFAULT_SOURCE@ 1",
+	}
+	setCalls := []string{}
+	for _, call := range pactl.Calls() {
+		if call[:4] == "set-" {
+			setCalls = append(setCalls, call)
+		}
+	}
+	if fmt.Sprint(setCalls) != fmt.Sprint(expectedCalls) {
+		t.Errorf("unexpected pactl calls %v", setCalls)
+	}
+}
+
+func TestAudioPushesExternalChanges(t *testing.T) {
+	pactl, client := startAudio(t)
+
+	pactl.Change("sink", func(fp *harness.FakePactl) { fp.DefaultSink().VolumePct = []int{20, 40} })
+	if state := expectState(t, client); state.Volume != 0.3 {
+		t.Errorf("change: unexpected state %+v", state)
+	}
+	// Changes which don't affect the state aren't sent.
+	pactl.Change("sink-input", func(fp *harness.FakePactl) {})
+	pactl.Change("sink", func(fp *harness.FakePactl) {})
+	client.ExpectNone(t, "state", time.Second/2)
+
+	// Changes are followed again once the sound server comes back.
+	pactl.EndSubscriptions()
+	deadline := time.Now().Add(harness.DefaultExpectTimeout)
+	for pactl.Subscribers() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+	pactl.Change("source", func(fp *harness.FakePactl) { fp.SourceName = "bluez_input.headset" })
+	if state := expectState(t, client); state.SourceName != "bluez_input.headset" {
+		t.Errorf("resubscribe: unexpected state %+v", state)
+	}
+}
+
+func TestAudioSessions(t *testing.T) {
+	pactl, client := startAudio(t)
+	const secondSession uint64 = 2
+
+	// A session joining later gets the last state sent.
+	client.Attach(t, secondSession)
+	attached := client.ExpectEnvelope(t, "state")
+	if state := attached.Message.Args.(*ext_audio.AudioState); attached.Session != secondSession || state.SinkName != pactl.SinkName {
+		t.Fatalf("attach: unexpected %+v", attached)
+	}
+
+	// Replies go to the session which asked, state changes to every session.
+	client.SendFrom(t, secondSession, "audio:set_mute", &ext_audio.MuteRequest{Muted: true})
+	if reply := client.ExpectEnvelope(t, "ok"); reply.Session != secondSession {
+		t.Errorf("set_mute: replied to session %d", reply.Session)
+	}
+	if event := client.ExpectEnvelope(t, "state"); event.Session != comm.BroadcastSession {
+		t.Errorf("state: sent to session %d", event.Session)
+	}
+}
+
+func TestAudioErrors(t *testing.T) {
+	pactl, client := startAudio(t)
+
+	client.Send(t, "audio:set_volume", &ext_audio.VolumeRequest{Volume: 2})
+	expectError(t, client, "audio:set_volume", ext_audio.ErrCodeInvalidValue)
+	client.Send(t, "audio:set_mute", "not a request")
+	expectError(t, client, "audio:set_mute", ext_models.ErrCodeDecode)
+	client.Send(t, "audio:nonexistent", nil)
+	expectError(t, client, "audio:nonexistent", ext_models.ErrCodeUnknownMethod)
+
+	pactl.Fail("set-sink-mute", fmt.Errorf("connection refused"))
+	client.Send(t, "audio:set_mute", &ext_audio.MuteRequest{Muted: true})
+	expectError(t, client, "audio:set_mute", ext_audio.ErrCodeAudioError)
+}
+
+func TestAudioStartFailsWithoutTooling(t *testing.T) {
+	pactl := harness.NewFakePactl()
+	pactl.Fail("get-default-sink", fmt.Errorf("pactl: not found"))
+	subsystem := audio.NewSubsystem(comm.NewBiDirMessageChannel(), pactl)
+	if startErr := subsystem.Start(context.Background()); startErr == nil {
+		t.Fatalf("start: expected an error")
+	}
+	if subsystem.State() != utils.StateStopped {
+		t.Errorf("start: subsystem is %s", subsystem.State())
+	}
+}
+
+// A `get` handled before the change notification doesn't keep the change
+// from the other sessions.
+func TestAudioGetBeforeChangeNotification(t *testing.T) {
+	pactl, client := startAudio(t)
+	const secondSession uint64 = 2
+	client.Attach(t, secondSession)
+	client.ExpectEnvelope(t, "state")
+
+	pactl.ChangeUnreported(func(fp *harness.FakePactl) { fp.DefaultSink().VolumePct = []int{80, 80} })
+	client.SendFrom(t, secondSession, "audio:get", nil)
+	if reply := client.ExpectEnvelope(t, "rstate"); reply.Message.Args.(*ext_audio.AudioState).Volume != 0.8 {
+		t.Errorf("get: unexpected state %+v", reply.Message.Args)
+	}
+	pactl.Report("change", "sink")
+	event := client.ExpectEnvelope(t, "state")
+	if state := event.Message.Args.(*ext_audio.AudioState); event.Session != comm.BroadcastSession || state.Volume != 0.8 {
+		t.Errorf("state: unexpected %+v (to session %d)", state, event.Session)
+	}
+}
@@ -0,0 +1,99 @@
+package audio
+
+import (
+	"testing"
+
+	"github.com/Artiqlate/cyprus/comm"
+	ext_audio "github.com/Artiqlate/cyprus/ext_models/audio"
+	"github.com/Artiqlate/cyprus/tests/harness"
+)
+
+var headphones = &harness.FakeSink{
+	Name:        "bluez_output.headphones.1",
+	Description: "Headphones",
+	ActivePort:  "headphone-output",
+	VolumePct:   []int{30, 30},
+}
+
+func TestListAndSwitchSinks(t *testing.T) {
+	pactl, client := startAudio(t)
+	pactl.AddSink(headphones)
+	client.Expect(t, "sink_added")
+	pactl.SinkInputs[7] = pactl.SinkName
+
+	client.Send(t, "audio:list_sinks", nil)
+	sinkList := client.Expect(t, "rsinks").Args.(*ext_audio.SinkList)
+	if len(sinkList.Sinks) != 2 {
+		t.Fatalf("list_sinks: unexpected %+v", sinkList.Sinks)
+	}
+	speakers, listedHeadphones := sinkList.Sinks[0], sinkList.Sinks[1]
+	if !speakers.Default || speakers.ActivePort != "analog-output-speaker" || speakers.Volume != 0.5 {
+		t.Errorf("list_sinks: unexpected speakers %+v", speakers)
+	}
+	if listedHeadphones.Default || listedHeadphones.Name != headphones.Name ||
+		listedHeadphones.Description != "Headphones" || listedHeadphones.Volume != 0.3 {
+		t.Errorf("list_sinks: unexpected headphones %+v", listedHeadphones)
+	}
+
+	// Playing streams move along with the default sink.
+	client.Send(t, "audio:set_default_sink", &ext_audio.SinkSelection{Name: headphones.Name})
+	expectOk(t, client, "audio:set_default_sink")
+	if state := expectState(t, client); state.SinkName != headphones.Name || state.Volume != 0.3 {
+		t.Errorf("set_default_sink: unexpected state %+v", state)
+	}
+	if sinkName := pactl.SinkInput(7); sinkName != headphones.Name {
+		t.Errorf("set_default_sink: stream still on %s", sinkName)
+	}
+
+	client.Send(t, "audio:set_default_sink", &ext_audio.SinkSelection{Name: "missing"})
+	expectError(t, client, "audio:set_default_sink", ext_audio.ErrCodeSinkNotFound)
+}
+
+func TestSinkPlugEvents(t *testing.T) {
+	pactl, client := startAudio(t)
+
+	pactl.AddSink(headphones)
+	added := client.Expect(t, "sink_added").Args.(*ext_audio.Sink)
+	if added.Name != headphones.Name || added.ActivePort != "headphone-output" {
+		t.Errorf("sink_added: unexpected %+v", added)
+	}
+
+	pactl.Change("sink", func(fp *harness.FakePactl) { fp.Sinks[0].ActivePort = "analog-output-headphones" })
+	changed := client.Expect(t, "sink_changed").Args.(*ext_audio.Sink)
+	if changed.Name != pactl.Sinks[0].Name || changed.ActivePort != "analog-output-headphones" {
+		t.Errorf("sink_changed: unexpected %+v", changed)
+	}
+
+	// Unplugging the default sink also changes the default.
+	client.Send(t, "audio:set_default_sink", &ext_audio.SinkSelection{Name: headphones.Name})
+	expectOk(t, client, "audio:set_default_sink")
+	expectState(t, client)
+	pactl.RemoveSink(headphones.Name)
+	removed := client.Expect(t, "sink_removed").Args.(*ext_audio.Sink)
+	if removed.Name != headphones.Name {
+		t.Errorf("sink_removed: unexpected %+v", removed)
+	}
+	if state := expectState(t, client); state.SinkName != "alsa_output.fake.analog-stereo" {
+		t.Errorf("sink_removed: unexpected state %+v", state)
+	}
+}
+
+// A `list_sinks` handled before the plug notification doesn't keep the plug
+// events from the other sessions.
+func TestListSinksBeforePlugNotification(t *testing.T) {
+	pactl, client := startAudio(t)
+	const secondSession uint64 = 2
+	client.Attach(t, secondSession)
+	client.ExpectEnvelope(t, "state")
+
+	pactl.ChangeUnreported(func(fp *harness.FakePactl) { fp.Sinks = append(fp.Sinks, headphones) })
+	client.SendFrom(t, secondSession, "audio:list_sinks", nil)
+	if reply := client.ExpectEnvelope(t, "rsinks"); len(reply.Message.Args.(*ext_audio.SinkList).Sinks) != 2 {
+		t.Errorf("list_sinks: unexpected %+v", reply.Message.Args)
+	}
+	pactl.Report("new", "sink")
+	event := client.ExpectEnvelope(t, "sink_added")
+	if added := event.Message.Args.(*ext_audio.Sink); event.Session != comm.BroadcastSession || added.Name != headphones.Name {
+		t.Errorf("sink_added: unexpected %+v (to session %d)", added, event.Session)
+	}
+}
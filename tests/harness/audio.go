@@ -0,0 +1,286 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Artiqlate/cyprus/comm"
+	"github.com/Artiqlate/cyprus/subsystems/audio"
+)
+
+type FakeSink struct {
+	Name        string
+	Description string
+	ActivePort  string
+	VolumePct   []int
+}
+
+// Fake `pactl`, with a default sink (out of `Sinks`) and a single source.
+type FakePactl struct {
+	mutex       sync.Mutex
+	Sinks       []*FakeSink
+	SinkName    string
+	Muted       bool
+	SourceName  string
+	SourceMuted bool
+	// Sink of each stream, by stream index
+	SinkInputs  map[int]string
+	calls       []string
+	failures    map[string]error
+	subscribers []chan string
+}
+
+func NewFakePactl() *FakePactl {
+	return &FakePactl{
+		Sinks: []*FakeSink{{
+			Name:        "alsa_output.fake.analog-stereo",
+			Description: "Built-in Audio Analog Stereo",
+			ActivePort:  "analog-output-speaker",
+			VolumePct:   []int{50, 50},
+		}},
+		SinkName:   "alsa_output.fake.analog-stereo",
+		SourceName: "alsa_input.fake.analog-stereo",
+		SinkInputs: make(map[int]string),
+		failures:   make(map[string]error),
+	}
+}
+
+// Called with the mutex held.
+func (fp *FakePactl) sink(sinkName string) (int, *FakeSink) {
+	for sinkIdx, sink := range fp.Sinks {
+		if sink.Name == sinkName {
+			return sinkIdx, sink
+		}
+	}
+	return -1, nil
+}
+
+// The default sink. Only change it through `Change`.
+func (fp *FakePactl) DefaultSink() *FakeSink {
+	_, sink := fp.sink(fp.SinkName)
+	return sink
+}
+
+// Reports a change like the sound server does. Called without the mutex.
+func (fp *FakePactl) emit(kind string, facility string, index int) {
+	fp.mutex.Lock()
+	subscribers := append([]chan string{}, fp.subscribers...)
+	fp.mutex.Unlock()
+	for _, subscriber := range subscribers {
+		subscriber <- fmt.Sprintf("Event '%s' on %s #%d", kind, facility, index)
+	}
+}
+
+// Changes the state from outside the server (ex: a volume key), and reports
+// it like the sound server does.
+func (fp *FakePactl) Change(facility string, change func(*FakePactl)) {
+	fp.mutex.Lock()
+	change(fp)
+	fp.mutex.Unlock()
+	fp.emit("change", facility, 1)
+}
+
+// Changes the state without reporting it yet (see `Report`), as when a
+// request comes in before the change notification.
+func (fp *FakePactl) ChangeUnreported(change func(*FakePactl)) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	change(fp)
+}
+
+// Reports a change made through `ChangeUnreported` (kind is "new", "change"
+// or "remove").
+func (fp *FakePactl) Report(kind string, facility string) {
+	fp.emit(kind, facility, 1)
+}
+
+// Plugs a sink in.
+func (fp *FakePactl) AddSink(sink *FakeSink) {
+	fp.mutex.Lock()
+	fp.Sinks = append(fp.Sinks, sink)
+	sinkIdx := len(fp.Sinks) - 1
+	fp.mutex.Unlock()
+	fp.emit("new", "sink", sinkIdx)
+}
+
+// Unplugs a sink. The first remaining sink becomes the default if it was.
+func (fp *FakePactl) RemoveSink(sinkName string) {
+	fp.mutex.Lock()
+	sinkIdx, _ := fp.sink(sinkName)
+	fp.Sinks = append(fp.Sinks[:sinkIdx], fp.Sinks[sinkIdx+1:]...)
+	defaultChanged := fp.SinkName == sinkName
+	if defaultChanged {
+		fp.SinkName = fp.Sinks[0].Name
+	}
+	fp.mutex.Unlock()
+	fp.emit("remove", "sink", sinkIdx)
+	if defaultChanged {
+		fp.emit("change", "server", -1)
+	}
+}
+
+// Sink of a stream.
+func (fp *FakePactl) SinkInput(inputIdx int) string {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	return fp.SinkInputs[inputIdx]
+}
+
+// Makes the given `pactl` subcommand (ex: "set-sink-volume") fail.
+func (fp *FakePactl) Fail(subcommand string, err error) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	fp.failures[subcommand] = err
+}
+
+// Subcommands run so far, with their arguments.
+func (fp *FakePactl) Calls() []string {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	return append([]string{}, fp.calls...)
+}
+
+// Ends `pactl subscribe` (ex: the sound server restarted).
+func (fp *FakePactl) EndSubscriptions() {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	for _, subscriber := range fp.subscribers {
+		close(subscriber)
+	}
+	fp.subscribers = nil
+}
+
+func (fp *FakePactl) Subscribers() int {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	return len(fp.subscribers)
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+func (fp *FakePactl) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	if name != audio.PactlCommand || len(args) == 0 {
+		return nil, fmt.Errorf("unexpected command %s %v", name, args)
+	}
+	fp.calls = append(fp.calls, strings.Join(args, " "))
+	if failure := fp.failures[args[0]]; failure != nil {
+		return nil, failure
+	}
+	switch args[0] {
+	case "get-default-sink":
+		return []byte(fp.SinkName + "\n"), nil
+	case "get-default-source":
+		return []byte(fp.SourceName + "\n"), nil
+	case "get-sink-volume":
+		return []byte(fakeVolume(fp.DefaultSink().VolumePct) + "\n        balance 0.00\n"), nil
+	case "get-sink-mute":
+		return []byte("Mute: " + yesNo(fp.Muted) + "\n"), nil
+	case "get-source-mute":
+		return []byte("Mute: " + yesNo(fp.SourceMuted) + "\n"), nil
+	case "set-sink-volume":
+		var percent int
+		fmt.Sscanf(args[2], "%d%%", &percent)
+		defaultSink := fp.DefaultSink()
+		for channelIdx := range defaultSink.VolumePct {
+			defaultSink.VolumePct[channelIdx] = percent
+		}
+	case "set-sink-mute":
+		fp.Muted = args[2] == "1"
+	case "set-source-mute":
+		fp.SourceMuted = args[2] == "1"
+	case "list":
+		if args[1] == "short" {
+			inputs := []string{}
+			for inputIdx, sinkName := range fp.SinkInputs {
+				sinkIdx, _ := fp.sink(sinkName)
+				inputs = append(inputs, fmt.Sprintf("%d\t%d\t3\tPipeWire\ts16le 2ch 44100Hz", inputIdx, sinkIdx))
+			}
+			return []byte(strings.Join(inputs, "\n")), nil
+		}
+		sinks := []string{}
+		for sinkIdx, sink := range fp.Sinks {
+			sinks = append(sinks, strings.Join([]string{
+				fmt.Sprintf("Sink #%d", sinkIdx),
+				"\tState: RUNNING",
+				"\tName: " + sink.Name,
+				"\tDescription: " + sink.Description,
+				"\tMute: no",
+				"\t" + fakeVolume(sink.VolumePct),
+				"\t        balance 0.00",
+				"\tBase Volume: 65536 / 100% / 0.00 dB",
+				"\tPorts:",
+				"\t\t" + sink.ActivePort + ": Port (type: Speaker, priority: 10000, availability unknown)",
+				"\tActive Port: " + sink.ActivePort,
+			}, "\n"))
+		}
+		return []byte(strings.Join(sinks, "\n\n") + "\n"), nil
+	case "set-default-sink":
+		if _, sink := fp.sink(args[1]); sink == nil {
+			return nil, fmt.Errorf("no such sink")
+		}
+		fp.SinkName = args[1]
+	case "move-sink-input":
+		var inputIdx int
+		fmt.Sscanf(args[1], "%d", &inputIdx)
+		fp.SinkInputs[inputIdx] = args[2]
+	default:
+		return nil, fmt.Errorf("unexpected subcommand %v", args)
+	}
+	return []byte{}, nil
+}
+
+func fakeVolume(volumePct []int) string {
+	channels := []string{}
+	for _, percent := range volumePct {
+		channels = append(channels, fmt.Sprintf("front: %d / %3d%% / 0.00 dB", percent*65536/100, percent))
+	}
+	return "Volume: " + strings.Join(channels, ",   ")
+}
+
+func (fp *FakePactl) Lines(ctx context.Context, name string, args ...string) (<-chan string, error) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+	if failure := fp.failures["subscribe"]; failure != nil {
+		return nil, failure
+	}
+	// Buffered, so changes never wait on the subsystem.
+	lines := make(chan string, 16)
+	fp.subscribers = append(fp.subscribers, lines)
+	return lines, nil
+}
+
+// Sets up and runs the audio subsystem with the given runner, and shuts it
+// down when the test finishes.
+func StartAudio(t *testing.T, runner audio.CommandRunner) (*audio.Subsystem, *Client) {
+	t.Helper()
+	channel := comm.NewBiDirMessageChannel()
+	client := NewClient(t, channel)
+	return RunAudio(t, channel, runner), client
+}
+
+// Same as `StartAudio`, on the given channel (ex: a transmission server's).
+func RunAudio(t *testing.T, channel *comm.BiDirMessageChannel, runner audio.CommandRunner) *audio.Subsystem {
+	t.Helper()
+	subsystem := audio.NewSubsystem(channel, runner)
+	if startErr := subsystem.Start(context.Background()); startErr != nil {
+		t.Fatalf("Audio: start: %v", startErr)
+	}
+	t.Cleanup(func() {
+		stopContext, cancel := context.WithTimeout(context.Background(), DefaultExpectTimeout)
+		defer cancel()
+		if stopErr := subsystem.Stop(stopContext); stopErr != nil {
+			t.Errorf("Audio: %v", stopErr)
+		}
+	})
+	return subsystem
+}
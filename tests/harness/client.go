@@ -0,0 +1,212 @@
+package harness
+
+/*
+Subsystem Client
+
+This acts as the client side of a subsystem's `BiDirMessageChannel`: it
+encodes requests the same way the transmission server forwards them (from
+session `ClientSession`), and records every outbound message for assertions.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Artiqlate/cyprus/comm"
+	"github.com/Artiqlate/cyprus/ext_models"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	DefaultExpectTimeout = time.Second * 5
+	outboxSize           = 256
+	// Session requests are sent from (by default)
+	ClientSession uint64 = 1
+)
+
+type Client struct {
+	Channel *comm.BiDirMessageChannel
+	outbox  chan comm.Envelope
+	stop    chan bool
+}
+
+// Creates a client for the given channel, and starts recording outbound
+// messages straight away (subsystems block on unbuffered sends otherwise).
+func NewClient(t *testing.T, channel *comm.BiDirMessageChannel) *Client {
+	client := &Client{
+		Channel: channel,
+		outbox:  make(chan comm.Envelope, outboxSize),
+		stop:    make(chan bool),
+	}
+	go client.record()
+	t.Cleanup(func() { close(client.stop) })
+	return client
+}
+
+func (c *Client) record() {
+	for {
+		select {
+		case message := <-c.Channel.OutChannel:
+			select {
+			case c.outbox <- message:
+			case <-c.stop:
+				return
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Sends a `[method, args]` request, exactly like the transmission server does.
+func (c *Client) Send(t *testing.T, method string, args interface{}) {
+	t.Helper()
+	c.SendFrom(t, ClientSession, method, args)
+}
+
+// Sends a request from the given session.
+func (c *Client) SendFrom(t *testing.T, session uint64, method string, args interface{}) {
+	t.Helper()
+	encoded, encodeErr := msgpack.Marshal(&models.Message{Method: method, Args: args})
+	if encodeErr != nil {
+		t.Fatalf("Client: encode %s: %v", method, encodeErr)
+	}
+	c.sendRequest(t, method, comm.Request{Session: session, Data: encoded})
+}
+
+// Sends a `[method, args, id]` request, with the ID the transmission server
+// decodes from it.
+func (c *Client) SendWithId(t *testing.T, method string, args interface{}, id interface{}) {
+	t.Helper()
+	encoded, encodeErr := msgpack.Marshal([]interface{}{method, args, id})
+	if encodeErr != nil {
+		t.Fatalf("Client: encode %s: %v", method, encodeErr)
+	}
+	encodedId, encodeErr := msgpack.Marshal(id)
+	if encodeErr != nil {
+		t.Fatalf("Client: encode %s ID: %v", method, encodeErr)
+	}
+	c.sendRequest(t, method, comm.Request{Session: ClientSession, Id: encodedId, Data: encoded})
+}
+
+func (c *Client) sendRequest(t *testing.T, method string, request comm.Request) {
+	t.Helper()
+	select {
+	case c.Channel.InChannel <- request:
+	case <-time.After(DefaultExpectTimeout):
+		t.Fatalf("Client: timed out sending %s", method)
+	}
+}
+
+// Tells the subsystem a session joined, like the server does when a session
+// enables a running module.
+func (c *Client) Attach(t *testing.T, session uint64) {
+	t.Helper()
+	select {
+	case c.Channel.AttachChannel <- session:
+	case <-time.After(DefaultExpectTimeout):
+		t.Fatalf("Client: timed out attaching session %d", session)
+	}
+}
+
+// Waits for the next message whose method ends with the given suffix
+// (ex: "psu" matches "mp:linux:psu"), skipping any other messages.
+func (c *Client) Expect(t *testing.T, methodSuffix string) models.Message {
+	t.Helper()
+	return c.ExpectWithin(t, methodSuffix, DefaultExpectTimeout)
+}
+
+func (c *Client) ExpectWithin(t *testing.T, methodSuffix string, timeout time.Duration) models.Message {
+	t.Helper()
+	return c.expectEnvelope(t, methodSuffix, timeout).Message
+}
+
+// Same as `Expect`, along with the session the message was sent to.
+func (c *Client) ExpectEnvelope(t *testing.T, methodSuffix string) comm.Envelope {
+	t.Helper()
+	return c.expectEnvelope(t, methodSuffix, DefaultExpectTimeout)
+}
+
+func (c *Client) expectEnvelope(t *testing.T, methodSuffix string, timeout time.Duration) comm.Envelope {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case envelope := <-c.outbox:
+			if matchesMethod(envelope.Message.Method, methodSuffix) {
+				return envelope
+			}
+			t.Logf("Client: skipping %s", envelope.Message.Method)
+		case <-deadline:
+			t.Fatalf("Client: timed out waiting for %s", methodSuffix)
+			return comm.Envelope{}
+		}
+	}
+}
+
+// Waits for the next message whose method ends with any of the given
+// suffixes, skipping any other messages.
+func (c *Client) ExpectAny(t *testing.T, methodSuffixes ...string) models.Message {
+	t.Helper()
+	deadline := time.After(DefaultExpectTimeout)
+	for {
+		select {
+		case envelope := <-c.outbox:
+			for _, methodSuffix := range methodSuffixes {
+				if matchesMethod(envelope.Message.Method, methodSuffix) {
+					return envelope.Message
+				}
+			}
+			t.Logf("Client: skipping %s", envelope.Message.Method)
+		case <-deadline:
+			t.Fatalf("Client: timed out waiting for any of %v", methodSuffixes)
+			return models.Message{}
+		}
+	}
+}
+
+// Waits for the next sequenced event with the given method suffix, as a
+// session with the `sequenced` capability would get it.
+func (c *Client) ExpectEvent(t *testing.T, methodSuffix string) *ext_models.SequencedEvent {
+	t.Helper()
+	envelope := c.ExpectEnvelope(t, methodSuffix)
+	if envelope.Seq == 0 {
+		t.Fatalf("Client: %s is not a sequenced event", envelope.Message.Method)
+	}
+	return &ext_models.SequencedEvent{Seq: envelope.Seq, Data: envelope.Message.Args}
+}
+
+// Asserts that no message with the given method suffix arrives within timeout.
+func (c *Client) ExpectNone(t *testing.T, methodSuffix string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case envelope := <-c.outbox:
+			if matchesMethod(envelope.Message.Method, methodSuffix) {
+				t.Fatalf("Client: unexpected %s: %+v", envelope.Message.Method, envelope.Message.Args)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// Discards every message received so far.
+func (c *Client) Drain() {
+	for {
+		select {
+		case <-c.outbox:
+		default:
+			return
+		}
+	}
+}
+
+func matchesMethod(method string, suffix string) bool {
+	return method == suffix || strings.HasSuffix(method, ":"+suffix)
+}
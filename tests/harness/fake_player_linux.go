@@ -0,0 +1,291 @@
+//go:build linux
+// +build linux
+
+package harness
+
+/*
+Fake MPRIS Player (Linux)
+
+This is a minimal MPRIS player, exported on its own bus connection, whose
+properties and signals are fully controlled by the test.
+
+REFERENCE: https://specifications.freedesktop.org/mpris-spec/latest/
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/Artiqlate/ganymede/models/mp"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const (
+	MPRISPath            = dbus.ObjectPath("/org/mpris/MediaPlayer2")
+	MPRISRootInterface   = "org.mpris.MediaPlayer2"
+	MPRISPlayerInterface = "org.mpris.MediaPlayer2.Player"
+	MPRISNamePrefix      = "org.mpris.MediaPlayer2."
+)
+
+type FakePlayer struct {
+	// Full bus name (org.mpris.MediaPlayer2.<suffix>)
+	Name  string
+	conn  *dbus.Conn
+	props *prop.Properties
+	// Calls received from the subsystem (method names, in order)
+	callsMu sync.Mutex
+	calls   []string
+	// Errors to return for a given method name (to simulate unsupported calls)
+	failures map[string]*dbus.Error
+}
+
+// Exported on "org.mpris.MediaPlayer2"
+type fakeRoot struct{ fp *FakePlayer }
+
+// Exported on "org.mpris.MediaPlayer2.Player"
+type fakePlayerIface struct{ fp *FakePlayer }
+
+// Go method names which differ from their D-Bus names.
+var playerMethodMapping = map[string]string{
+	"SeekBy": "Seek",
+}
+
+// Creates a fake player named `org.mpris.MediaPlayer2.<suffix>` on the given
+// session bus. The player is removed from the bus when the test finishes.
+func NewFakePlayer(t *testing.T, sb *SessionBus, suffix string) *FakePlayer {
+	t.Helper()
+	conn, connErr := dbus.Connect(sb.Address)
+	if connErr != nil {
+		t.Fatalf("FakePlayer: connect: %v", connErr)
+	}
+	fp := &FakePlayer{
+		Name:     MPRISNamePrefix + suffix,
+		conn:     conn,
+		failures: make(map[string]*dbus.Error),
+	}
+	if exportErr := conn.Export(&fakeRoot{fp}, MPRISPath, MPRISRootInterface); exportErr != nil {
+		t.Fatalf("FakePlayer: export root: %v", exportErr)
+	}
+	if exportErr := conn.ExportWithMap(&fakePlayerIface{fp}, playerMethodMapping, MPRISPath, MPRISPlayerInterface); exportErr != nil {
+		t.Fatalf("FakePlayer: export player: %v", exportErr)
+	}
+	props, propsErr := prop.Export(conn, MPRISPath, prop.Map{
+		MPRISRootInterface: {
+			"Identity":     {Value: suffix, Emit: prop.EmitConst},
+			"CanQuit":      {Value: true, Emit: prop.EmitConst},
+			"CanRaise":     {Value: false, Emit: prop.EmitConst},
+			"HasTrackList": {Value: false, Emit: prop.EmitConst},
+		},
+		MPRISPlayerInterface: {
+			"PlaybackStatus": {Value: mp.PlaybackStatusPaused, Emit: prop.EmitTrue},
+			"LoopStatus":     {Value: mp.LoopStatusNone, Writable: true, Emit: prop.EmitTrue},
+			"Rate":           {Value: 1.0, Writable: true, Emit: prop.EmitTrue},
+			"Shuffle":        {Value: false, Writable: true, Emit: prop.EmitTrue},
+			"Metadata":       {Value: map[string]dbus.Variant{}, Emit: prop.EmitTrue},
+			"Volume":         {Value: 1.0, Writable: true, Emit: prop.EmitTrue},
+			"Position":       {Value: int64(0), Emit: prop.EmitFalse},
+			"MinimumRate":    {Value: 1.0, Emit: prop.EmitConst},
+			"MaximumRate":    {Value: 1.0, Emit: prop.EmitConst},
+			"CanGoNext":      {Value: true, Emit: prop.EmitTrue},
+			"CanGoPrevious":  {Value: true, Emit: prop.EmitTrue},
+			"CanPlay":        {Value: true, Emit: prop.EmitTrue},
+			"CanPause":       {Value: true, Emit: prop.EmitTrue},
+			"CanSeek":        {Value: true, Emit: prop.EmitTrue},
+			"CanControl":     {Value: true, Emit: prop.EmitConst},
+		},
+	})
+	if propsErr != nil {
+		t.Fatalf("FakePlayer: export properties: %v", propsErr)
+	}
+	fp.props = props
+	t.Cleanup(func() { fp.conn.Close() })
+	return fp
+}
+
+// Requests the player's bus name, making it visible to MPRIS clients.
+func (fp *FakePlayer) Register(t *testing.T) {
+	t.Helper()
+	reply, requestErr := fp.conn.RequestName(fp.Name, dbus.NameFlagDoNotQueue)
+	if requestErr != nil {
+		t.Fatalf("FakePlayer: request name %s: %v", fp.Name, requestErr)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("FakePlayer: name %s already taken", fp.Name)
+	}
+}
+
+// Drops the player's bus connection (the player "exits").
+func (fp *FakePlayer) Close() {
+	fp.conn.Close()
+}
+
+// -- CONTROLLABLE PROPERTIES --
+
+func (fp *FakePlayer) SetPlaybackStatus(status string) {
+	fp.props.SetMust(MPRISPlayerInterface, "PlaybackStatus", status)
+}
+
+func (fp *FakePlayer) PlaybackStatus() string {
+	return fp.props.GetMust(MPRISPlayerInterface, "PlaybackStatus").(string)
+}
+
+func (fp *FakePlayer) SetMetadata(metadata map[string]dbus.Variant) {
+	fp.props.SetMust(MPRISPlayerInterface, "Metadata", metadata)
+}
+
+func (fp *FakePlayer) SetVolume(volume float64) {
+	fp.props.SetMust(MPRISPlayerInterface, "Volume", volume)
+}
+
+func (fp *FakePlayer) Volume() float64 {
+	return fp.props.GetMust(MPRISPlayerInterface, "Volume").(float64)
+}
+
+// Sets the position (in microseconds). Position changes never emit
+// `PropertiesChanged`, as per the MPRIS specification.
+func (fp *FakePlayer) SetPosition(positionUs int64) {
+	fp.props.SetMust(MPRISPlayerInterface, "Position", positionUs)
+}
+
+func (fp *FakePlayer) Position() int64 {
+	return fp.props.GetMust(MPRISPlayerInterface, "Position").(int64)
+}
+
+func (fp *FakePlayer) SetCapability(capability string, enabled bool) {
+	fp.props.SetMust(MPRISPlayerInterface, capability, enabled)
+}
+
+// Makes the given player method (ex: "Next") fail with the given D-Bus error.
+func (fp *FakePlayer) Fail(method string, err *dbus.Error) {
+	fp.callsMu.Lock()
+	defer fp.callsMu.Unlock()
+	fp.failures[method] = err
+}
+
+// -- SIGNALS --
+
+// Emits `org.mpris.MediaPlayer2.Player.Seeked` with the given position (μs).
+func (fp *FakePlayer) EmitSeeked(positionUs int64) error {
+	fp.SetPosition(positionUs)
+	return fp.conn.Emit(MPRISPath, MPRISPlayerInterface+".Seeked", positionUs)
+}
+
+// -- CALL RECORDING --
+
+func (fp *FakePlayer) record(method string) *dbus.Error {
+	fp.callsMu.Lock()
+	defer fp.callsMu.Unlock()
+	fp.calls = append(fp.calls, method)
+	return fp.failures[method]
+}
+
+// Returns a copy of all the method calls received so far.
+func (fp *FakePlayer) Calls() []string {
+	fp.callsMu.Lock()
+	defer fp.callsMu.Unlock()
+	calls := make([]string, len(fp.calls))
+	copy(calls, fp.calls)
+	return calls
+}
+
+// Returns the number of times the given method was called.
+func (fp *FakePlayer) CallCount(method string) int {
+	count := 0
+	for _, call := range fp.Calls() {
+		if call == method {
+			count++
+		}
+	}
+	return count
+}
+
+func (fp *FakePlayer) String() string {
+	return fmt.Sprintf("FakePlayer<%s>", fp.Name)
+}
+
+func asDBusError(err error) *dbus.Error {
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// -- ROOT INTERFACE METHODS --
+
+func (r *fakeRoot) Raise() *dbus.Error {
+	return r.fp.record("Raise")
+}
+
+// Quit is only recorded, the fake player never exits on its own.
+func (r *fakeRoot) Quit() *dbus.Error {
+	return r.fp.record("Quit")
+}
+
+// -- PLAYER INTERFACE METHODS --
+
+func (p *fakePlayerIface) Play() *dbus.Error {
+	if err := p.fp.record("Play"); err != nil {
+		return err
+	}
+	p.fp.SetPlaybackStatus(mp.PlaybackStatusPlaying)
+	return nil
+}
+
+func (p *fakePlayerIface) Pause() *dbus.Error {
+	if err := p.fp.record("Pause"); err != nil {
+		return err
+	}
+	p.fp.SetPlaybackStatus(mp.PlaybackStatusPaused)
+	return nil
+}
+
+func (p *fakePlayerIface) PlayPause() *dbus.Error {
+	if err := p.fp.record("PlayPause"); err != nil {
+		return err
+	}
+	if p.fp.PlaybackStatus() == mp.PlaybackStatusPlaying {
+		p.fp.SetPlaybackStatus(mp.PlaybackStatusPaused)
+	} else {
+		p.fp.SetPlaybackStatus(mp.PlaybackStatusPlaying)
+	}
+	return nil
+}
+
+func (p *fakePlayerIface) Stop() *dbus.Error {
+	if err := p.fp.record("Stop"); err != nil {
+		return err
+	}
+	p.fp.SetPlaybackStatus(mp.PlaybackStatusStopped)
+	return nil
+}
+
+func (p *fakePlayerIface) Next() *dbus.Error {
+	return p.fp.record("Next")
+}
+
+func (p *fakePlayerIface) Previous() *dbus.Error {
+	return p.fp.record("Previous")
+}
+
+// Exported as "Seek" (see `playerMethodMapping`).
+func (p *fakePlayerIface) SeekBy(offsetUs int64) *dbus.Error {
+	if err := p.fp.record("Seek"); err != nil {
+		return err
+	}
+	return asDBusError(p.fp.EmitSeeked(p.fp.Position() + offsetUs))
+}
+
+func (p *fakePlayerIface) SetPosition(trackId dbus.ObjectPath, positionUs int64) *dbus.Error {
+	if err := p.fp.record("SetPosition"); err != nil {
+		return err
+	}
+	return asDBusError(p.fp.EmitSeeked(positionUs))
+}
+
+func (p *fakePlayerIface) OpenUri(uri string) *dbus.Error {
+	return p.fp.record("OpenUri")
+}
@@ -0,0 +1,38 @@
+package harness
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Artiqlate/cyprus/comm"
+	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
+)
+
+// Sets up and runs the media player subsystem with the given backend, and
+// shuts it down when the test finishes. Data (ex: scrobbles) is kept in a
+// temporary directory.
+func StartMediaPlayerWith(t *testing.T, backend media_player.Backend) (*media_player.Subsystem, *Client) {
+	t.Helper()
+	channel := comm.NewBiDirMessageChannel()
+	client := NewClient(t, channel)
+	return RunMediaPlayer(t, channel, backend), client
+}
+
+// Same as `StartMediaPlayerWith`, on the given channel (ex: a transmission
+// server's).
+func RunMediaPlayer(t *testing.T, channel *comm.BiDirMessageChannel, backend media_player.Backend) *media_player.Subsystem {
+	t.Helper()
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	subsystem := media_player.NewSubsystem(channel, backend)
+	if startErr := subsystem.Start(context.Background()); startErr != nil {
+		t.Fatalf("MediaPlayer: start: %v", startErr)
+	}
+	t.Cleanup(func() {
+		stopContext, cancel := context.WithTimeout(context.Background(), DefaultExpectTimeout)
+		defer cancel()
+		if stopErr := subsystem.Stop(stopContext); stopErr != nil {
+			t.Errorf("MediaPlayer: %v", stopErr)
+		}
+	})
+	return subsystem
+}
@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package harness
+
+import (
+	"os"
+	"testing"
+
+	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
+)
+
+// Sets up and runs the media player subsystem with the MPRIS backend against
+// the given session bus, and shuts it down when the test finishes.
+//
+// Players registered before this call are picked up during setup, players
+// registered after it are picked up through `NameOwnerChanged`.
+func StartMediaPlayer(t *testing.T, sb *SessionBus) (*media_player.Subsystem, *Client) {
+	t.Helper()
+	// The backend connects through `DBUS_SESSION_BUS_ADDRESS`, which has to
+	// be the test's bus (not the one of another test, or the user's).
+	if address := os.Getenv(SessionBusEnv); address != sb.Address {
+		t.Fatalf("MediaPlayer: session bus is %q, expected %q", address, sb.Address)
+	}
+	return StartMediaPlayerWith(t, media_player.NewMPRISBackend())
+}
@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package harness
+
+/*
+Session Bus (Linux)
+
+This starts a private `dbus-daemon --session` for a single test, and points
+`DBUS_SESSION_BUS_ADDRESS` at it so that everything in the test process
+(including the media player subsystem) talks to it instead of the user's bus.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	DBusDaemonBinary   = "dbus-daemon"
+	SessionBusEnv      = "DBUS_SESSION_BUS_ADDRESS"
+	sessionBusStartMax = time.Second * 5
+)
+
+type SessionBus struct {
+	Address string
+	daemon  *exec.Cmd
+}
+
+// Starts a private session bus, and stops it when the test finishes.
+//
+// The test is skipped if `dbus-daemon` is not available on the machine.
+func StartSessionBus(t *testing.T) *SessionBus {
+	t.Helper()
+	daemonPath, lookupErr := exec.LookPath(DBusDaemonBinary)
+	if lookupErr != nil {
+		t.Skipf("SessionBus: %s not found, skipping: %v", DBusDaemonBinary, lookupErr)
+	}
+	daemon := exec.Command(
+		daemonPath,
+		"--session",
+		"--nofork",
+		"--nopidfile",
+		"--address=unix:tmpdir="+t.TempDir(),
+		"--print-address=1",
+	)
+	stdout, pipeErr := daemon.StdoutPipe()
+	if pipeErr != nil {
+		t.Fatalf("SessionBus: stdout pipe: %v", pipeErr)
+	}
+	if startErr := daemon.Start(); startErr != nil {
+		t.Fatalf("SessionBus: start: %v", startErr)
+	}
+	t.Cleanup(func() {
+		daemon.Process.Kill()
+		daemon.Wait()
+	})
+
+	// The first line printed by the daemon is the address it listens on.
+	addressChan := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		if scanner.Scan() {
+			addressChan <- strings.TrimSpace(scanner.Text())
+		}
+		close(addressChan)
+	}()
+	var address string
+	select {
+	case address = <-addressChan:
+	case <-time.After(sessionBusStartMax):
+	}
+	if address == "" {
+		t.Fatalf("SessionBus: daemon did not report an address")
+	}
+	t.Setenv(SessionBusEnv, address)
+	return &SessionBus{
+		Address: address,
+		daemon:  daemon,
+	}
+}
+
+// Opens a new private connection to the bus (not shared with `dbus.SessionBus`).
+func (sb *SessionBus) Connect(t *testing.T) *dbus.Conn {
+	t.Helper()
+	conn, connErr := dbus.Connect(sb.Address)
+	if connErr != nil {
+		t.Fatalf("SessionBus: connect: %v", connErr)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
@@ -0,0 +1,531 @@
+package harness
+
+/*
+Transmission Harness
+
+Runs the transmission server on a local port, with a fake server routine
+behind it (enabling the given modules for every session, and recording the
+modules sessions let go of), and connects websocket clients to it. Clients
+of a secure server pin its certificate.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Artiqlate/cyprus/comm"
+	"github.com/Artiqlate/cyprus/transmission"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/Artiqlate/ganymede/models/base"
+	"github.com/vmihailenco/msgpack/v5"
+	"nhooyr.io/websocket"
+)
+
+type TransmissionOptions struct {
+	// Modules which can be enabled
+	Modules []string
+	// Pairing is off without a trust store
+	TrustStore *transmission.TrustStore
+	// Serves in secure mode with a certificate (or one from files)
+	Certificate         *tls.Certificate
+	CertificateReloader *transmission.CertificateReloader
+	// Requires client certificates (secure mode only)
+	ClientAuthenticator *transmission.ClientAuthenticator
+	// Browser origins which can connect (see `transmission.OriginPolicy`)
+	AllowedOrigins []string
+	// Compression and message sizes (the defaults when nil)
+	Transport *transmission.TransportOptions
+}
+
+type TransmissionServer struct {
+	Url string
+	// Fingerprint clients pin (secure mode only)
+	Fingerprint string
+	Channels    *comm.CommChannels
+	// Module releases, as sent to the server routine
+	Closes chan comm.SessionClose
+	// Pairing PINs, as shown to the user
+	Pins chan string
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("Transmission: %v", listenErr)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// Starts the transmission server (insecure, without pairing), with the given
+// modules available, and shuts it down when the test finishes.
+func StartTransmission(t *testing.T, modules ...string) *TransmissionServer {
+	t.Helper()
+	return StartTransmissionWith(t, TransmissionOptions{Modules: modules})
+}
+
+func StartTransmissionWith(t *testing.T, options TransmissionOptions) *TransmissionServer {
+	t.Helper()
+	port := freePort(t)
+	initChan := make(chan comm.SessionInit)
+	closeChan := make(chan comm.SessionClose)
+	certificate := options.Certificate
+	if options.CertificateReloader != nil {
+		certificate = options.CertificateReloader.Certificate()
+	}
+	secure := certificate != nil
+	server := &TransmissionServer{
+		Url:         fmt.Sprintf("ws://127.0.0.1:%d", port),
+		Fingerprint: transmission.Fingerprint(certificate),
+		Channels:    comm.NewCommChannels(),
+		Closes:      make(chan comm.SessionClose, outboxSize),
+		Pins:        make(chan string, outboxSize),
+	}
+	if secure {
+		server.Url = fmt.Sprintf("wss://127.0.0.1:%d", port)
+	}
+	modules := options.Modules
+	nt := transmission.NewNetworkTransmissionServer(initChan, closeChan, server.Channels, options.TrustStore, port)
+	nt.SetPinDisplay(func(clientName string, pin string) { server.Pins <- pin })
+	nt.SetCertificate(options.Certificate)
+	if options.CertificateReloader != nil {
+		nt.SetCertificateReloader(options.CertificateReloader)
+	}
+	nt.SetClientAuthenticator(options.ClientAuthenticator)
+	originPolicy, originPolicyErr := transmission.NewOriginPolicy(options.AllowedOrigins)
+	if originPolicyErr != nil {
+		t.Fatalf("Transmission: %v", originPolicyErr)
+	}
+	nt.SetOriginPolicy(originPolicy)
+	if options.Transport != nil {
+		nt.SetTransportOptions(*options.Transport)
+	}
+	errChan := make(chan error, 1)
+	go nt.Coroutine(errChan, secure)
+	stop := make(chan bool)
+	go func() {
+		for {
+			select {
+			case sessionInit := <-initChan:
+				enabled := []string{}
+				for _, requested := range sessionInit.Modules {
+					for _, module := range modules {
+						if requested == module {
+							enabled = append(enabled, module)
+						}
+					}
+				}
+				sessionInit.Reply <- enabled
+			case sessionClose := <-closeChan:
+				server.Closes <- sessionClose
+			case <-stop:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		shutdownContext, cancel := context.WithTimeout(context.Background(), DefaultExpectTimeout)
+		defer cancel()
+		nt.Shutdown(shutdownContext)
+		close(stop)
+	})
+	// Wait for the server to listen.
+	deadline := time.Now().Add(DefaultExpectTimeout)
+	for {
+		conn, dialErr := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if dialErr == nil {
+			conn.Close()
+			return server
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Transmission: server not listening: %v", dialErr)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+// Waits for a module release.
+func (ts *TransmissionServer) ExpectClose(t *testing.T) comm.SessionClose {
+	t.Helper()
+	select {
+	case sessionClose := <-ts.Closes:
+		return sessionClose
+	case <-time.After(DefaultExpectTimeout):
+		t.Fatalf("Transmission: timed out waiting for a session close")
+		return comm.SessionClose{}
+	}
+}
+
+// Waits for the next pairing PIN.
+func (ts *TransmissionServer) ExpectPin(t *testing.T) string {
+	t.Helper()
+	select {
+	case pin := <-ts.Pins:
+		return pin
+	case <-time.After(DefaultExpectTimeout):
+		t.Fatalf("Transmission: timed out waiting for a PIN")
+		return ""
+	}
+}
+
+// Waits for the next request a module gets.
+func (ts *TransmissionServer) ExpectRequest(t *testing.T, module string) comm.Request {
+	t.Helper()
+	select {
+	case request := <-ts.Channels.Module(module).InChannel:
+		return request
+	case <-time.After(DefaultExpectTimeout):
+		t.Fatalf("Transmission: timed out waiting for a %s request", module)
+		return comm.Request{}
+	}
+}
+
+// Sends a message from a module, to a session (or `comm.BroadcastSession`).
+func (ts *TransmissionServer) Send(t *testing.T, module string, session uint64, message models.Message) {
+	t.Helper()
+	select {
+	case ts.Channels.Module(module).OutChannel <- comm.Envelope{Session: session, Message: message}:
+	case <-time.After(DefaultExpectTimeout):
+		t.Fatalf("Transmission: timed out sending %s", message.Method)
+	}
+}
+
+// Sends an event with the given sequence number from a module, to every
+// session which enabled it.
+func (ts *TransmissionServer) SendEvent(t *testing.T, module string, seq uint64, message models.Message) {
+	t.Helper()
+	select {
+	case ts.Channels.Module(module).OutChannel <- comm.Envelope{Session: comm.BroadcastSession, Message: message, Seq: seq}:
+	case <-time.After(DefaultExpectTimeout):
+		t.Fatalf("Transmission: timed out sending %s", message.Method)
+	}
+}
+
+// Replies to a request from a module, like modules do (echoing its ID).
+func (ts *TransmissionServer) Reply(t *testing.T, module string, request comm.Request, message models.Message) {
+	t.Helper()
+	select {
+	case ts.Channels.Module(module).OutChannel <- comm.Envelope{Session: request.Session, RequestId: request.Id, Message: message}:
+	case <-time.After(DefaultExpectTimeout):
+		t.Fatalf("Transmission: timed out replying %s", message.Method)
+	}
+}
+
+// A message as received by a websocket client, with its arguments (and
+// request ID, for replies to requests with one) left encoded.
+type WSMessage struct {
+	Method string
+	Args   msgpack.RawMessage
+	Id     msgpack.RawMessage
+}
+
+// Decodes a `[method, args]` or `[method, args, id]` message.
+func decodeWSMessage(data []byte) (WSMessage, error) {
+	var elements []msgpack.RawMessage
+	if decodeErr := msgpack.Unmarshal(data, &elements); decodeErr != nil {
+		return WSMessage{}, decodeErr
+	}
+	if len(elements) < 2 {
+		return WSMessage{}, fmt.Errorf("message with %d elements", len(elements))
+	}
+	message := WSMessage{Args: elements[1]}
+	if decodeErr := msgpack.Unmarshal(elements[0], &message.Method); decodeErr != nil {
+		return WSMessage{}, decodeErr
+	}
+	if len(elements) > 2 {
+		message.Id = elements[2]
+	}
+	return message, nil
+}
+
+type WSClient struct {
+	conn *websocket.Conn
+	// Negotiated the JSON codec
+	json     bool
+	messages chan WSMessage
+}
+
+// Connects a websocket client, and closes it when the test finishes.
+func (ts *TransmissionServer) Connect(t *testing.T) *WSClient {
+	t.Helper()
+	return ts.ConnectWith(t, "")
+}
+
+// Connects a websocket client asking for the given subprotocol (ex:
+// `transmission.ProtocolJSON`, none when empty).
+func (ts *TransmissionServer) ConnectWith(t *testing.T, subprotocol string) *WSClient {
+	t.Helper()
+	options := &websocket.DialOptions{}
+	if tlsConfig := ts.ClientTLSConfig(); tlsConfig != nil {
+		options.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+	if subprotocol != "" {
+		options.Subprotocols = []string{subprotocol}
+	}
+	conn, _, dialErr := ts.DialWith(options)
+	if dialErr != nil {
+		t.Fatalf("WSClient: %v", dialErr)
+	}
+	if conn.Subprotocol() != subprotocol {
+		t.Fatalf("WSClient: subprotocol %q negotiated, expected %q", conn.Subprotocol(), subprotocol)
+	}
+	return NewWSClient(t, conn)
+}
+
+// Client on an open connection (see `Dial`), closed when the test finishes.
+// Clients which negotiated the JSON codec send and receive JSON, but messages
+// are handled as MessagePack all the same.
+func NewWSClient(t *testing.T, conn *websocket.Conn) *WSClient {
+	t.Helper()
+	client := &WSClient{
+		conn:     conn,
+		json:     conn.Subprotocol() == transmission.ProtocolJSON,
+		messages: make(chan WSMessage, outboxSize),
+	}
+	go func() {
+		defer close(client.messages)
+		for {
+			messageType, data, readErr := conn.Read(context.Background())
+			if readErr != nil {
+				return
+			}
+			if client.json {
+				if messageType != websocket.MessageText {
+					continue
+				}
+				var transcodeErr error
+				if data, transcodeErr = jsonToMsgpack(data); transcodeErr != nil {
+					continue
+				}
+			}
+			if message, decodeErr := decodeWSMessage(data); decodeErr == nil {
+				client.messages <- message
+			}
+		}
+	}()
+	t.Cleanup(client.Close)
+	return client
+}
+
+// TLS configuration of clients which pin the server's certificate (nil for
+// insecure servers).
+func (ts *TransmissionServer) ClientTLSConfig() *tls.Config {
+	if ts.Fingerprint == "" {
+		return nil
+	}
+	return PinnedTLSConfig(ts.Fingerprint)
+}
+
+// TLS configuration which only trusts the certificate with the given
+// fingerprint (see `transmission.Fingerprint`).
+func PinnedTLSConfig(fingerprint string) *tls.Config {
+	return &tls.Config{
+		// Verified against the pinned fingerprint instead.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("no server certificate")
+			}
+			certificate := &tls.Certificate{Certificate: [][]byte{state.PeerCertificates[0].Raw}}
+			if pinned := transmission.Fingerprint(certificate); pinned != fingerprint {
+				return fmt.Errorf("server certificate %s isn't pinned", pinned)
+			}
+			return nil
+		},
+	}
+}
+
+// Opens a websocket connection with the given TLS configuration.
+func (ts *TransmissionServer) Dial(tlsConfig *tls.Config) (*websocket.Conn, error) {
+	options := &websocket.DialOptions{}
+	if tlsConfig != nil {
+		options.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+	conn, _, dialErr := ts.DialWith(options)
+	return conn, dialErr
+}
+
+// Opens a websocket connection with the given options, and returns the
+// server's response too.
+func (ts *TransmissionServer) DialWith(options *websocket.DialOptions) (*websocket.Conn, *http.Response, error) {
+	dialContext, cancel := context.WithTimeout(context.Background(), DefaultExpectTimeout)
+	defer cancel()
+	return websocket.Dial(dialContext, ts.Url, options)
+}
+
+func (c *WSClient) Close() {
+	c.conn.Close(websocket.StatusNormalClosure, "")
+}
+
+func (c *WSClient) Send(t *testing.T, method string, args interface{}) {
+	t.Helper()
+	c.SendRaw(t, method, &models.Message{Method: method, Args: args})
+}
+
+// Sends a `[method, args, id]` request.
+func (c *WSClient) SendWithId(t *testing.T, method string, args interface{}, id interface{}) {
+	t.Helper()
+	c.SendRaw(t, method, []interface{}{method, args, id})
+}
+
+// Sends the given value, encoded as it is (then transcoded to JSON, for JSON
+// clients).
+func (c *WSClient) SendRaw(t *testing.T, method string, message interface{}) {
+	t.Helper()
+	encoded, encodeErr := msgpack.Marshal(message)
+	messageType := websocket.MessageBinary
+	if encodeErr == nil && c.json {
+		encoded, encodeErr = msgpackToJSON(encoded)
+		messageType = websocket.MessageText
+	}
+	if encodeErr != nil {
+		t.Fatalf("WSClient: encode %s: %v", method, encodeErr)
+	}
+	if writeErr := c.conn.Write(context.Background(), messageType, encoded); writeErr != nil {
+		t.Fatalf("WSClient: send %s: %v", method, writeErr)
+	}
+}
+
+// Sends `init` with the given capabilities, and returns the enabled ones.
+func (c *WSClient) Init(t *testing.T, capabilities ...string) []string {
+	t.Helper()
+	c.Send(t, "init", base.NewInitWithCapabilities(capabilities))
+	var rinit base.Init
+	c.Expect(t, "rinit", &rinit)
+	return rinit.Capabilities
+}
+
+// Waits for the next message whose method ends with the given suffix
+// (skipping any other messages), and decodes its arguments into args
+// (unless nil).
+func (c *WSClient) Expect(t *testing.T, methodSuffix string, args interface{}) {
+	t.Helper()
+	message := c.ExpectMessage(t, methodSuffix)
+	if args != nil {
+		if decodeErr := msgpack.Unmarshal(message.Args, args); decodeErr != nil {
+			t.Fatalf("WSClient: decode %s: %v", message.Method, decodeErr)
+		}
+	}
+}
+
+// Same as `Expect`, returning the message as it is.
+func (c *WSClient) ExpectMessage(t *testing.T, methodSuffix string) WSMessage {
+	t.Helper()
+	deadline := time.After(DefaultExpectTimeout)
+	for {
+		select {
+		case message, connected := <-c.messages:
+			if !connected {
+				t.Fatalf("WSClient: disconnected waiting for %s", methodSuffix)
+			}
+			if !matchesMethod(message.Method, methodSuffix) {
+				t.Logf("WSClient: skipping %s", message.Method)
+				continue
+			}
+			return message
+		case <-deadline:
+			t.Fatalf("WSClient: timed out waiting for %s", methodSuffix)
+			return WSMessage{}
+		}
+	}
+}
+
+// Waits for the next message, whatever it is.
+func (c *WSClient) Next(t *testing.T) WSMessage {
+	t.Helper()
+	select {
+	case message, connected := <-c.messages:
+		if !connected {
+			t.Fatalf("WSClient: disconnected waiting for a message")
+		}
+		return message
+	case <-time.After(DefaultExpectTimeout):
+		t.Fatalf("WSClient: timed out waiting for a message")
+		return WSMessage{}
+	}
+}
+
+// Waits for the server to close the connection, skipping any messages.
+func (c *WSClient) ExpectDisconnect(t *testing.T) {
+	t.Helper()
+	deadline := time.After(DefaultExpectTimeout)
+	for {
+		select {
+		case _, connected := <-c.messages:
+			if !connected {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("WSClient: still connected")
+		}
+	}
+}
+
+// Asserts that no message with the given method suffix arrives within timeout.
+func (c *WSClient) ExpectNone(t *testing.T, methodSuffix string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case message, connected := <-c.messages:
+			if connected && matchesMethod(message.Method, methodSuffix) {
+				t.Fatalf("WSClient: unexpected %s", message.Method)
+			}
+			if !connected {
+				return
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// -- JSON CODEC --
+
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if decodeErr := decoder.Decode(&value); decodeErr != nil {
+		return nil, decodeErr
+	}
+	var convert func(value interface{}) interface{}
+	convert = func(value interface{}) interface{} {
+		switch value := value.(type) {
+		case json.Number:
+			if integer, intErr := value.Int64(); intErr == nil {
+				return integer
+			}
+			float, _ := value.Float64()
+			return float
+		case []interface{}:
+			for elementIdx := range value {
+				value[elementIdx] = convert(value[elementIdx])
+			}
+		case map[string]interface{}:
+			for key := range value {
+				value[key] = convert(value[key])
+			}
+		}
+		return value
+	}
+	return msgpack.Marshal(convert(value))
+}
+
+func msgpackToJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	if decodeErr := msgpack.Unmarshal(data, &value); decodeErr != nil {
+		return nil, decodeErr
+	}
+	return json.Marshal(value)
+}
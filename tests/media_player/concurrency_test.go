@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package media_player
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Artiqlate/cyprus/comm"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/Artiqlate/ganymede/models/mp"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Players come and go while the client keeps sending commands. Meant to be
+// run with `-race`: every request must still get exactly one reply.
+func TestPlayerChurnWithConcurrentCommands(t *testing.T) {
+	const (
+		churnRounds   = 10
+		requestRounds = 30
+	)
+	sb := harness.StartSessionBus(t)
+	steady := harness.NewFakePlayer(t, sb, "steady")
+	steady.Register(t)
+	subsystem, client := harness.StartMediaPlayer(t, sb)
+	client.Expect(t, "rsetup_metadata")
+
+	requests := []comm.Request{}
+	for _, request := range []models.Message{
+		{Method: "mp:list"},
+		{Method: "mp:sync"},
+		{Method: "mp:iplay", Args: &mp.PlayerIndex{PlayerIndex: 0}},
+		{Method: "mp:ipause", Args: &mp.PlayerIndex{PlayerIndex: 1}},
+	} {
+		encoded, encodeErr := msgpack.Marshal(&request)
+		if encodeErr != nil {
+			t.Fatalf("encode %s: %v", request.Method, encodeErr)
+		}
+		requests = append(requests, comm.Request{Session: harness.ClientSession, Data: encoded})
+	}
+
+	// Commands are sent from their own goroutine, like the transmission
+	// server does.
+	sent := make(chan bool)
+	go func() {
+		defer close(sent)
+		for round := 0; round < requestRounds; round++ {
+			for _, request := range requests {
+				client.Channel.InChannel <- request
+			}
+		}
+	}()
+	for round := 0; round < churnRounds; round++ {
+		player := harness.NewFakePlayer(t, sb, fmt.Sprintf("churn%d", round))
+		player.Register(t)
+		if round%2 == 0 {
+			player.Close()
+		}
+	}
+
+	replies := 0
+	for replies < requestRounds*len(requests) {
+		client.ExpectAny(t, "rlist", "rsync", "ok", "err")
+		replies++
+	}
+	<-sent
+
+	// Shutting down with players still around must not race or hang.
+	stopContext, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if stopErr := subsystem.Stop(stopContext); stopErr != nil {
+		t.Fatalf("stop: %v", stopErr)
+	}
+}
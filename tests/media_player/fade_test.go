@@ -0,0 +1,123 @@
+//go:build linux
+// +build linux
+
+package media_player
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+func waitForVolume(t *testing.T, volume func() float64, expected float64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 3)
+	for time.Now().Before(deadline) {
+		if math.Abs(volume()-expected) < 0.001 {
+			return
+		}
+		time.Sleep(media_player.FaderTickInterval)
+	}
+	t.Fatalf("volume: expected %f, got %f", expected, volume())
+}
+
+func TestFadeOutAndPauseWithFadeInOnResume(t *testing.T) {
+	player, client := startPlayingPlayer(t, "fade_pause")
+	player.SetVolume(0.6)
+
+	client.Send(t, "mp:fade", &ext_mp.FadeRequest{
+		PlayerName:       player.Name,
+		Target:           0,
+		DurationMs:       500,
+		PauseAtEnd:       true,
+		FadeInOnResumeMs: 300,
+	})
+	expectOk(t, client, "mp:fade")
+	time.Sleep(time.Millisecond * 250)
+	if volume := player.Volume(); volume <= 0 || volume >= 0.6 {
+		t.Errorf("mid-fade: unexpected volume %f", volume)
+	}
+	waitForVolume(t, player.Volume, 0)
+	client.Expect(t, "psu")
+	if player.PlaybackStatus() != mp.PlaybackStatusPaused {
+		t.Fatalf("fade: player is %s", player.PlaybackStatus())
+	}
+
+	// Resuming fades back in to the volume from before the fade.
+	client.Send(t, "mp:iplay", &mp.PlayerIndex{PlayerIndex: 0})
+	expectOk(t, client, "mp:iplay")
+	waitForVolume(t, player.Volume, 0.6)
+}
+
+func TestFadePauseRestoresVolume(t *testing.T) {
+	player, client := startPlayingPlayer(t, "fade_restore")
+	player.SetVolume(0.5)
+
+	client.Send(t, "mp:fade", &ext_mp.FadeRequest{
+		PlayerName: player.Name,
+		Target:     0,
+		DurationMs: 200,
+		PauseAtEnd: true,
+	})
+	expectOk(t, client, "mp:fade")
+	client.Expect(t, "psu")
+	waitForVolume(t, player.Volume, 0.5)
+}
+
+func TestNewFadeCancelsPrevious(t *testing.T) {
+	player, client := startPlayingPlayer(t, "fade_replace")
+	player.SetVolume(1)
+
+	client.Send(t, "mp:fade", &ext_mp.FadeRequest{
+		PlayerName: player.Name,
+		Target:     0,
+		DurationMs: 2000,
+		PauseAtEnd: true,
+	})
+	expectOk(t, client, "mp:fade")
+	client.Send(t, "mp:fade", &ext_mp.FadeRequest{
+		PlayerName: player.Name,
+		Target:     0.3,
+		DurationMs: 100,
+	})
+	expectOk(t, client, "mp:fade")
+	waitForVolume(t, player.Volume, 0.3)
+	time.Sleep(time.Second * 2)
+	if player.CallCount("Pause") != 0 || player.Volume() != 0.3 {
+		t.Errorf("replaced fade still ran (calls: %v, volume: %f)", player.Calls(), player.Volume())
+	}
+
+	client.Send(t, "mp:fade", &ext_mp.FadeRequest{PlayerName: "org.mpris.MediaPlayer2.missing"})
+	expectError(t, client, "mp:fade", ext_mp.ErrCodePlayerNotFound)
+}
+
+func TestStopRestoresFadedVolumes(t *testing.T) {
+	// Mid-fade
+	player, subsystem, client := startPlayingSubsystem(t, "fade_stop")
+	player.SetVolume(0.6)
+	client.Send(t, "mp:fade", &ext_mp.FadeRequest{PlayerName: player.Name, Target: 0, DurationMs: 2000})
+	expectOk(t, client, "mp:fade")
+	time.Sleep(time.Millisecond * 300)
+	stopWithin(t, subsystem, time.Second)
+	waitForVolume(t, player.Volume, 0.6)
+
+	// Faded out and paused, waiting to fade back in on resume
+	player, subsystem, client = startPlayingSubsystem(t, "fade_stop_paused")
+	player.SetVolume(0.4)
+	client.Send(t, "mp:fade", &ext_mp.FadeRequest{
+		PlayerName:       player.Name,
+		Target:           0,
+		DurationMs:       200,
+		PauseAtEnd:       true,
+		FadeInOnResumeMs: 300,
+	})
+	expectOk(t, client, "mp:fade")
+	client.Expect(t, "psu")
+	waitForVolume(t, player.Volume, 0)
+	stopWithin(t, subsystem, time.Second)
+	waitForVolume(t, player.Volume, 0.4)
+}
@@ -0,0 +1,106 @@
+package media_player
+
+import (
+	"testing"
+	"time"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
+	"github.com/Artiqlate/ganymede/models/mp"
+	mp_signals "github.com/Artiqlate/ganymede/models/mp/signals"
+)
+
+const handoffTargetName = "org.mpris.MediaPlayer2.target"
+
+func TestServiceUrl(t *testing.T) {
+	testCases := []struct {
+		metadata   mp.Metadata
+		serviceUrl string
+	}{
+		{mp.Metadata{Url: "https://www.youtube.com/watch?v=abc"}, "https://www.youtube.com/watch?v=abc"},
+		{mp.Metadata{Url: "spotify:track:4uLU6hMC"}, "https://open.spotify.com/track/4uLU6hMC"},
+		{mp.Metadata{TrackId: "/com/spotify/track/4uLU6hMC"}, "https://open.spotify.com/track/4uLU6hMC"},
+		{mp.Metadata{Url: "file:///music/song.flac"}, ""},
+		{mp.Metadata{TrackId: "/com/spotify/ad"}, ""},
+		{mp.Metadata{}, ""},
+	}
+	for _, testCase := range testCases {
+		if serviceUrl := media_player.ServiceUrl(&testCase.metadata); serviceUrl != testCase.serviceUrl {
+			t.Errorf("%+v: expected %q, got %q", testCase.metadata, testCase.serviceUrl, serviceUrl)
+		}
+	}
+}
+
+func TestHandoffCaptureAndApply(t *testing.T) {
+	backend, client := startMemoryPlayer(t)
+	backend.SetMetadata(memoryPlayerName, &mp.Metadata{
+		TrackId: "/com/spotify/track/4uLU6hMC",
+		Url:     "spotify:track:4uLU6hMC",
+		Title:   "Handed Off",
+	})
+	client.ExpectEvent(t, "mu")
+	backend.SetPlaybackStatus(memoryPlayerName, mp.PlaybackStatusPlaying)
+	client.ExpectEvent(t, "psu")
+	backend.SetPosition(memoryPlayerName, 42*time.Second)
+	backend.SetRate(memoryPlayerName, 1.5)
+	backend.AddPlayer(handoffTargetName, mp.PlaybackStatusStopped, nil)
+	client.ExpectEvent(t, "cr")
+
+	client.Send(t, "mp:handoff", &ext_mp.HandoffRequest{PlayerName: memoryPlayerName, Pause: true})
+	descriptor := client.Expect(t, "rhandoff").Args.(*ext_mp.HandoffDescriptor)
+	if descriptor.Url != "spotify:track:4uLU6hMC" ||
+		descriptor.TrackId != "/com/spotify/track/4uLU6hMC" ||
+		descriptor.PositionUs != int64(42*time.Second/time.Microsecond) ||
+		descriptor.Rate != 1.5 ||
+		descriptor.ServiceUrl != "https://open.spotify.com/track/4uLU6hMC" {
+		t.Errorf("handoff: unexpected descriptor %+v", descriptor)
+	}
+	if status, _ := backend.PlaybackStatus(memoryPlayerName); status != mp.PlaybackStatusPaused {
+		t.Errorf("handoff: source is %s", status)
+	}
+	client.ExpectEvent(t, "psu")
+
+	// The target opens the track, and is seeked once it has loaded it.
+	client.Send(t, "mp:handoff_apply", &ext_mp.HandoffApplyRequest{
+		PlayerName: handoffTargetName,
+		Descriptor: *descriptor,
+	})
+	expectOk(t, client, "mp:handoff_apply")
+	opened := client.ExpectEvent(t, "mu").Data.(*mp_signals.MetadataChanged)
+	if opened.PlayerName != handoffTargetName || opened.Metadata.Url != descriptor.Url {
+		t.Errorf("handoff_apply: unexpected metadata %+v", opened)
+	}
+	client.ExpectEvent(t, "psu")
+	seeked := client.ExpectEvent(t, "seeked").Data.(*mp_signals.Seeked)
+	if seeked.PlayerName != handoffTargetName || seeked.SeekedInUs != descriptor.PositionUs {
+		t.Errorf("handoff_apply: unexpected seek %+v", seeked)
+	}
+	if rate, _ := backend.Rate(handoffTargetName); rate != descriptor.Rate {
+		t.Errorf("handoff_apply: target plays at %f", rate)
+	}
+
+	// Applying to a player which already plays the track only seeks it.
+	descriptor.PositionUs = int64(10 * time.Second / time.Microsecond)
+	descriptor.Rate = 1
+	client.Send(t, "mp:handoff_apply", &ext_mp.HandoffApplyRequest{
+		PlayerName: handoffTargetName,
+		Descriptor: *descriptor,
+	})
+	expectOk(t, client, "mp:handoff_apply")
+	seeked = client.ExpectEvent(t, "seeked").Data.(*mp_signals.Seeked)
+	if seeked.SeekedInUs != descriptor.PositionUs {
+		t.Errorf("handoff_apply: unexpected seek %+v", seeked)
+	}
+	if rate, _ := backend.Rate(handoffTargetName); rate != descriptor.Rate {
+		t.Errorf("handoff_apply: target plays at %f", rate)
+	}
+}
+
+func TestHandoffErrors(t *testing.T) {
+	_, client := startMemoryPlayer(t)
+
+	client.Send(t, "mp:handoff", &ext_mp.HandoffRequest{PlayerName: "org.mpris.MediaPlayer2.missing"})
+	expectError(t, client, "mp:handoff", ext_mp.ErrCodePlayerNotFound)
+	client.Send(t, "mp:handoff_apply", &ext_mp.HandoffApplyRequest{PlayerName: memoryPlayerName})
+	expectError(t, client, "mp:handoff_apply", ext_mp.ErrCodeDecode)
+}
@@ -0,0 +1,33 @@
+package media_player
+
+import (
+	"testing"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/cyprus/tests/harness"
+)
+
+func expectOk(t *testing.T, client *harness.Client, requestMethod string) {
+	t.Helper()
+	reply, isOk := client.Expect(t, "ok").Args.(*ext_mp.CommandOk)
+	if !isOk || reply.Method != requestMethod {
+		t.Errorf("expected ok for %s, got %+v", requestMethod, reply)
+	}
+}
+
+func expectError(t *testing.T, client *harness.Client, requestMethod string, code string) {
+	t.Helper()
+	reply, isErr := client.Expect(t, "err").Args.(*ext_mp.CommandError)
+	if !isErr || reply.Method != requestMethod || reply.Code != code {
+		t.Errorf("expected %s error for %s, got %+v", code, requestMethod, reply)
+	}
+}
+
+func expectSleepState(t *testing.T, client *harness.Client) *ext_mp.SleepTimerState {
+	t.Helper()
+	state, isState := client.ExpectEvent(t, "sleep").Data.(*ext_mp.SleepTimerState)
+	if !isState {
+		t.Fatalf("sleep: unexpected event data")
+	}
+	return state
+}
@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package media_player
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Artiqlate/cyprus/comm"
+	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/utils"
+)
+
+func stopWithin(t *testing.T, subsystem *media_player.Subsystem, timeout time.Duration) {
+	t.Helper()
+	stopContext, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if stopErr := subsystem.Stop(stopContext); stopErr != nil {
+		t.Fatalf("stop: %v", stopErr)
+	}
+	if state := subsystem.State(); state != utils.StateStopped {
+		t.Fatalf("stop: subsystem is %s", state)
+	}
+}
+
+func TestStartAndStopAreIdempotent(t *testing.T) {
+	sb := harness.StartSessionBus(t)
+	subsystem, client := harness.StartMediaPlayer(t, sb)
+	client.Expect(t, "rsetup_metadata")
+	if state := subsystem.State(); state != utils.StateRunning {
+		t.Fatalf("start: subsystem is %s", state)
+	}
+	if startErr := subsystem.Start(context.Background()); startErr != nil {
+		t.Errorf("second start: %v", startErr)
+	}
+
+	stopWithin(t, subsystem, time.Second)
+	stopWithin(t, subsystem, time.Second)
+	if startErr := subsystem.Start(context.Background()); !errors.Is(startErr, media_player.ErrSubsystemStopped) {
+		t.Errorf("start after stop: expected ErrSubsystemStopped, got %v", startErr)
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	subsystem := media_player.NewSubsystem(comm.NewBiDirMessageChannel(), media_player.NewMPRISBackend())
+	if state := subsystem.State(); state != utils.StateCreated {
+		t.Fatalf("new: subsystem is %s", state)
+	}
+	stopWithin(t, subsystem, time.Second)
+}
+
+func TestStopAfterClientClose(t *testing.T) {
+	sb := harness.StartSessionBus(t)
+	subsystem, client := harness.StartMediaPlayer(t, sb)
+	client.Expect(t, "rsetup_metadata")
+
+	client.Send(t, "mp:close", nil)
+	expectOk(t, client, "mp:close")
+	stopWithin(t, subsystem, time.Second)
+}
+
+func TestContextCancellationStops(t *testing.T) {
+	harness.StartSessionBus(t)
+	channel := comm.NewBiDirMessageChannel()
+	client := harness.NewClient(t, channel)
+	subsystem := media_player.NewSubsystem(channel, media_player.NewMPRISBackend())
+	ctx, cancel := context.WithCancel(context.Background())
+	if startErr := subsystem.Start(ctx); startErr != nil {
+		t.Fatalf("start: %v", startErr)
+	}
+	client.Expect(t, "rsetup_metadata")
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for subsystem.State() != utils.StateStopped {
+		if time.Now().After(deadline) {
+			t.Fatalf("cancel: subsystem is still %s", subsystem.State())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// Nobody reads from the subsystem here, so it's stuck sending its setup event.
+func TestStopWithUnreadClient(t *testing.T) {
+	harness.StartSessionBus(t)
+	subsystem := media_player.NewSubsystem(comm.NewBiDirMessageChannel(), media_player.NewMPRISBackend())
+	started := make(chan error, 1)
+	go func() { started <- subsystem.Start(context.Background()) }()
+	time.Sleep(time.Millisecond * 100)
+
+	stopWithin(t, subsystem, time.Second)
+	if startErr := <-started; startErr != nil {
+		t.Errorf("start: %v", startErr)
+	}
+}
@@ -0,0 +1,248 @@
+//go:build linux
+// +build linux
+
+package media_player
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/ganymede/models/mp"
+	mp_signals "github.com/Artiqlate/ganymede/models/mp/signals"
+	"github.com/godbus/dbus/v5"
+)
+
+func TestSetupReportsExistingPlayers(t *testing.T) {
+	sb := harness.StartSessionBus(t)
+	player := harness.NewFakePlayer(t, sb, "setup")
+	player.SetMetadata(map[string]dbus.Variant{
+		mp.TITLE:  dbus.MakeVariant("Setup Song"),
+		mp.ARTIST: dbus.MakeVariant([]string{"Setup Artist"}),
+	})
+	player.Register(t)
+
+	_, client := harness.StartMediaPlayer(t, sb)
+
+	setupEvent := client.ExpectEvent(t, "rsetup_metadata")
+	setupStatus, ok := setupEvent.Data.(*mp.SetupStatus)
+	if !ok {
+		t.Fatalf("unexpected args: %T", setupEvent.Data)
+	}
+	if len(setupStatus.Statuses) != 1 {
+		t.Fatalf("expected 1 player, got %d", len(setupStatus.Statuses))
+	}
+	status := setupStatus.Statuses[0]
+	if status.Name != player.Name || status.Metadata.Title != "Setup Song" {
+		t.Errorf("unexpected setup status: %+v", status)
+	}
+
+	client.Send(t, "mp:list", nil)
+	listMessage := client.Expect(t, "rlist")
+	playerList := listMessage.Args.(*mp.MPlayerList)
+	if len(playerList.Players) != 1 || playerList.Players[0] != player.Name {
+		t.Errorf("unexpected player list: %v", playerList.Players)
+	}
+}
+
+func TestPlayerCreatedAndRemoved(t *testing.T) {
+	sb := harness.StartSessionBus(t)
+	_, client := harness.StartMediaPlayer(t, sb)
+
+	player := harness.NewFakePlayer(t, sb, "churn")
+	player.Register(t)
+	created := client.ExpectEvent(t, "cr").Data.(*mp_signals.PlayerCreated)
+	if created.PlayerName != player.Name {
+		t.Errorf("created: expected %s, got %s", player.Name, created.PlayerName)
+	}
+	if len(created.UpdatedPlayerNames) != 1 {
+		t.Errorf("created: unexpected player names %v", created.UpdatedPlayerNames)
+	}
+
+	player.Close()
+	removed := client.ExpectEvent(t, "rm").Data.(*mp_signals.PlayerRemoved)
+	if removed.PlayerName != player.Name || len(removed.UpdatedPlayerNames) != 0 {
+		t.Errorf("removed: unexpected %+v", removed)
+	}
+}
+
+func TestPropertySignals(t *testing.T) {
+	sb := harness.StartSessionBus(t)
+	player := harness.NewFakePlayer(t, sb, "signals")
+	player.Register(t)
+	_, client := harness.StartMediaPlayer(t, sb)
+	client.Expect(t, "rsetup_metadata")
+	client.Drain()
+
+	player.SetPlaybackStatus(mp.PlaybackStatusPlaying)
+	statusChanged := client.ExpectEvent(t, "psu").Data.(*mp_signals.PlaybackStatusChanged)
+	if statusChanged.PlayerName != player.Name || statusChanged.PlaybackStatus != mp.PlaybackStatusPlaying {
+		t.Errorf("psu: unexpected %+v", statusChanged)
+	}
+
+	player.SetMetadata(map[string]dbus.Variant{
+		mp.TITLE: dbus.MakeVariant("Next Song"),
+	})
+	metadataChanged := client.ExpectEvent(t, "mu").Data.(*mp_signals.MetadataChanged)
+	if metadataChanged.PlayerName != player.Name || metadataChanged.Metadata.Title != "Next Song" {
+		t.Errorf("mu: unexpected %+v", metadataChanged)
+	}
+
+	player.EmitSeeked(42_000_000)
+	seeked := client.ExpectEvent(t, "seeked").Data.(*mp_signals.Seeked)
+	if seeked.PlayerName != player.Name || seeked.SeekedInUs != 42_000_000 {
+		t.Errorf("seeked: unexpected %+v", seeked)
+	}
+}
+
+func TestEventSequenceAndSync(t *testing.T) {
+	sb := harness.StartSessionBus(t)
+	player := harness.NewFakePlayer(t, sb, "sync")
+	player.SetMetadata(map[string]dbus.Variant{
+		mp.TITLE: dbus.MakeVariant("First Song"),
+	})
+	player.Register(t)
+	_, client := harness.StartMediaPlayer(t, sb)
+
+	setupEvent := client.ExpectEvent(t, "rsetup_metadata")
+	if setupEvent.Seq != 1 {
+		t.Errorf("setup: expected seq 1, got %d", setupEvent.Seq)
+	}
+	player.SetPlaybackStatus(mp.PlaybackStatusPlaying)
+	statusEvent := client.ExpectEvent(t, "psu")
+	player.SetMetadata(map[string]dbus.Variant{
+		mp.TITLE: dbus.MakeVariant("Second Song"),
+	})
+	metadataEvent := client.ExpectEvent(t, "mu")
+	if statusEvent.Seq != setupEvent.Seq+1 || metadataEvent.Seq != statusEvent.Seq+1 {
+		t.Errorf("expected consecutive seqs, got %d, %d, %d", setupEvent.Seq, statusEvent.Seq, metadataEvent.Seq)
+	}
+
+	client.Send(t, "mp:sync", nil)
+	snapshot, isSnapshot := client.Expect(t, "rsync").Args.(*ext_mp.Snapshot)
+	if !isSnapshot {
+		t.Fatalf("rsync: unexpected reply")
+	}
+	if snapshot.Seq != metadataEvent.Seq {
+		t.Errorf("rsync: expected seq %d, got %d", metadataEvent.Seq, snapshot.Seq)
+	}
+	if len(snapshot.Statuses) != 1 ||
+		snapshot.Statuses[0].Status != mp.PlaybackStatusPlaying ||
+		snapshot.Statuses[0].Metadata.Title != "Second Song" {
+		t.Errorf("rsync: unexpected statuses %+v", snapshot.Statuses)
+	}
+}
+
+func TestIndexCommands(t *testing.T) {
+	sb := harness.StartSessionBus(t)
+	player := harness.NewFakePlayer(t, sb, "commands")
+	player.Register(t)
+	_, client := harness.StartMediaPlayer(t, sb)
+	client.Expect(t, "rsetup_metadata")
+
+	client.Send(t, "mp:iplay", &mp.PlayerIndex{PlayerIndex: 0})
+	expectOk(t, client, "mp:iplay")
+	if player.PlaybackStatus() != mp.PlaybackStatusPlaying {
+		t.Errorf("iplay: player is %s", player.PlaybackStatus())
+	}
+
+	client.Send(t, "mp:ipause", &mp.PlayerIndex{PlayerIndex: 0})
+	expectOk(t, client, "mp:ipause")
+	if player.PlaybackStatus() != mp.PlaybackStatusPaused {
+		t.Errorf("ipause: player is %s", player.PlaybackStatus())
+	}
+
+	client.Send(t, "mp:ifwd", &mp.PlayerIndex{PlayerIndex: 0})
+	expectOk(t, client, "mp:ifwd")
+	client.Send(t, "mp:iprv", &mp.PlayerIndex{PlayerIndex: 0})
+	expectOk(t, client, "mp:iprv")
+	if player.CallCount("Next") != 1 || player.CallCount("Previous") != 1 {
+		t.Errorf("unexpected calls: %v", player.Calls())
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	sb := harness.StartSessionBus(t)
+	player := harness.NewFakePlayer(t, sb, "errors")
+	player.Register(t)
+	_, client := harness.StartMediaPlayer(t, sb)
+	client.Expect(t, "rsetup_metadata")
+
+	client.Send(t, "mp:ifwd", &mp.PlayerIndex{PlayerIndex: 3})
+	expectError(t, client, "mp:ifwd", ext_mp.ErrCodeInvalidIndex)
+
+	client.Send(t, "mp:ifwd", "not an index")
+	expectError(t, client, "mp:ifwd", ext_mp.ErrCodeDecode)
+
+	client.Send(t, "mp:nonexistent", nil)
+	expectError(t, client, "mp:nonexistent", ext_mp.ErrCodeUnknownMethod)
+
+	player.SetCapability("CanGoNext", false)
+	client.Send(t, "mp:ifwd", &mp.PlayerIndex{PlayerIndex: 0})
+	expectError(t, client, "mp:ifwd", ext_mp.ErrCodeNotSupported)
+
+	player.Fail("Previous", dbus.NewError(media_player.DBusErrorNotSupported, nil))
+	client.Send(t, "mp:iprv", &mp.PlayerIndex{PlayerIndex: 0})
+	expectError(t, client, "mp:iprv", ext_mp.ErrCodeNotSupported)
+
+	player.Fail("Play", dbus.MakeFailedError(fmt.Errorf("broken")))
+	client.Send(t, "mp:iplay", &mp.PlayerIndex{PlayerIndex: 0})
+	expectError(t, client, "mp:iplay", ext_mp.ErrCodePlayerError)
+
+	if player.CallCount("Next") != 0 {
+		t.Errorf("unsupported Next was called: %v", player.Calls())
+	}
+}
+
+func TestHandoffOnMPRISPlayer(t *testing.T) {
+	sb := harness.StartSessionBus(t)
+	player := harness.NewFakePlayer(t, sb, "handoff")
+	player.SetMetadata(map[string]dbus.Variant{
+		mp.TRACKID: dbus.MakeVariant(dbus.ObjectPath("/org/fake/track/1")),
+		mp.URL:     dbus.MakeVariant("file:///music/My%20Song.flac"),
+		mp.TITLE:   dbus.MakeVariant("My Song"),
+	})
+	player.SetPosition(5000000)
+	player.Register(t)
+	_, client := harness.StartMediaPlayer(t, sb)
+	client.Expect(t, "rsetup_metadata")
+
+	// The URL is captured as the player reports it (not decoded).
+	client.Send(t, "mp:handoff", &ext_mp.HandoffRequest{PlayerName: player.Name})
+	descriptor := client.Expect(t, "rhandoff").Args.(*ext_mp.HandoffDescriptor)
+	if descriptor.Url != "file:///music/My%20Song.flac" || descriptor.PositionUs != 5000000 || descriptor.ServiceUrl != "" {
+		t.Errorf("handoff: unexpected descriptor %+v", descriptor)
+	}
+
+	// Same track: seeked with `SetPosition`, without reopening it.
+	descriptor.PositionUs = 9000000
+	client.Send(t, "mp:handoff_apply", &ext_mp.HandoffApplyRequest{PlayerName: player.Name, Descriptor: *descriptor})
+	expectOk(t, client, "mp:handoff_apply")
+	seeked := client.ExpectEvent(t, "seeked").Data.(*mp_signals.Seeked)
+	if seeked.SeekedInUs != 9000000 || player.CallCount("SetPosition") != 1 || player.CallCount("OpenUri") != 0 {
+		t.Errorf("handoff_apply: unexpected seek %+v (calls %v)", seeked, player.Calls())
+	}
+
+	// Another track loading in the meantime drops the seek.
+	descriptor.Url = "file:///music/Next.flac"
+	client.Send(t, "mp:handoff_apply", &ext_mp.HandoffApplyRequest{PlayerName: player.Name, Descriptor: *descriptor})
+	expectOk(t, client, "mp:handoff_apply")
+	player.SetPlaybackStatus(mp.PlaybackStatusPlaying)
+	player.SetMetadata(map[string]dbus.Variant{
+		mp.TRACKID: dbus.MakeVariant(dbus.ObjectPath("/org/fake/track/2")),
+		mp.URL:     dbus.MakeVariant("file:///music/Unrelated.flac"),
+	})
+	client.ExpectEvent(t, "mu")
+	client.ExpectNone(t, "seeked", time.Second/2)
+	if player.CallCount("OpenUri") != 1 || player.CallCount("SetPosition") != 1 {
+		t.Errorf("handoff_apply: seeked another track (calls %v)", player.Calls())
+	}
+
+	player.Fail("OpenUri", dbus.NewError(media_player.DBusErrorNotSupported, nil))
+	descriptor.Url = "file:///music/Other.flac"
+	client.Send(t, "mp:handoff_apply", &ext_mp.HandoffApplyRequest{PlayerName: player.Name, Descriptor: *descriptor})
+	expectError(t, client, "mp:handoff_apply", ext_mp.ErrCodeNotSupported)
+}
@@ -0,0 +1,232 @@
+package media_player
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Artiqlate/cyprus/comm"
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/utils"
+	"github.com/Artiqlate/ganymede/models/mp"
+	mp_signals "github.com/Artiqlate/ganymede/models/mp/signals"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const memoryPlayerName = "org.mpris.MediaPlayer2.memory"
+
+func startMemoryPlayer(t *testing.T) (*media_player.MemoryBackend, *harness.Client) {
+	t.Helper()
+	backend := media_player.NewMemoryBackend()
+	backend.AddPlayer(memoryPlayerName, mp.PlaybackStatusPaused, &mp.Metadata{
+		TrackId: "/track/1",
+		Title:   "Memory Song",
+		Length:  uint64(time.Minute / time.Microsecond),
+	})
+	_, client := harness.StartMediaPlayerWith(t, backend)
+	setup := client.ExpectEvent(t, "rsetup_metadata").Data.(*mp.SetupStatus)
+	if len(setup.Statuses) != 1 || setup.Statuses[0].Metadata.Title != "Memory Song" {
+		t.Fatalf("setup: unexpected statuses %+v", setup.Statuses)
+	}
+	return backend, client
+}
+
+func TestMemoryEventsUsePlatformMethods(t *testing.T) {
+	backend, client := startMemoryPlayer(t)
+
+	backend.AddPlayer("org.mpris.MediaPlayer2.second", mp.PlaybackStatusPlaying, nil)
+	created := client.Expect(t, "cr")
+	expectedMethod := utils.GeneratePlatformMethod("mp", utils.CurrentPlatform(), "cr")
+	if created.Method != expectedMethod {
+		t.Errorf("created: expected method %s, got %s", expectedMethod, created.Method)
+	}
+	playerCreated := created.Args.(*mp_signals.PlayerCreated)
+	if len(playerCreated.UpdatedPlayerNames) != 2 {
+		t.Errorf("created: unexpected player names %v", playerCreated.UpdatedPlayerNames)
+	}
+
+	backend.RemovePlayer(memoryPlayerName)
+	removed := client.ExpectEvent(t, "rm").Data.(*mp_signals.PlayerRemoved)
+	if removed.PlayerName != memoryPlayerName || len(removed.UpdatedPlayerNames) != 1 {
+		t.Errorf("removed: unexpected %+v", removed)
+	}
+	// Indexes follow the registry.
+	client.Send(t, "mp:ipause", &mp.PlayerIndex{PlayerIndex: 0})
+	expectOk(t, client, "mp:ipause")
+	if actions := backend.Actions("org.mpris.MediaPlayer2.second"); len(actions) != 1 || actions[0] != media_player.ActionPause {
+		t.Errorf("ipause: unexpected actions %v", actions)
+	}
+}
+
+func TestMemoryActionsAndErrors(t *testing.T) {
+	backend, client := startMemoryPlayer(t)
+
+	// The reply is sent before the routine gets to the player's event.
+	client.Send(t, "mp:iplay", &mp.PlayerIndex{PlayerIndex: 0})
+	expectOk(t, client, "mp:iplay")
+	statusChanged := client.ExpectEvent(t, "psu").Data.(*mp_signals.PlaybackStatusChanged)
+	if statusChanged.PlaybackStatus != mp.PlaybackStatusPlaying {
+		t.Errorf("iplay: unexpected status %+v", statusChanged)
+	}
+
+	backend.SetSupported(memoryPlayerName, media_player.ActionNext, false)
+	client.Send(t, "mp:ifwd", &mp.PlayerIndex{PlayerIndex: 0})
+	expectError(t, client, "mp:ifwd", ext_mp.ErrCodeNotSupported)
+	client.Send(t, "mp:iprv", &mp.PlayerIndex{PlayerIndex: 3})
+	expectError(t, client, "mp:iprv", ext_mp.ErrCodeInvalidIndex)
+}
+
+func TestMemoryMetadataAndSeeked(t *testing.T) {
+	backend, client := startMemoryPlayer(t)
+
+	backend.SetMetadata(memoryPlayerName, &mp.Metadata{TrackId: "/track/2", Title: "Next Song"})
+	metadataChanged := client.ExpectEvent(t, "mu").Data.(*mp_signals.MetadataChanged)
+	if metadataChanged.Metadata.Title != "Next Song" {
+		t.Errorf("metadata: unexpected %+v", metadataChanged.Metadata)
+	}
+
+	backend.Seek(memoryPlayerName, time.Second*30)
+	seeked := client.ExpectEvent(t, "seeked").Data.(*mp_signals.Seeked)
+	if seeked.SeekedInUs != int64(30*time.Second/time.Microsecond) {
+		t.Errorf("seeked: unexpected position %d", seeked.SeekedInUs)
+	}
+
+	client.Send(t, "mp:sync", nil)
+	snapshot := client.Expect(t, "rsync").Args.(*ext_mp.Snapshot)
+	if len(snapshot.Statuses) != 1 || snapshot.Statuses[0].Metadata.TrackId != "/track/2" {
+		t.Errorf("sync: unexpected snapshot %+v", snapshot)
+	}
+}
+
+func TestMemorySleepTimerAtTrackEnd(t *testing.T) {
+	backend, client := startMemoryPlayer(t)
+	backend.SetPlaybackStatus(memoryPlayerName, mp.PlaybackStatusPlaying)
+	backend.SetPosition(memoryPlayerName, time.Minute-time.Second/2)
+	client.Expect(t, "psu")
+
+	client.Send(t, "mp:sleep", &ext_mp.SleepTimerRequest{Mode: ext_mp.SleepModeTrackEnd})
+	armed := expectSleepState(t, client)
+	if armed.PlayerName != memoryPlayerName || armed.RemainingMs > 500 {
+		t.Errorf("armed: unexpected state %+v", armed)
+	}
+	if fired := expectSleepState(t, client); fired.Active {
+		t.Errorf("fired: timer still active")
+	}
+	if status, _ := backend.PlaybackStatus(memoryPlayerName); status != mp.PlaybackStatusPaused {
+		t.Errorf("fired: player is %s", status)
+	}
+}
+
+func TestMemorySleepTimerWaitsOutPauses(t *testing.T) {
+	backend, client := startMemoryPlayer(t)
+	backend.SetPlaybackStatus(memoryPlayerName, mp.PlaybackStatusPlaying)
+	backend.SetPosition(memoryPlayerName, time.Minute-time.Second/2)
+	client.Expect(t, "psu")
+
+	client.Send(t, "mp:sleep", &ext_mp.SleepTimerRequest{Mode: ext_mp.SleepModeTrackEnd})
+	if armed := expectSleepState(t, client); armed.RemainingMs > 500 {
+		t.Errorf("armed: unexpected state %+v", armed)
+	}
+
+	// The end of the track doesn't come any closer while it's paused.
+	backend.SetPlaybackStatus(memoryPlayerName, mp.PlaybackStatusPaused)
+	if paused := expectSleepState(t, client); !paused.Active || paused.RemainingMs != -1 {
+		t.Errorf("paused: unexpected state %+v", paused)
+	}
+	client.ExpectNone(t, "sleep", time.Second)
+
+	// Resuming from further back in the track
+	backend.SetPosition(memoryPlayerName, time.Minute-time.Second)
+	backend.SetPlaybackStatus(memoryPlayerName, mp.PlaybackStatusPlaying)
+	if resumed := expectSleepState(t, client); !resumed.Active || resumed.RemainingMs < 500 || resumed.RemainingMs > 1000 {
+		t.Errorf("resumed: unexpected state %+v", resumed)
+	}
+	if fired := expectSleepState(t, client); fired.Active {
+		t.Errorf("fired: timer still active")
+	}
+	if status, _ := backend.PlaybackStatus(memoryPlayerName); status != mp.PlaybackStatusPaused {
+		t.Errorf("fired: player is %s", status)
+	}
+}
+
+func TestMemoryPlatformQualifiedMethods(t *testing.T) {
+	backend, client := startMemoryPlayer(t)
+
+	platformMethod := utils.GeneratePlatformMethod("mp", utils.CurrentPlatform(), "iplay")
+	client.Send(t, platformMethod, &mp.PlayerIndex{PlayerIndex: 0})
+	expectOk(t, client, platformMethod)
+	if actions := backend.Actions(memoryPlayerName); len(actions) != 1 || actions[0] != media_player.ActionPlay {
+		t.Errorf("%s: unexpected actions %v", platformMethod, actions)
+	}
+
+	otherPlatform := utils.PlatformKind(utils.PlatformWindows)
+	if utils.CurrentPlatform() == otherPlatform {
+		otherPlatform = utils.PlatformLinux
+	}
+	otherMethod := utils.GeneratePlatformMethod("mp", otherPlatform, "ipause")
+	client.Send(t, otherMethod, &mp.PlayerIndex{PlayerIndex: 0})
+	expectError(t, client, otherMethod, ext_mp.ErrCodePlatformMismatch)
+	client.Send(t, "mp:iplay:extra:parts", &mp.PlayerIndex{PlayerIndex: 0})
+	expectError(t, client, "mp:iplay:extra:parts", ext_mp.ErrCodeDecode)
+	if actions := backend.Actions(memoryPlayerName); len(actions) != 1 {
+		t.Errorf("rejected methods ran: %v", actions)
+	}
+}
+
+func TestMemorySessions(t *testing.T) {
+	backend, client := startMemoryPlayer(t)
+	const secondSession uint64 = 2
+
+	// A session joining later gets the statuses, tagged with the last event.
+	backend.AddPlayer("org.mpris.MediaPlayer2.second", mp.PlaybackStatusPlaying, nil)
+	created := client.ExpectEvent(t, "cr")
+	client.Attach(t, secondSession)
+	attached := client.ExpectEnvelope(t, "rsetup_metadata")
+	setup, isSetup := attached.Message.Args.(*mp.SetupStatus)
+	if !isSetup || attached.Session != secondSession || attached.Seq != created.Seq {
+		t.Fatalf("attach: unexpected %+v", attached)
+	}
+	if statuses := setup.Statuses; len(statuses) != 2 {
+		t.Errorf("attach: expected 2 statuses, got %+v", statuses)
+	}
+
+	// Replies go to the session which asked, events to every session.
+	client.SendFrom(t, secondSession, "mp:list", nil)
+	if reply := client.ExpectEnvelope(t, "rlist"); reply.Session != secondSession {
+		t.Errorf("list: replied to session %d", reply.Session)
+	}
+	client.Send(t, "mp:iplay", &mp.PlayerIndex{PlayerIndex: 0})
+	if reply := client.ExpectEnvelope(t, "ok"); reply.Session != harness.ClientSession {
+		t.Errorf("iplay: replied to session %d", reply.Session)
+	}
+	if event := client.ExpectEnvelope(t, "psu"); event.Session != comm.BroadcastSession {
+		t.Errorf("psu: sent to session %d", event.Session)
+	}
+}
+
+func TestMemoryRepliesEchoRequestIds(t *testing.T) {
+	backend, client := startMemoryPlayer(t)
+
+	client.SendWithId(t, "mp:list", nil, 42)
+	var requestId int
+	reply := client.ExpectEnvelope(t, "rlist")
+	if decodeErr := msgpack.Unmarshal(reply.RequestId, &requestId); decodeErr != nil || requestId != 42 {
+		t.Errorf("rlist: unexpected request ID %x (%v)", reply.RequestId, decodeErr)
+	}
+	client.SendWithId(t, "mp:ipause", &mp.PlayerIndex{PlayerIndex: 7}, "pause-1")
+	var errorId string
+	if reply := client.ExpectEnvelope(t, "err"); msgpack.Unmarshal(reply.RequestId, &errorId) != nil || errorId != "pause-1" {
+		t.Errorf("err: unexpected request ID %x", reply.RequestId)
+	}
+
+	// Events (and replies to requests without an ID) have none.
+	backend.AddPlayer("org.mpris.MediaPlayer2.second", mp.PlaybackStatusPlaying, nil)
+	if event := client.ExpectEnvelope(t, "cr"); event.RequestId != nil {
+		t.Errorf("cr: unexpected request ID %x", event.RequestId)
+	}
+	client.Send(t, "mp:list", nil)
+	if reply := client.ExpectEnvelope(t, "rlist"); reply.RequestId != nil {
+		t.Errorf("rlist: unexpected request ID %x", reply.RequestId)
+	}
+}
@@ -0,0 +1,98 @@
+package media_player
+
+import (
+	"strings"
+	"testing"
+
+	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
+	"github.com/Artiqlate/ganymede/models/mp"
+	"github.com/godbus/dbus/v5"
+)
+
+func TestMetadataTypesAreNormalized(t *testing.T) {
+	for _, length := range []interface{}{int64(180000000), uint64(180000000), int32(180000000)} {
+		metadata := media_player.MetadataFromMPRIS("org.mpris.MediaPlayer2.test", map[string]dbus.Variant{
+			mp.TRACKID: dbus.MakeVariant(dbus.ObjectPath("/track/1")),
+			mp.LENGTH:  dbus.MakeVariant(length),
+			mp.ARTIST:  dbus.MakeVariant("Solo Artist"),
+		})
+		if metadata.Length != 180000000 {
+			t.Errorf("length %T: got %d", length, metadata.Length)
+		}
+		if metadata.TrackId != "/track/1" {
+			t.Errorf("trackid: got %s", metadata.TrackId)
+		}
+		if len(metadata.Artist) != 1 || metadata.Artist[0] != "Solo Artist" {
+			t.Errorf("artist string: got %v", metadata.Artist)
+		}
+	}
+}
+
+func TestMetadataArtistsAndUrl(t *testing.T) {
+	metadata := media_player.MetadataFromMPRIS("org.mpris.MediaPlayer2.test", map[string]dbus.Variant{
+		mp.ARTIST: dbus.MakeVariant([]string{"First", " Second ", "", "First"}),
+		mp.URL:    dbus.MakeVariant("file:///music/My%20Song%20%231.flac"),
+	})
+	if len(metadata.Artist) != 1 || metadata.Artist[0] != "First, Second" {
+		t.Errorf("artists: got %v", metadata.Artist)
+	}
+	if metadata.Url != "file:///music/My Song #1.flac" {
+		t.Errorf("url: got %s", metadata.Url)
+	}
+	// Invalid escapes are left alone.
+	broken := media_player.MetadataFromMPRIS("org.mpris.MediaPlayer2.test", map[string]dbus.Variant{
+		mp.URL: dbus.MakeVariant("https://example.com/100%"),
+	})
+	if broken.Url != "https://example.com/100%" {
+		t.Errorf("broken url: got %s", broken.Url)
+	}
+}
+
+func TestDerivedTrackId(t *testing.T) {
+	raw := map[string]dbus.Variant{
+		mp.TRACKID: dbus.MakeVariant(""),
+		mp.TITLE:   dbus.MakeVariant("Untracked"),
+		mp.ARTIST:  dbus.MakeVariant([]string{"Someone"}),
+	}
+	first := media_player.MetadataFromMPRIS("org.mpris.MediaPlayer2.test", raw)
+	second := media_player.MetadataFromMPRIS("org.mpris.MediaPlayer2.test", raw)
+	if !strings.HasPrefix(first.TrackId, media_player.DerivedTrackIdPrefix) || first.TrackId != second.TrackId {
+		t.Errorf("derived: unstable track IDs %s, %s", first.TrackId, second.TrackId)
+	}
+	raw[mp.TITLE] = dbus.MakeVariant("Another")
+	if other := media_player.MetadataFromMPRIS("org.mpris.MediaPlayer2.test", raw); other.TrackId == first.TrackId {
+		t.Errorf("derived: different tracks share %s", other.TrackId)
+	}
+	noTrack := media_player.MetadataFromMPRIS("org.mpris.MediaPlayer2.test", map[string]dbus.Variant{
+		mp.TRACKID: dbus.MakeVariant(dbus.ObjectPath(media_player.MPRISNoTrack)),
+	})
+	if noTrack.TrackId != "" {
+		t.Errorf("no track: got %s", noTrack.TrackId)
+	}
+}
+
+func TestMetadataQuirks(t *testing.T) {
+	chromium := media_player.MetadataFromMPRIS("org.mpris.MediaPlayer2.chromium.instance42", map[string]dbus.Variant{
+		mp.TRACKID: dbus.MakeVariant(dbus.ObjectPath("/org/chromium/MediaPlayer2/TrackList/TrackFooBar")),
+		mp.URL:     dbus.MakeVariant("https://example.com/watch"),
+	})
+	if !strings.HasPrefix(chromium.TrackId, media_player.DerivedTrackIdPrefix) {
+		t.Errorf("chromium: track ID not derived (%s)", chromium.TrackId)
+	}
+	spotify := media_player.MetadataFromMPRIS("org.mpris.MediaPlayer2.spotify", map[string]dbus.Variant{
+		mp.ART_URL: dbus.MakeVariant("https://open.spotify.com/image/abc"),
+	})
+	if spotify.ArtUrl != "https://i.scdn.co/image/abc" {
+		t.Errorf("spotify: art URL not rewritten (%s)", spotify.ArtUrl)
+	}
+
+	media_player.MetadataQuirkTable["splitter"] = media_player.MetadataQuirks{ArtistSplit: "; ", LengthInMs: true}
+	defer delete(media_player.MetadataQuirkTable, "splitter")
+	split := media_player.MetadataFromMPRIS("org.mpris.MediaPlayer2.splitter", map[string]dbus.Variant{
+		mp.ARTIST: dbus.MakeVariant("A; B"),
+		mp.LENGTH: dbus.MakeVariant(int64(1500)),
+	})
+	if split.Artist[0] != "A, B" || split.Length != 1500000 {
+		t.Errorf("splitter: got %v, %d", split.Artist, split.Length)
+	}
+}
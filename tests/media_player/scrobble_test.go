@@ -0,0 +1,119 @@
+package media_player
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+// Scrobbled after half a second of play
+var shortTrack = &mp.Metadata{
+	TrackId: "/track/short",
+	Title:   "Short Song",
+	Artist:  []string{"Short Artist"},
+	Album:   "Short Album",
+	Length:  uint64(time.Second / time.Microsecond),
+}
+
+func TestScrobbleQueue(t *testing.T) {
+	queuePath := filepath.Join(t.TempDir(), "queue", media_player.ScrobbleQueueFileName)
+	queue := media_player.NewScrobbleQueue(queuePath)
+	if listens, listErr := queue.List(); listErr != nil || len(listens) != 0 {
+		t.Fatalf("empty queue: %v %v", listens, listErr)
+	}
+	for _, track := range []string{"One", "Two"} {
+		listen := media_player.ListenFromScrobble(&ext_mp.Scrobble{ListenedAt: 1700000000, Artist: "A", Track: track})
+		if appendErr := queue.Append(listen); appendErr != nil {
+			t.Fatalf("append: %v", appendErr)
+		}
+	}
+	// Broken lines (ex: edited by hand) are skipped.
+	queueFile, _ := os.OpenFile(queuePath, os.O_WRONLY|os.O_APPEND, 0)
+	queueFile.WriteString("{broken\n")
+	queueFile.Close()
+
+	listens, listErr := queue.List()
+	if listErr != nil || len(listens) != 2 || listens[1].TrackMetadata.TrackName != "Two" {
+		t.Fatalf("list: unexpected %+v (%v)", listens, listErr)
+	}
+	if listens[0].TrackMetadata.AdditionalInfo.SubmissionClient != media_player.ScrobbleSubmissionClient {
+		t.Errorf("list: unexpected additional info %+v", listens[0].TrackMetadata.AdditionalInfo)
+	}
+	if clearErr := queue.Clear(); clearErr != nil {
+		t.Fatalf("clear: %v", clearErr)
+	}
+	if listens, _ := queue.List(); len(listens) != 0 {
+		t.Errorf("clear: %d listens left", len(listens))
+	}
+}
+
+func TestScrobbleAfterHalfTheTrack(t *testing.T) {
+	backend, client := startMemoryPlayer(t)
+	backend.SetMetadata(memoryPlayerName, shortTrack)
+	client.ExpectEvent(t, "mu")
+	started := time.Now()
+	backend.SetPlaybackStatus(memoryPlayerName, mp.PlaybackStatusPlaying)
+	client.ExpectEvent(t, "psu")
+
+	scrobble := client.ExpectEvent(t, "scrobble").Data.(*ext_mp.Scrobble)
+	if elapsed := time.Since(started); elapsed < time.Second/2 {
+		t.Errorf("scrobbled after %v", elapsed)
+	}
+	if scrobble.Track != "Short Song" || scrobble.Artist != "Short Artist" ||
+		scrobble.Release != "Short Album" || scrobble.DurationMs != 1000 || scrobble.PlayerName != memoryPlayerName {
+		t.Errorf("scrobble: unexpected %+v", scrobble)
+	}
+	// Only once per play.
+	client.ExpectNone(t, "scrobble", time.Second)
+
+	client.Send(t, "mp:scrobble_list", nil)
+	scrobbleList := client.Expect(t, "rscrobbles").Args.(*ext_mp.ScrobbleList)
+	if len(scrobbleList.Scrobbles) != 1 || scrobbleList.Scrobbles[0].Track != "Short Song" {
+		t.Errorf("scrobble_list: unexpected %+v", scrobbleList.Scrobbles)
+	}
+
+	client.Send(t, "mp:scrobble_export", nil)
+	exported := client.Expect(t, "rscrobble_export").Args.(*ext_mp.ScrobbleExport)
+	var submission media_player.ListenSubmission
+	if decodeErr := json.Unmarshal([]byte(exported.Json), &submission); decodeErr != nil {
+		t.Fatalf("scrobble_export: %v", decodeErr)
+	}
+	if exported.Count != 1 || submission.ListenType != "import" || len(submission.Payload) != 1 ||
+		submission.Payload[0].TrackMetadata.ArtistName != "Short Artist" {
+		t.Errorf("scrobble_export: unexpected %+v", submission)
+	}
+
+	client.Send(t, "mp:scrobble_clear", nil)
+	expectOk(t, client, "mp:scrobble_clear")
+	client.Send(t, "mp:scrobble_list", nil)
+	if scrobbleList := client.Expect(t, "rscrobbles").Args.(*ext_mp.ScrobbleList); len(scrobbleList.Scrobbles) != 0 {
+		t.Errorf("scrobble_clear: %d scrobbles left", len(scrobbleList.Scrobbles))
+	}
+}
+
+func TestScrobbleOnlyCountsPlayTime(t *testing.T) {
+	backend, client := startMemoryPlayer(t)
+	backend.SetMetadata(memoryPlayerName, shortTrack)
+	client.ExpectEvent(t, "mu")
+
+	// Paused tracks never scrobble.
+	backend.SetPlaybackStatus(memoryPlayerName, mp.PlaybackStatusPlaying)
+	client.ExpectEvent(t, "psu")
+	time.Sleep(time.Second / 4)
+	backend.SetPlaybackStatus(memoryPlayerName, mp.PlaybackStatusPaused)
+	client.ExpectEvent(t, "psu")
+	client.ExpectNone(t, "scrobble", time.Second/2)
+
+	// A new track starts over, and tracks without an artist are ignored.
+	backend.SetMetadata(memoryPlayerName, &mp.Metadata{TrackId: "/track/anonymous", Title: "No Artist", Length: shortTrack.Length})
+	client.ExpectEvent(t, "mu")
+	backend.SetPlaybackStatus(memoryPlayerName, mp.PlaybackStatusPlaying)
+	client.ExpectEvent(t, "psu")
+	client.ExpectNone(t, "scrobble", time.Second)
+}
@@ -0,0 +1,134 @@
+//go:build linux
+// +build linux
+
+package media_player
+
+import (
+	"testing"
+	"time"
+
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/ganymede/models/mp"
+	"github.com/godbus/dbus/v5"
+)
+
+func startPlayingPlayer(t *testing.T, suffix string) (*harness.FakePlayer, *harness.Client) {
+	t.Helper()
+	player, _, client := startPlayingSubsystem(t, suffix)
+	return player, client
+}
+
+func startPlayingSubsystem(t *testing.T, suffix string) (*harness.FakePlayer, *media_player.Subsystem, *harness.Client) {
+	t.Helper()
+	sb := harness.StartSessionBus(t)
+	player := harness.NewFakePlayer(t, sb, suffix)
+	player.SetMetadata(map[string]dbus.Variant{
+		mp.TRACKID: dbus.MakeVariant(dbus.ObjectPath("/track/1")),
+		mp.TITLE:   dbus.MakeVariant("Lullaby"),
+		mp.LENGTH:  dbus.MakeVariant(int64(time.Hour / time.Microsecond)),
+	})
+	player.SetPlaybackStatus(mp.PlaybackStatusPlaying)
+	player.Register(t)
+	subsystem, client := harness.StartMediaPlayer(t, sb)
+	client.Expect(t, "rsetup_metadata")
+	return player, subsystem, client
+}
+
+func TestSleepTimerDuration(t *testing.T) {
+	player, client := startPlayingPlayer(t, "sleep_duration")
+
+	client.Send(t, "mp:sleep", &ext_mp.SleepTimerRequest{Mode: ext_mp.SleepModeDuration, DurationSec: 1})
+	armed := expectSleepState(t, client)
+	expectOk(t, client, "mp:sleep")
+	if !armed.Active || armed.Mode != ext_mp.SleepModeDuration || armed.RemainingMs <= 0 {
+		t.Errorf("armed: unexpected state %+v", armed)
+	}
+
+	client.Send(t, "mp:sleep_get", nil)
+	queried := client.Expect(t, "rsleep").Args.(*ext_mp.SleepTimerState)
+	if !queried.Active || queried.RemainingMs > 1000 {
+		t.Errorf("query: unexpected state %+v", queried)
+	}
+
+	fired := expectSleepState(t, client)
+	if fired.Active {
+		t.Errorf("fired: timer still active")
+	}
+	if player.PlaybackStatus() != mp.PlaybackStatusPaused {
+		t.Errorf("fired: player is %s", player.PlaybackStatus())
+	}
+}
+
+func TestSleepTimerCancel(t *testing.T) {
+	player, client := startPlayingPlayer(t, "sleep_cancel")
+
+	client.Send(t, "mp:sleep", &ext_mp.SleepTimerRequest{Mode: ext_mp.SleepModeDuration, DurationSec: 1})
+	expectSleepState(t, client)
+	expectOk(t, client, "mp:sleep")
+	client.Send(t, "mp:sleep_cancel", nil)
+	if cancelled := expectSleepState(t, client); cancelled.Active {
+		t.Errorf("cancelled: timer still active")
+	}
+	expectOk(t, client, "mp:sleep_cancel")
+	client.ExpectNone(t, "sleep", time.Second*3/2)
+	if player.CallCount("Pause") != 0 {
+		t.Errorf("cancelled timer paused the player")
+	}
+}
+
+func TestSleepTimerTrackChange(t *testing.T) {
+	player, client := startPlayingPlayer(t, "sleep_track")
+
+	client.Send(t, "mp:sleep", &ext_mp.SleepTimerRequest{Mode: ext_mp.SleepModeTrackEnd})
+	armed := expectSleepState(t, client)
+	if armed.PlayerName != player.Name {
+		t.Errorf("armed: expected player %s, got %+v", player.Name, armed)
+	}
+
+	player.SetMetadata(map[string]dbus.Variant{
+		mp.TRACKID: dbus.MakeVariant(dbus.ObjectPath("/track/2")),
+		mp.TITLE:   dbus.MakeVariant("Wake Up"),
+	})
+	if fired := expectSleepState(t, client); fired.Active {
+		t.Errorf("fired: timer still active")
+	}
+	if player.PlaybackStatus() != mp.PlaybackStatusPaused {
+		t.Errorf("fired: player is %s", player.PlaybackStatus())
+	}
+}
+
+func TestSleepTimerTrackLengthWithFade(t *testing.T) {
+	player, client := startPlayingPlayer(t, "sleep_fade")
+	player.SetVolume(0.8)
+	player.SetMetadata(map[string]dbus.Variant{
+		mp.TRACKID: dbus.MakeVariant(dbus.ObjectPath("/track/short")),
+		mp.LENGTH:  dbus.MakeVariant(int64(61 * time.Second / time.Microsecond)),
+	})
+	player.SetPosition(int64(59 * time.Second / time.Microsecond))
+	client.Drain()
+
+	client.Send(t, "mp:sleep", &ext_mp.SleepTimerRequest{Mode: ext_mp.SleepModeTrackEnd, FadeSec: 1})
+	armed := expectSleepState(t, client)
+	if armed.RemainingMs <= 0 || armed.RemainingMs > 2000 {
+		t.Errorf("armed: unexpected remaining time %+v", armed)
+	}
+	if fading := expectSleepState(t, client); !fading.Fading {
+		t.Errorf("expected fading state, got %+v", fading)
+	}
+	time.Sleep(time.Second / 2)
+	if volume := player.Volume(); volume >= 0.8 {
+		t.Errorf("fading: volume is still %f", volume)
+	}
+
+	if fired := expectSleepState(t, client); fired.Active {
+		t.Errorf("fired: timer still active")
+	}
+	if player.PlaybackStatus() != mp.PlaybackStatusPaused {
+		t.Errorf("fired: player is %s", player.PlaybackStatus())
+	}
+	if volume := player.Volume(); volume != 0.8 {
+		t.Errorf("fired: volume not restored (%f)", volume)
+	}
+}
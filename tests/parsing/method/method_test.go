@@ -0,0 +1,51 @@
+package method
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Artiqlate/cyprus/utils"
+)
+
+func TestParseMethod(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected utils.MethodName
+	}{
+		{"init", utils.MethodName{Module: "init"}},
+		{"mp:iplay", utils.MethodName{Module: "mp", Method: "iplay"}},
+		{"mp:linux:iplay", utils.MethodName{Module: "mp", Platform: utils.PlatformLinux, Method: "iplay"}},
+		{"audio:macos:get", utils.MethodName{Module: "audio", Platform: utils.PlatformMacOS, Method: "get"}},
+	}
+	for _, testCase := range testCases {
+		methodName, parseErr := utils.ParseMethod(testCase.name)
+		if parseErr != nil {
+			t.Errorf("%s: %v", testCase.name, parseErr)
+			continue
+		}
+		if *methodName != testCase.expected {
+			t.Errorf("%s: expected %+v, got %+v", testCase.name, testCase.expected, *methodName)
+		}
+		if methodName.String() != testCase.name {
+			t.Errorf("%s: formatted as %s", testCase.name, methodName.String())
+		}
+	}
+	for _, malformed := range []string{"", "mp:", ":iplay", "mp::iplay", "mp:beos:iplay", "mp:linux:iplay:extra"} {
+		if _, parseErr := utils.ParseMethod(malformed); !errors.Is(parseErr, utils.ErrMalformedMethod) {
+			t.Errorf("%q: expected a malformed method error, got %v", malformed, parseErr)
+		}
+	}
+}
+
+func TestParsePlatformMethod(t *testing.T) {
+	if _, parseErr := utils.ParsePlatformMethod("mp:iplay", utils.PlatformLinux); parseErr != nil {
+		t.Errorf("generic method: %v", parseErr)
+	}
+	if _, parseErr := utils.ParsePlatformMethod("mp:linux:iplay", utils.PlatformLinux); parseErr != nil {
+		t.Errorf("matching platform: %v", parseErr)
+	}
+	_, parseErr := utils.ParsePlatformMethod("mp:windows:iplay", utils.PlatformLinux)
+	if !errors.Is(parseErr, utils.ErrPlatformMismatch) {
+		t.Errorf("other platform: expected a platform mismatch, got %v", parseErr)
+	}
+}
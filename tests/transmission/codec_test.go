@@ -0,0 +1,90 @@
+package transmission
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	ext_audio "github.com/Artiqlate/cyprus/ext_models/audio"
+	media_player "github.com/Artiqlate/cyprus/subsystems/media_player"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/transmission"
+	"github.com/Artiqlate/ganymede/models/mp"
+	"nhooyr.io/websocket"
+)
+
+const memoryPlayerName = "org.mpris.MediaPlayer2.memory"
+
+func TestSubsystemsUnderBothCodecs(t *testing.T) {
+	for name, subprotocol := range map[string]string{"msgpack": "", "json": transmission.ProtocolJSON} {
+		t.Run(name, func(t *testing.T) {
+			server := harness.StartTransmission(t, "mp", "audio")
+			client := server.ConnectWith(t, subprotocol)
+			if enabled := client.Init(t, "mp", "audio"); !reflect.DeepEqual(enabled, []string{"mp", "audio"}) {
+				t.Fatalf("init: unexpected modules %v", enabled)
+			}
+
+			backend := media_player.NewMemoryBackend()
+			backend.AddPlayer(memoryPlayerName, mp.PlaybackStatusPlaying, &mp.Metadata{Title: "Codec Song"})
+			harness.RunMediaPlayer(t, &server.Channels.MPChannel, backend)
+			client.Expect(t, "rsetup_metadata", nil)
+			client.SendWithId(t, "mp:ipause", &mp.PlayerIndex{PlayerIndex: 0}, 1)
+			client.Expect(t, "ok", nil)
+			if actions := backend.Actions(memoryPlayerName); !reflect.DeepEqual(actions, []media_player.PlayerAction{media_player.ActionPause}) {
+				t.Errorf("ipause: unexpected actions %v", actions)
+			}
+			var list mp.MPlayerList
+			client.Send(t, "mp:list", nil)
+			client.Expect(t, "rlist", &list)
+			if !reflect.DeepEqual(list.Players, []string{memoryPlayerName}) {
+				t.Errorf("list: unexpected players %v", list.Players)
+			}
+
+			pactl := harness.NewFakePactl()
+			harness.RunAudio(t, &server.Channels.AudioChannel, pactl)
+			client.Expect(t, "state", nil)
+			// A whole number, which JSON doesn't tell apart from an integer
+			client.Send(t, "audio:set_volume", &ext_audio.VolumeRequest{Volume: 1})
+			client.Expect(t, "ok", nil)
+			var state ext_audio.AudioState
+			client.Send(t, "audio:get", nil)
+			client.Expect(t, "rstate", &state)
+			if state.Volume != 1 || state.SinkName != pactl.SinkName {
+				t.Errorf("get: unexpected state %+v", state)
+			}
+		})
+	}
+}
+
+func TestJSONCodecMessages(t *testing.T) {
+	server := harness.StartTransmission(t, "mp")
+	conn, _, dialErr := server.DialWith(&websocket.DialOptions{Subprotocols: []string{transmission.ProtocolJSON}})
+	if dialErr != nil {
+		t.Fatalf("dial: %v", dialErr)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readContext, cancel := context.WithTimeout(context.Background(), harness.DefaultExpectTimeout)
+	defer cancel()
+
+	// Same shapes as MessagePack, structs included.
+	conn.Write(readContext, websocket.MessageText, []byte(`["init", ["amd64", "linux", ["mp", "tv"]], "init-1"]`))
+	messageType, data, readErr := conn.Read(readContext)
+	if readErr != nil || messageType != websocket.MessageText {
+		t.Fatalf("rinit: %v (%v)", readErr, messageType)
+	}
+	var rinit []interface{}
+	if decodeErr := json.Unmarshal(data, &rinit); decodeErr != nil {
+		t.Fatalf("rinit: %s: %v", data, decodeErr)
+	}
+	if len(rinit) != 3 || rinit[0] != "rinit" || rinit[2] != "init-1" ||
+		!reflect.DeepEqual(rinit[1].([]interface{})[2], []interface{}{"mp"}) {
+		t.Errorf("rinit: unexpected %s", data)
+	}
+
+	// Anything other than a message array ends the connection.
+	conn.Write(readContext, websocket.MessageText, []byte(`{"method": "mp:list"}`))
+	if _, _, readErr := conn.Read(readContext); websocket.CloseStatus(readErr) != websocket.StatusInternalError {
+		t.Errorf("still connected after a malformed message (%v)", readErr)
+	}
+}
@@ -0,0 +1,78 @@
+package transmission
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/transmission"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/Artiqlate/ganymede/models/base"
+	"github.com/vmihailenco/msgpack/v5"
+	"nhooyr.io/websocket"
+)
+
+const (
+	testHeartbeatInterval = time.Millisecond * 50
+	testIdleTimeout       = time.Millisecond * 250
+)
+
+func startHeartbeatServer(t *testing.T) *harness.TransmissionServer {
+	t.Helper()
+	return harness.StartTransmissionWith(t, harness.TransmissionOptions{
+		Modules: []string{"mp"},
+		Transport: &transmission.TransportOptions{
+			HeartbeatInterval: transmission.Duration(testHeartbeatInterval),
+			IdleTimeout:       transmission.Duration(testIdleTimeout),
+		},
+	})
+}
+
+func TestHeartbeatKeepsQuietClients(t *testing.T) {
+	server := startHeartbeatServer(t)
+	client := server.Connect(t)
+	client.Init(t, "mp")
+
+	// Quiet for several idle timeouts, while answering pings
+	time.Sleep(testIdleTimeout * 4)
+	select {
+	case sessionClose := <-server.Closes:
+		t.Fatalf("quiet client was disconnected: %+v", sessionClose)
+	default:
+	}
+	server.Send(t, "mp", harness.ClientSession, models.Message{Method: "mp:linux:rlist", Args: []string{}})
+	client.Expect(t, "rlist", nil)
+}
+
+func TestHeartbeatDetectsDeadConnections(t *testing.T) {
+	server := startHeartbeatServer(t)
+	conn, dialErr := server.Dial(nil)
+	if dialErr != nil {
+		t.Fatalf("dial: %v", dialErr)
+	}
+	defer conn.CloseNow()
+	ctx, cancel := context.WithTimeout(context.Background(), harness.DefaultExpectTimeout)
+	defer cancel()
+	encoded, _ := msgpack.Marshal(&models.Message{Method: "init", Args: base.NewInitWithCapabilities([]string{"mp"})})
+	if writeErr := conn.Write(ctx, websocket.MessageBinary, encoded); writeErr != nil {
+		t.Fatalf("init: %v", writeErr)
+	}
+	if _, _, readErr := conn.Read(ctx); readErr != nil {
+		t.Fatalf("rinit: %v", readErr)
+	}
+
+	// The client stops reading (so stops answering pings), as if it dropped
+	// off the network.
+	lostAt := time.Now()
+	sessionClose := server.ExpectClose(t)
+	if sessionClose.Session != harness.ClientSession || sessionClose.Modules != nil {
+		t.Errorf("unexpected release %+v", sessionClose)
+	}
+	if elapsed := time.Since(lostAt); elapsed < testIdleTimeout-testHeartbeatInterval || elapsed > testIdleTimeout*4 {
+		t.Errorf("dead connection released after %s (idle timeout %s)", elapsed, testIdleTimeout)
+	}
+	if _, _, readErr := conn.Read(ctx); readErr == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+}
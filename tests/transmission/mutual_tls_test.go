@@ -0,0 +1,173 @@
+package transmission
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/transmission"
+	"github.com/Artiqlate/ganymede/models/base"
+	"nhooyr.io/websocket"
+)
+
+// Starts a secure server requiring client certificates from the CA, or
+// pinned in the trust store (with pairing on).
+func startMutualTLS(t *testing.T) (*harness.TransmissionServer, *transmission.ClientCA, *transmission.TrustStore) {
+	t.Helper()
+	dir := t.TempDir()
+	certificate, identityErr := transmission.NewTLSIdentity(dir).LoadOrCreate(nil)
+	if identityErr != nil {
+		t.Fatalf("identity: %v", identityErr)
+	}
+	clientCA := transmission.NewClientCA(dir)
+	if caErr := clientCA.LoadOrCreate(); caErr != nil {
+		t.Fatalf("client CA: %v", caErr)
+	}
+	trustStore := transmission.NewTrustStore(filepath.Join(dir, transmission.TrustStoreFileName))
+	server := harness.StartTransmissionWith(t, harness.TransmissionOptions{
+		Modules:             []string{"mp"},
+		TrustStore:          trustStore,
+		Certificate:         certificate,
+		ClientAuthenticator: transmission.NewClientAuthenticator(clientCA, trustStore),
+	})
+	return server, clientCA, trustStore
+}
+
+func issueClient(t *testing.T, clientCA *transmission.ClientCA, clientName string) (tls.Certificate, *transmission.IssuedClient) {
+	t.Helper()
+	certificatePEM, keyPEM, issuedClient, issueErr := clientCA.Issue(clientName)
+	if issueErr != nil {
+		t.Fatalf("issue: %v", issueErr)
+	}
+	clientCertificate, pairErr := tls.X509KeyPair(certificatePEM, keyPEM)
+	if pairErr != nil {
+		t.Fatalf("issue: %v", pairErr)
+	}
+	return clientCertificate, issuedClient
+}
+
+// Opens a websocket connection with the given client certificate (none when
+// nil).
+func dialWithCertificate(server *harness.TransmissionServer, clientCertificate *tls.Certificate) (*websocket.Conn, error) {
+	tlsConfig := server.ClientTLSConfig()
+	if clientCertificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*clientCertificate}
+	}
+	return server.Dial(tlsConfig)
+}
+
+func TestMutualTLSIssuedCertificates(t *testing.T) {
+	server, clientCA, _ := startMutualTLS(t)
+	clientCertificate, issuedClient := issueClient(t, clientCA, "phone")
+
+	// Clients with an issued certificate can `init` without pairing.
+	conn, dialErr := dialWithCertificate(server, &clientCertificate)
+	if dialErr != nil {
+		t.Fatalf("issued certificate rejected: %v", dialErr)
+	}
+	client := harness.NewWSClient(t, conn)
+	if enabled := client.Init(t, "mp"); !reflect.DeepEqual(enabled, []string{"mp"}) {
+		t.Errorf("init: unexpected modules %v", enabled)
+	}
+
+	if conn, dialErr := dialWithCertificate(server, nil); dialErr == nil {
+		conn.Close(websocket.StatusNormalClosure, "")
+		t.Errorf("connected without a client certificate")
+	}
+	otherCA := transmission.NewClientCA(t.TempDir())
+	otherCA.LoadOrCreate()
+	otherCertificate, _ := issueClient(t, otherCA, "stranger")
+	if conn, dialErr := dialWithCertificate(server, &otherCertificate); dialErr == nil {
+		conn.Close(websocket.StatusNormalClosure, "")
+		t.Errorf("connected with a certificate from another CA")
+	}
+
+	// Revoked certificates are rejected from then on.
+	if revoked, revokeErr := clientCA.Revoke(issuedClient.Serial); revoked != 1 || revokeErr != nil {
+		t.Fatalf("revoke: %d revoked (%v)", revoked, revokeErr)
+	}
+	if conn, dialErr := dialWithCertificate(server, &clientCertificate); dialErr == nil {
+		conn.Close(websocket.StatusNormalClosure, "")
+		t.Errorf("connected with a revoked certificate")
+	}
+	if issued, _ := clientCA.Issued(); len(issued) != 1 || issued[0].RevokedAt == 0 {
+		t.Errorf("unexpected issued certificates %+v", issued)
+	}
+}
+
+func TestMutualTLSPinnedCertificates(t *testing.T) {
+	server, _, trustStore := startMutualTLS(t)
+	// A self-signed certificate, as a client would make for itself.
+	pinned, identityErr := transmission.NewTLSIdentity(t.TempDir()).LoadOrCreate(nil)
+	if identityErr != nil {
+		t.Fatalf("client identity: %v", identityErr)
+	}
+	if conn, dialErr := dialWithCertificate(server, pinned); dialErr == nil {
+		conn.Close(websocket.StatusNormalClosure, "")
+		t.Errorf("connected with a certificate which isn't pinned")
+	}
+
+	if _, pinErr := trustStore.PinCertificate("laptop", transmission.Fingerprint(pinned)); pinErr != nil {
+		t.Fatalf("pin: %v", pinErr)
+	}
+	conn, dialErr := dialWithCertificate(server, pinned)
+	if dialErr != nil {
+		t.Fatalf("pinned certificate rejected: %v", dialErr)
+	}
+	client := harness.NewWSClient(t, conn)
+	client.Send(t, "init", base.NewInitWithCapabilities([]string{"mp"}))
+	client.Expect(t, "rinit", nil)
+
+	// Pinned certificates can't be used as pairing credentials.
+	clients, _ := trustStore.Clients()
+	if verified, _ := trustStore.Verify(clients[0].Id, ""); verified != nil {
+		t.Errorf("pinned client authenticated with an empty credential")
+	}
+
+	if removed, removeErr := trustStore.Remove(transmission.Fingerprint(pinned)); removed != 1 || removeErr != nil {
+		t.Fatalf("remove: %d removed (%v)", removed, removeErr)
+	}
+	if conn, dialErr := dialWithCertificate(server, pinned); dialErr == nil {
+		conn.Close(websocket.StatusNormalClosure, "")
+		t.Errorf("connected with an unpinned certificate")
+	}
+}
+
+func TestMutualTLSRevocationWithResumedSessions(t *testing.T) {
+	server, clientCA, trustStore := startMutualTLS(t)
+	clientCertificate, issuedClient := issueClient(t, clientCA, "phone")
+	pinned, identityErr := transmission.NewTLSIdentity(t.TempDir()).LoadOrCreate(nil)
+	if identityErr != nil {
+		t.Fatalf("client identity: %v", identityErr)
+	}
+	trustStore.PinCertificate("laptop", transmission.Fingerprint(pinned))
+
+	for _, testCase := range []struct {
+		name        string
+		certificate *tls.Certificate
+		revoke      func()
+	}{
+		{"revoked", &clientCertificate, func() { clientCA.Revoke(issuedClient.Serial) }},
+		{"unpinned", pinned, func() { trustStore.Remove(transmission.Fingerprint(pinned)) }},
+	} {
+		// Clients which keep their session tickets, to resume sessions with
+		tlsConfig := server.ClientTLSConfig()
+		tlsConfig.Certificates = []tls.Certificate{*testCase.certificate}
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+		for attempt := 0; attempt < 2; attempt++ {
+			conn, dialErr := server.Dial(tlsConfig)
+			if dialErr != nil {
+				t.Fatalf("%s: rejected before it was revoked: %v", testCase.name, dialErr)
+			}
+			harness.NewWSClient(t, conn).Init(t, "mp")
+		}
+
+		testCase.revoke()
+		if conn, dialErr := server.Dial(tlsConfig); dialErr == nil {
+			conn.Close(websocket.StatusNormalClosure, "")
+			t.Errorf("%s: connected again by resuming a session", testCase.name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package transmission
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/transmission"
+	"nhooyr.io/websocket"
+)
+
+func dialFromOrigin(t *testing.T, server *harness.TransmissionServer, origin string) (int, bool) {
+	t.Helper()
+	options := &websocket.DialOptions{HTTPHeader: http.Header{}}
+	if origin != "" {
+		options.HTTPHeader.Set("Origin", origin)
+	}
+	conn, response, dialErr := server.DialWith(options)
+	if dialErr != nil {
+		if response == nil {
+			t.Fatalf("%s: %v", origin, dialErr)
+		}
+		return response.StatusCode, false
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+	return response.StatusCode, true
+}
+
+func TestBrowserOriginsRejectedByDefault(t *testing.T) {
+	server := harness.StartTransmission(t, "mp")
+	// Native clients don't send an origin.
+	if _, connected := dialFromOrigin(t, server, ""); !connected {
+		t.Errorf("client without an origin rejected")
+	}
+	for _, origin := range []string{"http://evil.example.com", strings.Replace(server.Url, "ws://", "http://", 1), "null"} {
+		if status, connected := dialFromOrigin(t, server, origin); connected || status != http.StatusForbidden {
+			t.Errorf("%s: connected %v (status %d)", origin, connected, status)
+		}
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	server := harness.StartTransmissionWith(t, harness.TransmissionOptions{
+		Modules:        []string{"mp"},
+		AllowedOrigins: []string{"remote.example.com", "*.lan:8080"},
+	})
+	for origin, allowed := range map[string]bool{
+		"https://remote.example.com":   true,
+		"https://REMOTE.example.com":   true,
+		"http://player.lan:8080":       true,
+		"http://player.lan:9090":       false,
+		"https://evil.example.com":     false,
+		"https://remote.example.com.x": false,
+	} {
+		if _, connected := dialFromOrigin(t, server, origin); connected != allowed {
+			t.Errorf("%s: connected %v, expected %v", origin, connected, allowed)
+		}
+	}
+
+	if _, patternErr := transmission.NewOriginPolicy([]string{"[broken"}); patternErr == nil {
+		t.Errorf("broken pattern accepted")
+	}
+}
@@ -0,0 +1,178 @@
+package transmission
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Artiqlate/cyprus/ext_models"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/transmission"
+	"github.com/Artiqlate/ganymede/models/base"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func startPairingServer(t *testing.T) (*harness.TransmissionServer, *transmission.TrustStore) {
+	t.Helper()
+	trustStore := transmission.NewTrustStore(filepath.Join(t.TempDir(), transmission.TrustStoreFileName))
+	return harness.StartTransmissionWith(t, harness.TransmissionOptions{
+		Modules:    []string{"mp"},
+		TrustStore: trustStore,
+	}), trustStore
+}
+
+func expectError(t *testing.T, client *harness.WSClient, requestMethod string, code string) {
+	t.Helper()
+	var commandErr ext_models.CommandError
+	client.Expect(t, "err", &commandErr)
+	if commandErr.Method != requestMethod || commandErr.Code != code {
+		t.Errorf("expected %s error for %s, got %+v", code, requestMethod, commandErr)
+	}
+}
+
+// Pairs a client, and returns its credential.
+func pair(t *testing.T, server *harness.TransmissionServer, client *harness.WSClient) ext_models.ClientCredential {
+	t.Helper()
+	client.Send(t, "pair", &ext_models.PairRequest{ClientName: "Phone"})
+	var challenge ext_models.PairChallenge
+	client.Expect(t, "rpair", &challenge)
+	pin := server.ExpectPin(t)
+	client.Send(t, "pair_verify", &ext_models.PairVerify{Proof: transmission.PinProof(pin, challenge.Nonce)})
+	var credential ext_models.ClientCredential
+	client.Expect(t, "rpair_verify", &credential)
+	return credential
+}
+
+func TestPairing(t *testing.T) {
+	server, trustStore := startPairingServer(t)
+	phone := server.Connect(t)
+
+	// Nothing is accepted before pairing.
+	phone.Send(t, "init", base.NewInitWithCapabilities([]string{"mp"}))
+	expectError(t, phone, "init", ext_models.ErrCodeUnauthorized)
+
+	// A wrong proof uses the PIN up.
+	phone.Send(t, "pair", &ext_models.PairRequest{ClientName: "Phone"})
+	var challenge ext_models.PairChallenge
+	phone.Expect(t, "rpair", &challenge)
+	pin := server.ExpectPin(t)
+	if len(pin) != transmission.PairingPinDigits || challenge.Nonce == "" {
+		t.Fatalf("pair: unexpected PIN %q, challenge %+v", pin, challenge)
+	}
+	phone.Send(t, "pair_verify", &ext_models.PairVerify{Proof: transmission.PinProof("not the pin", challenge.Nonce)})
+	expectError(t, phone, "pair_verify", ext_models.ErrCodePairingFailed)
+	phone.Send(t, "pair_verify", &ext_models.PairVerify{Proof: transmission.PinProof(pin, challenge.Nonce)})
+	expectError(t, phone, "pair_verify", ext_models.ErrCodePairingFailed)
+
+	credential := pair(t, server, phone)
+	if enabled := phone.Init(t, "mp"); !reflect.DeepEqual(enabled, []string{"mp"}) {
+		t.Errorf("init: unexpected modules %v", enabled)
+	}
+	clients, clientsErr := trustStore.Clients()
+	if clientsErr != nil || len(clients) != 1 || clients[0].Id != credential.ClientId || clients[0].Name != "Phone" {
+		t.Fatalf("trust store: unexpected clients %+v (%v)", clients, clientsErr)
+	}
+	if clients[0].CredentialHash == credential.Credential {
+		t.Errorf("trust store: credential kept in the clear")
+	}
+	if info, statErr := os.Stat(trustStore.Path()); statErr != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("trust store: unexpected file %v (%v)", info, statErr)
+	}
+
+	// Paired clients authenticate with their credential later on.
+	again := server.Connect(t)
+	again.Send(t, "auth", &credential)
+	again.Expect(t, "rauth", nil)
+	if enabled := again.Init(t, "mp"); !reflect.DeepEqual(enabled, []string{"mp"}) {
+		t.Errorf("auth: unexpected modules %v", enabled)
+	}
+	intruder := server.Connect(t)
+	intruder.Send(t, "auth", &ext_models.ClientCredential{ClientId: credential.ClientId, Credential: "guess"})
+	expectError(t, intruder, "auth", ext_models.ErrCodeAuthFailed)
+	intruder.Send(t, "init", base.NewInitWithCapabilities([]string{"mp"}))
+	expectError(t, intruder, "init", ext_models.ErrCodeUnauthorized)
+}
+
+func TestPairingAttemptsAreLimited(t *testing.T) {
+	server, _ := startPairingServer(t)
+	client := server.Connect(t)
+	for attempt := 0; attempt < transmission.MaxPairingAttempts; attempt++ {
+		client.Send(t, "pair", &ext_models.PairRequest{ClientName: "Guesser"})
+		client.Expect(t, "rpair", nil)
+	}
+	client.Send(t, "pair", &ext_models.PairRequest{ClientName: "Guesser"})
+	client.ExpectDisconnect(t)
+}
+
+func TestReplacedPinsCountAsFailures(t *testing.T) {
+	server, _ := startPairingServer(t)
+
+	// Asking for new PINs instead of proving them runs into the cooldown too.
+	pinsShown := 0
+	for client := 0; ; client++ {
+		guesser := server.Connect(t)
+		for attempt := 0; attempt < transmission.MaxPairingAttempts; attempt++ {
+			guesser.Send(t, "pair", &ext_models.PairRequest{ClientName: "Guesser"})
+			message := guesser.Next(t)
+			if message.Method == ext_models.MethodError {
+				var commandErr ext_models.CommandError
+				msgpack.Unmarshal(message.Args, &commandErr)
+				if commandErr.Code != ext_models.ErrCodePairingUnavailable || pinsShown != transmission.PairingFailuresAllowed+1 {
+					t.Fatalf("after %d PINs: unexpected error %+v", pinsShown, commandErr)
+				}
+				return
+			}
+			server.ExpectPin(t)
+			pinsShown++
+		}
+		if client > 0 {
+			t.Fatalf("%d PINs shown without a cooldown", pinsShown)
+		}
+		guesser.Close()
+	}
+}
+
+func TestPairingIsLimitedAcrossReconnects(t *testing.T) {
+	server, _ := startPairingServer(t)
+
+	// One PIN at a time
+	first, second := server.Connect(t), server.Connect(t)
+	first.Send(t, "pair", &ext_models.PairRequest{ClientName: "First"})
+	var challenge ext_models.PairChallenge
+	first.Expect(t, "rpair", &challenge)
+	server.ExpectPin(t)
+	second.Send(t, "pair", &ext_models.PairRequest{ClientName: "Second"})
+	expectError(t, second, "pair", ext_models.ErrCodePairingUnavailable)
+	first.Send(t, "pair_verify", &ext_models.PairVerify{Proof: transmission.PinProof("wrong", challenge.Nonce)})
+	expectError(t, first, "pair_verify", ext_models.ErrCodePairingFailed)
+	first.Close()
+
+	// Guessers reconnecting for fresh PINs get a cooldown.
+	for attempt := 1; ; attempt++ {
+		guesser := server.Connect(t)
+		guesser.Send(t, "pair", &ext_models.PairRequest{ClientName: "Guesser"})
+		message := guesser.Next(t)
+		if message.Method == ext_models.MethodError {
+			var commandErr ext_models.CommandError
+			msgpack.Unmarshal(message.Args, &commandErr)
+			if commandErr.Code != ext_models.ErrCodePairingUnavailable || attempt != transmission.PairingFailuresAllowed+1 {
+				t.Fatalf("attempt %d: unexpected error %+v", attempt, commandErr)
+			}
+			break
+		}
+		if attempt > transmission.PairingFailuresAllowed {
+			t.Fatalf("attempt %d: still pairing", attempt)
+		}
+		msgpack.Unmarshal(message.Args, &challenge)
+		server.ExpectPin(t)
+		guesser.Send(t, "pair_verify", &ext_models.PairVerify{Proof: transmission.PinProof("000000", challenge.Nonce)})
+		expectError(t, guesser, "pair_verify", ext_models.ErrCodePairingFailed)
+		guesser.Close()
+	}
+	select {
+	case pin := <-server.Pins:
+		t.Errorf("PIN %s shown during the cooldown", pin)
+	default:
+	}
+}
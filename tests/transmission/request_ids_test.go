@@ -0,0 +1,64 @@
+package transmission
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/Artiqlate/ganymede/models/base"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func decodeId(t *testing.T, encoded msgpack.RawMessage) interface{} {
+	t.Helper()
+	if encoded == nil {
+		return nil
+	}
+	var id interface{}
+	if decodeErr := msgpack.Unmarshal(encoded, &id); decodeErr != nil {
+		t.Fatalf("decode ID %x: %v", encoded, decodeErr)
+	}
+	return id
+}
+
+func TestRepliesEchoRequestIds(t *testing.T) {
+	server := harness.StartTransmission(t, "mp")
+	client := server.Connect(t)
+
+	client.SendWithId(t, "init", base.NewInitWithCapabilities([]string{"mp"}), 1)
+	if id := decodeId(t, client.ExpectMessage(t, "rinit").Id); id != int8(1) {
+		t.Errorf("rinit: unexpected ID %#v", id)
+	}
+
+	// Module requests carry the ID, and their replies get it back.
+	client.SendWithId(t, "mp:list", nil, "list-1")
+	request := server.ExpectRequest(t, "mp")
+	if id := decodeId(t, request.Id); id != "list-1" {
+		t.Fatalf("request: unexpected ID %#v", id)
+	}
+	server.Reply(t, "mp", request, models.Message{Method: "mp:linux:rlist", Args: []string{}})
+	if id := decodeId(t, client.ExpectMessage(t, "rlist").Id); id != "list-1" {
+		t.Errorf("rlist: unexpected ID %#v", id)
+	}
+
+	// Events don't have one, so older clients keep decoding them.
+	server.SendEvent(t, "mp", 1, models.Message{Method: "mp:linux:psu", Args: []string{}})
+	if event := client.ExpectMessage(t, "psu"); event.Id != nil {
+		t.Errorf("psu: unexpected ID %#v", decodeId(t, event.Id))
+	}
+
+	// Errors the server replies with itself echo it too.
+	client.SendWithId(t, "mp:windows:play", nil, []interface{}{"nested", 2})
+	if id := decodeId(t, client.ExpectMessage(t, "err").Id); !reflect.DeepEqual(id, []interface{}{"nested", int8(2)}) {
+		t.Errorf("err: unexpected ID %#v", id)
+	}
+
+	// Requests without an ID (or with a nil one) get replies without one.
+	client.SendWithId(t, "mp:close", nil, nil)
+	if reply := client.ExpectMessage(t, "ok"); reply.Id != nil {
+		t.Errorf("ok: unexpected ID %#v", decodeId(t, reply.Id))
+	}
+	client.ExpectNone(t, "ok", time.Millisecond*50)
+}
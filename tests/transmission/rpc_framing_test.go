@@ -0,0 +1,179 @@
+package transmission
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Artiqlate/cyprus/ext_models"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/transmission"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/Artiqlate/ganymede/models/base"
+	"github.com/Artiqlate/ganymede/models/mp"
+	"github.com/vmihailenco/msgpack/v5"
+	"nhooyr.io/websocket"
+)
+
+// A client speaking MessagePack-RPC, with a standard library's framing.
+type rpcClient struct {
+	conn *websocket.Conn
+}
+
+func connectRPC(t *testing.T, server *harness.TransmissionServer) *rpcClient {
+	t.Helper()
+	conn, _, dialErr := server.DialWith(&websocket.DialOptions{Subprotocols: []string{transmission.ProtocolMsgpackRPC}})
+	if dialErr != nil {
+		t.Fatalf("dial: %v", dialErr)
+	}
+	t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+	if conn.Subprotocol() != transmission.ProtocolMsgpackRPC {
+		t.Fatalf("subprotocol %q not negotiated", conn.Subprotocol())
+	}
+	return &rpcClient{conn: conn}
+}
+
+func (c *rpcClient) send(t *testing.T, frame ...interface{}) {
+	t.Helper()
+	encoded, _ := msgpack.Marshal(frame)
+	if writeErr := c.conn.Write(context.Background(), websocket.MessageBinary, encoded); writeErr != nil {
+		t.Fatalf("send: %v", writeErr)
+	}
+}
+
+// Reads the next message, as its (still encoded) elements.
+func (c *rpcClient) receive(t *testing.T) []msgpack.RawMessage {
+	t.Helper()
+	readContext, cancel := context.WithTimeout(context.Background(), harness.DefaultExpectTimeout)
+	defer cancel()
+	_, data, readErr := c.conn.Read(readContext)
+	if readErr != nil {
+		t.Fatalf("receive: %v", readErr)
+	}
+	var frame []msgpack.RawMessage
+	if decodeErr := msgpack.Unmarshal(data, &frame); decodeErr != nil {
+		t.Fatalf("receive: %v", decodeErr)
+	}
+	return frame
+}
+
+// Reads the response to the given message ID, decoding its error and result.
+func (c *rpcClient) expectResponse(t *testing.T, msgid uint32, errorValue interface{}, result interface{}) {
+	t.Helper()
+	frame := c.receive(t)
+	var messageType int
+	var responseId uint32
+	msgpack.Unmarshal(frame[0], &messageType)
+	msgpack.Unmarshal(frame[1], &responseId)
+	if len(frame) != 4 || messageType != 1 || responseId != msgid {
+		t.Fatalf("expected response %d, got %d elements (type %d, msgid %d)", msgid, len(frame), messageType, responseId)
+	}
+	for _, decode := range []struct {
+		encoded msgpack.RawMessage
+		value   interface{}
+	}{{frame[2], errorValue}, {frame[3], result}} {
+		if decode.value == nil {
+			var nilValue interface{}
+			if msgpack.Unmarshal(decode.encoded, &nilValue); nilValue != nil {
+				t.Fatalf("response %d: unexpected %#v", msgid, nilValue)
+			}
+		} else if decodeErr := msgpack.Unmarshal(decode.encoded, decode.value); decodeErr != nil {
+			t.Fatalf("response %d: %v", msgid, decodeErr)
+		}
+	}
+}
+
+func TestMsgpackRPCFraming(t *testing.T) {
+	server := harness.StartTransmission(t, "mp")
+	client := connectRPC(t, server)
+
+	client.send(t, 0, 1, "init", []interface{}{base.NewInitWithCapabilities([]string{"mp"})})
+	var rinit base.Init
+	client.expectResponse(t, 1, nil, &rinit)
+	if !reflect.DeepEqual(rinit.Capabilities, []string{"mp"}) {
+		t.Errorf("init: unexpected modules %v", rinit.Capabilities)
+	}
+
+	// Requests reach the module like native ones, with the message ID.
+	client.send(t, 0, 2, "mp:list", []interface{}{})
+	request := server.ExpectRequest(t, "mp")
+	var native []interface{}
+	msgpack.Unmarshal(request.Data, &native)
+	if !reflect.DeepEqual(native, []interface{}{"mp:list", nil, int8(2)}) {
+		t.Errorf("request: unexpected native message %#v", native)
+	}
+	server.Reply(t, "mp", request, models.Message{Method: "mp:linux:rlist", Args: []string{"player"}})
+	var players []string
+	client.expectResponse(t, 2, nil, &players)
+	if !reflect.DeepEqual(players, []string{"player"}) {
+		t.Errorf("list: unexpected result %v", players)
+	}
+
+	// Error replies are the error of the response.
+	client.send(t, 0, 3, "mp:windows:play", []interface{}{})
+	var commandErr ext_models.CommandError
+	client.expectResponse(t, 3, &commandErr, nil)
+	if commandErr.Code != ext_models.ErrCodePlatformMismatch {
+		t.Errorf("error: unexpected %+v", commandErr)
+	}
+
+	// Notifications have no message ID, and events are notifications.
+	client.send(t, 2, "mp:play", []interface{}{})
+	if request := server.ExpectRequest(t, "mp"); request.Id != nil {
+		t.Errorf("notification: unexpected ID %x", request.Id)
+	}
+	server.SendEvent(t, "mp", 4, models.Message{Method: "mp:linux:psu", Args: &mp.MPlayerList{Players: []string{"org.mpris.MediaPlayer2.first"}}})
+	frame := client.receive(t)
+	var messageType int
+	var method string
+	var params []mp.MPlayerList
+	msgpack.Unmarshal(frame[0], &messageType)
+	msgpack.Unmarshal(frame[1], &method)
+	msgpack.Unmarshal(frame[2], &params)
+	if len(frame) != 3 || messageType != 2 || method != "mp:linux:psu" || len(params) != 1 || len(params[0].Players) != 1 {
+		t.Errorf("event: unexpected notification %d %s %+v", messageType, method, params)
+	}
+
+	// Messages which aren't MessagePack-RPC end the connection.
+	client.send(t, "mp:list", nil)
+	readContext, cancel := context.WithTimeout(context.Background(), harness.DefaultExpectTimeout)
+	defer cancel()
+	if _, _, readErr := client.conn.Read(readContext); websocket.CloseStatus(readErr) != websocket.StatusInternalError {
+		t.Errorf("still connected after a malformed message (%v)", readErr)
+	}
+}
+
+// Requests which don't get to a subsystem get a response too, so library
+// calls don't wait forever.
+func TestMsgpackRPCRespondsToEveryRequest(t *testing.T) {
+	server := harness.StartTransmission(t, "mp", "audio")
+	client := connectRPC(t, server)
+	client.send(t, 0, 1, "init", []interface{}{base.NewInitWithCapabilities([]string{"mp"})})
+	client.expectResponse(t, 1, nil, &base.Init{})
+
+	for msgid, request := range []struct {
+		method string
+		code   string
+	}{
+		{"audio:get", ext_models.ErrCodeModuleNotEnabled},
+		{"nothing:get", ext_models.ErrCodeUnknownModule},
+		{"mp::list", ext_models.ErrCodeDecode},
+		{"init", ext_models.ErrCodeAlreadyInitialized},
+		{ext_models.MethodPair, ext_models.ErrCodePairingDisabled},
+	} {
+		client.send(t, 0, 10+msgid, request.method, []interface{}{})
+		var commandErr ext_models.CommandError
+		client.expectResponse(t, uint32(10+msgid), &commandErr, nil)
+		if commandErr.Method != request.method || commandErr.Code != request.code {
+			t.Errorf("%s: unexpected error %+v", request.method, commandErr)
+		}
+	}
+
+	client.send(t, 0, 20, "close", []interface{}{})
+	var commandOk ext_models.CommandOk
+	client.expectResponse(t, 20, nil, &commandOk)
+	if commandOk.Method != "close" {
+		t.Errorf("close: unexpected result %+v", commandOk)
+	}
+	server.ExpectClose(t)
+}
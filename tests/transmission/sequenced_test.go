@@ -0,0 +1,48 @@
+package transmission
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Artiqlate/cyprus/ext_models"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+func TestSequencedEvents(t *testing.T) {
+	server := harness.StartTransmission(t, "mp")
+	plain := server.Connect(t)
+	plain.Init(t, "mp")
+	sequenced := server.Connect(t)
+	if enabled := sequenced.Init(t, "mp", ext_models.CapabilitySequenced); !reflect.DeepEqual(enabled, []string{"mp", ext_models.CapabilitySequenced}) {
+		t.Fatalf("init: unexpected capabilities %v", enabled)
+	}
+
+	// Events keep their arguments, unless the session asked for sequence
+	// numbers.
+	players := []string{"org.mpris.MediaPlayer2.first"}
+	server.SendEvent(t, "mp", 7, models.Message{Method: "mp:linux:cr", Args: &mp.MPlayerList{Players: players}})
+	var list mp.MPlayerList
+	plain.Expect(t, "cr", &list)
+	if !reflect.DeepEqual(list.Players, players) {
+		t.Errorf("plain: unexpected %+v", list)
+	}
+	var event struct {
+		//lint:ignore U1000 `msgpack` options, not for serialization.
+		_msgpack struct{} `msgpack:",as_array"`
+		Seq      uint64
+		Data     mp.MPlayerList
+	}
+	sequenced.Expect(t, "cr", &event)
+	if event.Seq != 7 || !reflect.DeepEqual(event.Data.Players, players) {
+		t.Errorf("sequenced: unexpected %+v", event)
+	}
+
+	// Replies aren't sequenced.
+	server.Send(t, "mp", harness.ClientSession+1, models.Message{Method: "mp:linux:rlist", Args: &mp.MPlayerList{Players: players}})
+	sequenced.Expect(t, "rlist", &list)
+	if !reflect.DeepEqual(list.Players, players) {
+		t.Errorf("rlist: unexpected %+v", list)
+	}
+}
@@ -0,0 +1,71 @@
+package transmission
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Artiqlate/cyprus/comm"
+	"github.com/Artiqlate/cyprus/ext_models"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/Artiqlate/ganymede/models/mp"
+)
+
+func TestConcurrentSessions(t *testing.T) {
+	server := harness.StartTransmission(t, "mp")
+	phone := server.Connect(t)
+	tablet := server.Connect(t)
+
+	// Each session has its own initialization.
+	if enabled := phone.Init(t, "mp", "audio"); !reflect.DeepEqual(enabled, []string{"mp"}) {
+		t.Fatalf("phone: unexpected modules %v", enabled)
+	}
+	if enabled := tablet.Init(t, "mp"); !reflect.DeepEqual(enabled, []string{"mp"}) {
+		t.Fatalf("tablet: unexpected modules %v", enabled)
+	}
+	phone.Send(t, "mp:list", nil)
+	phoneSession := server.ExpectRequest(t, "mp").Session
+	tablet.Send(t, "mp:list", nil)
+	tabletSession := server.ExpectRequest(t, "mp").Session
+	if phoneSession == tabletSession || phoneSession == comm.BroadcastSession {
+		t.Fatalf("unexpected sessions %d and %d", phoneSession, tabletSession)
+	}
+
+	// Replies only go to their session, events to every subscribed session.
+	server.Send(t, "mp", phoneSession, models.Message{
+		Method: "mp:linux:rlist",
+		Args:   &mp.MPlayerList{Players: []string{"phone"}},
+	})
+	var players mp.MPlayerList
+	phone.Expect(t, "rlist", &players)
+	if !reflect.DeepEqual(players.Players, []string{"phone"}) {
+		t.Errorf("phone: unexpected players %v", players.Players)
+	}
+	tablet.ExpectNone(t, "rlist", time.Second/2)
+	server.Send(t, "mp", comm.BroadcastSession, models.Message{Method: "mp:linux:psu"})
+	phone.Expect(t, "psu", nil)
+	tablet.Expect(t, "psu", nil)
+	server.Send(t, "audio", comm.BroadcastSession, models.Message{Method: "audio:linux:state"})
+	phone.ExpectNone(t, "state", time.Second/2)
+
+	// Closing a module only lets go of it for that session.
+	phone.Send(t, "mp:close", nil)
+	var closed ext_models.CommandOk
+	phone.Expect(t, "ok", &closed)
+	if closed.Method != "mp:close" {
+		t.Errorf("close: unexpected reply %+v", closed)
+	}
+	if release := server.ExpectClose(t); release.Session != phoneSession || !reflect.DeepEqual(release.Modules, []string{"mp"}) {
+		t.Errorf("close: unexpected release %+v", release)
+	}
+	server.Send(t, "mp", comm.BroadcastSession, models.Message{Method: "mp:linux:mu"})
+	tablet.Expect(t, "mu", nil)
+	phone.ExpectNone(t, "mu", time.Second/2)
+
+	// Disconnecting lets go of everything the session used.
+	tablet.Close()
+	if release := server.ExpectClose(t); release.Session != tabletSession || release.Modules != nil {
+		t.Errorf("disconnect: unexpected release %+v", release)
+	}
+}
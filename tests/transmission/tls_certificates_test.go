@@ -0,0 +1,207 @@
+package transmission
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Artiqlate/cyprus"
+	ext_mp "github.com/Artiqlate/cyprus/ext_models/mp"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/transmission"
+	"github.com/Artiqlate/ganymede/models"
+	"nhooyr.io/websocket"
+)
+
+// A certificate (signed by parent, or self-signed without one) and its key.
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+func newTestCertificate(t *testing.T, name string, parent *testCertificate, isCA bool, notAfter time.Time) *testCertificate {
+	t.Helper()
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("key: %v", keyErr)
+	}
+	serialNumber, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour * 48),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	parentCertificate, parentKey := template, key
+	if parent != nil {
+		parentCertificate, parentKey = parent.certificate, parent.key
+	}
+	der, createErr := x509.CreateCertificate(rand.Reader, template, parentCertificate, &key.PublicKey, parentKey)
+	if createErr != nil {
+		t.Fatalf("certificate: %v", createErr)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// Writes the leaf (and chain, if any) to dir, returning their files.
+func writeCertificateFiles(t *testing.T, dir string, leaf *testCertificate, chain ...*testCertificate) transmission.CertificateFiles {
+	t.Helper()
+	files := transmission.CertificateFiles{
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+	}
+	os.WriteFile(files.CertFile, leaf.certPEM, 0o644)
+	os.WriteFile(files.KeyFile, leaf.keyPEM, 0o600)
+	if len(chain) != 0 {
+		files.ChainFile = filepath.Join(dir, "chain.crt")
+		chainPEM := []byte{}
+		for _, certificate := range chain {
+			chainPEM = append(chainPEM, certificate.certPEM...)
+		}
+		os.WriteFile(files.ChainFile, chainPEM, 0o644)
+	}
+	return files
+}
+
+func TestCertificateFilesValidation(t *testing.T) {
+	validUntil := time.Now().Add(time.Hour * 24)
+	root := newTestCertificate(t, "Root CA", nil, true, validUntil)
+	intermediate := newTestCertificate(t, "Intermediate CA", root, true, validUntil)
+	leaf := newTestCertificate(t, "cyprus.lan", intermediate, false, validUntil)
+
+	certificate, loadErr := writeCertificateFiles(t, t.TempDir(), leaf, intermediate).Load()
+	if loadErr != nil {
+		t.Fatalf("valid certificate: %v", loadErr)
+	}
+	if len(certificate.Certificate) != 2 {
+		t.Errorf("chain not served: %d certificates", len(certificate.Certificate))
+	}
+
+	other := newTestCertificate(t, "other", intermediate, false, validUntil)
+	mismatched := writeCertificateFiles(t, t.TempDir(), leaf, intermediate)
+	os.WriteFile(mismatched.KeyFile, other.keyPEM, 0o600)
+	expired := newTestCertificate(t, "expired", intermediate, false, time.Now().Add(-time.Hour))
+	for _, test := range []struct {
+		name          string
+		files         transmission.CertificateFiles
+		expectedError string
+	}{
+		{"mismatched key", mismatched, "TLS key"},
+		{"expired", writeCertificateFiles(t, t.TempDir(), expired, intermediate), "expired"},
+		{"broken chain", writeCertificateFiles(t, t.TempDir(), leaf, root), "isn't signed by"},
+		{"no key", transmission.CertificateFiles{CertFile: mismatched.CertFile}, "key file"},
+		{"missing file", transmission.CertificateFiles{CertFile: "missing.crt", KeyFile: "missing.key"}, "missing.crt"},
+	} {
+		if _, loadErr := test.files.Load(); loadErr == nil || !strings.Contains(loadErr.Error(), test.expectedError) {
+			t.Errorf("%s: unexpected error %v", test.name, loadErr)
+		}
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	validUntil := time.Now().Add(time.Hour * 24)
+	ca := newTestCertificate(t, "CA", nil, true, validUntil)
+	dir := t.TempDir()
+	files := writeCertificateFiles(t, dir, newTestCertificate(t, "first", ca, false, validUntil))
+	reloader, reloaderErr := transmission.NewCertificateReloader(files, t.Logf)
+	if reloaderErr != nil {
+		t.Fatalf("reloader: %v", reloaderErr)
+	}
+	reloaded := make(chan *tls.Certificate, 1)
+	reloader.OnReload(func(certificate *tls.Certificate) { reloaded <- certificate })
+	server := harness.StartTransmissionWith(t, harness.TransmissionOptions{
+		Modules:             []string{"mp"},
+		CertificateReloader: reloader,
+	})
+	first := server.Fingerprint
+	client := server.Connect(t)
+	client.Init(t, "mp")
+
+	// New connections get the new certificate, open ones stay up.
+	writeCertificateFiles(t, dir, newTestCertificate(t, "second", ca, false, validUntil))
+	reloader.Reload()
+	select {
+	case certificate := <-reloaded:
+		server.Fingerprint = transmission.Fingerprint(certificate)
+	default:
+		t.Fatalf("certificate not reloaded")
+	}
+	if server.Fingerprint == first {
+		t.Fatalf("fingerprint unchanged")
+	}
+	if conn, dialErr := server.Dial(harness.PinnedTLSConfig(server.Fingerprint)); dialErr != nil {
+		t.Errorf("new certificate not served: %v", dialErr)
+	} else {
+		conn.Close(websocket.StatusNormalClosure, "")
+	}
+	server.Send(t, "mp", harness.ClientSession, models.Message{
+		Method: "mp:linux:ok",
+		Args:   &ext_mp.CommandOk{Method: "mp:play"},
+	})
+	client.Expect(t, "ok", nil)
+
+	// A broken change keeps the current certificate.
+	os.WriteFile(files.KeyFile, []byte("garbage"), 0o600)
+	reloader.Reload()
+	if transmission.Fingerprint(reloader.Certificate()) != server.Fingerprint {
+		t.Errorf("broken reload replaced the certificate")
+	}
+	if conn, dialErr := server.Dial(harness.PinnedTLSConfig(server.Fingerprint)); dialErr != nil {
+		t.Errorf("certificate not served after a broken reload: %v", dialErr)
+	} else {
+		conn.Close(websocket.StatusNormalClosure, "")
+	}
+}
+
+func TestConfigResolvesCertificatePaths(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, cyprus.ConfigFileName)
+	os.WriteFile(configPath, []byte(`{"port": 4000, "tls": {"cert_file": "server.crt", "key_file": "/etc/cyprus/server.key"}}`), 0o644)
+	config, configErr := cyprus.LoadConfig(configPath, true)
+	if configErr != nil {
+		t.Fatalf("config: %v", configErr)
+	}
+	if config.Port != 4000 || !config.Secure || !config.Pairing {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if config.TLS.CertFile != filepath.Join(dir, "server.crt") || config.TLS.KeyFile != "/etc/cyprus/server.key" {
+		t.Errorf("unexpected certificate files %+v", config.TLS)
+	}
+
+	// A missing config file is only an error when it's required.
+	if _, missingErr := cyprus.LoadConfig(filepath.Join(dir, "missing.json"), false); missingErr != nil {
+		t.Errorf("optional config: %v", missingErr)
+	}
+	if _, missingErr := cyprus.LoadConfig(filepath.Join(dir, "missing.json"), true); missingErr == nil {
+		t.Errorf("required config: missing file loaded")
+	}
+}
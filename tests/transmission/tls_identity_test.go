@@ -0,0 +1,76 @@
+package transmission
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/transmission"
+	"nhooyr.io/websocket"
+)
+
+func TestIdentityIsKeptAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	addresses := []net.IP{net.IPv4(192, 168, 1, 20)}
+	identity := transmission.NewTLSIdentity(dir)
+	created, createErr := identity.LoadOrCreate(addresses)
+	if createErr != nil {
+		t.Fatalf("create: %v", createErr)
+	}
+	loaded, loadErr := transmission.NewTLSIdentity(dir).LoadOrCreate(addresses)
+	if loadErr != nil {
+		t.Fatalf("load: %v", loadErr)
+	}
+	if transmission.Fingerprint(created) != transmission.Fingerprint(loaded) {
+		t.Errorf("identity changed across loads")
+	}
+	if len(transmission.Fingerprint(created)) != 64 {
+		t.Errorf("unexpected fingerprint %q", transmission.Fingerprint(created))
+	}
+	keyInfo, statErr := os.Stat(filepath.Join(dir, transmission.IdentityKeyFileName))
+	if statErr != nil || keyInfo.Mode().Perm() != 0o600 {
+		t.Errorf("key: unexpected file %v (%v)", keyInfo, statErr)
+	}
+
+	// Rotating replaces it for good.
+	rotated, rotateErr := identity.Rotate(addresses)
+	if rotateErr != nil {
+		t.Fatalf("rotate: %v", rotateErr)
+	}
+	reloaded, _ := identity.LoadOrCreate(addresses)
+	if transmission.Fingerprint(rotated) == transmission.Fingerprint(created) ||
+		transmission.Fingerprint(reloaded) != transmission.Fingerprint(rotated) {
+		t.Errorf("rotate: identity not replaced")
+	}
+
+	// A broken identity isn't silently replaced.
+	os.WriteFile(identity.CertPath(), []byte("garbage"), 0o644)
+	if _, brokenErr := identity.LoadOrCreate(addresses); brokenErr == nil {
+		t.Errorf("broken identity loaded")
+	}
+}
+
+func TestSecureServerWithPinnedCertificate(t *testing.T) {
+	certificate, identityErr := transmission.NewTLSIdentity(t.TempDir()).LoadOrCreate(nil)
+	if identityErr != nil {
+		t.Fatalf("identity: %v", identityErr)
+	}
+	server := harness.StartTransmissionWith(t, harness.TransmissionOptions{
+		Modules:     []string{"mp"},
+		Certificate: certificate,
+	})
+	client := server.Connect(t)
+	if enabled := client.Init(t, "mp"); !reflect.DeepEqual(enabled, []string{"mp"}) {
+		t.Errorf("init: unexpected modules %v", enabled)
+	}
+
+	// Clients pinning another certificate don't connect.
+	other, _ := transmission.NewTLSIdentity(t.TempDir()).LoadOrCreate(nil)
+	if conn, dialErr := server.Dial(harness.PinnedTLSConfig(transmission.Fingerprint(other))); dialErr == nil {
+		conn.Close(websocket.StatusNormalClosure, "")
+		t.Errorf("connected with the wrong pinned certificate")
+	}
+}
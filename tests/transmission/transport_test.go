@@ -0,0 +1,134 @@
+package transmission
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Artiqlate/cyprus/ext_models"
+	"github.com/Artiqlate/cyprus/tests/harness"
+	"github.com/Artiqlate/cyprus/transmission"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/Artiqlate/ganymede/models/mp"
+	"github.com/vmihailenco/msgpack/v5"
+	"nhooyr.io/websocket"
+)
+
+func TestCompressionNegotiation(t *testing.T) {
+	for _, compression := range []bool{true, false} {
+		server := harness.StartTransmissionWith(t, harness.TransmissionOptions{
+			Modules:   []string{"mp"},
+			Transport: &transmission.TransportOptions{Compression: compression},
+		})
+		conn, response, dialErr := server.DialWith(&websocket.DialOptions{CompressionMode: websocket.CompressionNoContextTakeover})
+		if dialErr != nil {
+			t.Fatalf("dial: %v", dialErr)
+		}
+		negotiated := strings.Contains(response.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+		if negotiated != compression {
+			t.Errorf("compression %v: negotiated %q", compression, response.Header.Get("Sec-WebSocket-Extensions"))
+		}
+		// Compressed or not, messages get through.
+		client := harness.NewWSClient(t, conn)
+		if enabled := client.Init(t, "mp", strings.Repeat("x", 2048)); !reflect.DeepEqual(enabled, []string{"mp"}) {
+			t.Errorf("compression %v: unexpected modules %v", compression, enabled)
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	server := harness.StartTransmissionWith(t, harness.TransmissionOptions{
+		Modules:   []string{"mp"},
+		Transport: &transmission.TransportOptions{MaxMessageSize: 1024},
+	})
+	conn, dialErr := server.Dial(nil)
+	if dialErr != nil {
+		t.Fatalf("dial: %v", dialErr)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	ctx, cancel := context.WithTimeout(context.Background(), harness.DefaultExpectTimeout)
+	defer cancel()
+	encoded, _ := msgpack.Marshal(&models.Message{Method: "mp:list", Args: strings.Repeat("x", 2048)})
+	conn.Write(ctx, websocket.MessageBinary, encoded)
+	if _, _, readErr := conn.Read(ctx); websocket.CloseStatus(readErr) != websocket.StatusMessageTooBig {
+		t.Errorf("expected the connection to close as too big, got %v", readErr)
+	}
+}
+
+func TestChunkedTransfers(t *testing.T) {
+	const chunkSize = 1024
+	server := harness.StartTransmissionWith(t, harness.TransmissionOptions{
+		Modules:   []string{"mp"},
+		Transport: &transmission.TransportOptions{ChunkSize: chunkSize},
+	})
+	client := server.Connect(t)
+	if enabled := client.Init(t, "mp", ext_models.CapabilityChunked); !reflect.DeepEqual(enabled, []string{"mp", ext_models.CapabilityChunked}) {
+		t.Fatalf("init: unexpected capabilities %v", enabled)
+	}
+
+	// A large reply, with events right behind it
+	players := make([]string, 20000)
+	for playerIdx := range players {
+		players[playerIdx] = fmt.Sprintf("org.mpris.MediaPlayer2.player%d", playerIdx)
+	}
+	server.Send(t, "mp", harness.ClientSession, models.Message{Method: "mp:linux:rlist", Args: &mp.MPlayerList{Players: players}})
+	const events = 20
+	for eventIdx := 0; eventIdx < events; eventIdx++ {
+		server.SendEvent(t, "mp", uint64(eventIdx+1), models.Message{Method: "mp:linux:psu", Args: []string{}})
+	}
+
+	var transfer bytes.Buffer
+	eventsBeforeEnd, eventsSeen := 0, 0
+	for complete := false; !complete || eventsSeen < events; {
+		message := client.Next(t)
+		switch message.Method {
+		case ext_models.MethodChunk:
+			var chunk ext_models.Chunk
+			if decodeErr := msgpack.Unmarshal(message.Args, &chunk); decodeErr != nil {
+				t.Fatalf("chunk: %v", decodeErr)
+			}
+			if len(chunk.Data) > chunkSize || chunk.Index != transfer.Len()/chunkSize {
+				t.Fatalf("chunk: unexpected chunk %d of %d (%d bytes)", chunk.Index, chunk.Count, len(chunk.Data))
+			}
+			transfer.Write(chunk.Data)
+			complete = chunk.Index == chunk.Count-1
+		case "mp:linux:psu":
+			eventsSeen++
+			if !complete {
+				eventsBeforeEnd++
+			}
+		default:
+			t.Fatalf("unexpected %s", message.Method)
+		}
+	}
+	if eventsBeforeEnd == 0 {
+		t.Errorf("events held up behind the whole transfer")
+	}
+	var reply struct {
+		//lint:ignore U1000 `msgpack` options, not for serialization.
+		_msgpack struct{} `msgpack:",as_array"`
+		Method   string
+		Players  mp.MPlayerList
+	}
+	if decodeErr := msgpack.Unmarshal(transfer.Bytes(), &reply); decodeErr != nil {
+		t.Fatalf("transfer: %v", decodeErr)
+	}
+	if reply.Method != "mp:linux:rlist" || !reflect.DeepEqual(reply.Players.Players, players) {
+		t.Errorf("transfer: unexpected %s with %d players", reply.Method, len(reply.Players.Players))
+	}
+
+	// Sessions which didn't ask for chunks get whole messages (past the chunk
+	// size, within the client's read limit).
+	players = players[:200]
+	other := server.Connect(t)
+	other.Init(t, "mp")
+	server.Send(t, "mp", harness.ClientSession+1, models.Message{Method: "mp:linux:rlist", Args: &mp.MPlayerList{Players: players}})
+	var list mp.MPlayerList
+	other.Expect(t, "rlist", &list)
+	if len(list.Players) != len(players) {
+		t.Errorf("unchunked: unexpected %d players", len(list.Players))
+	}
+}
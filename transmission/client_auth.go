@@ -0,0 +1,85 @@
+package transmission
+
+/*
+Mutual TLS Client Authentication
+
+In mutual TLS mode, clients present a certificate during the TLS handshake:
+either one issued by the client CA (see `ClientCA`) which isn't revoked, or
+one whose fingerprint is pinned in the trust store. Any other client fails
+the handshake, before it gets to the websocket upgrade. Sessions of accepted
+clients are authenticated, so they don't have to pair.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+type ClientAuthenticator struct {
+	// Either can be nil
+	ca         *ClientCA
+	trustStore *TrustStore
+}
+
+func NewClientAuthenticator(ca *ClientCA, trustStore *TrustStore) *ClientAuthenticator {
+	return &ClientAuthenticator{ca: ca, trustStore: trustStore}
+}
+
+// Checks the certificate chain a client presented (for
+// `tls.Config.VerifyConnection`, which is called for resumed sessions too, so
+// revocations apply to clients with session tickets).
+func (ca *ClientAuthenticator) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	fingerprint := Fingerprint(&tls.Certificate{Certificate: [][]byte{state.PeerCertificates[0].Raw}})
+	if ca.trustStore != nil {
+		client, verifyErr := ca.trustStore.VerifyCertificate(fingerprint)
+		if verifyErr != nil {
+			return verifyErr
+		}
+		if client != nil {
+			return nil
+		}
+	}
+	if ca.ca == nil {
+		return fmt.Errorf("client certificate %s isn't pinned", fingerprint)
+	}
+	leaf := state.PeerCertificates[0]
+	if _, chainErr := leaf.Verify(x509.VerifyOptions{
+		Roots:       ca.ca.CertPool(),
+		CurrentTime: time.Now(),
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); chainErr != nil {
+		return fmt.Errorf("client certificate %s isn't pinned, or issued by the client CA: %v", fingerprint, chainErr)
+	}
+	issuedClient, lookupErr := ca.ca.Lookup(fingerprint)
+	if lookupErr != nil {
+		return lookupErr
+	}
+	if issuedClient == nil {
+		return fmt.Errorf("client certificate %s wasn't issued by this server", fingerprint)
+	}
+	if issuedClient.RevokedAt != 0 {
+		return fmt.Errorf("client certificate %s (%q) is revoked", fingerprint, issuedClient.Name)
+	}
+	return nil
+}
+
+// Requires clients to present a certificate this authenticator accepts.
+func (ca *ClientAuthenticator) configure(tlsConfig *tls.Config, logf func(f string, v ...interface{})) {
+	// Verified by `VerifyConnection` instead (pinned certificates are
+	// usually self-signed).
+	tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		verifyErr := ca.VerifyConnection(state)
+		if verifyErr != nil {
+			logf("Client rejected: %v", verifyErr)
+		}
+		return verifyErr
+	}
+}
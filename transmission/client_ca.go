@@ -0,0 +1,294 @@
+package transmission
+
+/*
+Client Certificate Authority
+
+Issues the client certificates mutual TLS accepts (see
+`ClientAuthenticator`). The CA is generated once, and kept in the config
+directory along with a record of every certificate it issued, so that they
+can be revoked. Its key never leaves the server.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Artiqlate/cyprus/utils"
+)
+
+const (
+	ClientCACertFileName       = "client_ca.crt"
+	ClientCAKeyFileName        = "client_ca.key"
+	IssuedClientsFileName      = "issued_clients.json"
+	ClientCAValidity           = time.Hour * 24 * 365 * 10
+	ClientCertificateValidity  = time.Hour * 24 * 365 * 2
+	clientCertificateSerialMax = 128
+)
+
+// A client certificate the CA issued.
+type IssuedClient struct {
+	// Hex-encoded serial number
+	Serial string `json:"serial"`
+	Name   string `json:"name"`
+	// See `Fingerprint`
+	Fingerprint string `json:"fingerprint"`
+	IssuedAt    int64  `json:"issued_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+	// Zero unless it was revoked
+	RevokedAt int64 `json:"revoked_at,omitempty"`
+}
+
+type ClientCA struct {
+	certPath   string
+	keyPath    string
+	issuedPath string
+	mutex      sync.Mutex
+	// Loaded by `LoadOrCreate`
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// CA kept in the given directory.
+func NewClientCA(dir string) *ClientCA {
+	return &ClientCA{
+		certPath:   filepath.Join(dir, ClientCACertFileName),
+		keyPath:    filepath.Join(dir, ClientCAKeyFileName),
+		issuedPath: filepath.Join(dir, IssuedClientsFileName),
+	}
+}
+
+// CA in the config directory (see `utils.ConfigDir`), loaded (or generated
+// first, if there's none yet).
+func DefaultClientCA() (*ClientCA, error) {
+	configDir, configDirErr := utils.ConfigDir()
+	if configDirErr != nil {
+		return nil, configDirErr
+	}
+	ca := NewClientCA(configDir)
+	if loadErr := ca.LoadOrCreate(); loadErr != nil {
+		return nil, loadErr
+	}
+	return ca, nil
+}
+
+func (ca *ClientCA) CertPath() string {
+	return ca.certPath
+}
+
+// Loads the CA, generating it first if there's none yet. A broken CA isn't
+// replaced, as that would invalidate every certificate it issued.
+func (ca *ClientCA) LoadOrCreate() error {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	keyPair, loadErr := tls.LoadX509KeyPair(ca.certPath, ca.keyPath)
+	if loadErr != nil {
+		if _, statErr := os.Stat(ca.certPath); !errors.Is(statErr, os.ErrNotExist) {
+			return fmt.Errorf("client CA %s: %w", ca.certPath, loadErr)
+		}
+		return ca.create()
+	}
+	certificate, parseErr := x509.ParseCertificate(keyPair.Certificate[0])
+	if parseErr != nil {
+		return fmt.Errorf("client CA %s: %w", ca.certPath, parseErr)
+	}
+	key, isECDSA := keyPair.PrivateKey.(*ecdsa.PrivateKey)
+	if !isECDSA {
+		return fmt.Errorf("client CA %s: unsupported key type", ca.keyPath)
+	}
+	ca.certificate, ca.key = certificate, key
+	return nil
+}
+
+// Called with the mutex held.
+func (ca *ClientCA) create() error {
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		return keyErr
+	}
+	serialNumber, serialErr := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), clientCertificateSerialMax))
+	if serialErr != nil {
+		return serialErr
+	}
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "Cyprus Client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(ClientCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	certificateBytes, createErr := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if createErr != nil {
+		return createErr
+	}
+	keyBytes, marshalErr := x509.MarshalPKCS8PrivateKey(key)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	if mkdirErr := os.MkdirAll(filepath.Dir(ca.certPath), 0o700); mkdirErr != nil {
+		return mkdirErr
+	}
+	if writeErr := writeFileAtomic(ca.keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0o600); writeErr != nil {
+		return writeErr
+	}
+	if writeErr := writeFileAtomic(ca.certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateBytes}), 0o644); writeErr != nil {
+		return writeErr
+	}
+	certificate, parseErr := x509.ParseCertificate(certificateBytes)
+	if parseErr != nil {
+		return parseErr
+	}
+	ca.certificate, ca.key = certificate, key
+	return nil
+}
+
+// Pool with the CA certificate, to verify client certificates against.
+func (ca *ClientCA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	return pool
+}
+
+// -- ISSUED CERTIFICATES --
+
+// Called with the mutex held.
+func (ca *ClientCA) loadIssued() ([]IssuedClient, error) {
+	content, readErr := os.ReadFile(ca.issuedPath)
+	if errors.Is(readErr, os.ErrNotExist) {
+		return []IssuedClient{}, nil
+	} else if readErr != nil {
+		return nil, readErr
+	}
+	issued := []IssuedClient{}
+	if decodeErr := json.Unmarshal(content, &issued); decodeErr != nil {
+		return nil, fmt.Errorf("issued clients %s: %w", ca.issuedPath, decodeErr)
+	}
+	return issued, nil
+}
+
+// Called with the mutex held.
+func (ca *ClientCA) saveIssued(issued []IssuedClient) error {
+	content, encodeErr := json.MarshalIndent(issued, "", "  ")
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return writeFileAtomic(ca.issuedPath, content, 0o600)
+}
+
+func (ca *ClientCA) Issued() ([]IssuedClient, error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	return ca.loadIssued()
+}
+
+// Issues a certificate for a client, and returns it with its key
+// (PEM-encoded). The key isn't kept.
+func (ca *ClientCA) Issue(clientName string) ([]byte, []byte, *IssuedClient, error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if ca.certificate == nil {
+		return nil, nil, nil, fmt.Errorf("client CA isn't loaded")
+	}
+	issued, loadErr := ca.loadIssued()
+	if loadErr != nil {
+		return nil, nil, nil, loadErr
+	}
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		return nil, nil, nil, keyErr
+	}
+	serialNumber, serialErr := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), clientCertificateSerialMax))
+	if serialErr != nil {
+		return nil, nil, nil, serialErr
+	}
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: clientName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(ClientCertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certificateBytes, createErr := x509.CreateCertificate(rand.Reader, &template, ca.certificate, &key.PublicKey, ca.key)
+	if createErr != nil {
+		return nil, nil, nil, createErr
+	}
+	keyBytes, marshalErr := x509.MarshalPKCS8PrivateKey(key)
+	if marshalErr != nil {
+		return nil, nil, nil, marshalErr
+	}
+	issuedClient := IssuedClient{
+		Serial:      serialNumber.Text(16),
+		Name:        clientName,
+		Fingerprint: Fingerprint(&tls.Certificate{Certificate: [][]byte{certificateBytes}}),
+		IssuedAt:    time.Now().Unix(),
+		ExpiresAt:   template.NotAfter.Unix(),
+	}
+	if saveErr := ca.saveIssued(append(issued, issuedClient)); saveErr != nil {
+		return nil, nil, nil, saveErr
+	}
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateBytes})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+	return certificatePEM, keyPEM, &issuedClient, nil
+}
+
+// Revokes the certificates with the given serial number, or fingerprint.
+// Returns how many were revoked.
+func (ca *ClientCA) Revoke(serialOrFingerprint string) (int, error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	issued, loadErr := ca.loadIssued()
+	if loadErr != nil {
+		return 0, loadErr
+	}
+	serialOrFingerprint = strings.ToLower(serialOrFingerprint)
+	revoked := 0
+	for issuedIdx := range issued {
+		issuedClient := &issued[issuedIdx]
+		if issuedClient.RevokedAt != 0 ||
+			(issuedClient.Serial != serialOrFingerprint && issuedClient.Fingerprint != serialOrFingerprint) {
+			continue
+		}
+		issuedClient.RevokedAt = time.Now().Unix()
+		revoked++
+	}
+	if revoked == 0 {
+		return 0, nil
+	}
+	return revoked, ca.saveIssued(issued)
+}
+
+// Returns the issued certificate with the given fingerprint (nil when the
+// CA didn't issue it).
+func (ca *ClientCA) Lookup(fingerprint string) (*IssuedClient, error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	issued, loadErr := ca.loadIssued()
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	for issuedIdx := range issued {
+		if issued[issuedIdx].Fingerprint == fingerprint {
+			return &issued[issuedIdx], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,76 @@
+package transmission
+
+/*
+Message Framing
+
+How messages are laid out on the wire, negotiated per connection through the
+websocket subprotocol. Without one, messages are framed natively, as
+`[method, args]` arrays (with an optional request ID, see `session.go`).
+Other framings translate to and from the native one, so every request goes
+through `decodeData` the same way.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"nhooyr.io/websocket"
+)
+
+type framing interface {
+	// Turns a received message into a native one.
+	decode(data []byte) ([]byte, error)
+	encode(outgoing outgoingMessage) ([]byte, error)
+	messageType() websocket.MessageType
+}
+
+// Subprotocols clients can ask for, in order of preference.
+var subprotocols = []string{ProtocolMsgpackRPC, ProtocolJSON}
+
+// Framing (or codec) for the subprotocol the connection agreed on ("" for
+// none).
+func framingFor(subprotocol string) framing {
+	switch subprotocol {
+	case ProtocolMsgpackRPC:
+		return rpcFraming{}
+	case ProtocolJSON:
+		return jsonFraming{}
+	}
+	return nativeFraming{}
+}
+
+// -- NATIVE --
+
+type nativeFraming struct{}
+
+func (nativeFraming) decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// `[method, args]`, or `[method, args, id]` for replies to requests with an
+// ID.
+func (nativeFraming) encode(outgoing outgoingMessage) ([]byte, error) {
+	var encodedData bytes.Buffer
+	encoder := msgpack.NewEncoder(&encodedData)
+	if outgoing.requestId == nil {
+		encodeErr := encoder.Encode(&outgoing.message)
+		return encodedData.Bytes(), encodeErr
+	}
+	encodeErr := encoder.EncodeArrayLen(3)
+	if encodeErr == nil {
+		encodeErr = encoder.EncodeString(outgoing.message.Method)
+	}
+	if encodeErr == nil {
+		encodeErr = encoder.Encode(outgoing.message.Args)
+	}
+	if encodeErr == nil {
+		encodeErr = encoder.Encode(outgoing.requestId)
+	}
+	return encodedData.Bytes(), encodeErr
+}
+
+func (nativeFraming) messageType() websocket.MessageType {
+	return websocket.MessageBinary
+}
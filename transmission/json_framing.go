@@ -0,0 +1,103 @@
+package transmission
+
+/*
+JSON Codec
+
+For clients which ask for the `cyprus.json` subprotocol (ex: web dashboards,
+or debugging from a browser's devtools). Messages keep their native shapes
+and method names, they're only written as JSON text: `[method, args]`, with
+arguments laid out exactly as in MessagePack (so structs are arrays). They
+are transcoded to and from MessagePack, so subsystems work the same for both.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"nhooyr.io/websocket"
+)
+
+const ProtocolJSON = "cyprus.json"
+
+type jsonFraming struct{}
+
+func (jsonFraming) decode(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Integers stay integers (rather than becoming floats).
+	decoder.UseNumber()
+	var message interface{}
+	if decodeErr := decoder.Decode(&message); decodeErr != nil {
+		return nil, fmt.Errorf("json: %w", decodeErr)
+	}
+	if _, isArray := message.([]interface{}); !isArray {
+		return nil, fmt.Errorf("json: expected a [method, args] array")
+	}
+	return msgpack.Marshal(fromJSON(message))
+}
+
+func (jsonFraming) encode(outgoing outgoingMessage) ([]byte, error) {
+	native, encodeErr := nativeFraming{}.encode(outgoing)
+	if encodeErr != nil {
+		return nil, encodeErr
+	}
+	var message interface{}
+	if decodeErr := msgpack.Unmarshal(native, &message); decodeErr != nil {
+		return nil, decodeErr
+	}
+	return json.Marshal(toJSON(message))
+}
+
+func (jsonFraming) messageType() websocket.MessageType {
+	return websocket.MessageText
+}
+
+// Replaces JSON numbers with integers where they are ones.
+func fromJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if integer, intErr := value.Int64(); intErr == nil {
+			return integer
+		}
+		float, _ := value.Float64()
+		if float >= 0 && float < math.MaxUint64 && float == math.Trunc(float) {
+			return uint64(float)
+		}
+		return float
+	case []interface{}:
+		for elementIdx := range value {
+			value[elementIdx] = fromJSON(value[elementIdx])
+		}
+	case map[string]interface{}:
+		for key := range value {
+			value[key] = fromJSON(value[key])
+		}
+	}
+	return value
+}
+
+// Replaces maps with non-string keys (which JSON doesn't have) with ones with
+// string keys.
+func toJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case []interface{}:
+		for elementIdx := range value {
+			value[elementIdx] = toJSON(value[elementIdx])
+		}
+	case map[string]interface{}:
+		for key := range value {
+			value[key] = toJSON(value[key])
+		}
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, element := range value {
+			converted[fmt.Sprint(key)] = toJSON(element)
+		}
+		return converted
+	}
+	return value
+}
@@ -3,70 +3,139 @@ package transmission
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Artiqlate/cyprus/comm"
 	"github.com/Artiqlate/cyprus/ext_models"
 	"github.com/Artiqlate/cyprus/utils"
 	"github.com/Artiqlate/ganymede/models"
-	"github.com/Artiqlate/ganymede/network"
+	"github.com/Artiqlate/ganymede/models/base"
 	"github.com/vmihailenco/msgpack/v5"
 	"nhooyr.io/websocket"
 )
 
+// Time given to a subsystem to accept a request.
+const ModuleSendTimeout = time.Second * 5
+
 type NetworkTransmissionServer struct {
-	// Server Initialization
-	init bool
 	// Port given to listen to
 	serverPort int
-	// Initialization channel
-	moduleInitChan  chan []string
-	moduleCloseChan chan bool
-	context         context.Context
-	httpServer      *http.Server
-	serveMux        http.ServeMux
-	wsConn          *websocket.Conn
-	writeChannel    chan models.Message
-	commChannels    *comm.CommChannels
-	logf            func(f string, v ...interface{})
+	// Module initialization and release (see `comm.SessionInit`)
+	moduleInitChan  chan comm.SessionInit
+	moduleCloseChan chan comm.SessionClose
+	// Cancelled on shutdown
+	context    context.Context
+	cancel     context.CancelFunc
+	httpServer *http.Server
+	serveMux   http.ServeMux
+	// Connected sessions, by ID (IDs start at 1, see `comm.BroadcastSession`)
+	sessionsMutex sync.RWMutex
+	sessions      map[uint64]*session
+	lastSessionId uint64
+	// Paired clients (nil when pairing is off, and any session can `init`)
+	trustStore *TrustStore
+	// PINs across sessions (see `pairing.go`)
+	pairingLimiter pairingLimiter
+	// Certificate secure mode serves with: from files (reloaded when they
+	// change), or else a fixed one (see `TLSIdentity`)
+	certificateReloader *CertificateReloader
+	certificate         *tls.Certificate
+	// Client certificates secure mode requires (nil unless mutual TLS is on)
+	clientAuthenticator *ClientAuthenticator
+	// Browser origins which can connect (none by default)
+	originPolicy *OriginPolicy
+	// Compression, and message size limits
+	transport TransportOptions
+	// Shows pairing PINs (logs them by default)
+	showPin      func(clientName string, pin string)
+	commChannels *comm.CommChannels
+	logf         func(f string, v ...interface{})
 }
 
 // -- CONSTRUCTOR
 func NewNetworkTransmissionServer(
-	writeChannel chan models.Message,
-	moduleInitChan chan []string,
-	moduleCloseChan chan bool,
+	moduleInitChan chan comm.SessionInit,
+	moduleCloseChan chan comm.SessionClose,
 	commChannels *comm.CommChannels,
+	trustStore *TrustStore,
 	port int,
 ) *NetworkTransmissionServer {
+	ctx, cancel := context.WithCancel(context.Background())
 	newNT := &NetworkTransmissionServer{
-		init:            false,
 		serverPort:      port,
 		moduleInitChan:  moduleInitChan,
 		moduleCloseChan: moduleCloseChan,
+		context:         ctx,
+		cancel:          cancel,
+		sessions:        make(map[uint64]*session),
+		trustStore:      trustStore,
+		originPolicy:    &OriginPolicy{},
+		transport:       DefaultTransportOptions().withDefaults(),
 		commChannels:    commChannels,
-		writeChannel:    writeChannel,
 		logf: func(f string, v ...interface{}) {
 			utils.LogFunc("NT", f, v...)
 		},
 	}
+	newNT.showPin = func(clientName string, pin string) {
+		newNT.logf("Pairing PIN for %q: %s", clientName, pin)
+	}
 	newNT.serveMux.HandleFunc("/", newNT.WebsocketHandler)
 	return newNT
 }
 
+// Sets the certificate to serve with in secure mode (the default identity is
+// used otherwise). Has to be set before serving.
+func (nt *NetworkTransmissionServer) SetCertificate(certificate *tls.Certificate) {
+	nt.certificate = certificate
+}
+
+// Serves with the certificate from files in secure mode, rather than a fixed
+// one. Has to be set before serving.
+func (nt *NetworkTransmissionServer) SetCertificateReloader(certificateReloader *CertificateReloader) {
+	nt.certificateReloader = certificateReloader
+}
+
+// Requires client certificates (see `ClientAuthenticator`) in secure mode.
+// Has to be set before serving.
+func (nt *NetworkTransmissionServer) SetClientAuthenticator(clientAuthenticator *ClientAuthenticator) {
+	nt.clientAuthenticator = clientAuthenticator
+}
+
+// Allows browser origins (see `OriginPolicy`). Has to be set before serving.
+func (nt *NetworkTransmissionServer) SetOriginPolicy(originPolicy *OriginPolicy) {
+	nt.originPolicy = originPolicy
+}
+
+// Has to be set before serving.
+func (nt *NetworkTransmissionServer) SetTransportOptions(transport TransportOptions) {
+	nt.transport = transport.withDefaults()
+}
+
+// Shows pairing PINs some other way than in the log (ex: on a control
+// interface). Has to be set before serving.
+func (nt *NetworkTransmissionServer) SetPinDisplay(showPin func(clientName string, pin string)) {
+	nt.showPin = showPin
+}
+
 // -- COROUTINE FOR SERVER
 func (nt *NetworkTransmissionServer) Coroutine(errChan chan error, secure bool) {
 	nt.logf("Attempting to start server")
+	go nt.dispatchLoop()
 	errChan <- nt.Serve(secure)
 }
 
 // -- DATA DECODE AND PARSING
-func (nt *NetworkTransmissionServer) decodeData(data []byte) error {
+func (nt *NetworkTransmissionServer) decodeData(ses *session, data []byte) error {
 	// Initialize the decoder object
 	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	// Replies echo the request's ID
+	ses.requestId = decodeRequestId(data)
 
 	// Decode length of the array. If it's less than 2, error out.
 	arrLen, arrLenErr := decoder.DecodeArrayLen()
@@ -82,48 +151,236 @@ func (nt *NetworkTransmissionServer) decodeData(data []byte) error {
 		nt.logf("method decode: %v", msDecodeErr)
 	}
 
-	subsystem, method, subsystemMethodExists := strings.Cut(methodAndSubsystem, ":")
-	nt.logf("Subsystem: %s, Method: %s\n", subsystem, method)
+	methodName, methodErr := utils.ParsePlatformMethod(methodAndSubsystem, utils.CurrentPlatform())
+	if errors.Is(methodErr, utils.ErrPlatformMismatch) {
+		module, _, _ := strings.Cut(methodAndSubsystem, ":")
+		requestError(
+			ses,
+			utils.GeneratePlatformMethod(module, utils.CurrentPlatform(), ext_models.MethodError),
+			methodAndSubsystem,
+			ext_models.ErrCodePlatformMismatch,
+			"%v", methodErr,
+		)
+		return nil
+	} else if methodErr != nil {
+		requestError(ses, ext_models.MethodError, methodAndSubsystem, ext_models.ErrCodeDecode, "%v", methodErr)
+		return nil
+	}
+	subsystem, method := methodName.Module, methodName.Method
+	nt.logf("Session %d: Subsystem: %s, Method: %s\n", ses.id, subsystem, method)
 
 	switch subsystem {
+	// Pairing
+	case ext_models.MethodPair, ext_models.MethodPairVerify, ext_models.MethodAuth:
+		if nt.trustStore == nil {
+			requestError(ses, ext_models.MethodError, subsystem, ext_models.ErrCodePairingDisabled, "pairing is off")
+		} else if subsystem == ext_models.MethodPair {
+			return nt.handlePair(ses, decoder)
+		} else if subsystem == ext_models.MethodPairVerify {
+			nt.handlePairVerify(ses, decoder)
+		} else {
+			nt.handleAuth(ses, decoder)
+		}
 	case "init":
-		// Block multiple initializations
-		if !nt.init {
-			init, initErr := ext_models.ProcessInit(nt.wsConn, decoder)
-			if initErr != nil {
-				nt.logf("Ping err: %v\n", initErr)
-			}
-			// Send it to main module for processing
-			nt.moduleInitChan <- init.Capabilities
-			nt.init = true
-			nt.logf("Initialized")
+		if !ses.authenticated {
+			pairingError(ses, "init", ext_models.ErrCodeUnauthorized, "pair or authenticate first")
+			return nil
 		}
-	// Add all subsystem-based methods here
-	case "mp":
-		if !subsystemMethodExists {
-			return fmt.Errorf("mp: method doesn't exist")
+		// Block multiple initializations
+		if ses.init {
+			requestError(ses, ext_models.MethodError, "init", ext_models.ErrCodeAlreadyInitialized, "close the session first")
+			return nil
 		}
-		if nt.init {
-			nt.commChannels.MPChannel.InChannel <- data
+		init, initErr := ext_models.ProcessInit(ses.conn, decoder)
+		if initErr != nil {
+			requestError(ses, ext_models.MethodError, "init", ext_models.ErrCodeDecode, "%v", initErr)
+			return nil
 		}
+		nt.initSession(ses, init.Capabilities)
 	case "close":
-		nt.init = false
-		nt.logf("CLOSE command received from remote. Server Closing")
+		ses.init = false
+		nt.releaseModules(ses, nil)
+		nt.logf("Session %d: CLOSE command received from remote", ses.id)
+		ses.reply(models.Message{
+			Method: ext_models.MethodOk,
+			Args:   &ext_models.CommandOk{Method: methodAndSubsystem},
+		})
 		return nil
+	default:
+		// Add all subsystem-based methods to `comm.CommChannels`
+		channel := nt.commChannels.Module(subsystem)
+		if channel == nil {
+			requestError(ses, ext_models.MethodError, methodAndSubsystem, ext_models.ErrCodeUnknownModule, "no module %q", subsystem)
+			return nil
+		}
+		if method == "" {
+			return fmt.Errorf("%s: method doesn't exist", subsystem)
+		}
+		moduleError := utils.GeneratePlatformMethod(subsystem, utils.CurrentPlatform(), ext_models.MethodError)
+		if !ses.enabled(subsystem) {
+			requestError(ses, moduleError, methodAndSubsystem, ext_models.ErrCodeModuleNotEnabled, "%s isn't enabled (see init)", subsystem)
+			return nil
+		}
+		// Other sessions may still be using the module, only this session
+		// lets go of it.
+		if method == "close" {
+			nt.releaseModules(ses, []string{subsystem})
+			ses.reply(models.Message{
+				Method: utils.GeneratePlatformMethod(subsystem, utils.CurrentPlatform(), ext_models.MethodOk),
+				Args:   &ext_models.CommandOk{Method: methodAndSubsystem},
+			})
+			return nil
+		}
+		if !nt.sendToModule(subsystem, channel, method, comm.Request{Session: ses.id, Id: ses.requestId, Data: data}) {
+			requestError(ses, moduleError, methodAndSubsystem, ext_models.ErrCodeModuleUnavailable, "%s isn't accepting requests", subsystem)
+		}
 	}
 	// Remove this later
 	return nil
 }
 
-func (nt *NetworkTransmissionServer) write(msgData models.Message) error {
-	// Marshal the given message to data
-	encodedData, marshalErr := msgpack.Marshal(&msgData)
-	if marshalErr != nil {
-		return marshalErr
+// Replies to the request being handled with an error (logging it too), for
+// requests which don't get to a subsystem, so every request gets a reply.
+func requestError(ses *session, errorMethod string, requestMethod string, code string, format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	ses.logf("Session %d: %s: %s", ses.id, requestMethod, message)
+	ses.reply(models.Message{
+		Method: errorMethod,
+		Args: &ext_models.CommandError{
+			Method:  requestMethod,
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// Enables the requested modules (and capabilities, see
+// `ext_models.CapabilityChunked` and `ext_models.CapabilitySequenced`) for a
+// session, and replies with the ones
+// which could be enabled. The session is subscribed to the requested modules
+// beforehand, so it gets their events from setup on.
+func (nt *NetworkTransmissionServer) initSession(ses *session, capabilities []string) {
+	// Capabilities of the session itself, rather than modules
+	modules := []string{}
+	chunked, sequenced := false, false
+	for _, capability := range capabilities {
+		switch capability {
+		case ext_models.CapabilityChunked:
+			chunked = true
+		case ext_models.CapabilitySequenced:
+			sequenced = true
+		default:
+			modules = append(modules, capability)
+		}
+	}
+	ses.setModules(modules)
+	reply := make(chan []string, 1)
+	select {
+	case nt.moduleInitChan <- comm.SessionInit{Session: ses.id, Modules: modules, Reply: reply}:
+	case <-ses.ctx.Done():
+		return
+	}
+	var enabledModules []string
+	select {
+	case enabledModules = <-reply:
+	case <-ses.ctx.Done():
+		return
+	}
+	ses.setModules(enabledModules)
+	ses.init = true
+	if chunked {
+		ses.chunked.Store(true)
+		enabledModules = append(enabledModules, ext_models.CapabilityChunked)
+	}
+	if sequenced {
+		ses.sequenced.Store(true)
+		enabledModules = append(enabledModules, ext_models.CapabilitySequenced)
+	}
+	ses.reply(*base.NewInitWithCapabilities(enabledModules).GenMessage("rinit"))
+	nt.logf("Session %d: Initialized %v", ses.id, enabledModules)
+}
+
+// Lets go of the given modules for a session (all of them when nil).
+func (nt *NetworkTransmissionServer) releaseModules(ses *session, modules []string) {
+	if modules == nil {
+		ses.setModules(nil)
+	} else {
+		for _, module := range modules {
+			ses.disable(module)
+		}
+	}
+	select {
+	case nt.moduleCloseChan <- comm.SessionClose{Session: ses.id, Modules: modules}:
+	case <-nt.context.Done():
+	}
+}
+
+// Hands a request to a subsystem, and returns whether it accepted it. The
+// subsystem may have stopped (ex: after `mp:close`), so the connection isn't
+// blocked on it for more than `ModuleSendTimeout`.
+func (nt *NetworkTransmissionServer) sendToModule(
+	subsystem string,
+	channel *comm.BiDirMessageChannel,
+	method string,
+	request comm.Request,
+) bool {
+	select {
+	case channel.InChannel <- request:
+		return true
+	case <-time.After(ModuleSendTimeout):
+		nt.logf("%s: subsystem not accepting requests, dropped %s", subsystem, method)
+		return false
+	}
+}
+
+// -- SESSIONS --
+
+func (nt *NetworkTransmissionServer) addSession(conn *websocket.Conn) *session {
+	nt.sessionsMutex.Lock()
+	defer nt.sessionsMutex.Unlock()
+	nt.lastSessionId++
+	ses := newSession(nt.context, nt.lastSessionId, conn, nt.transport.ChunkSize, nt.logf)
+	ses.authenticated = nt.trustStore == nil
+	nt.sessions[ses.id] = ses
+	return ses
+}
+
+func (nt *NetworkTransmissionServer) removeSession(ses *session) {
+	nt.sessionsMutex.Lock()
+	defer nt.sessionsMutex.Unlock()
+	delete(nt.sessions, ses.id)
+}
+
+// Queues a subsystem message for the session it's addressed to, or for
+// every session which enabled the module.
+func (nt *NetworkTransmissionServer) dispatch(module string, envelope comm.Envelope) {
+	nt.sessionsMutex.RLock()
+	defer nt.sessionsMutex.RUnlock()
+	if envelope.Session != comm.BroadcastSession {
+		if ses, sessionExists := nt.sessions[envelope.Session]; sessionExists && ses.enabled(module) {
+			ses.queueEnvelope(envelope)
+		}
+		return
+	}
+	for _, ses := range nt.sessions {
+		if ses.enabled(module) {
+			ses.queueEnvelope(envelope)
+		}
+	}
+}
+
+// Routes subsystem messages to the sessions until shutdown.
+func (nt *NetworkTransmissionServer) dispatchLoop() {
+	for {
+		select {
+		case <-nt.context.Done():
+			return
+		case envelope := <-nt.commChannels.MPChannel.OutChannel:
+			nt.dispatch("mp", envelope)
+		case envelope := <-nt.commChannels.AudioChannel.OutChannel:
+			nt.dispatch("audio", envelope)
+		}
 	}
-	// fmt.Printf("%x\n", encodedData)
-	// Encode and send the binary data through WS
-	return nt.wsConn.Write(nt.context, websocket.MessageBinary, encodedData)
 }
 
 // -- HTTP SPECIFIC --
@@ -139,13 +396,22 @@ func (nt *NetworkTransmissionServer) Serve(secure bool) error {
 	}
 	if secure {
 		// Add TLS Configuration for Security
-		ipAddress, ipAddrErr := getAvailableIPAddresses()
-		if ipAddrErr != nil {
-			return ipAddrErr
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if nt.certificateReloader != nil {
+			tlsConfig.GetCertificate = nt.certificateReloader.GetCertificate
+			go nt.certificateReloader.Run(nt.context)
+		} else {
+			if nt.certificate == nil {
+				certificate, identityErr := LoadDefaultIdentity()
+				if identityErr != nil {
+					return identityErr
+				}
+				nt.certificate = certificate
+			}
+			tlsConfig.Certificates = []tls.Certificate{*nt.certificate}
 		}
-		tlsConfig, tlsConfigErr := network.GenerateTLSConfig(ipAddress)
-		if tlsConfigErr != nil {
-			return tlsConfigErr
+		if nt.clientAuthenticator != nil {
+			nt.clientAuthenticator.configure(tlsConfig, nt.logf)
 		}
 		nt.httpServer.TLSConfig = tlsConfig
 		return nt.httpServer.ListenAndServeTLS("", "")
@@ -156,70 +422,81 @@ func (nt *NetworkTransmissionServer) Serve(secure bool) error {
 
 // -- Shutdown Server
 func (nt *NetworkTransmissionServer) Shutdown(context context.Context) error {
+	nt.cancel()
+	nt.sessionsMutex.RLock()
+	for _, ses := range nt.sessions {
+		ses.conn.Close(websocket.StatusGoingAway, "Cyprus Shutting Down")
+	}
+	nt.sessionsMutex.RUnlock()
 	return nt.httpServer.Shutdown(context)
 }
 
 // -- WEBSOCKET-SPECIFIC --
 
 // - UPGRADE TO WS
-func (nt *NetworkTransmissionServer) upgradeToWebsockets(w http.ResponseWriter, req *http.Request) error {
-	if nt.wsConn != nil {
-		http.Error(w, "Server already connected, cannot accept more connections.", http.StatusLocked)
-		return fmt.Errorf("connection already established")
+func (nt *NetworkTransmissionServer) upgradeToWebsockets(w http.ResponseWriter, req *http.Request) (*websocket.Conn, error) {
+	if originErr := nt.originPolicy.Check(req); originErr != nil {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return nil, originErr
 	}
 	wsConn, wsConnAcceptErr := websocket.Accept(w, req, &websocket.AcceptOptions{
-		// TODO: Provide a more tighter security.
-		OriginPatterns: []string{"*"},
+		// Checked by the origin policy instead.
+		InsecureSkipVerify:   true,
+		Subprotocols:         subprotocols,
+		CompressionMode:      nt.transport.compressionMode(),
+		CompressionThreshold: nt.transport.CompressionThreshold,
 	})
 	if wsConnAcceptErr != nil {
-		return fmt.Errorf("wsConnAcceptErr %v", wsConnAcceptErr)
-	}
-	nt.wsConn = wsConn
-	return nil
-}
-
-// - WEBSOCKET CLOSE
-func (nt *NetworkTransmissionServer) wsClose(statusCode websocket.StatusCode, reason string) {
-	if nt.wsConn != nil {
-		nt.logf("WS Connection Closing")
-		nt.wsConn.Close(statusCode, reason)
-		nt.init = false
-		nt.wsConn = nil
+		return nil, fmt.Errorf("wsConnAcceptErr %v", wsConnAcceptErr)
 	}
+	// Larger messages close the connection (with `websocket.StatusMessageTooBig`).
+	wsConn.SetReadLimit(nt.transport.MaxMessageSize)
+	return wsConn, nil
 }
 
-// - TODO: WS REQUEST HANDLER
+// - WS REQUEST HANDLER
 func (nt *NetworkTransmissionServer) WebsocketHandler(w http.ResponseWriter, req *http.Request) {
 	// Upgrade to websockets if possible
-	wsUpgrdErr := nt.upgradeToWebsockets(w, req)
+	wsConn, wsUpgrdErr := nt.upgradeToWebsockets(w, req)
 	if wsUpgrdErr != nil {
-		nt.logf("WS Upgrade Error: %v", wsUpgrdErr)
+		nt.logf("WS Upgrade refused (%s): %v", req.RemoteAddr, wsUpgrdErr)
+		return
 	}
-	// on WS Error
-	defer nt.wsClose(websocket.StatusInternalError, "SERVER ERROR")
-
-	// Setup function context
-	nt.context = context.Background()
+	ses := nt.addSession(wsConn)
+	nt.logf("Session %d: connected (%s)", ses.id, req.RemoteAddr)
+	// The client certificate was verified during the handshake.
+	if nt.clientAuthenticator != nil && req.TLS != nil && len(req.TLS.PeerCertificates) != 0 {
+		ses.authenticated = true
+		nt.logf("Session %d: Authenticated with certificate %q", ses.id, req.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	defer nt.removeSession(ses)
+	defer ses.cancel()
 
 	// Run Write Loop
-	// TODO: Add synchronization if needed
-	go nt.writeLoop()
+	go ses.writeLoop()
+	go ses.heartbeatLoop(time.Duration(nt.transport.HeartbeatInterval), time.Duration(nt.transport.IdleTimeout))
 
 	// Read loop
-	readErr := nt.readLoop()
-	nt.moduleCloseChan <- true
-	if readErr != nil {
-		nt.logf("Read Error: %v", readErr)
+	readErr := nt.readLoop(ses)
+	nt.abandonPairing(ses)
+	// Modules this session used may be stopped, if no other session uses them.
+	nt.releaseModules(ses, nil)
+	if ses.lost.Load() {
+		nt.logf("Session %d: Connection lost", ses.id)
+	} else if readErr != nil {
+		nt.logf("Session %d: Read Error: %v", ses.id, readErr)
+		wsConn.Close(websocket.StatusInternalError, "SERVER ERROR")
 	} else {
-		nt.wsClose(websocket.StatusNormalClosure, "Cyprus Disconnected")
+		nt.logf("Session %d: WS Connection Closing", ses.id)
+		wsConn.Close(websocket.StatusNormalClosure, "Cyprus Disconnected")
 	}
 }
 
-// -- READ AND WRITE LOOPS
+// -- READ LOOP
 
-func (nt *NetworkTransmissionServer) readLoop() error {
+func (nt *NetworkTransmissionServer) readLoop(ses *session) error {
 	for {
-		_, data, readErr := nt.wsConn.Read(nt.context)
+		_, data, readErr := ses.conn.Read(ses.ctx)
 		// nt.logf("readLoop:DATA: %x", data)
 		if readErr != nil {
 			if websocket.CloseStatus(readErr) == websocket.StatusNormalClosure ||
@@ -228,21 +505,15 @@ func (nt *NetworkTransmissionServer) readLoop() error {
 			}
 			return readErr
 		}
-		decodeErr := nt.decodeData(data)
+		ses.seen()
+		data, framingErr := ses.framing.decode(data)
+		if framingErr != nil {
+			return framingErr
+		}
+		decodeErr := nt.decodeData(ses, data)
 		if decodeErr != nil {
 			return decodeErr
 		}
 	}
 	return nil
 }
-
-func (nt *NetworkTransmissionServer) writeLoop() {
-	for nt.wsConn != nil {
-		select {
-		case writeObject := <-nt.writeChannel:
-			nt.write(writeObject)
-		case mpObject := <-nt.commChannels.MPChannel.OutChannel:
-			nt.write(mpObject)
-		}
-	}
-}
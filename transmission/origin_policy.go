@@ -0,0 +1,64 @@
+package transmission
+
+/*
+Websocket Origin Policy
+
+Browsers send the origin of the page opening a websocket, so any page open
+on the LAN could otherwise talk to the server. Connections without an origin
+(native clients) are accepted, but browser origins have to be allowed
+explicitly, by host patterns (`path.Match` syntax, ex: "app.example.com",
+"*.lan:8080", or "*" for any origin).
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+type OriginPolicy struct {
+	patterns []string
+}
+
+// Policy allowing origins whose host (with its port, if any) matches one of
+// the patterns. No patterns rejects every browser origin.
+func NewOriginPolicy(patterns []string) (*OriginPolicy, error) {
+	policy := &OriginPolicy{patterns: []string{}}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if _, matchErr := path.Match(pattern, ""); matchErr != nil {
+			return nil, fmt.Errorf("origin pattern %q: %w", pattern, matchErr)
+		}
+		policy.patterns = append(policy.patterns, pattern)
+	}
+	return policy, nil
+}
+
+// Returns why the request's origin isn't allowed (nil when it is).
+func (op *OriginPolicy) Check(req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	originUrl, parseErr := url.Parse(origin)
+	if parseErr != nil || originUrl.Host == "" {
+		return fmt.Errorf("origin %q isn't a valid URL with a host", origin)
+	}
+	host := strings.ToLower(originUrl.Host)
+	for _, pattern := range op.patterns {
+		if matched, _ := path.Match(pattern, host); matched {
+			return nil
+		}
+	}
+	if len(op.patterns) == 0 {
+		return fmt.Errorf("origin %q isn't allowed (no browser origins are)", origin)
+	}
+	return fmt.Errorf("origin %q isn't allowed (allowed: %s)", origin, strings.Join(op.patterns, ", "))
+}
@@ -0,0 +1,248 @@
+package transmission
+
+/*
+Device Pairing
+
+Sessions from unknown clients have to pair before `init` is accepted (see
+`ext_models/pairing.go` for the flow). The PIN is only shown on the server
+(in its log, by default), so pairing needs someone at the server. A PIN can
+only be tried once, and expires after `PairingPinTimeout`.
+
+PINs are limited server-wide too, as clients can reconnect for new ones:
+only one can be outstanding at a time, and after `PairingFailuresAllowed`
+failed (or abandoned) PINs, new ones are refused for a cooldown, doubled with
+every further failure, until a client pairs.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/Artiqlate/cyprus/ext_models"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	PairingPinDigits  = 6
+	PairingPinTimeout = time.Minute * 2
+	// PINs a session can ask for before it's disconnected
+	MaxPairingAttempts = 3
+	// Failed PINs (server-wide) before new ones are refused for a cooldown
+	PairingFailuresAllowed = 3
+	PairingCooldown        = time.Second * 5
+	PairingCooldownMax     = time.Minute * 5
+	pairingNonceSize       = 16
+)
+
+// Proof that a client knows the PIN: the hex-encoded HMAC-SHA256 of the
+// (hex-encoded) nonce, keyed with the PIN.
+func PinProof(pin string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(pin))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func generatePin() (string, error) {
+	maxPin := new(big.Int).Exp(big.NewInt(10), big.NewInt(PairingPinDigits), nil)
+	pin, randErr := rand.Int(rand.Reader, maxPin)
+	if randErr != nil {
+		return "", randErr
+	}
+	return fmt.Sprintf("%0*d", PairingPinDigits, pin), nil
+}
+
+// A PIN waiting to be proven by a session.
+type pendingPairing struct {
+	clientName string
+	pin        string
+	nonce      string
+	deadline   time.Time
+}
+
+// Server-wide PIN limits.
+type pairingLimiter struct {
+	mutex sync.Mutex
+	// Session with the outstanding PIN (0 for none), until its deadline
+	session  uint64
+	deadline time.Time
+	// Failed PINs since the last pairing, and the end of their cooldown
+	failures     int
+	blockedUntil time.Time
+}
+
+// Takes the outstanding PIN for a session (which may already have it).
+func (pl *pairingLimiter) begin(sessionId uint64, now time.Time) error {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	if now.Before(pl.blockedUntil) {
+		return fmt.Errorf("too many failed pairings, try again in %s", pl.blockedUntil.Sub(now).Round(time.Second))
+	}
+	if pl.session != 0 && pl.session != sessionId && now.Before(pl.deadline) {
+		return fmt.Errorf("another client is pairing, try again later")
+	}
+	pl.session, pl.deadline = sessionId, now.Add(PairingPinTimeout)
+	return nil
+}
+
+// Ends the PIN of a session, either paired or failed.
+func (pl *pairingLimiter) end(sessionId uint64, paired bool, now time.Time) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	if pl.session == sessionId {
+		pl.session = 0
+	}
+	if paired {
+		pl.failures = 0
+		pl.blockedUntil = time.Time{}
+		return
+	}
+	pl.failures++
+	if pl.failures <= PairingFailuresAllowed {
+		return
+	}
+	cooldown := PairingCooldown
+	for failure := PairingFailuresAllowed + 1; failure < pl.failures && cooldown < PairingCooldownMax; failure++ {
+		cooldown *= 2
+	}
+	if cooldown > PairingCooldownMax {
+		cooldown = PairingCooldownMax
+	}
+	pl.blockedUntil = now.Add(cooldown)
+}
+
+// -- REPLIES --
+
+func pairingError(ses *session, requestMethod string, code string, format string, v ...interface{}) {
+	requestError(ses, ext_models.MethodError, requestMethod, code, format, v...)
+}
+
+// -- HANDLERS --
+
+// Shows a new PIN for the session, and sends the challenge to prove it
+// against. A PIN the session didn't prove yet counts as failed, so it can't
+// hold on to pairing by asking for new ones. Returns an error once the
+// session asked for too many PINs.
+func (nt *NetworkTransmissionServer) handlePair(ses *session, decoder *msgpack.Decoder) error {
+	var pairRequest ext_models.PairRequest
+	if decodeErr := decoder.Decode(&pairRequest); decodeErr != nil {
+		pairingError(ses, ext_models.MethodPair, ext_models.ErrCodeDecode, "%v", decodeErr)
+		return nil
+	}
+	ses.pairingAttempts++
+	if ses.pairingAttempts > MaxPairingAttempts {
+		return fmt.Errorf("too many pairing attempts")
+	}
+	nt.abandonPairing(ses)
+	if limitErr := nt.pairingLimiter.begin(ses.id, time.Now()); limitErr != nil {
+		pairingError(ses, ext_models.MethodPair, ext_models.ErrCodePairingUnavailable, "%v", limitErr)
+		return nil
+	}
+	pin, pinErr := generatePin()
+	if pinErr != nil {
+		return pinErr
+	}
+	nonce, nonceErr := randomHex(pairingNonceSize)
+	if nonceErr != nil {
+		return nonceErr
+	}
+	ses.pairing = &pendingPairing{
+		clientName: pairRequest.ClientName,
+		pin:        pin,
+		nonce:      nonce,
+		deadline:   time.Now().Add(PairingPinTimeout),
+	}
+	nt.logf("Session %d: Pairing with %q", ses.id, pairRequest.ClientName)
+	nt.showPin(pairRequest.ClientName, pin)
+	ses.reply(models.Message{
+		Method: ext_models.MethodRPair,
+		Args: &ext_models.PairChallenge{
+			Nonce:     nonce,
+			ExpiresIn: int64(PairingPinTimeout / time.Second),
+		},
+	})
+	return nil
+}
+
+// Checks the PIN proof, and trusts the client if it's right. The PIN is
+// used up either way.
+func (nt *NetworkTransmissionServer) handlePairVerify(ses *session, decoder *msgpack.Decoder) {
+	var pairVerify ext_models.PairVerify
+	if decodeErr := decoder.Decode(&pairVerify); decodeErr != nil {
+		pairingError(ses, ext_models.MethodPairVerify, ext_models.ErrCodeDecode, "%v", decodeErr)
+		return
+	}
+	pairing := ses.pairing
+	ses.pairing = nil
+	if pairing == nil {
+		pairingError(ses, ext_models.MethodPairVerify, ext_models.ErrCodePairingFailed, "no pairing in progress")
+		return
+	}
+	now := time.Now()
+	if now.After(pairing.deadline) {
+		nt.pairingLimiter.end(ses.id, false, now)
+		pairingError(ses, ext_models.MethodPairVerify, ext_models.ErrCodePairingFailed, "PIN expired")
+		return
+	}
+	expectedProof := PinProof(pairing.pin, pairing.nonce)
+	if !hmac.Equal([]byte(expectedProof), []byte(pairVerify.Proof)) {
+		nt.pairingLimiter.end(ses.id, false, now)
+		pairingError(ses, ext_models.MethodPairVerify, ext_models.ErrCodePairingFailed, "wrong PIN")
+		return
+	}
+	clientId, credential, addErr := nt.trustStore.Add(pairing.clientName)
+	if addErr != nil {
+		nt.pairingLimiter.end(ses.id, false, now)
+		pairingError(ses, ext_models.MethodPairVerify, ext_models.ErrCodeStorage, "%v", addErr)
+		return
+	}
+	nt.pairingLimiter.end(ses.id, true, now)
+	ses.authenticated = true
+	nt.logf("Session %d: Paired with %q (%s)", ses.id, pairing.clientName, clientId)
+	ses.reply(models.Message{
+		Method: ext_models.MethodRPairVerify,
+		Args:   &ext_models.ClientCredential{ClientId: clientId, Credential: credential},
+	})
+}
+
+// Counts the PIN a session left without proving as failed (when it
+// disconnects, or asks for a new one), so reconnecting doesn't get around
+// the limits.
+func (nt *NetworkTransmissionServer) abandonPairing(ses *session) {
+	if ses.pairing != nil {
+		ses.pairing = nil
+		nt.pairingLimiter.end(ses.id, false, time.Now())
+	}
+}
+
+// Authenticates a session with the credential of a paired client.
+func (nt *NetworkTransmissionServer) handleAuth(ses *session, decoder *msgpack.Decoder) {
+	var clientCredential ext_models.ClientCredential
+	if decodeErr := decoder.Decode(&clientCredential); decodeErr != nil {
+		pairingError(ses, ext_models.MethodAuth, ext_models.ErrCodeDecode, "%v", decodeErr)
+		return
+	}
+	client, verifyErr := nt.trustStore.Verify(clientCredential.ClientId, clientCredential.Credential)
+	if verifyErr != nil {
+		pairingError(ses, ext_models.MethodAuth, ext_models.ErrCodeStorage, "%v", verifyErr)
+		return
+	}
+	if client == nil {
+		pairingError(ses, ext_models.MethodAuth, ext_models.ErrCodeAuthFailed, "unknown client or wrong credential")
+		return
+	}
+	ses.authenticated = true
+	nt.logf("Session %d: Authenticated as %q (%s)", ses.id, client.Name, client.Id)
+	ses.reply(models.Message{
+		Method: ext_models.MethodRAuth,
+		Args:   &ext_models.CommandOk{Method: ext_models.MethodAuth},
+	})
+}
@@ -0,0 +1,111 @@
+package transmission
+
+/*
+MessagePack-RPC Framing
+
+Framing of the MessagePack-RPC specification, for clients which ask for the
+`cyprus.msgpack-rpc` subprotocol (so standard msgpack-rpc libraries can be
+used as they are):
+
+	[0, msgid, method, params]   request (replied to with a response)
+	[1, msgid, error, result]    response
+	[2, method, params]          notification
+
+Methods are the native ones (ex: "mp:iplay"), and params hold the native
+arguments as their only element (or no element, for methods without any).
+Responses carry the native reply's arguments as their result, or its error
+(see `ext_models.CommandError`) as their error. Events are sent as notifications,
+as are the replies to notifications.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/Artiqlate/cyprus/ext_models"
+	"github.com/vmihailenco/msgpack/v5"
+	"nhooyr.io/websocket"
+)
+
+const ProtocolMsgpackRPC = "cyprus.msgpack-rpc"
+
+// MessagePack-RPC message types
+const (
+	rpcRequest      = 0
+	rpcResponse     = 1
+	rpcNotification = 2
+)
+
+type rpcFraming struct{}
+
+func (rpcFraming) decode(data []byte) ([]byte, error) {
+	var frame []msgpack.RawMessage
+	if decodeErr := msgpack.Unmarshal(data, &frame); decodeErr != nil {
+		return nil, fmt.Errorf("msgpack-rpc: %w", decodeErr)
+	}
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("msgpack-rpc: empty message")
+	}
+	var messageType int
+	if decodeErr := msgpack.Unmarshal(frame[0], &messageType); decodeErr != nil {
+		return nil, fmt.Errorf("msgpack-rpc: message type: %w", decodeErr)
+	}
+	var requestId, method, params msgpack.RawMessage
+	switch {
+	case messageType == rpcRequest && len(frame) == 4:
+		requestId, method, params = frame[1], frame[2], frame[3]
+	case messageType == rpcNotification && len(frame) == 3:
+		method, params = frame[1], frame[2]
+	default:
+		return nil, fmt.Errorf("msgpack-rpc: unexpected message (type %d, %d elements)", messageType, len(frame))
+	}
+	var args []msgpack.RawMessage
+	if decodeErr := msgpack.Unmarshal(params, &args); decodeErr != nil {
+		return nil, fmt.Errorf("msgpack-rpc: params: %w", decodeErr)
+	}
+	if len(args) > 1 {
+		return nil, fmt.Errorf("msgpack-rpc: params: expected at most one element, got %d", len(args))
+	}
+	// Native `[method, args]` (or `[method, args, id]`)
+	var native bytes.Buffer
+	encoder := msgpack.NewEncoder(&native)
+	nativeLen := 2
+	if requestId != nil {
+		nativeLen = 3
+	}
+	encodeErr := encoder.EncodeArrayLen(nativeLen)
+	if encodeErr == nil {
+		encodeErr = encoder.Encode(method)
+	}
+	if encodeErr == nil && len(args) == 0 {
+		encodeErr = encoder.EncodeNil()
+	} else if encodeErr == nil {
+		encodeErr = encoder.Encode(args[0])
+	}
+	if encodeErr == nil && requestId != nil {
+		encodeErr = encoder.Encode(requestId)
+	}
+	return native.Bytes(), encodeErr
+}
+
+func isErrorMethod(method string) bool {
+	return method == ext_models.MethodError || strings.HasSuffix(method, ":"+ext_models.MethodError)
+}
+
+func (rpcFraming) encode(outgoing outgoingMessage) ([]byte, error) {
+	message := outgoing.message
+	if outgoing.requestId == nil {
+		return msgpack.Marshal([]interface{}{rpcNotification, message.Method, []interface{}{message.Args}})
+	}
+	if isErrorMethod(message.Method) {
+		return msgpack.Marshal([]interface{}{rpcResponse, outgoing.requestId, message.Args, nil})
+	}
+	return msgpack.Marshal([]interface{}{rpcResponse, outgoing.requestId, nil, message.Args})
+}
+
+func (rpcFraming) messageType() websocket.MessageType {
+	return websocket.MessageBinary
+}
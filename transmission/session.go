@@ -0,0 +1,282 @@
+package transmission
+
+/*
+Client Sessions
+
+Every websocket connection is a session, with its own initialization state,
+enabled modules and write queue. Messages from the subsystems are addressed
+to a session (replies), or to every session which enabled the module
+(events).
+
+Natively (see `framing.go`), requests are `[method, args]` arrays, with an
+optional third element: an ID (of any type) which replies and errors to the
+request echo back, as `[method, args, id]`. Events (and replies to requests
+without an ID) stay `[method, args]`.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Artiqlate/cyprus/comm"
+	"github.com/Artiqlate/cyprus/ext_models"
+	"github.com/Artiqlate/ganymede/models"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+	"nhooyr.io/websocket"
+)
+
+// Messages queued for a session before new ones are dropped (a client which
+// stops reading can't hold up the others).
+const SessionWriteQueueSize = 256
+
+type session struct {
+	id     uint64
+	conn   *websocket.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+	logf   func(f string, v ...interface{})
+	// Only touched by the read loop
+	init bool
+	// ID of the request being handled (see `reply`)
+	requestId msgpack.RawMessage
+	// Paired or authenticated (see `pairing.go`)
+	authenticated   bool
+	pairing         *pendingPairing
+	pairingAttempts int
+	// Modules enabled through `init` (read by the dispatch loop as well)
+	mutex   sync.Mutex
+	modules map[string]bool
+	// Negotiated on connection (see `framing.go`)
+	framing framing
+	// Messages waiting to be written
+	writeQueue chan outgoingMessage
+	// Larger messages are sent in chunks, once the session asked for them
+	// (see `ext_models.Chunk`)
+	chunked   atomic.Bool
+	chunkSize int
+	// Events are sent with their sequence numbers, once the session asked
+	// for them (see `ext_models.SequencedEvent`)
+	sequenced atomic.Bool
+	// Only touched by the write loop: chunks waiting to be written, and the
+	// last transfer they were split off for
+	pendingChunks []outgoingMessage
+	lastTransfer  uint64
+	// Last time the client sent something, or answered a ping (as
+	// `time.Time.UnixNano`), and whether it was given up on since
+	lastSeen atomic.Int64
+	lost     atomic.Bool
+}
+
+// A message, with the ID of the request it replies to (nil for events).
+type outgoingMessage struct {
+	message   models.Message
+	requestId msgpack.RawMessage
+}
+
+func newSession(
+	ctx context.Context,
+	id uint64,
+	conn *websocket.Conn,
+	chunkSize int,
+	logf func(f string, v ...interface{}),
+) *session {
+	sessionCtx, cancel := context.WithCancel(ctx)
+	ses := &session{
+		id:         id,
+		conn:       conn,
+		ctx:        sessionCtx,
+		cancel:     cancel,
+		logf:       logf,
+		framing:    framingFor(conn.Subprotocol()),
+		modules:    make(map[string]bool),
+		writeQueue: make(chan outgoingMessage, SessionWriteQueueSize),
+		chunkSize:  chunkSize,
+	}
+	ses.seen()
+	return ses
+}
+
+// Records a sign of life from the client.
+func (s *session) seen() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// Pings the client every interval, until the session ends. A client which
+// shows no sign of life for idleTimeout (ex: a phone which dropped off the
+// network) is lost: its connection is closed, which ends the read loop.
+func (s *session) heartbeatLoop(interval time.Duration, idleTimeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// Answer to the ping in flight (nil when there's none). A client which
+	// is busy, but still sending, keeps a single ping waiting.
+	var pong chan error
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Waited for here rather than through a context, which would have
+		// the connection closed before the session is marked as lost.
+		if pong == nil {
+			pong = make(chan error, 1)
+			go func(pong chan<- error) { pong <- s.conn.Ping(s.ctx) }(pong)
+		}
+		deadline := time.NewTimer(time.Until(time.Unix(0, s.lastSeen.Load()).Add(idleTimeout)))
+		select {
+		case <-s.ctx.Done():
+			deadline.Stop()
+			return
+		case pingErr := <-pong:
+			deadline.Stop()
+			pong = nil
+			if pingErr == nil {
+				s.seen()
+			}
+			continue
+		case <-deadline.C:
+		}
+		// Messages may have come in while the pong didn't.
+		if time.Since(time.Unix(0, s.lastSeen.Load())) < idleTimeout {
+			continue
+		}
+		s.lost.Store(true)
+		s.logf("Session %d: no sign of life for %s", s.id, idleTimeout)
+		// Without a close handshake, the client isn't there to answer it.
+		s.conn.CloseNow()
+		return
+	}
+}
+
+func (s *session) enabled(module string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.modules[module]
+}
+
+// Replaces the enabled modules.
+func (s *session) setModules(modules []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.modules = make(map[string]bool)
+	for _, module := range modules {
+		s.modules[module] = true
+	}
+}
+
+func (s *session) disable(module string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.modules, module)
+}
+
+// Queues a message (replying to the request with the given ID, if any),
+// dropping it if the queue is full.
+func (s *session) queue(message models.Message, requestId msgpack.RawMessage) {
+	select {
+	case s.writeQueue <- outgoingMessage{message: message, requestId: requestId}:
+	default:
+		s.logf("Session %d: write queue full, dropped %s", s.id, message.Method)
+	}
+}
+
+// Queues a subsystem message, wrapping sequenced events for sessions which
+// asked for it.
+func (s *session) queueEnvelope(envelope comm.Envelope) {
+	message := envelope.Message
+	if envelope.Seq != 0 && s.sequenced.Load() {
+		message.Args = &ext_models.SequencedEvent{Seq: envelope.Seq, Data: message.Args}
+	}
+	s.queue(message, envelope.RequestId)
+}
+
+// Queues a reply to the request being handled (only from the read loop).
+func (s *session) reply(message models.Message) {
+	s.queue(message, s.requestId)
+}
+
+// ID of a request (nil when it has none, or it's nil).
+func decodeRequestId(data []byte) msgpack.RawMessage {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	arrLen, arrLenErr := decoder.DecodeArrayLen()
+	if arrLenErr != nil || arrLen < 3 {
+		return nil
+	}
+	// Skip the method and arguments
+	for elementIdx := 0; elementIdx < 2; elementIdx++ {
+		if skipErr := decoder.Skip(); skipErr != nil {
+			return nil
+		}
+	}
+	requestId, decodeErr := decoder.DecodeRaw()
+	if decodeErr != nil || (len(requestId) == 1 && requestId[0] == msgpcode.Nil) {
+		return nil
+	}
+	return requestId
+}
+
+func (s *session) write(outgoing outgoingMessage) error {
+	encodedData, encodeErr := s.framing.encode(outgoing)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if len(encodedData) > s.chunkSize && s.chunked.Load() && outgoing.message.Method != ext_models.MethodChunk {
+		s.splitChunks(encodedData)
+		return nil
+	}
+	return s.conn.Write(s.ctx, s.framing.messageType(), encodedData)
+}
+
+// Queues the chunks of an encoded message, to be written once there's no
+// other message waiting.
+func (s *session) splitChunks(encodedData []byte) {
+	s.lastTransfer++
+	count := (len(encodedData) + s.chunkSize - 1) / s.chunkSize
+	for index := 0; index < count; index++ {
+		end := (index + 1) * s.chunkSize
+		if end > len(encodedData) {
+			end = len(encodedData)
+		}
+		s.pendingChunks = append(s.pendingChunks, outgoingMessage{message: models.Message{
+			Method: ext_models.MethodChunk,
+			Args: &ext_models.Chunk{
+				Transfer: s.lastTransfer,
+				Index:    index,
+				Count:    count,
+				Data:     encodedData[index*s.chunkSize : end],
+			},
+		}})
+	}
+}
+
+// Writes queued messages until the session ends. Chunks are only written
+// when no other message is waiting, so they can't hold up events.
+func (s *session) writeLoop() {
+	for {
+		var outgoing outgoingMessage
+		select {
+		case <-s.ctx.Done():
+			return
+		case outgoing = <-s.writeQueue:
+		default:
+			if len(s.pendingChunks) != 0 {
+				outgoing, s.pendingChunks = s.pendingChunks[0], s.pendingChunks[1:]
+			} else {
+				select {
+				case <-s.ctx.Done():
+					return
+				case outgoing = <-s.writeQueue:
+				}
+			}
+		}
+		if writeErr := s.write(outgoing); writeErr != nil {
+			s.logf("Session %d: write %s: %v", s.id, outgoing.message.Method, writeErr)
+		}
+	}
+}
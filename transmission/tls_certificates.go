@@ -0,0 +1,230 @@
+package transmission
+
+/*
+TLS Certificate Files
+
+A certificate (and key, and optional chain) brought in from outside, ex: one
+issued by an internal CA. The files are validated when they're loaded, and
+reloaded when they change on disk. Connections which are already open keep
+the certificate they were set up with.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How often certificate files are checked for changes.
+const CertificateReloadInterval = time.Second * 5
+
+type CertificateFiles struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Intermediate certificates, leaf first (optional)
+	ChainFile string `json:"chain_file"`
+}
+
+// Whether any certificate file is given.
+func (cf CertificateFiles) Configured() bool {
+	return cf.CertFile != "" || cf.KeyFile != "" || cf.ChainFile != ""
+}
+
+// Same files, with relative paths resolved against dir.
+func (cf CertificateFiles) RelativeTo(dir string) CertificateFiles {
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	return CertificateFiles{
+		CertFile:  resolve(cf.CertFile),
+		KeyFile:   resolve(cf.KeyFile),
+		ChainFile: resolve(cf.ChainFile),
+	}
+}
+
+func parseCertificates(path string, content []byte) ([]*x509.Certificate, error) {
+	certificates := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("%s: unexpected %s block (only certificates expected)", path, block.Type)
+		}
+		certificate, parseErr := x509.ParseCertificate(block.Bytes)
+		if parseErr != nil {
+			return nil, fmt.Errorf("%s: %v", path, parseErr)
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("%s: no PEM certificate found", path)
+	}
+	return certificates, nil
+}
+
+// Loads and validates the certificate: the key has to match it, it has to be
+// valid right now, and each chain certificate has to have signed the one
+// before it.
+func (cf CertificateFiles) Load() (*tls.Certificate, error) {
+	if cf.CertFile == "" || cf.KeyFile == "" {
+		return nil, fmt.Errorf("TLS: both a certificate file and a key file are needed")
+	}
+	certPEM, readErr := os.ReadFile(cf.CertFile)
+	if readErr != nil {
+		return nil, fmt.Errorf("TLS certificate: %w", readErr)
+	}
+	keyPEM, readErr := os.ReadFile(cf.KeyFile)
+	if readErr != nil {
+		return nil, fmt.Errorf("TLS key: %w", readErr)
+	}
+	certificates, parseErr := parseCertificates(cf.CertFile, certPEM)
+	if parseErr != nil {
+		return nil, fmt.Errorf("TLS certificate: %w", parseErr)
+	}
+	if cf.ChainFile != "" {
+		chainPEM, readErr := os.ReadFile(cf.ChainFile)
+		if readErr != nil {
+			return nil, fmt.Errorf("TLS chain: %w", readErr)
+		}
+		chain, parseErr := parseCertificates(cf.ChainFile, chainPEM)
+		if parseErr != nil {
+			return nil, fmt.Errorf("TLS chain: %w", parseErr)
+		}
+		certificates = append(certificates, chain...)
+		certPEM = append(append(certPEM, '\n'), chainPEM...)
+	}
+	leaf := certificates[0]
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("TLS certificate %s: not valid before %s", cf.CertFile, leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("TLS certificate %s: expired on %s", cf.CertFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	for certIdx := 1; certIdx < len(certificates); certIdx++ {
+		if signatureErr := certificates[certIdx-1].CheckSignatureFrom(certificates[certIdx]); signatureErr != nil {
+			return nil, fmt.Errorf(
+				"TLS chain: %q isn't signed by %q: %v",
+				certificates[certIdx-1].Subject.CommonName,
+				certificates[certIdx].Subject.CommonName,
+				signatureErr,
+			)
+		}
+	}
+	certificate, pairErr := tls.X509KeyPair(certPEM, keyPEM)
+	if pairErr != nil {
+		return nil, fmt.Errorf("TLS key %s: %v", cf.KeyFile, pairErr)
+	}
+	certificate.Leaf = leaf
+	return &certificate, nil
+}
+
+// -- RELOADING --
+
+// Serves the certificate from the given files, and reloads it when they
+// change. A change which doesn't load (ex: a key written after its
+// certificate) keeps the previous certificate, until the files are fixed.
+type CertificateReloader struct {
+	files       CertificateFiles
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	// File contents the certificate was last loaded from
+	reloadMutex sync.Mutex
+	loaded      []byte
+	// Called (from the reloading goroutine) with every new certificate
+	onReload func(*tls.Certificate)
+	logf     func(f string, v ...interface{})
+}
+
+// Loads the certificate (failing if it isn't valid).
+func NewCertificateReloader(files CertificateFiles, logf func(f string, v ...interface{})) (*CertificateReloader, error) {
+	cr := &CertificateReloader{files: files, logf: logf}
+	certificate, loadErr := files.Load()
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	cr.certificate = certificate
+	cr.loaded = cr.contents()
+	return cr, nil
+}
+
+// Has to be set before `Run`.
+func (cr *CertificateReloader) OnReload(onReload func(*tls.Certificate)) {
+	cr.onReload = onReload
+}
+
+// Current content of all the files (missing files count as empty).
+func (cr *CertificateReloader) contents() []byte {
+	contents := []byte{}
+	for _, path := range []string{cr.files.CertFile, cr.files.KeyFile, cr.files.ChainFile} {
+		if path == "" {
+			continue
+		}
+		content, _ := os.ReadFile(path)
+		contents = append(append(contents, content...), 0)
+	}
+	return contents
+}
+
+func (cr *CertificateReloader) Certificate() *tls.Certificate {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return cr.certificate
+}
+
+// For `tls.Config.GetCertificate`.
+func (cr *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.Certificate(), nil
+}
+
+// Reloads the certificate if the files changed.
+func (cr *CertificateReloader) Reload() {
+	cr.reloadMutex.Lock()
+	defer cr.reloadMutex.Unlock()
+	contents := cr.contents()
+	if bytes.Equal(contents, cr.loaded) {
+		return
+	}
+	cr.loaded = contents
+	certificate, loadErr := cr.files.Load()
+	if loadErr != nil {
+		cr.logf("Certificate not reloaded, still serving the previous one: %v", loadErr)
+		return
+	}
+	cr.mutex.Lock()
+	cr.certificate = certificate
+	cr.mutex.Unlock()
+	cr.logf("Certificate reloaded (SHA-256: %s)", Fingerprint(certificate))
+	if cr.onReload != nil {
+		cr.onReload(certificate)
+	}
+}
+
+// Checks for changes every `CertificateReloadInterval`, until ctx is done.
+func (cr *CertificateReloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(CertificateReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cr.Reload()
+		}
+	}
+}
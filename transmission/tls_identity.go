@@ -0,0 +1,189 @@
+package transmission
+
+/*
+TLS Identity
+
+The certificate and key secure mode serves with. They're generated once, and
+kept in the config directory, so the certificate stays the same across
+restarts and clients can pin its SHA-256 fingerprint (published through
+network discovery, and logged on start). `Rotate` replaces them.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Artiqlate/cyprus/utils"
+)
+
+const (
+	IdentityCertFileName = "identity.crt"
+	IdentityKeyFileName  = "identity.key"
+	// Generated certificates are valid this long. Clients pin the
+	// certificate rather than trusting its subject, so it's long-lived.
+	IdentityValidity = time.Hour * 24 * 365 * 10
+)
+
+type TLSIdentity struct {
+	certPath string
+	keyPath  string
+}
+
+// Identity kept in the given directory.
+func NewTLSIdentity(dir string) *TLSIdentity {
+	return &TLSIdentity{
+		certPath: filepath.Join(dir, IdentityCertFileName),
+		keyPath:  filepath.Join(dir, IdentityKeyFileName),
+	}
+}
+
+// Identity in the config directory (see `utils.ConfigDir`).
+func DefaultTLSIdentity() (*TLSIdentity, error) {
+	configDir, configDirErr := utils.ConfigDir()
+	if configDirErr != nil {
+		return nil, configDirErr
+	}
+	return NewTLSIdentity(configDir), nil
+}
+
+func (ti *TLSIdentity) CertPath() string {
+	return ti.certPath
+}
+
+// Loads the default identity (for the addresses of the network interfaces
+// which are up), generating it first if there's none yet.
+func LoadDefaultIdentity() (*tls.Certificate, error) {
+	identity, identityErr := DefaultTLSIdentity()
+	if identityErr != nil {
+		return nil, identityErr
+	}
+	ipAddresses, ipAddrErr := getAvailableIPAddresses()
+	if ipAddrErr != nil {
+		return nil, ipAddrErr
+	}
+	return identity.LoadOrCreate(ipAddresses)
+}
+
+// Replaces the default identity.
+func RotateDefaultIdentity() (*tls.Certificate, error) {
+	identity, identityErr := DefaultTLSIdentity()
+	if identityErr != nil {
+		return nil, identityErr
+	}
+	ipAddresses, ipAddrErr := getAvailableIPAddresses()
+	if ipAddrErr != nil {
+		return nil, ipAddrErr
+	}
+	return identity.Rotate(ipAddresses)
+}
+
+// Hex-encoded SHA-256 of the (DER-encoded) leaf certificate.
+func Fingerprint(certificate *tls.Certificate) string {
+	if certificate == nil || len(certificate.Certificate) == 0 {
+		return ""
+	}
+	fingerprint := sha256.Sum256(certificate.Certificate[0])
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// Loads the identity, generating it first if there's none yet.
+func (ti *TLSIdentity) LoadOrCreate(ipAddresses []net.IP) (*tls.Certificate, error) {
+	certificate, loadErr := tls.LoadX509KeyPair(ti.certPath, ti.keyPath)
+	if loadErr == nil {
+		return &certificate, nil
+	}
+	if _, statErr := os.Stat(ti.certPath); !errors.Is(statErr, os.ErrNotExist) {
+		return nil, fmt.Errorf("TLS identity %s: %w", ti.certPath, loadErr)
+	}
+	return ti.Rotate(ipAddresses)
+}
+
+// Generates a new identity, replacing the current one. Clients which pinned
+// the old certificate have to pin the new one.
+func (ti *TLSIdentity) Rotate(ipAddresses []net.IP) (*tls.Certificate, error) {
+	certificatePEM, privateKeyPEM, generateErr := generateCertificate(ipAddresses)
+	if generateErr != nil {
+		return nil, generateErr
+	}
+	if mkdirErr := os.MkdirAll(filepath.Dir(ti.certPath), 0o700); mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	// If a crash leaves a key and certificate which don't match, loading
+	// fails (rather than quietly changing the identity) until it's rotated.
+	if writeErr := writeFileAtomic(ti.keyPath, privateKeyPEM, 0o600); writeErr != nil {
+		return nil, writeErr
+	}
+	if writeErr := writeFileAtomic(ti.certPath, certificatePEM, 0o644); writeErr != nil {
+		return nil, writeErr
+	}
+	certificate, pairErr := tls.X509KeyPair(certificatePEM, privateKeyPEM)
+	if pairErr != nil {
+		return nil, pairErr
+	}
+	return &certificate, nil
+}
+
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tempPath := path + ".tmp"
+	if writeErr := os.WriteFile(tempPath, content, perm); writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(tempPath, path)
+}
+
+// Self-signed ECDSA P-256 certificate for the given addresses (and
+// localhost), PEM-encoded along with its key.
+func generateCertificate(ipAddresses []net.IP) ([]byte, []byte, error) {
+	privateKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		return nil, nil, keyErr
+	}
+	serialNumber, serialErr := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if serialErr != nil {
+		return nil, nil, serialErr
+	}
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: "Cyprus",
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(IdentityValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           append([]net.IP{net.IPv4(127, 0, 0, 1)}, ipAddresses...),
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname, hostname+".local")
+	}
+	certificateBytes, createErr := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if createErr != nil {
+		return nil, nil, createErr
+	}
+	privateKeyBytes, marshalErr := x509.MarshalPKCS8PrivateKey(privateKey)
+	if marshalErr != nil {
+		return nil, nil, marshalErr
+	}
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateBytes})
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})
+	return certificatePEM, privateKeyPEM, nil
+}
@@ -0,0 +1,106 @@
+package transmission
+
+/*
+Transport Options
+
+Websocket settings of every session: permessage-deflate compression (used
+with clients which support it), the largest message accepted from clients,
+the size above which messages are sent in chunks (to sessions which ask
+for it, see `ext_models.Chunk`), and the heartbeat which detects clients
+that dropped off the network without closing their connection.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+const (
+	// Messages smaller than this aren't worth compressing.
+	DefaultCompressionThreshold = 512
+	DefaultMaxMessageSize       = 32 * 1024
+	DefaultChunkSize            = 16 * 1024
+	DefaultHeartbeatInterval    = time.Second * 2
+	DefaultIdleTimeout          = time.Second * 6
+)
+
+// A duration, written as a string in config files (ex: "5s", see
+// `time.ParseDuration`).
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var durationString string
+	if decodeErr := json.Unmarshal(data, &durationString); decodeErr != nil {
+		return fmt.Errorf("duration: %w", decodeErr)
+	}
+	duration, parseErr := time.ParseDuration(durationString)
+	if parseErr != nil {
+		return parseErr
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+type TransportOptions struct {
+	// Negotiate permessage-deflate with clients which support it
+	Compression bool `json:"compression"`
+	// Messages smaller than this (in bytes) are sent uncompressed (0 for
+	// `DefaultCompressionThreshold`)
+	CompressionThreshold int `json:"compression_threshold"`
+	// Larger messages from clients end their connection (0 for
+	// `DefaultMaxMessageSize`)
+	MaxMessageSize int64 `json:"max_message_size"`
+	// Larger messages are sent in chunks of this size (0 for
+	// `DefaultChunkSize`)
+	ChunkSize int `json:"chunk_size"`
+	// Clients are pinged this often (0 for `DefaultHeartbeatInterval`)
+	HeartbeatInterval Duration `json:"heartbeat_interval"`
+	// Clients which don't send anything, or answer pings, for this long are
+	// disconnected (0 for `DefaultIdleTimeout`, at least the heartbeat
+	// interval)
+	IdleTimeout Duration `json:"idle_timeout"`
+}
+
+func DefaultTransportOptions() TransportOptions {
+	return TransportOptions{Compression: true}
+}
+
+// Same options, with defaults in place of zero values.
+func (to TransportOptions) withDefaults() TransportOptions {
+	if to.CompressionThreshold <= 0 {
+		to.CompressionThreshold = DefaultCompressionThreshold
+	}
+	if to.MaxMessageSize <= 0 {
+		to.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if to.ChunkSize <= 0 {
+		to.ChunkSize = DefaultChunkSize
+	}
+	if to.HeartbeatInterval <= 0 {
+		to.HeartbeatInterval = Duration(DefaultHeartbeatInterval)
+	}
+	if to.IdleTimeout <= 0 {
+		to.IdleTimeout = Duration(DefaultIdleTimeout)
+	}
+	if to.IdleTimeout < to.HeartbeatInterval {
+		to.IdleTimeout = to.HeartbeatInterval
+	}
+	return to
+}
+
+func (to TransportOptions) compressionMode() websocket.CompressionMode {
+	if !to.Compression {
+		return websocket.CompressionDisabled
+	}
+	// Doesn't keep a compression window per session.
+	return websocket.CompressionNoContextTakeover
+}
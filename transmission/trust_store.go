@@ -0,0 +1,231 @@
+package transmission
+
+/*
+Trust Store
+
+Clients which paired with this server (see `ext_models.PairRequest`), or
+whose certificate fingerprint was pinned for mutual TLS (see
+`ClientAuthenticator`), kept in a local JSON file. Only a hash of each
+client's credential is stored.
+
+Copyright (C) 2023 Goutham Krishna K V
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Artiqlate/cyprus/utils"
+)
+
+const (
+	TrustStoreFileName = "trusted_clients.json"
+	// Random bytes in client IDs and credentials
+	clientIdSize   = 16
+	credentialSize = 32
+)
+
+type TrustedClient struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Hex-encoded SHA-256 of the credential
+	CredentialHash string `json:"credential_hash"`
+	// Pinned client certificate (see `Fingerprint`), for mutual TLS
+	CertificateFingerprint string `json:"certificate_fingerprint,omitempty"`
+	PairedAt               int64  `json:"paired_at"`
+}
+
+type TrustStore struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewTrustStore(path string) *TrustStore {
+	return &TrustStore{path: path}
+}
+
+// Trust store in the data directory (see `utils.DataDir`).
+func DefaultTrustStore() (*TrustStore, error) {
+	dataDir, dataDirErr := utils.DataDir()
+	if dataDirErr != nil {
+		return nil, dataDirErr
+	}
+	return NewTrustStore(filepath.Join(dataDir, TrustStoreFileName)), nil
+}
+
+func (ts *TrustStore) Path() string {
+	return ts.path
+}
+
+func randomHex(size int) (string, error) {
+	randomBytes := make([]byte, size)
+	if _, randErr := rand.Read(randomBytes); randErr != nil {
+		return "", randErr
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+func hashCredential(credential string) string {
+	credentialHash := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(credentialHash[:])
+}
+
+// Called with the mutex held.
+func (ts *TrustStore) load() ([]TrustedClient, error) {
+	content, readErr := os.ReadFile(ts.path)
+	if errors.Is(readErr, os.ErrNotExist) {
+		return []TrustedClient{}, nil
+	} else if readErr != nil {
+		return nil, readErr
+	}
+	clients := []TrustedClient{}
+	if decodeErr := json.Unmarshal(content, &clients); decodeErr != nil {
+		return nil, fmt.Errorf("trust store %s: %w", ts.path, decodeErr)
+	}
+	return clients, nil
+}
+
+// Called with the mutex held. Written to a temporary file first, so a crash
+// can't leave a truncated store behind.
+func (ts *TrustStore) save(clients []TrustedClient) error {
+	content, encodeErr := json.MarshalIndent(clients, "", "  ")
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if mkdirErr := os.MkdirAll(filepath.Dir(ts.path), 0o700); mkdirErr != nil {
+		return mkdirErr
+	}
+	return writeFileAtomic(ts.path, content, 0o600)
+}
+
+func (ts *TrustStore) Clients() ([]TrustedClient, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.load()
+}
+
+// Trusts a new client, and returns the ID and credential it authenticates
+// with (the credential isn't kept).
+func (ts *TrustStore) Add(clientName string) (string, string, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	clients, loadErr := ts.load()
+	if loadErr != nil {
+		return "", "", loadErr
+	}
+	clientId, idErr := randomHex(clientIdSize)
+	if idErr != nil {
+		return "", "", idErr
+	}
+	credential, credentialErr := randomHex(credentialSize)
+	if credentialErr != nil {
+		return "", "", credentialErr
+	}
+	clients = append(clients, TrustedClient{
+		Id:             clientId,
+		Name:           clientName,
+		CredentialHash: hashCredential(credential),
+		PairedAt:       time.Now().Unix(),
+	})
+	if saveErr := ts.save(clients); saveErr != nil {
+		return "", "", saveErr
+	}
+	return clientId, credential, nil
+}
+
+// Checks a client's credential, and returns the client (nil when the client
+// is unknown, or the credential is wrong).
+func (ts *TrustStore) Verify(clientId string, credential string) (*TrustedClient, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	clients, loadErr := ts.load()
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	credentialHash := hashCredential(credential)
+	for clientIdx := range clients {
+		client := &clients[clientIdx]
+		if client.Id != clientId {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(client.CredentialHash), []byte(credentialHash)) == 1 {
+			return client, nil
+		}
+		break
+	}
+	return nil, nil
+}
+
+// Trusts a client with the certificate of the given fingerprint (for mutual
+// TLS), and returns its ID.
+func (ts *TrustStore) PinCertificate(clientName string, fingerprint string) (string, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	clients, loadErr := ts.load()
+	if loadErr != nil {
+		return "", loadErr
+	}
+	clientId, idErr := randomHex(clientIdSize)
+	if idErr != nil {
+		return "", idErr
+	}
+	clients = append(clients, TrustedClient{
+		Id:                     clientId,
+		Name:                   clientName,
+		CertificateFingerprint: strings.ToLower(fingerprint),
+		PairedAt:               time.Now().Unix(),
+	})
+	if saveErr := ts.save(clients); saveErr != nil {
+		return "", saveErr
+	}
+	return clientId, nil
+}
+
+// Returns the client with the pinned certificate (nil when none is).
+func (ts *TrustStore) VerifyCertificate(fingerprint string) (*TrustedClient, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	clients, loadErr := ts.load()
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	for clientIdx := range clients {
+		if fingerprint != "" && clients[clientIdx].CertificateFingerprint == fingerprint {
+			return &clients[clientIdx], nil
+		}
+	}
+	return nil, nil
+}
+
+// Stops trusting the clients with the given ID, or pinned certificate
+// fingerprint. Returns how many were removed.
+func (ts *TrustStore) Remove(idOrFingerprint string) (int, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	clients, loadErr := ts.load()
+	if loadErr != nil {
+		return 0, loadErr
+	}
+	idOrFingerprint = strings.ToLower(idOrFingerprint)
+	kept := []TrustedClient{}
+	for _, client := range clients {
+		if client.Id != idOrFingerprint && client.CertificateFingerprint != idOrFingerprint {
+			kept = append(kept, client)
+		}
+	}
+	removed := len(clients) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, ts.save(kept)
+}
@@ -0,0 +1,68 @@
+package utils
+
+import "sync"
+
+// Subsystem lifecycle states
+//
+// A subsystem is started once and stopped once:
+// created -> setting up -> running -> stopping -> stopped. It can also go
+// straight to stopped (stopped before being started, or failed setup).
+type LifecycleState int
+
+const (
+	StateCreated LifecycleState = iota
+	StateSettingUp
+	StateRunning
+	StateStopping
+	StateStopped
+)
+
+func (state LifecycleState) String() string {
+	switch state {
+	case StateCreated:
+		return "created"
+	case StateSettingUp:
+		return "setting up"
+	case StateRunning:
+		return "running"
+	case StateStopping:
+		return "stopping"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// Lifecycle holds the current state of a subsystem, safe for use from any
+// goroutine.
+type Lifecycle struct {
+	mutex sync.Mutex
+	state LifecycleState
+}
+
+func (lc *Lifecycle) State() LifecycleState {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	return lc.state
+}
+
+// Moves to `to` only if the current state is `from`. Returns whether it moved.
+func (lc *Lifecycle) Transition(from LifecycleState, to LifecycleState) bool {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if lc.state != from {
+		return false
+	}
+	lc.state = to
+	return true
+}
+
+// Moves to `to`, unless the lifecycle is already at (or past) it.
+func (lc *Lifecycle) Advance(to LifecycleState) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if lc.state < to {
+		lc.state = to
+	}
+}
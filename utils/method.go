@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrMalformedMethod  = errors.New("malformed method name")
+	ErrPlatformMismatch = errors.New("platform mismatch")
+)
+
+// Method name of a message: `module`, `module:method` or
+// `module:platform:method` (see `GenerateMethod` and
+// `GeneratePlatformMethod`).
+type MethodName struct {
+	Module string
+	// Empty when the method isn't platform-qualified
+	Platform PlatformKind
+	// Empty for module-only names (ex: "init")
+	Method string
+}
+
+func ParseMethod(name string) (*MethodName, error) {
+	parts := strings.Split(name, ":")
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("%w: %q", ErrMalformedMethod, name)
+		}
+	}
+	switch len(parts) {
+	case 1:
+		return &MethodName{Module: parts[0]}, nil
+	case 2:
+		return &MethodName{Module: parts[0], Method: parts[1]}, nil
+	case 3:
+		platform := PlatformKind(parts[1])
+		if _, platformExists := Platforms[platform]; !platformExists {
+			return nil, fmt.Errorf("%w: unknown platform in %q", ErrMalformedMethod, name)
+		}
+		return &MethodName{Module: parts[0], Platform: platform, Method: parts[2]}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrMalformedMethod, name)
+	}
+}
+
+// Parses a method name meant for the given platform: platform-qualified
+// names for any other platform fail with `ErrPlatformMismatch`.
+func ParsePlatformMethod(name string, platform PlatformKind) (*MethodName, error) {
+	methodName, parseErr := ParseMethod(name)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	if methodName.Platform != "" && methodName.Platform != platform {
+		return nil, fmt.Errorf(
+			"%w: %q is for %s, running on %s",
+			ErrPlatformMismatch,
+			name,
+			methodName.Platform,
+			platform,
+		)
+	}
+	return methodName, nil
+}
+
+func (mn *MethodName) String() string {
+	if mn.Method == "" {
+		return mn.Module
+	}
+	if mn.Platform != "" {
+		return GeneratePlatformMethod(mn.Module, mn.Platform, mn.Method)
+	}
+	return GenerateMethod(mn.Module, mn.Method)
+}
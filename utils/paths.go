@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const AppDirName = "cyprus"
+
+// Directory for data kept by cyprus (`$XDG_DATA_HOME/cyprus`, defaulting to
+// `~/.local/share/cyprus`). It isn't created.
+func DataDir() (string, error) {
+	return xdgDir("XDG_DATA_HOME", filepath.Join(".local", "share"))
+}
+
+// Directory for the configuration of cyprus (`$XDG_CONFIG_HOME/cyprus`,
+// defaulting to `~/.config/cyprus`). It isn't created.
+func ConfigDir() (string, error) {
+	return xdgDir("XDG_CONFIG_HOME", ".config")
+}
+
+// `$<envVar>/cyprus`, or `~/<homeFallback>/cyprus` when the variable isn't set
+// (or isn't an absolute path, as per the XDG base directory spec).
+func xdgDir(envVar string, homeFallback string) (string, error) {
+	if baseDir := os.Getenv(envVar); filepath.IsAbs(baseDir) {
+		return filepath.Join(baseDir, AppDirName), nil
+	}
+	homeDir, homeErr := os.UserHomeDir()
+	if homeErr != nil {
+		return "", fmt.Errorf("%s not set: %w", envVar, homeErr)
+	}
+	return filepath.Join(homeDir, homeFallback, AppDirName), nil
+}
@@ -46,3 +46,17 @@ func GenerateAutoPlatformMethod(module string, method string) string {
 		return fmt.Sprintf("%s:%s:%s", module, PlatformOther, method)
 	}
 }
+
+// Platform the server is running on.
+func CurrentPlatform() PlatformKind {
+	switch runtime.GOOS {
+	case "windows":
+		return PlatformWindows
+	case "linux":
+		return PlatformLinux
+	case "darwin":
+		return PlatformMacOS
+	default:
+		return PlatformOther
+	}
+}